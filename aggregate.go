@@ -0,0 +1,94 @@
+package tstorage
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// AggrFunc is a function to aggregate data points within each step into one. See SelectAggregated.
+type AggrFunc int
+
+const (
+	// AggrMin gives back the minimum value.
+	AggrMin AggrFunc = iota
+	// AggrMax gives back the maximum value.
+	AggrMax
+	// AggrSum gives back the sum of values.
+	AggrSum
+	// AggrAvg gives back the arithmetic mean of values.
+	AggrAvg
+	// AggrCount gives back the number of data points.
+	AggrCount
+)
+
+func (f AggrFunc) String() string {
+	switch f {
+	case AggrMin:
+		return "min"
+	case AggrMax:
+		return "max"
+	case AggrSum:
+		return "sum"
+	case AggrAvg:
+		return "avg"
+	case AggrCount:
+		return "count"
+	default:
+		return fmt.Sprintf("AggrFunc(%d)", int(f))
+	}
+}
+
+func (s *storage) SelectAggregated(metric string, labels []Label, start, end int64, step time.Duration, fn AggrFunc, opts ...SelectOption) ([]*DataPoint, error) {
+	if fn < AggrMin || fn > AggrCount {
+		return nil, fmt.Errorf("unknown aggregation function %d", int(fn))
+	}
+	width := toPrecision(step, s.timestampPrecision)
+	if width <= 0 {
+		return nil, fmt.Errorf("step must be at least one unit of the timestamp precision")
+	}
+	points, fn, err := s.selectForAggregation(metric, labels, start, end, width, fn, opts)
+	if err != nil {
+		return nil, err
+	}
+	return aggregate(points, start, width, fn), nil
+}
+
+// aggregate folds the given data points sorted by timestamp into one for each step of the given width
+// counted from start, which is timestamped at the beginning of the step. Steps without data points are omitted.
+func aggregate(points []DataPoint, start, width int64, fn AggrFunc) []*DataPoint {
+	out := make([]*DataPoint, 0)
+	for i := 0; i < len(points); {
+		bucket := start + (points[i].Timestamp-start)/width*width
+		var (
+			value float64
+			n     int
+		)
+		switch fn {
+		case AggrMin:
+			value = math.Inf(1)
+		case AggrMax:
+			value = math.Inf(-1)
+		}
+		for ; i < len(points) && points[i].Timestamp < bucket+width; i++ {
+			v := points[i].Value
+			switch fn {
+			case AggrMin:
+				value = math.Min(value, v)
+			case AggrMax:
+				value = math.Max(value, v)
+			case AggrSum, AggrAvg:
+				value += v
+			}
+			n++
+		}
+		switch fn {
+		case AggrAvg:
+			value /= float64(n)
+		case AggrCount:
+			value = float64(n)
+		}
+		out = append(out, &DataPoint{Timestamp: bucket, Value: value})
+	}
+	return out
+}
@@ -0,0 +1,58 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_aggregate(t *testing.T) {
+	points := []DataPoint{
+		{Timestamp: 10, Value: 3},
+		{Timestamp: 12, Value: 1},
+		{Timestamp: 19, Value: 2},
+		// Nothing within 20-29.
+		{Timestamp: 35, Value: 4},
+	}
+	tests := []struct {
+		fn   AggrFunc
+		want []*DataPoint
+	}{
+		{fn: AggrMin, want: []*DataPoint{{Timestamp: 10, Value: 1}, {Timestamp: 30, Value: 4}}},
+		{fn: AggrMax, want: []*DataPoint{{Timestamp: 10, Value: 3}, {Timestamp: 30, Value: 4}}},
+		{fn: AggrSum, want: []*DataPoint{{Timestamp: 10, Value: 6}, {Timestamp: 30, Value: 4}}},
+		{fn: AggrAvg, want: []*DataPoint{{Timestamp: 10, Value: 2}, {Timestamp: 30, Value: 4}}},
+		{fn: AggrCount, want: []*DataPoint{{Timestamp: 10, Value: 3}, {Timestamp: 30, Value: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fn.String(), func(t *testing.T) {
+			assert.Equal(t, tt.want, aggregate(points, 10, 10, tt.fn))
+		})
+	}
+}
+
+func Test_storage_SelectAggregated(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	for ts := int64(1600000000); ts < 1600000180; ts += 15 {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 1}}}))
+	}
+
+	got, err := s.SelectAggregated("metric1", nil, 1600000000, 1600000180, time.Minute, AggrCount)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1600000000, Value: 4},
+		{Timestamp: 1600000060, Value: 4},
+		{Timestamp: 1600000120, Value: 4},
+	}, got)
+
+	_, err = s.SelectAggregated("metric1", nil, 1600000000, 1600000180, time.Millisecond, AggrSum)
+	assert.Error(t, err)
+	_, err = s.SelectAggregated("metric1", nil, 1600000000, 1600000180, time.Minute, AggrFunc(100))
+	assert.Error(t, err)
+	_, err = s.SelectAggregated("metric2", nil, 1600000000, 1600000180, time.Minute, AggrSum)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
@@ -0,0 +1,400 @@
+package tstorage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// ErrInvalidBulkFormat is returned by BulkLoad when the given data doesn't follow the bulk-load format.
+var ErrInvalidBulkFormat = errors.New("invalid bulk-load format")
+
+// The bulk-load format starts with the header below, followed by any number of series blocks:
+/*
+   +---------------+------------+
+   | "TSBULK"(6b)  | version(1b)|
+   +---------------+------------+
+*/
+// A series block holds data points of a metric in any order:
+/*
+   +---------------------+--------+--------------------+--------------------------------------------+
+   | len metric(varints) | metric | num labels(varints)| len name(varints), name, len value, value..|
+   +---------------------+--------+--------------------+--------------------------------------------+
+   +--------------------+--------------------------------------------------------------+
+   | num points(varints)| timestamp(varints), value(8b, little-endian float bits)...  |
+   +--------------------+--------------------------------------------------------------+
+*/
+const (
+	bulkFormatVersion = 1
+	// maxBulkStringLen limits the length of metric names and labels, so that broken data doesn't
+	// make us allocate a huge buffer.
+	maxBulkStringLen = 1 << 20
+
+	// bulkLoadBufferedPoints is the number of data points BulkLoad buffers in heap at most before
+	// writing them into partitions.
+	bulkLoadBufferedPoints = 1 << 20
+)
+
+var bulkMagic = []byte("TSBULK")
+
+// BulkWriter writes series in the bulk-load format, which BulkLoad reads.
+type BulkWriter struct {
+	w             *bufio.Writer
+	headerWritten bool
+	buf           []byte
+}
+
+// NewBulkWriter gives back a BulkWriter writing to w.
+func NewBulkWriter(w io.Writer) *BulkWriter {
+	return &BulkWriter{
+		w:   bufio.NewWriter(w),
+		buf: make([]byte, binary.MaxVarintLen64),
+	}
+}
+
+// WriteSeries writes data points of the given metric and labels as a block.
+// Data points don't have to be sorted, and a series can be split into any number of blocks.
+func (b *BulkWriter) WriteSeries(metric string, labels []Label, points []DataPoint) error {
+	if metric == "" {
+		return ErrEmptyMetric
+	}
+	if err := b.writeHeader(); err != nil {
+		return err
+	}
+	if err := b.writeString(metric); err != nil {
+		return fmt.Errorf("failed to write the metric: %w", err)
+	}
+	if err := b.writeUvarint(uint64(len(labels))); err != nil {
+		return fmt.Errorf("failed to write the number of labels: %w", err)
+	}
+	for _, l := range labels {
+		if err := b.writeString(l.Name); err != nil {
+			return fmt.Errorf("failed to write the label name: %w", err)
+		}
+		if err := b.writeString(l.Value); err != nil {
+			return fmt.Errorf("failed to write the label value: %w", err)
+		}
+	}
+	if err := b.writeUvarint(uint64(len(points))); err != nil {
+		return fmt.Errorf("failed to write the number of data points: %w", err)
+	}
+	for i := range points {
+		n := binary.PutVarint(b.buf, points[i].Timestamp)
+		if _, err := b.w.Write(b.buf[:n]); err != nil {
+			return fmt.Errorf("failed to write the timestamp: %w", err)
+		}
+		binary.LittleEndian.PutUint64(b.buf, math.Float64bits(points[i].Value))
+		if _, err := b.w.Write(b.buf[:8]); err != nil {
+			return fmt.Errorf("failed to write the value: %w", err)
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer. It must be called after all series get written.
+func (b *BulkWriter) Flush() error {
+	if err := b.writeHeader(); err != nil {
+		return err
+	}
+	return b.w.Flush()
+}
+
+func (b *BulkWriter) writeHeader() error {
+	if b.headerWritten {
+		return nil
+	}
+	if _, err := b.w.Write(bulkMagic); err != nil {
+		return fmt.Errorf("failed to write the header: %w", err)
+	}
+	if err := b.w.WriteByte(bulkFormatVersion); err != nil {
+		return fmt.Errorf("failed to write the header: %w", err)
+	}
+	b.headerWritten = true
+	return nil
+}
+
+func (b *BulkWriter) writeUvarint(x uint64) error {
+	n := binary.PutUvarint(b.buf, x)
+	_, err := b.w.Write(b.buf[:n])
+	return err
+}
+
+func (b *BulkWriter) writeString(s string) error {
+	if err := b.writeUvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := b.w.WriteString(s)
+	return err
+}
+
+// bulkReader reads series blocks in the bulk-load format one by one.
+type bulkReader struct {
+	r *bufio.Reader
+
+	// The current block. points gets reused for the next block.
+	metric string
+	labels []Label
+	points []DataPoint
+	err    error
+}
+
+func newBulkReader(r io.Reader) (*bulkReader, error) {
+	br := &bulkReader{r: bufio.NewReader(r)}
+	header := make([]byte, len(bulkMagic)+1)
+	if _, err := io.ReadFull(br.r, header); err != nil {
+		return nil, fmt.Errorf("%w: failed to read the header: %w", ErrInvalidBulkFormat, err)
+	}
+	if string(header[:len(bulkMagic)]) != string(bulkMagic) {
+		return nil, fmt.Errorf("%w: unknown header %q", ErrInvalidBulkFormat, header[:len(bulkMagic)])
+	}
+	if v := header[len(bulkMagic)]; v != bulkFormatVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBulkFormat, v)
+	}
+	return br, nil
+}
+
+// next reads the next block. It gives back false at the end of data or when an error occurs.
+func (b *bulkReader) next() bool {
+	if _, err := b.r.Peek(1); errors.Is(err, io.EOF) {
+		return false
+	}
+	if err := b.readBlock(); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		b.err = fmt.Errorf("%w: %w", ErrInvalidBulkFormat, err)
+		return false
+	}
+	return true
+}
+
+func (b *bulkReader) readBlock() error {
+	metric, err := b.readString()
+	if err != nil {
+		return fmt.Errorf("failed to read the metric: %w", err)
+	}
+	if metric == "" {
+		return fmt.Errorf("empty metric found")
+	}
+	numLabels, err := binary.ReadUvarint(b.r)
+	if err != nil {
+		return fmt.Errorf("failed to read the number of labels: %w", err)
+	}
+	if numLabels > maxBulkStringLen {
+		return fmt.Errorf("too many labels: %d", numLabels)
+	}
+	// Labels are held by rows, so never reused.
+	var labels []Label
+	for i := uint64(0); i < numLabels; i++ {
+		name, err := b.readString()
+		if err != nil {
+			return fmt.Errorf("failed to read the label name: %w", err)
+		}
+		value, err := b.readString()
+		if err != nil {
+			return fmt.Errorf("failed to read the label value: %w", err)
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	numPoints, err := binary.ReadUvarint(b.r)
+	if err != nil {
+		return fmt.Errorf("failed to read the number of data points: %w", err)
+	}
+	b.points = b.points[:0]
+	value := make([]byte, 8)
+	for i := uint64(0); i < numPoints; i++ {
+		timestamp, err := binary.ReadVarint(b.r)
+		if err != nil {
+			return fmt.Errorf("failed to read the timestamp: %w", err)
+		}
+		if _, err := io.ReadFull(b.r, value); err != nil {
+			return fmt.Errorf("failed to read the value: %w", err)
+		}
+		b.points = append(b.points, DataPoint{
+			Timestamp: timestamp,
+			Value:     math.Float64frombits(binary.LittleEndian.Uint64(value)),
+		})
+	}
+	b.metric, b.labels = metric, labels
+	return nil
+}
+
+func (b *bulkReader) readString() (string, error) {
+	n, err := binary.ReadUvarint(b.r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxBulkStringLen {
+		return "", fmt.Errorf("too long string: %d bytes", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(b.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (s *storage) BulkLoad(r io.Reader) error {
+	return s.bulkLoad(r, bulkLoadBufferedPoints)
+}
+
+// bulkLoad is BulkLoad buffering up to the given number of data points.
+func (s *storage) bulkLoad(r io.Reader, maxBuffered int) error {
+	if err := s.beginWrite(); err != nil {
+		return err
+	}
+	defer s.wg.Done()
+	br, err := newBulkReader(r)
+	if err != nil {
+		return err
+	}
+	l := &bulkLoader{
+		s:           s,
+		windows:     make(map[int64][]Row),
+		maxBuffered: maxBuffered,
+	}
+	l.minT, l.bounded = s.oldestTimestamp()
+	for br.next() {
+		if err := l.add(br.metric, br.labels, br.points); err != nil {
+			l.abort()
+			return err
+		}
+	}
+	if br.err != nil {
+		l.abort()
+		return br.err
+	}
+	if err := l.flush(); err != nil {
+		l.abort()
+		return err
+	}
+	l.commit()
+	return nil
+}
+
+// bulkLoader puts rows older than all partitions into new partitions. They are buffered by partition-sized
+// windows of time without being indexed, and then get sorted and written out at once when too many are buffered.
+// Partitions written are never visible until all rows get loaded.
+type bulkLoader struct {
+	s *storage
+	// Rows older than minT go into new partitions; bounded is false if the storage holds nothing.
+	minT    int64
+	bounded bool
+
+	windows     map[int64][]Row
+	buffered    int
+	maxBuffered int
+
+	partitions []partition
+	// dirs of disk partitions written, which are removed when aborting.
+	dirs []string
+}
+
+func (l *bulkLoader) add(metric string, labels []Label, points []DataPoint) error {
+	rows := make([]Row, 0, len(points))
+	for i := range points {
+		rows = append(rows, Row{Metric: metric, Labels: labels, DataPoint: points[i]})
+	}
+	if l.s.validTimeRange != nil {
+		if err := l.s.validTimeRange.validate(rows); err != nil {
+			return err
+		}
+	}
+	var newerRows []Row
+	duration := toPrecision(l.s.partitionDuration, l.s.timestampPrecision)
+	for i := range rows {
+		if l.bounded && rows[i].Timestamp >= l.minT {
+			newerRows = append(newerRows, rows[i])
+			continue
+		}
+		w := floorDiv(rows[i].Timestamp, duration)
+		l.windows[w] = append(l.windows[w], rows[i])
+		l.buffered++
+	}
+	if len(newerRows) > 0 {
+		if err := l.s.insertRows(context.Background(), newerRows, false); err != nil {
+			return fmt.Errorf("failed to insert rows: %w", err)
+		}
+	}
+	if l.buffered >= l.maxBuffered {
+		return l.flush()
+	}
+	return nil
+}
+
+// flush writes all buffered rows into partitions, one for each window.
+func (l *bulkLoader) flush() error {
+	for w, rows := range l.windows {
+		if err := l.writePartition(rows); err != nil {
+			return err
+		}
+		delete(l.windows, w)
+	}
+	l.buffered = 0
+	return nil
+}
+
+func (l *bulkLoader) writePartition(rows []Row) error {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Timestamp < rows[j].Timestamp
+	})
+	m := newMemoryPartition(nil, l.s.partitionDuration, l.s.timestampPrecision).(*memoryPartition)
+	if _, err := m.insertRows(rows); err != nil {
+		return err
+	}
+	if l.s.inMemoryMode() {
+		l.partitions = append(l.partitions, m)
+		return nil
+	}
+
+	dir := l.s.newPartitionDir(m.minTimestamp(), m.maxTimestamp())
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("partition %s already exists", dir)
+	}
+	l.dirs = append(l.dirs, dir)
+	if err := l.s.commitPartition(dir, m, time.Now()); err != nil {
+		return fmt.Errorf("failed to write partition %s: %w", dir, err)
+	}
+	part, err := openDiskPartition(dir, l.s.retention)
+	if err != nil {
+		return fmt.Errorf("failed to open partition %s: %w", dir, err)
+	}
+	l.partitions = append(l.partitions, part)
+	return nil
+}
+
+// commit puts all partitions written to the tail in order.
+func (l *bulkLoader) commit() {
+	sort.SliceStable(l.partitions, func(i, j int) bool {
+		return l.partitions[i].minTimestamp() > l.partitions[j].minTimestamp()
+	})
+	for _, p := range l.partitions {
+		l.s.partitionList.insertTail(p)
+		l.s.hooks.partitionCreated(p)
+	}
+}
+
+// abort removes partitions written so far. Rows inserted into existing partitions are kept.
+func (l *bulkLoader) abort() {
+	for _, dir := range l.dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			l.s.logger.Warn("failed to remove partition", "dir", dir, "err", err)
+		}
+	}
+}
+
+// floorDiv is x divided by y rounded toward negative infinity.
+func floorDiv(x, y int64) int64 {
+	q := x / y
+	if x%y != 0 && (x < 0) != (y < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,109 @@
+package tstorage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_BulkLoad(t *testing.T) {
+	labels := []Label{{Name: "host", Value: "host-1"}}
+	dir := t.TempDir()
+	s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600010000, Value: 0.1}},
+	}))
+
+	// Out-of-order data points spanning several partitions, and a series split into blocks.
+	var buf bytes.Buffer
+	w := NewBulkWriter(&buf)
+	require.NoError(t, w.WriteSeries("metric1", labels, []DataPoint{
+		{Timestamp: 1600005000, Value: 0.5},
+		{Timestamp: 1600000000, Value: 0.2},
+		{Timestamp: 1600010001, Value: 0.6},
+	}))
+	require.NoError(t, w.WriteSeries("metric2", nil, []DataPoint{
+		{Timestamp: 1600000001, Value: 1},
+	}))
+	require.NoError(t, w.WriteSeries("metric1", labels, []DataPoint{
+		{Timestamp: 1600000002, Value: 0.3},
+		{Timestamp: 1600003700, Value: 0.4},
+	}))
+	require.NoError(t, w.Flush())
+	require.NoError(t, s.(*storage).bulkLoad(&buf, 2))
+
+	want := []*DataPoint{
+		{Timestamp: 1600000000, Value: 0.2},
+		{Timestamp: 1600000002, Value: 0.3},
+		{Timestamp: 1600003700, Value: 0.4},
+		{Timestamp: 1600005000, Value: 0.5},
+		{Timestamp: 1600010000, Value: 0.1},
+		{Timestamp: 1600010001, Value: 0.6},
+	}
+	got, err := s.Select("metric1", labels, 1600000000, 1600010002)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	got, err = s.Select("metric2", nil, 1600000000, 1600010002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000001, Value: 1}}, got)
+
+	// Loaded data points are persisted.
+	require.NoError(t, s.Close())
+	s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	got, err = s.Select("metric1", labels, 1600000000, 1600010002)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_BulkLoad_invalid(t *testing.T) {
+	var valid bytes.Buffer
+	w := NewBulkWriter(&valid)
+	require.NoError(t, w.WriteSeries("metric1", nil, []DataPoint{{Timestamp: 1600000000, Value: 0.1}}))
+	require.NoError(t, w.WriteSeries("metric1", nil, []DataPoint{{Timestamp: 1600009000, Value: 0.2}}))
+	require.NoError(t, w.Flush())
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "unknown header", data: []byte("TSDATA\x01")},
+		{name: "unsupported version", data: []byte("TSBULK\x02")},
+		{name: "truncated", data: valid.Bytes()[:valid.Len()-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			err = s.(*storage).bulkLoad(bytes.NewReader(tt.data), 1)
+			assert.ErrorIs(t, err, ErrInvalidBulkFormat)
+
+			// Partitions written before the failure are removed.
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			for _, e := range entries {
+				assert.False(t, partitionDirRegex.MatchString(e.Name()), e.Name())
+			}
+			_, err = s.Select("metric1", nil, 1600000000, 1600010000)
+			assert.ErrorIs(t, err, ErrNoDataPoints)
+			require.NoError(t, s.Close())
+		})
+	}
+}
+
+func Test_storage_BulkLoad_empty(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, NewBulkWriter(&buf).Flush())
+	s, err := NewStorage()
+	require.NoError(t, err)
+	assert.NoError(t, s.BulkLoad(&buf))
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,291 @@
+package tstorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// diskChunk holds meta data to access a chunk, a fixed-length group of encoded data points.
+// Each chunk can be decoded independently.
+type diskChunk struct {
+	Offset        int64 `json:"offset"`
+	Length        int64 `json:"length"`
+	MinTimestamp  int64 `json:"minTimestamp"`
+	MaxTimestamp  int64 `json:"maxTimestamp"`
+	NumDataPoints int64 `json:"numDataPoints"`
+	// Interval is non-zero if timestamps in the chunk are exactly MinTimestamp+i*Interval,
+	// which allows to find data points within a range without comparing timestamps.
+	Interval int64 `json:"interval,omitempty"`
+	// Checksum is the CRC-32 of the chunk as stored. Zero means the chunk was written before
+	// checksums got introduced, which can't be verified.
+	Checksum uint32 `json:"checksum,omitempty"`
+}
+
+var chunkChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// verify ensures the given bytes of the chunk are not altered since they were written.
+func (c *diskChunk) verify(data []byte) error {
+	if c.Checksum == 0 {
+		return nil
+	}
+	if sum := crc32.Checksum(data, chunkChecksumTable); sum != c.Checksum {
+		return fmt.Errorf("checksum mismatch of chunk at %d: want %08x, got %08x", c.Offset, c.Checksum, sum)
+	}
+	return nil
+}
+
+// searchChunks gives back the index of the first chunk holding data points at or after the given timestamp,
+// or the number of chunks if none, with binary search. Chunks of a metric are in ascending order of timestamp,
+// which lets selects skip chunks before the range without looking into each of them.
+func searchChunks(chunks []diskChunk, start int64) int {
+	return sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].MaxTimestamp >= start
+	})
+}
+
+// chunkEncoder implements seriesEncoder, which divides the given data points into chunks
+// holding up to chunkSize points, and then writes each of them compressed.
+// It is not goroutine safe.
+type chunkEncoder struct {
+	// backend writer
+	w io.Writer
+	// offset of the backend writer
+	offset int64
+
+	buf        bytes.Buffer
+	encoder    seriesEncoder
+	compressor compressor
+	// zero means no limit.
+	chunkSize int
+
+	// the chunk being encoded
+	current  diskChunk
+	interval intervalTracker
+	// chunks written since the last reset
+	chunks []diskChunk
+	// buffer for compressed bytes
+	compressed []byte
+}
+
+func newChunkEncoder(w io.Writer, offset int64, c compressor, chunkSize int) *chunkEncoder {
+	e := &chunkEncoder{
+		w:          w,
+		offset:     offset,
+		compressor: c,
+		chunkSize:  chunkSize,
+	}
+	e.encoder = newSeriesEncoder(&e.buf)
+	return e
+}
+
+func (e *chunkEncoder) encodePoint(point *DataPoint) error {
+	if e.current.NumDataPoints == 0 {
+		e.current.MinTimestamp = point.Timestamp
+	}
+	if err := e.encoder.encodePoint(point); err != nil {
+		return err
+	}
+	e.current.MaxTimestamp = point.Timestamp
+	e.current.NumDataPoints++
+	e.interval.add(point.Timestamp)
+	if e.chunkSize > 0 && e.current.NumDataPoints >= int64(e.chunkSize) {
+		return e.cut()
+	}
+	return nil
+}
+
+// flush writes the chunk being encoded.
+func (e *chunkEncoder) flush() error {
+	if e.current.NumDataPoints == 0 {
+		return nil
+	}
+	return e.cut()
+}
+
+// cut compresses the chunk being encoded and writes it to the backend writer.
+func (e *chunkEncoder) cut() error {
+	if err := e.encoder.flush(); err != nil {
+		return err
+	}
+	var err error
+	e.compressed, err = e.compressor.compress(e.compressed[:0], e.buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to compress chunk: %w", err)
+	}
+	n, err := e.w.Write(e.compressed)
+	if err != nil {
+		return fmt.Errorf("failed to write chunk: %w", err)
+	}
+	e.current.Offset = e.offset
+	e.current.Length = int64(n)
+	e.current.Interval = e.interval.regularInterval()
+	e.current.Checksum = crc32.Checksum(e.compressed, chunkChecksumTable)
+	e.chunks = append(e.chunks, e.current)
+
+	e.offset += int64(n)
+	e.current = diskChunk{}
+	e.interval = intervalTracker{}
+	e.buf.Reset()
+	return nil
+}
+
+// reset gives back the chunks written so far and forgets them.
+func (e *chunkEncoder) reset() []diskChunk {
+	chunks := e.chunks
+	e.chunks = nil
+	return chunks
+}
+
+// Chunk is a run of data points of a metric encoded as they are stored on disk,
+// which allows to stream data points, e.g. for remote-read servers and replication,
+// without decoding and re-encoding them. See Reader.SelectChunks.
+type Chunk struct {
+	MinTimestamp  int64
+	MaxTimestamp  int64
+	NumDataPoints int
+	// Compression is the algorithm Data is compressed with.
+	Compression Compression
+	// Data holds Gorilla-encoded data points compressed with Compression.
+	Data []byte
+}
+
+// DataPoints decodes all data points the chunk holds.
+func (c *Chunk) DataPoints() ([]DataPoint, error) {
+	if c.NumDataPoints < 0 {
+		return nil, fmt.Errorf("%w: negative number of data points %d", ErrCorrupted, c.NumDataPoints)
+	}
+	d, err := newDecompressor(c.Compression)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.decompress(nil, c.Data, c.NumDataPoints*maxEncodedPointSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decompress chunk: %w", ErrCorrupted, err)
+	}
+	decoder, err := newSeriesDecoder(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	points := make([]DataPoint, c.NumDataPoints)
+	for i := range points {
+		if err := decoder.decodePoint(&points[i]); err != nil {
+			return nil, fmt.Errorf("%w: failed to decode point: %w", ErrCorrupted, err)
+		}
+	}
+	return points, nil
+}
+
+// appendEncodedChunks encodes the given data points sorted by timestamp into chunks
+// holding up to chunkSize points, and then appends them to dst.
+func appendEncodedChunks(dst []Chunk, points []DataPoint, chunkSize int) ([]Chunk, error) {
+	if len(points) == 0 {
+		return dst, nil
+	}
+	var buf bytes.Buffer
+	encoder := newChunkEncoder(&buf, 0, &nopCompressor{}, chunkSize)
+	for i := range points {
+		if err := encoder.encodePoint(&points[i]); err != nil {
+			return dst, fmt.Errorf("failed to encode a data point: %w", err)
+		}
+	}
+	if err := encoder.flush(); err != nil {
+		return dst, fmt.Errorf("failed to flush data points: %w", err)
+	}
+	data := buf.Bytes()
+	for _, c := range encoder.reset() {
+		dst = append(dst, Chunk{
+			MinTimestamp:  c.MinTimestamp,
+			MaxTimestamp:  c.MaxTimestamp,
+			NumDataPoints: int(c.NumDataPoints),
+			Compression:   NoCompression,
+			Data:          data[c.Offset : c.Offset+c.Length : c.Offset+c.Length],
+		})
+	}
+	return dst, nil
+}
+
+// ChunkIterator iterates over chunks. See Reader.SelectChunks.
+type ChunkIterator interface {
+	// Next advances to the next chunk and reports whether there is one.
+	Next() bool
+	// At gives back the current chunk.
+	At() Chunk
+	// Err gives back the error that stopped the iteration, if any.
+	Err() error
+}
+
+// chunkIterator reads chunks out of partitions from the oldest one, one partition at a time.
+type chunkIterator struct {
+	// partitions yet to be read, in order of newest to oldest.
+	parts      []partition
+	metric     string
+	labels     []Label
+	start, end int64
+	chunkSize  int
+	// deletions to be applied to chunks.
+	tombstones []tombstone
+	// report is called with the error that stopped the iteration.
+	report func(err error)
+
+	// chunks read out of the current partition yet to be given back.
+	chunks  []Chunk
+	current Chunk
+	err     error
+}
+
+func (it *chunkIterator) Next() bool {
+	for len(it.chunks) == 0 {
+		if it.err != nil || len(it.parts) == 0 {
+			return false
+		}
+		part := it.parts[len(it.parts)-1]
+		it.parts[len(it.parts)-1] = nil
+		it.parts = it.parts[:len(it.parts)-1]
+
+		chunks, err := appendPartitionChunks(it.chunks[:0], part, it.metric, it.labels, it.start, it.end, it.chunkSize)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err == nil && len(it.tombstones) > 0 {
+			chunks, err = dropDeletedChunks(chunks, it.tombstones, it.chunkSize)
+		}
+		if err != nil {
+			it.err = fmt.Errorf("failed to select chunks: %w", err)
+			if it.report != nil {
+				it.report(it.err)
+			}
+			return false
+		}
+		it.chunks = chunks
+	}
+	it.current = it.chunks[0]
+	it.chunks[0] = Chunk{}
+	it.chunks = it.chunks[1:]
+	return true
+}
+
+func (it *chunkIterator) At() Chunk {
+	return it.current
+}
+
+func (it *chunkIterator) Err() error {
+	return it.err
+}
+
+// appendPartitionChunks appends chunks of the given metric overlapping the given range in the partition to dst.
+// Disk partitions give back chunks as they are stored, while the others encode data points on the fly.
+func appendPartitionChunks(dst []Chunk, part partition, metric string, labels []Label, start, end int64, chunkSize int) ([]Chunk, error) {
+	if d, ok := part.(*diskPartition); ok {
+		return d.appendChunks(dst, metric, labels, start, end, chunkSize)
+	}
+	points, err := part.appendDataPoints(context.Background(), nil, metric, labels, start, end)
+	if err != nil {
+		return dst, err
+	}
+	return appendEncodedChunks(dst, points, chunkSize)
+}
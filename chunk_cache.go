@@ -0,0 +1,130 @@
+package tstorage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// chunkCache is an LRU cache of data points decoded from chunks of disk partitions, bounded by the approximate
+// number of bytes they take. Chunks of a disk partition never change, hence cached ones never get invalidated;
+// ones of partitions since removed just get evicted in time. A nil cache caches nothing.
+type chunkCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List
+	entries  map[chunkCacheKey]*list.Element
+}
+
+type chunkCacheKey struct {
+	// id of the disk partition, which is unique within the process.
+	partition uint64
+	offset    int64
+}
+
+type chunkCacheEntry struct {
+	key    chunkCacheKey
+	points []DataPoint
+}
+
+// diskPartitionIDs assigns ids to disk partitions, which tell chunks of ones rewritten in the same directory apart.
+var diskPartitionIDs uint64
+
+func nextDiskPartitionID() uint64 {
+	return atomic.AddUint64(&diskPartitionIDs, 1)
+}
+
+func newChunkCache(maxBytes int64) *chunkCache {
+	return &chunkCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[chunkCacheKey]*list.Element),
+	}
+}
+
+// get gives back the data points cached for the given key, which must not be modified.
+func (c *chunkCache) get(key chunkCacheKey) ([]DataPoint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*chunkCacheEntry).points, true
+}
+
+// put caches the given data points for the key, which must not be modified afterwards, unless they don't fit
+// in the cache at all. The least recently used chunks get evicted to make room for them.
+func (c *chunkCache) put(key chunkCacheKey, points []DataPoint) {
+	size := int64(len(points)) * memoryPointSize
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	for c.bytes+size > c.maxBytes {
+		entry := c.lru.Remove(c.lru.Back()).(*chunkCacheEntry)
+		delete(c.entries, entry.key)
+		c.bytes -= int64(len(entry.points)) * memoryPointSize
+	}
+	c.entries[key] = c.lru.PushFront(&chunkCacheEntry{key: key, points: points})
+	c.bytes += size
+}
+
+type chunkCacheCtxKey struct{}
+
+// withChunkCache gives back a context that carries the given cache, which disk partitions decode chunks through.
+// Giving nil means no cache.
+func withChunkCache(ctx context.Context, cache *chunkCache) context.Context {
+	if cache == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, chunkCacheCtxKey{}, cache)
+}
+
+// chunkCacheFrom gives back the cache carried by ctx, which is nil if none.
+func chunkCacheFrom(ctx context.Context) *chunkCache {
+	cache, _ := ctx.Value(chunkCacheCtxKey{}).(*chunkCache)
+	return cache
+}
+
+// decodeCachedChunk is like decodeDataPoints but for a single chunk, which gets decoded as a whole through
+// the given cache, so that repeated queries skip decompressing and decoding it.
+func (d *diskPartition) decodeCachedChunk(ctx context.Context, cache *chunkCache, mt *diskMetric, chunk *diskChunk, start, end int64, fn func(DataPoint)) error {
+	key := chunkCacheKey{partition: d.id, offset: chunk.Offset}
+	points, ok := cache.get(key)
+	if !ok {
+		decoder, err := d.newChunkDecoder(chunk)
+		if err != nil {
+			return newCorruptionError(d.dirPath, mt.Name, fmt.Errorf("failed to generate decoder: %w", err))
+		}
+		points = make([]DataPoint, chunk.NumDataPoints)
+		for i := range points {
+			if err := decoder.decodePoint(&points[i]); err != nil {
+				return newCorruptionError(d.dirPath, mt.Name, fmt.Errorf("failed to decode point: %w", err))
+			}
+		}
+		cache.put(key, points)
+	}
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Timestamp >= start
+	})
+	j := i + sort.Search(len(points)-i, func(j int) bool {
+		return points[i+j].Timestamp >= end
+	})
+	if err := chargeQueryMemory(ctx, j-i); err != nil {
+		return err
+	}
+	for _, point := range points[i:j] {
+		fn(point)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_chunkCache_put(t *testing.T) {
+	c := newChunkCache(3 * memoryPointSize)
+	c.put(chunkCacheKey{partition: 1, offset: 0}, make([]DataPoint, 2))
+	c.put(chunkCacheKey{partition: 1, offset: 10}, make([]DataPoint, 1))
+	_, ok := c.get(chunkCacheKey{partition: 1, offset: 0})
+	require.True(t, ok)
+
+	// The least recently used one gets evicted.
+	c.put(chunkCacheKey{partition: 2, offset: 0}, make([]DataPoint, 1))
+	_, ok = c.get(chunkCacheKey{partition: 1, offset: 10})
+	assert.False(t, ok)
+	_, ok = c.get(chunkCacheKey{partition: 1, offset: 0})
+	assert.True(t, ok)
+	assert.Equal(t, int64(3*memoryPointSize), c.bytes)
+
+	// Ones not fitting in the cache never get cached.
+	c.put(chunkCacheKey{partition: 3, offset: 0}, make([]DataPoint, 4))
+	_, ok = c.get(chunkCacheKey{partition: 3, offset: 0})
+	assert.False(t, ok)
+}
+
+func Test_storage_WithChunkCache(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithChunkSize(4))
+	require.NoError(t, err)
+	for ts := int64(1600000000); ts < 1600000020; ts++ {
+		// Skip a timestamp to have chunks at irregular intervals as well.
+		if ts == 1600000013 {
+			continue
+		}
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+	}
+	require.NoError(t, s.Close())
+
+	uncached, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer uncached.Close()
+	cached, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithChunkCache(1<<20))
+	require.NoError(t, err)
+	defer cached.Close()
+	cache := cached.(*storage).chunkCache
+
+	ranges := [][2]int64{
+		{1600000002, 1600000007},
+		{1600000000, 1600000020},
+		{1600000011, 1600000016},
+		{1600000005, 1600000006},
+	}
+	for _, r := range ranges {
+		want, err := uncached.Select("metric1", nil, r[0], r[1])
+		require.NoError(t, err)
+		got, err := cached.Select("metric1", nil, r[0], r[1], SelectWhere(ValueGreaterThan(0)))
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "range %v", r)
+	}
+	// Each of 5 chunks got cached once.
+	assert.Len(t, cache.entries, 5)
+
+	_, err = NewStorage(WithChunkCache(-1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,213 @@
+package tstorage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_chunkEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := newChunkEncoder(&buf, 10, &nopCompressor{}, 2)
+	for i := int64(1); i <= 5; i++ {
+		require.NoError(t, encoder.encodePoint(&DataPoint{Timestamp: i, Value: 0.1}))
+	}
+	require.NoError(t, encoder.flush())
+	chunks := encoder.reset()
+
+	require.Len(t, chunks, 3)
+	assert.Equal(t, int64(10), chunks[0].Offset)
+	var total int64
+	for i, c := range chunks {
+		if i > 0 {
+			assert.Equal(t, chunks[i-1].Offset+chunks[i-1].Length, c.Offset)
+		}
+		total += c.Length
+		// The backend writer starts at 10.
+		assert.NotZero(t, c.Checksum)
+		assert.NoError(t, c.verify(buf.Bytes()[c.Offset-10:c.Offset-10+c.Length]))
+	}
+	assert.Equal(t, int64(buf.Len()), total)
+	assert.Equal(t, diskChunk{Offset: chunks[2].Offset, Length: chunks[2].Length, MinTimestamp: 5, MaxTimestamp: 5, NumDataPoints: 1, Checksum: chunks[2].Checksum}, chunks[2])
+	assert.Empty(t, encoder.reset())
+}
+
+func Test_diskPartition_selectDataPoints_chunks(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression Compression
+		chunkSize   int
+	}{
+		{
+			name:        "a single chunk without compression",
+			compression: NoCompression,
+		},
+		{
+			name:        "multiple chunks with gzip",
+			compression: Gzip,
+			chunkSize:   3,
+		},
+		{
+			name:        "multiple chunks with zstd",
+			compression: Zstd,
+			chunkSize:   3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCompressor(tt.compression, 0)
+			require.NoError(t, err)
+			s := &storage{compressor: c, compression: tt.compression, chunkSize: tt.chunkSize, logger: &nopLogger{}}
+			m := newMemoryPartition(nil, 0, "").(*memoryPartition)
+			rows := make([]Row, 0, 10)
+			for i := int64(1); i <= 10; i++ {
+				rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}})
+			}
+			_, err = m.insertRows(rows)
+			require.NoError(t, err)
+
+			dir := t.TempDir()
+			require.NoError(t, s.flush(dir, m))
+			p, err := openDiskPartition(dir, defaultRetention)
+			require.NoError(t, err)
+
+			got, err := p.selectDataPoints(context.Background(), "metric1", nil, 4, 8)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{
+				{Timestamp: 4, Value: 4},
+				{Timestamp: 5, Value: 5},
+				{Timestamp: 6, Value: 6},
+				{Timestamp: 7, Value: 7},
+			}, got)
+		})
+	}
+}
+
+func Test_diskPartition_chunkChecksum(t *testing.T) {
+	rows := make([]Row, 0, 10)
+	for i := int64(1); i <= 10; i++ {
+		rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}})
+	}
+	d := newTestDiskPartition(t, rows)
+	chunk := d.meta.Metrics["metric1"].Chunks[0]
+
+	// Flip a bit in the chunk, which the meta doesn't notice.
+	path := filepath.Join(d.dirPath, dataFileName)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[chunk.Offset+chunk.Length-1] ^= 1
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	p, err := openDiskPartition(d.dirPath, time.Hour)
+	require.NoError(t, err)
+
+	_, err = p.selectDataPoints(context.Background(), "metric1", nil, 1, 11)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+	_, err = p.(*diskPartition).appendChunks(nil, "metric1", nil, 1, 11, 0)
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func Test_storage_SelectChunks(t *testing.T) {
+	older := newTestDiskPartition(t, []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.1}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 3, Value: 0.1}},
+	})
+	_, err := older.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 5, Value: 0.2}},
+	})
+	require.NoError(t, err)
+	newer := newMemoryPartition(nil, time.Hour, Seconds)
+	_, err = newer.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 11, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 12, Value: 0.3}},
+	})
+	require.NoError(t, err)
+	list := newPartitionList()
+	list.insert(older)
+	list.insert(newer)
+	s := &storage{partitionList: list, chunkSize: 2}
+
+	it, err := s.SelectChunks("metric1", nil, 2, 13)
+	require.NoError(t, err)
+	var chunks []Chunk
+	var got []DataPoint
+	for it.Next() {
+		c := it.At()
+		points, err := c.DataPoints()
+		require.NoError(t, err)
+		assert.Len(t, points, c.NumDataPoints)
+		chunks = append(chunks, c)
+		got = append(got, points...)
+	}
+	require.NoError(t, it.Err())
+
+	// The persisted chunk, the late one, and the ones encoded from the memory partition.
+	require.Len(t, chunks, 4)
+	assert.Equal(t, int64(1), chunks[0].MinTimestamp)
+	assert.Equal(t, int64(3), chunks[0].MaxTimestamp)
+	assert.Equal(t, int64(5), chunks[1].MinTimestamp)
+	assert.Equal(t, 2, chunks[2].NumDataPoints)
+	assert.Equal(t, 1, chunks[3].NumDataPoints)
+	// Chunks are given back as a whole, including the data point out of the range.
+	assert.Equal(t, []DataPoint{
+		{Timestamp: 1, Value: 0.1},
+		{Timestamp: 2, Value: 0.1},
+		{Timestamp: 3, Value: 0.1},
+		{Timestamp: 5, Value: 0.2},
+		{Timestamp: 10, Value: 0.3},
+		{Timestamp: 11, Value: 0.3},
+		{Timestamp: 12, Value: 0.3},
+	}, got)
+
+	it, err = s.SelectChunks("unknown", nil, 1, 12)
+	require.NoError(t, err)
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+
+	_, err = s.SelectChunks("metric1", nil, 12, 1)
+	assert.Error(t, err)
+}
+
+func Test_Chunk_DataPoints_corrupted(t *testing.T) {
+	chunks, err := appendEncodedChunks(nil, []DataPoint{{Timestamp: 1, Value: 0.1}, {Timestamp: 2, Value: 0.2}}, 0)
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+
+	c := chunks[0]
+	c.NumDataPoints = 100
+	_, err = c.DataPoints()
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func Test_searchChunks(t *testing.T) {
+	chunks := []diskChunk{
+		{MinTimestamp: 1, MaxTimestamp: 3, NumDataPoints: 3},
+		{MinTimestamp: 3, MaxTimestamp: 5, NumDataPoints: 3},
+		{MinTimestamp: 7, MaxTimestamp: 9, NumDataPoints: 2},
+	}
+	tests := []struct {
+		name  string
+		start int64
+		want  int
+	}{
+		{name: "before all", start: 0, want: 0},
+		{name: "timestamp shared by two chunks", start: 3, want: 0},
+		{name: "within the second", start: 4, want: 1},
+		{name: "between chunks", start: 6, want: 2},
+		{name: "after all", start: 10, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, searchChunks(chunks, tt.start))
+		})
+	}
+}
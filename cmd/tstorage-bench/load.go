@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nakabonne/tstorage"
+)
+
+type config struct {
+	series        int
+	labels        int
+	churn         float64
+	outOfOrder    float64
+	outOfOrderLag time.Duration
+	rate          int
+	batchSize     int
+	writers       int
+	readers       int
+	queryRange    time.Duration
+	duration      time.Duration
+
+	dataPath          string
+	partitionDuration time.Duration
+}
+
+func (c *config) validate() error {
+	switch {
+	case c.series <= 0:
+		return fmt.Errorf("series must be positive")
+	case c.batchSize <= 0:
+		return fmt.Errorf("batch must be positive")
+	case c.writers <= 0:
+		return fmt.Errorf("writers must be positive")
+	case c.readers < 0 || c.labels < 0 || c.rate < 0:
+		return fmt.Errorf("readers, labels and rate must not be negative")
+	case c.churn < 0 || c.churn > 1 || c.outOfOrder < 0 || c.outOfOrder > 1:
+		return fmt.Errorf("churn and ooo must be between 0 and 1")
+	}
+	return nil
+}
+
+type report struct {
+	elapsed        time.Duration
+	insertedPoints int64
+	insertErrors   int64
+	selects        int64
+	selectErrors   int64
+	insertLatency  latencies
+	selectLatency  latencies
+	peakHeapAlloc  uint64
+	sys            uint64
+}
+
+func (r *report) print(w io.Writer) {
+	fmt.Fprintf(w, "elapsed:        %s\n", r.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "ingestion:      %d points (%.0f points/s), %d errors\n",
+		r.insertedPoints, float64(r.insertedPoints)/r.elapsed.Seconds(), r.insertErrors)
+	fmt.Fprintf(w, "insert latency: %s\n", r.insertLatency.summary())
+	fmt.Fprintf(w, "selects:        %d (%.0f selects/s), %d errors\n",
+		r.selects, float64(r.selects)/r.elapsed.Seconds(), r.selectErrors)
+	fmt.Fprintf(w, "select latency: %s\n", r.selectLatency.summary())
+	fmt.Fprintf(w, "memory:         peak heap %s, sys %s\n", formatBytes(r.peakHeapAlloc), formatBytes(r.sys))
+}
+
+// latencies is a list of observed durations.
+type latencies []time.Duration
+
+// percentile gives back the p-th percentile, where p is in [0, 100].
+// The receiver must be sorted.
+func (l latencies) percentile(p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	i := int(float64(len(l))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(l) {
+		i = len(l) - 1
+	}
+	return l[i]
+}
+
+func (l latencies) summary() string {
+	if len(l) == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s, max %s",
+		l.percentile(50), l.percentile(90), l.percentile(99), l[len(l)-1])
+}
+
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// seriesSet gives series within a window of ids, which slides to churn series.
+type seriesSet struct {
+	size   int
+	labels int
+	// the id of the first active series
+	offset int64
+}
+
+func (s *seriesSet) pick(rnd *rand.Rand) (string, []tstorage.Label) {
+	id := atomic.LoadInt64(&s.offset) + int64(rnd.Intn(s.size))
+	labels := make([]tstorage.Label, 0, s.labels)
+	for i := 0; i < s.labels; i++ {
+		labels = append(labels, tstorage.Label{
+			Name:  "label" + strconv.Itoa(i),
+			Value: strconv.FormatInt(id, 10),
+		})
+	}
+	return "metric" + strconv.FormatInt(id, 10), labels
+}
+
+func (s *seriesSet) churn(n int) {
+	atomic.AddInt64(&s.offset, int64(n))
+}
+
+func run(c *config) (*report, error) {
+	opts := []tstorage.Option{
+		tstorage.WithPartitionDuration(c.partitionDuration),
+		tstorage.WithTimestampPrecision(tstorage.Nanoseconds),
+	}
+	if c.dataPath != "" {
+		opts = append(opts, tstorage.WithDataPath(c.dataPath))
+	}
+	storage, err := tstorage.NewStorage(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+
+	var (
+		r      report
+		series = &seriesSet{size: c.series, labels: c.labels}
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		doneCh = make(chan struct{})
+	)
+	var interval time.Duration
+	if c.rate > 0 {
+		// Each writer inserts a batch per interval.
+		interval = time.Duration(float64(time.Second) * float64(c.batchSize*c.writers) / float64(c.rate))
+	}
+
+	for w := 0; w < c.writers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			var (
+				lat            latencies
+				points, errors int64
+			)
+			var ticker *time.Ticker
+			if interval > 0 {
+				ticker = time.NewTicker(interval)
+				defer ticker.Stop()
+			}
+			rows := make([]tstorage.Row, c.batchSize)
+			for {
+				if ticker != nil {
+					select {
+					case <-doneCh:
+					case <-ticker.C:
+					}
+				}
+				select {
+				case <-doneCh:
+					mu.Lock()
+					r.insertLatency = append(r.insertLatency, lat...)
+					r.insertedPoints += points
+					r.insertErrors += errors
+					mu.Unlock()
+					return
+				default:
+				}
+				now := time.Now().UnixNano()
+				for i := range rows {
+					rows[i].Metric, rows[i].Labels = series.pick(rnd)
+					rows[i].Timestamp = now
+					if c.outOfOrder > 0 && rnd.Float64() < c.outOfOrder {
+						rows[i].Timestamp -= rnd.Int63n(int64(c.outOfOrderLag) + 1)
+					}
+					rows[i].Value = rnd.Float64()
+				}
+				start := time.Now()
+				if err := storage.InsertRows(rows); err != nil {
+					errors++
+					continue
+				}
+				lat = append(lat, time.Since(start))
+				points += int64(len(rows))
+			}
+		}(int64(w))
+	}
+
+	for q := 0; q < c.readers; q++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			var (
+				lat             latencies
+				selects, errors int64
+			)
+			for {
+				select {
+				case <-doneCh:
+					mu.Lock()
+					r.selectLatency = append(r.selectLatency, lat...)
+					r.selects += selects
+					r.selectErrors += errors
+					mu.Unlock()
+					return
+				default:
+				}
+				metric, labels := series.pick(rnd)
+				end := time.Now().UnixNano()
+				start := time.Now()
+				_, err := storage.Select(metric, labels, end-int64(c.queryRange), end)
+				if err != nil && err != tstorage.ErrNoDataPoints {
+					errors++
+					continue
+				}
+				lat = append(lat, time.Since(start))
+				selects++
+			}
+		}(int64(c.writers + q))
+	}
+
+	started := time.Now()
+	timer := time.NewTimer(c.duration)
+	defer timer.Stop()
+	churnTicker := time.NewTicker(time.Second)
+	defer churnTicker.Stop()
+	memTicker := time.NewTicker(100 * time.Millisecond)
+	defer memTicker.Stop()
+	var ms runtime.MemStats
+	for running := true; running; {
+		select {
+		case <-timer.C:
+			running = false
+		case <-churnTicker.C:
+			series.churn(int(float64(c.series) * c.churn))
+		case <-memTicker.C:
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > r.peakHeapAlloc {
+				r.peakHeapAlloc = ms.HeapAlloc
+			}
+		}
+	}
+	close(doneCh)
+	wg.Wait()
+	r.elapsed = time.Since(started)
+	runtime.ReadMemStats(&ms)
+	r.sys = ms.Sys
+
+	sort.Slice(r.insertLatency, func(i, j int) bool { return r.insertLatency[i] < r.insertLatency[j] })
+	sort.Slice(r.selectLatency, func(i, j int) bool { return r.selectLatency[i] < r.selectLatency[j] })
+	if err := storage.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close storage: %w", err)
+	}
+	return &r, nil
+}
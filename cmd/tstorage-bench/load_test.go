@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_latencies_percentile(t *testing.T) {
+	l := make(latencies, 0, 100)
+	for i := 1; i <= 100; i++ {
+		l = append(l, time.Duration(i))
+	}
+	assert.Equal(t, time.Duration(1), l.percentile(0))
+	assert.Equal(t, time.Duration(50), l.percentile(50))
+	assert.Equal(t, time.Duration(99), l.percentile(99))
+	assert.Equal(t, time.Duration(100), l.percentile(100))
+	assert.Equal(t, time.Duration(0), latencies{}.percentile(50))
+}
+
+func Test_run(t *testing.T) {
+	r, err := run(&config{
+		series:            10,
+		labels:            1,
+		churn:             0.5,
+		outOfOrder:        0.1,
+		outOfOrderLag:     time.Millisecond,
+		rate:              10000,
+		batchSize:         10,
+		writers:           2,
+		readers:           1,
+		queryRange:        time.Second,
+		duration:          200 * time.Millisecond,
+		partitionDuration: time.Hour,
+	})
+	require.NoError(t, err)
+	assert.NotZero(t, r.insertedPoints)
+	assert.Zero(t, r.insertErrors)
+	assert.NotZero(t, r.selects)
+}
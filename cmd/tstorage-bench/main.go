@@ -0,0 +1,44 @@
+// tstorage-bench drives a configurable load of ingestion and queries against tstorage,
+// then reports the throughput, latency percentiles and memory usage.
+//
+// Usage:
+//
+//	tstorage-bench -series=1000 -rate=100000 -duration=30s -ooo=0.01 -readers=2
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func main() {
+	var c config
+	flag.IntVar(&c.series, "series", 1000, "number of active series")
+	flag.IntVar(&c.labels, "labels", 2, "number of labels per series")
+	flag.Float64Var(&c.churn, "churn", 0, "fraction of series replaced with new ones every second")
+	flag.Float64Var(&c.outOfOrder, "ooo", 0, "fraction of data points given out of order")
+	flag.DurationVar(&c.outOfOrderLag, "ooo-lag", time.Second, "max lag of out-of-order data points")
+	flag.IntVar(&c.rate, "rate", 0, "data points per second in total; 0 means as fast as possible")
+	flag.IntVar(&c.batchSize, "batch", 100, "number of rows per InsertRows")
+	flag.IntVar(&c.writers, "writers", 4, "number of concurrent writers")
+	flag.IntVar(&c.readers, "readers", 1, "number of concurrent readers")
+	flag.DurationVar(&c.queryRange, "query-range", time.Minute, "time range of each Select")
+	flag.DurationVar(&c.duration, "duration", 10*time.Second, "how long to run")
+	flag.StringVar(&c.dataPath, "data-path", "", "directory to store data; in-memory if empty")
+	flag.DurationVar(&c.partitionDuration, "partition-duration", time.Hour, "partition duration")
+	flag.Parse()
+
+	if err := c.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	r, err := run(&c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	r.print(os.Stdout)
+}
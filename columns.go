@@ -0,0 +1,29 @@
+package tstorage
+
+// maxPooledPoints caps the capacity of scratch slices kept in the pool, so that a huge query doesn't pin memory.
+const maxPooledPoints = 1 << 16
+
+func (s *storage) SelectColumns(metric string, labels []Label, start, end int64, opts ...SelectOption) ([]int64, []float64, error) {
+	buf, ok := s.pointsPool.Get().(*[]DataPoint)
+	if !ok {
+		buf = &[]DataPoint{}
+	}
+	defer func() {
+		if cap(*buf) <= maxPooledPoints {
+			*buf = (*buf)[:0]
+			s.pointsPool.Put(buf)
+		}
+	}()
+	points, err := s.SelectInto((*buf)[:0], metric, labels, start, end, opts...)
+	*buf = points
+	if err != nil {
+		return nil, nil, err
+	}
+	timestamps := make([]int64, len(points))
+	values := make([]float64, len(points))
+	for i := range points {
+		timestamps[i] = points[i].Timestamp
+		values[i] = points[i].Value
+	}
+	return timestamps, values, nil
+}
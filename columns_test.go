@@ -0,0 +1,39 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectColumns(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithPartitionMaxPoints(2))
+	require.NoError(t, err)
+	defer s.Close()
+	labels := []Label{{Name: "host", Value: "host-1"}}
+	for ts := int64(1600000000); ts < 1600000005; ts++ {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: ts, Value: float64(ts - 1600000000)}},
+		}))
+	}
+
+	timestamps, values, err := s.SelectColumns("metric1", labels, 1600000001, 1600000004)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1600000001, 1600000002, 1600000003}, timestamps)
+	assert.Equal(t, []float64{1, 2, 3}, values)
+
+	timestamps, values, err = s.SelectColumns("metric1", labels, 1600000000, 1600000005, SelectDescending(), SelectLimit(2))
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1600000004, 1600000003}, timestamps)
+	assert.Equal(t, []float64{4, 3}, values)
+
+	// Results never share the pooled buffer.
+	again, _, err := s.SelectColumns("metric1", labels, 1600000000, 1600000001)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1600000000}, again)
+	assert.Equal(t, []int64{1600000004, 1600000003}, timestamps)
+
+	_, _, err = s.SelectColumns("unknown", nil, 1600000000, 1600000005)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
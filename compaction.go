@@ -0,0 +1,208 @@
+package tstorage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// compactingDirPrefix is the prefix of the directory a disk partition is rewritten into.
+// It must not match partitionDirRegex so that half-written partitions are never opened.
+const compactingDirPrefix = "compacting-"
+
+// compactedFileName is the name of the file marking a rewrite as complete, which holds the names of
+// the partition directory to be replaced and the one the rewrite gets renamed into, one per line.
+// A rewrite with it survives crashes, while one without it gets removed on startup.
+const compactedFileName = "compacted"
+
+// compactPartitions rewrites disk partitions that hold data points to be removed.
+func (s *storage) compactPartitions() error {
+	// Tombstones made before it get applied by the compaction.
+	deleteCutoff := time.Now().Add(-s.deleteGracePeriod)
+	targets := make([]*diskPartition, 0)
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		d, ok := iterator.value().(*diskPartition)
+		if !ok || s.unreadable(d) {
+			continue
+		}
+		if s.needsCompaction(d) {
+			targets = append(targets, d)
+		}
+	}
+	for _, d := range targets {
+		if err := s.compact(d); err != nil {
+			s.reportCorruption(err)
+			return fmt.Errorf("failed to compact partition %q: %w", d.dirPath, err)
+		}
+	}
+	if err := s.purgeTombstones(deleteCutoff); err != nil {
+		return fmt.Errorf("failed to purge tombstones: %w", err)
+	}
+	return nil
+}
+
+// needsCompaction reports whether the given partition holds late data points to be merged,
+// data points out of their metric's retention, or data points deleted beyond the grace period.
+func (s *storage) needsCompaction(d *diskPartition) bool {
+	if d.expired() {
+		return false
+	}
+	if d.numLatePoints() > 0 {
+		return true
+	}
+	if !s.tombstones.isEmpty() {
+		before := time.Now().Add(-s.deleteGracePeriod)
+		for _, name := range d.metricNames() {
+			for _, t := range s.appliedTombstones(name, before) {
+				if t.overlaps(d.minTimestamp(), d.maxTimestamp()) {
+					return true
+				}
+			}
+		}
+	}
+	if len(s.metricRetentions) == 0 {
+		return false
+	}
+	for name, mt := range d.meta.Metrics {
+		if cutoff, ok := s.metricCutoff(name); ok && mt.MinTimestamp < cutoff {
+			return true
+		}
+	}
+	return false
+}
+
+// metricCutoff gives back the timestamp before which data points of the given metric should be removed.
+// The second returned value will be false if the metric has no retention of its own.
+func (s *storage) metricCutoff(name string) (int64, bool) {
+	metric, _ := unmarshalMetricName(name)
+	retention, ok := s.metricRetentions[metric]
+	if !ok {
+		return 0, false
+	}
+	return toUnix(time.Now(), s.timestampPrecision) - toPrecision(retention, s.timestampPrecision), true
+}
+
+// compact rewrites the given disk partition by merging late data points and leaving out data points
+// to be removed, and then swaps it for the rewritten one.
+// Rows appended during compaction wait for it, and then go into the rewritten one.
+func (s *storage) compact(d *diskPartition) error {
+	return d.seal(func() (partition, error) {
+		return s.rewrite(d)
+	})
+}
+
+// rewrite writes the data points to be kept in the given partition into a new partition, and then swaps it for
+// the given one. The new partition will be given back, or nil if the given one is just removed.
+func (s *storage) rewrite(d *diskPartition) (partition, error) {
+	rows := make([]Row, 0, d.size())
+	deleteCutoff := time.Now().Add(-s.deleteGracePeriod)
+	for _, name := range d.metricNames() {
+		// marshalMetricName gives back the name as is if no labels given.
+		points, err := d.selectDataPoints(context.Background(), name, nil, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		cutoff, hasCutoff := s.metricCutoff(name)
+		tombstones := s.appliedTombstones(name, deleteCutoff)
+		for _, p := range points {
+			if hasCutoff && p.Timestamp < cutoff {
+				continue
+			}
+			if deleted(tombstones, p.Timestamp) {
+				continue
+			}
+			rows = append(rows, Row{Metric: name, DataPoint: *p})
+		}
+	}
+	if len(rows) == 0 {
+		info := newPartitionInfo(d)
+		if err := s.partitionList.remove(d); err != nil {
+			return nil, err
+		}
+		s.hooks.partitionRemoved(info)
+		return nil, nil
+	}
+
+	m := newMemoryPartition(nil, s.partitionDuration, s.timestampPrecision).(*memoryPartition)
+	if _, err := m.insertRows(rows); err != nil {
+		return nil, err
+	}
+	// Rewrite it in the same data directory, which renaming requires.
+	dataPath := filepath.Dir(d.dirPath)
+	tmpDir := filepath.Join(dataPath, compactingDirPrefix+filepath.Base(d.dirPath))
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, err
+	}
+	// Keep the creation time to retain the partition as long as the original one.
+	if err := s.writePartition(tmpDir, m, d.meta.CreatedAt); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(dataPath, fmt.Sprintf("p-%d-%d", m.minTimestamp(), m.maxTimestamp()))
+	if err := markCompacted(tmpDir, d.dirPath, dir); err != nil {
+		return nil, err
+	}
+	if err := promoteCompacted(tmpDir); err != nil {
+		return nil, err
+	}
+	newPart, err := openDiskPartition(dir, s.retention)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.partitionList.swap(d, newPart); err != nil {
+		return nil, err
+	}
+	return newPart, nil
+}
+
+// markCompacted marks the rewrite in the given directory as complete, which is to replace oldDir and
+// be renamed into newDir. Both must be in the same data directory as the rewrite.
+func markCompacted(tmpDir, oldDir, newDir string) error {
+	content := filepath.Base(oldDir) + "\n" + filepath.Base(newDir) + "\n"
+	if err := writeFileSync(filepath.Join(tmpDir, compactedFileName), []byte(content)); err != nil {
+		return err
+	}
+	if err := syncDir(tmpDir); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", tmpDir, err)
+	}
+	return nil
+}
+
+// promoteCompacted replaces the partition directory with the complete rewrite in the given directory.
+// It can be done over again until it succeeds, even after crashes in the middle of it.
+func promoteCompacted(tmpDir string) error {
+	markerPath := filepath.Join(tmpDir, compactedFileName)
+	b, err := os.ReadFile(markerPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", markerPath, err)
+	}
+	names := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(names) != 2 || !partitionDirRegex.MatchString(names[0]) || !partitionDirRegex.MatchString(names[1]) {
+		return fmt.Errorf("%w: malformed %s", ErrCorrupted, markerPath)
+	}
+	dataPath := filepath.Dir(tmpDir)
+	oldDir, newDir := filepath.Join(dataPath, names[0]), filepath.Join(dataPath, names[1])
+	if err := injectFault(faultPartitionRemove); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", oldDir, err)
+	}
+	// Rename never replaces a non-empty directory.
+	if err := os.RemoveAll(newDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", newDir, err)
+	}
+	if err := os.Rename(tmpDir, newDir); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpDir, newDir, err)
+	}
+	if err := syncDir(dataPath); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dataPath, err)
+	}
+	// Left behind by a crash, it's just ignored by the partition.
+	os.Remove(filepath.Join(newDir, compactedFileName))
+	return nil
+}
@@ -0,0 +1,133 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_compactPartitions(t *testing.T) {
+	dataPath := t.TempDir()
+	now := time.Now().Unix()
+	s := &storage{
+		partitionList:      newPartitionList(),
+		dataPath:           dataPath,
+		retention:          defaultRetention,
+		timestampPrecision: Seconds,
+		metricRetentions:   map[string]time.Duration{"short": time.Hour},
+		compressor:         &nopCompressor{},
+		logger:             &nopLogger{},
+	}
+	m := newMemoryPartition(nil, 0, Seconds).(*memoryPartition)
+	_, err := m.insertRows([]Row{
+		{Metric: "short", DataPoint: DataPoint{Timestamp: now - 7200, Value: 1}},
+		{Metric: "short", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: now - 7200, Value: 2}},
+		{Metric: "short", DataPoint: DataPoint{Timestamp: now - 60, Value: 3}},
+		{Metric: "long", DataPoint: DataPoint{Timestamp: now - 7200, Value: 4}},
+	})
+	require.NoError(t, err)
+	dir := dataPath + "/p-1"
+	require.NoError(t, s.flush(dir, m))
+	d, err := openDiskPartition(dir, s.retention)
+	require.NoError(t, err)
+	s.partitionList.insert(d)
+	assert.True(t, s.needsCompaction(d.(*diskPartition)))
+
+	require.NoError(t, s.compactPartitions())
+
+	got, err := s.Select("short", nil, now-10000, now)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: now - 60, Value: 3}}, got)
+	_, err = s.Select("short", []Label{{Name: "host", Value: "a"}}, now-10000, now)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	got, err = s.Select("long", nil, now-10000, now)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: now - 7200, Value: 4}}, got)
+
+	// The rewritten partition keeps the creation time.
+	head := s.partitionList.getHead().(*diskPartition)
+	assert.Equal(t, d.(*diskPartition).meta.CreatedAt.Unix(), head.meta.CreatedAt.Unix())
+	assert.False(t, s.needsCompaction(head))
+}
+
+func Test_storage_compactPartitions_crash(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash leaves the data directory as if the process crashed in the middle of the compaction.
+		crash func(t *testing.T, s *storage, dataPath string)
+	}{
+		{
+			name: "before marking the rewrite complete",
+			crash: func(t *testing.T, s *storage, dataPath string) {
+				injectFaults(t, fault{point: faultPartitionSync, action: faultFail, after: 3})
+				assert.ErrorIs(t, s.compactPartitions(), errInjectedFault)
+				assert.NoFileExists(t, filepath.Join(dataPath, compactingDirPrefix+"p-1-3", compactedFileName))
+			},
+		},
+		{
+			name: "before removing the old partition",
+			crash: func(t *testing.T, s *storage, dataPath string) {
+				injectFaults(t, fault{point: faultPartitionRemove, action: faultFail})
+				assert.ErrorIs(t, s.compactPartitions(), errInjectedFault)
+			},
+		},
+		{
+			name: "in the middle of removing the old partition",
+			crash: func(t *testing.T, s *storage, dataPath string) {
+				injectFaults(t, fault{point: faultPartitionRemove, action: faultFail})
+				assert.ErrorIs(t, s.compactPartitions(), errInjectedFault)
+				require.NoError(t, os.Remove(filepath.Join(dataPath, "p-1-3", dataFileName)))
+			},
+		},
+		{
+			name: "before renaming the rewrite",
+			crash: func(t *testing.T, s *storage, dataPath string) {
+				injectFaults(t, fault{point: faultPartitionRemove, action: faultFail})
+				assert.ErrorIs(t, s.compactPartitions(), errInjectedFault)
+				require.NoError(t, os.RemoveAll(filepath.Join(dataPath, "p-1-3")))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := t.TempDir()
+			opts := []Option{WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionDuration(3 * time.Second)}
+			st, err := NewStorage(opts...)
+			require.NoError(t, err)
+			s := st.(*storage)
+			for _, ts := range [][]int64{{1, 3}, {4, 6}, {7, 8}} {
+				require.NoError(t, s.InsertRows([]Row{
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts[0], Value: 0.1}},
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts[1], Value: 0.1}},
+				}))
+			}
+			s.flushWG.Wait()
+			require.NoError(t, s.flushPartitions())
+			// Goes into the late file of the disk partition, which makes it compacted.
+			require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}}}))
+			tt.crash(t, s, dataPath)
+			setFaultInjector(nil)
+
+			// Either the old partition or the rewrite is there, but never both nor none.
+			st, err = NewStorage(opts...)
+			require.NoError(t, err)
+			defer st.Close()
+			entries, err := os.ReadDir(dataPath)
+			require.NoError(t, err)
+			for _, e := range entries {
+				assert.NotContains(t, e.Name(), compactingDirPrefix)
+			}
+			got, err := st.Select("metric1", nil, 1, 4)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{
+				{Timestamp: 1, Value: 0.1},
+				{Timestamp: 2, Value: 0.2},
+				{Timestamp: 3, Value: 0.1},
+			}, got)
+		})
+	}
+}
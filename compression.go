@@ -0,0 +1,185 @@
+package tstorage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression represents an algorithm to compress chunks of data points in disk partitions.
+// See WithCompression
+type Compression string
+
+const (
+	NoCompression Compression = "none"
+	Gzip          Compression = "gzip"
+	// Zstd compresses as well as Gzip while taking way less CPU on both flush and query.
+	Zstd Compression = "zstd"
+)
+
+// compressor compresses a chunk of encoded data points.
+type compressor interface {
+	// compress appends the compressed src to dst and gives back the result.
+	compress(dst, src []byte) ([]byte, error)
+}
+
+// decompressor decompresses a chunk compressed by compressor.
+type decompressor interface {
+	// decompress appends the decompressed src to dst and gives back the result.
+	// It fails if the decompressed size exceeds limit, which guards against corrupt or malicious src.
+	decompress(dst, src []byte, limit int) ([]byte, error)
+}
+
+// newCompressor gives back a compressor for the given algorithm.
+// Giving 0 as a level uses the default level of the algorithm.
+func newCompressor(c Compression, level int) (compressor, error) {
+	switch c {
+	case "", NoCompression:
+		return &nopCompressor{}, nil
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		// Check if the level is valid in advance.
+		if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+			return nil, err
+		}
+		return &gzipCompressor{level: level}, nil
+	case Zstd:
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			if level < 1 || level > 22 {
+				return nil, fmt.Errorf("zstd: invalid compression level: %d", level)
+			}
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		// An encoder is goroutine safe as long as it's used only through EncodeAll.
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdCompressor{encoder: encoder}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q given", c)
+	}
+}
+
+// newDecompressor gives back a decompressor for the given algorithm.
+func newDecompressor(c Compression) (decompressor, error) {
+	switch c {
+	case "", NoCompression:
+		return &nopCompressor{}, nil
+	case Gzip:
+		return &gzipCompressor{}, nil
+	case Zstd:
+		return &zstdCompressor{}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q found", c)
+	}
+}
+
+type nopCompressor struct{}
+
+func (n *nopCompressor) compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (n *nopCompressor) decompress(dst, src []byte, limit int) ([]byte, error) {
+	if len(src) > limit {
+		return nil, fmt.Errorf("decompressed size %d exceeds the limit %d", len(src), limit)
+	}
+	if len(dst) == 0 {
+		// Avoid copying since src is never modified by callers.
+		return src, nil
+	}
+	return append(dst, src...), nil
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (g *gzipCompressor) compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := gzip.NewWriterLevel(buf, g.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, fmt.Errorf("failed to compress with gzip: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress with gzip: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *gzipCompressor) decompress(dst, src []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress with gzip: %w", err)
+	}
+	defer r.Close()
+	buf := bytes.NewBuffer(dst)
+	// Read one more byte than the limit to tell if it's exceeded.
+	n, err := io.Copy(buf, io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress with gzip: %w", err)
+	}
+	if n > int64(limit) {
+		return nil, fmt.Errorf("decompressed size exceeds the limit %d", limit)
+	}
+	return buf.Bytes(), nil
+}
+
+// zstdDecoder is shared by all partitions since a decoder is goroutine safe as long as it's used only
+// through DecodeAll, and holds buffers worth reusing.
+var (
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+	zstdDecoderOnce sync.Once
+)
+
+func sharedZstdDecoder() (*zstd.Decoder, error) {
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, zstdDecoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdDecoder, zstdDecoderErr
+}
+
+type zstdCompressor struct {
+	// nil for decompression.
+	encoder *zstd.Encoder
+}
+
+func (z *zstdCompressor) compress(dst, src []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(src, dst), nil
+}
+
+func (z *zstdCompressor) decompress(dst, src []byte, limit int) ([]byte, error) {
+	var header zstd.Header
+	if err := header.Decode(src); err != nil {
+		return nil, fmt.Errorf("failed to decompress with zstd: %w", err)
+	}
+	// Reject it before allocating if the frame tells its size, which EncodeAll always does.
+	if header.HasFCS && header.FrameContentSize > uint64(limit) {
+		return nil, fmt.Errorf("decompressed size %d exceeds the limit %d", header.FrameContentSize, limit)
+	}
+	decoder, err := sharedZstdDecoder()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	n := len(dst)
+	dst, err = decoder.DecodeAll(src, dst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress with zstd: %w", err)
+	}
+	if len(dst)-n > limit {
+		return nil, fmt.Errorf("decompressed size exceeds the limit %d", limit)
+	}
+	return dst, nil
+}
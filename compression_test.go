@@ -0,0 +1,92 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_compressor_roundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression Compression
+		level       int
+		wantErr     bool
+	}{
+		{
+			name:        "no compression",
+			compression: NoCompression,
+		},
+		{
+			name:        "gzip with default level",
+			compression: Gzip,
+		},
+		{
+			name:        "gzip with best speed",
+			compression: Gzip,
+			level:       1,
+		},
+		{
+			name:        "gzip with invalid level",
+			compression: Gzip,
+			level:       100,
+			wantErr:     true,
+		},
+		{
+			name:        "zstd with default level",
+			compression: Zstd,
+		},
+		{
+			name:        "zstd with best compression",
+			compression: Zstd,
+			level:       22,
+		},
+		{
+			name:        "zstd with invalid level",
+			compression: Zstd,
+			level:       23,
+			wantErr:     true,
+		},
+		{
+			name:        "unknown compression",
+			compression: "unknown",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCompressor(tt.compression, tt.level)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if err != nil {
+				return
+			}
+			src := []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+			compressed, err := c.compress(nil, src)
+			require.NoError(t, err)
+
+			d, err := newDecompressor(tt.compression)
+			require.NoError(t, err)
+			got, err := d.decompress(nil, compressed, len(src))
+			require.NoError(t, err)
+			assert.Equal(t, src, got)
+		})
+	}
+}
+
+func Test_decompressor_limit(t *testing.T) {
+	for _, compression := range []Compression{NoCompression, Gzip, Zstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			c, err := newCompressor(compression, 0)
+			require.NoError(t, err)
+			src := make([]byte, 1024)
+			compressed, err := c.compress(nil, src)
+			require.NoError(t, err)
+
+			d, err := newDecompressor(compression)
+			require.NoError(t, err)
+			_, err = d.decompress(nil, compressed, len(src)-1)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package tstorage
+
+import "fmt"
+
+// CorruptionError describes a corruption found in a disk partition, such as data points failing
+// to decode and metadata failing to verify its checksum. It matches ErrCorrupted with errors.Is.
+// See WithCorruptionHandler.
+type CorruptionError struct {
+	// Path is the directory of the disk partition.
+	Path string
+	// Metric and Labels identify the series the corruption was found in.
+	// Metric is empty if it was found outside of series, e.g. in the metadata.
+	Metric string
+	Labels []Label
+	Err    error
+}
+
+func newCorruptionError(path, name string, err error) *CorruptionError {
+	e := &CorruptionError{Path: path, Err: err}
+	if name != "" {
+		e.Metric, e.Labels = unmarshalMetricName(name)
+	}
+	return e
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Metric == "" {
+		return fmt.Sprintf("%v in %q: %v", ErrCorrupted, e.Path, e.Err)
+	}
+	return fmt.Sprintf("%v in metric %q in %q: %v", ErrCorrupted, e.Metric, e.Path, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupted
+}
@@ -0,0 +1,69 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_WithCorruptionHandler(t *testing.T) {
+	labels := []Label{{Name: "host", Value: "host-1"}}
+	d := newTestDiskPartition(t, []Row{
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 2, Value: 0.1}},
+	})
+	// Pretend the data file got truncated.
+	release, err := d.acquireData()
+	require.NoError(t, err)
+	release()
+	d.mappedFile = d.mappedFile[:1]
+	list := newPartitionList()
+	list.insert(d)
+
+	var got []*CorruptionError
+	s := &storage{
+		partitionList: list,
+		corruptionHandler: func(err *CorruptionError) {
+			got = append(got, err)
+		},
+	}
+	_, err = s.Select("metric1", labels, 1, 3)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	_, err = s.SelectInto(nil, "metric1", labels, 1, 3)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	it, err := s.SelectChunks("metric1", labels, 1, 3)
+	require.NoError(t, err)
+	assert.False(t, it.Next())
+	assert.ErrorIs(t, it.Err(), ErrCorrupted)
+
+	require.Len(t, got, 3)
+	for _, e := range got {
+		assert.Equal(t, d.dirPath, e.Path)
+		assert.Equal(t, "metric1", e.Metric)
+		assert.Equal(t, labels, e.Labels)
+	}
+
+	// Corruption found while opening partitions is reported as well.
+	tmpDir := t.TempDir()
+	st, err := NewStorage(WithDataPath(tmpDir))
+	require.NoError(t, err)
+	require.NoError(t, st.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}}))
+	require.NoError(t, st.Close())
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+	require.NoError(t, os.WriteFile(filepath.Join(dirs[0], metaFileName), []byte("{"), 0644))
+
+	got = nil
+	st, err = NewStorage(WithDataPath(tmpDir), WithCorruptionHandler(func(err *CorruptionError) {
+		got = append(got, err)
+	}))
+	require.NoError(t, err)
+	defer st.Close()
+	require.Len(t, got, 1)
+	assert.Equal(t, dirs[0], got[0].Path)
+	assert.Empty(t, got[0].Metric)
+}
@@ -0,0 +1,74 @@
+package tstorage
+
+import (
+	"context"
+	"errors"
+	"math"
+)
+
+func (s *storage) Count(metric string, labels []Label, start, end int64) (int64, error) {
+	if s.closed.Load() {
+		return 0, ErrClosed
+	}
+	parts, err := s.appendPartitionsInRange(nil, metric, start, end)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	if !s.countable(metric, labels) {
+		points, err := s.selectDataPoints(ctx, metric, labels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			return 0, nil
+		}
+		if err != nil {
+			s.reportCorruption(err)
+			return 0, err
+		}
+		return int64(len(points)), nil
+	}
+	var count int64
+	for _, part := range parts {
+		n, err := part.countDataPoints(ctx, metric, labels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			s.reportCorruption(err)
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+func (s *storage) Exists(metric string, labels []Label) bool {
+	if s.closed.Load() || metric == "" {
+		return false
+	}
+	if !s.countable(metric, labels) {
+		n, err := s.Count(metric, labels, math.MinInt64, math.MaxInt64)
+		return err == nil && n > 0
+	}
+	ctx := context.Background()
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		part := iterator.value()
+		if part == nil {
+			continue
+		}
+		// Every chunk is within the whole range, which takes no decoding.
+		if n, err := part.countDataPoints(ctx, metric, labels, math.MinInt64, math.MaxInt64); err == nil && n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// countable reports whether the number of data points partitions hold is the one Select would give back,
+// which isn't true if some of them are hidden by deletions or duplicate resolution.
+func (s *storage) countable(metric string, labels []Label) bool {
+	if s.duplicatePolicy != KeepDuplicates {
+		return false
+	}
+	return s.tombstones.isEmpty() || len(s.tombstones.get(marshalMetricName(metric, labels))) == 0
+}
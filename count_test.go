@@ -0,0 +1,86 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Count(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "in-memory",
+		},
+		{
+			name: "compressed head",
+			opts: []Option{WithCompressedHead()},
+		},
+		{
+			name: "on disk",
+			opts: []Option{WithDataPath(t.TempDir())},
+		},
+		{
+			name: "duplicates resolved",
+			opts: []Option{WithDataPath(t.TempDir()), WithDuplicatePolicy(LastWriteWins)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(append([]Option{WithTimestampPrecision(Seconds), WithPartitionMaxPoints(300)}, tt.opts...)...)
+			require.NoError(t, err)
+			defer s.Close()
+			var rows []Row
+			for ts := int64(1600000000); ts < 1600001000; ts++ {
+				// Make them irregular to require decoding partial chunks.
+				if ts%7 != 0 {
+					rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}})
+				}
+			}
+			for len(rows) > 0 {
+				n := 100
+				if n > len(rows) {
+					n = len(rows)
+				}
+				require.NoError(t, s.InsertRows(rows[:n]))
+				rows = rows[n:]
+			}
+			// Out-of-order data point, which goes into the late file once flushed.
+			require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000007}}}))
+			s.(*storage).flushWG.Wait()
+
+			ranges := [][2]int64{
+				{1600000000, 1600001000},
+				{1600000003, 1600000500},
+				{1600000123, 1600000124},
+				{1600000700, 1600000701},
+				{1600002000, 1600003000},
+			}
+			for _, r := range ranges {
+				want := 0
+				if points, err := s.Select("metric1", nil, r[0], r[1]); err == nil {
+					want = len(points)
+				}
+				got, err := s.Count("metric1", nil, r[0], r[1])
+				require.NoError(t, err)
+				assert.Equal(t, int64(want), got, "range %v", r)
+			}
+
+			require.NoError(t, s.Delete("metric1", nil, 1600000000, 1600000010))
+			got, err := s.Count("metric1", nil, 1600000000, 1600000020)
+			require.NoError(t, err)
+			assert.Equal(t, int64(8), got)
+
+			assert.True(t, s.Exists("metric1", nil))
+			assert.False(t, s.Exists("metric2", nil))
+			require.NoError(t, s.Delete("metric1", nil, 1600000000, 1600001000))
+			assert.False(t, s.Exists("metric1", nil))
+
+			_, err = s.Count("metric1", nil, 1, 1)
+			assert.ErrorIs(t, err, ErrInvalidTimestampRange)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package tstorage
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ErrInvalidCSV is returned by ImportCSV when the given data doesn't follow the CSV format written by ExportCSV.
+var ErrInvalidCSV = errors.New("invalid csv")
+
+// csvImportBatchSize is the number of rows ImportCSV buffers before inserting them at once.
+const csvImportBatchSize = 1 << 12
+
+// csvHeader is the first record ExportCSV writes.
+var csvHeader = []string{"timestamp", "value"}
+
+func (s *storage) ExportCSV(w io.Writer, metric string, labels []Label, start, end int64) error {
+	points, err := s.Select(metric, labels, start, end)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return fmt.Errorf("failed to write the header: %w", err)
+	}
+	record := make([]string, 2)
+	for _, p := range points {
+		record[0] = strconv.FormatInt(p.Timestamp, 10)
+		record[1] = strconv.FormatFloat(p.Value, 'g', -1, 64)
+		if err := cw.Write(record); err != nil {
+			return fmt.Errorf("failed to write the data point: %w", err)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (s *storage) ImportCSV(r io.Reader, metric string, labels []Label) error {
+	if metric == "" {
+		return ErrEmptyMetric
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	cr.ReuseRecord = true
+	rows := make([]Row, 0, csvImportBatchSize)
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidCSV, err)
+		}
+		if line == 1 && record[0] == csvHeader[0] && record[1] == csvHeader[1] {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: line %d: invalid timestamp %q", ErrInvalidCSV, line, record[0])
+		}
+		value, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			return fmt.Errorf("%w: line %d: invalid value %q", ErrInvalidCSV, line, record[1])
+		}
+		rows = append(rows, Row{Metric: metric, Labels: labels, DataPoint: DataPoint{Timestamp: timestamp, Value: value}})
+		if len(rows) == csvImportBatchSize {
+			if err := s.InsertRows(rows); err != nil {
+				return err
+			}
+			// Rows are held by partitions, so never reused.
+			rows = make([]Row, 0, csvImportBatchSize)
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return s.InsertRows(rows)
+}
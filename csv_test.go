@@ -0,0 +1,67 @@
+package tstorage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_ExportCSV_ImportCSV(t *testing.T) {
+	labels := []Label{{Name: "host", Value: "host-1"}}
+	src, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer src.Close()
+	require.NoError(t, src.InsertRows([]Row{
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000001, Value: -2}},
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000002, Value: 1e100}},
+	}))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.ExportCSV(&buf, "metric1", labels, 1600000000, 1600000002))
+	assert.Equal(t, "timestamp,value\n1600000000,0.1\n1600000001,-2\n", buf.String())
+
+	dst, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer dst.Close()
+	require.NoError(t, dst.ImportCSV(&buf, "metric2", nil))
+	got, err := dst.Select("metric2", nil, 1600000000, 1600000003)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1600000000, Value: 0.1},
+		{Timestamp: 1600000001, Value: -2},
+	}, got)
+
+	// The header is optional.
+	require.NoError(t, dst.ImportCSV(strings.NewReader("1600000002,1e+100\n"), "metric2", nil))
+	got, err = dst.Select("metric2", nil, 1600000002, 1600000003)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000002, Value: 1e100}}, got)
+
+	err = src.ExportCSV(&buf, "unknown", nil, 1600000000, 1600000002)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
+
+func Test_storage_ImportCSV_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "invalid timestamp", data: "timestamp,value\nfoo,1\n"},
+		{name: "invalid value", data: "1600000000,foo\n"},
+		{name: "missing field", data: "1600000000\n"},
+		{name: "extra field", data: "1600000000,1,2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			defer s.Close()
+			err = s.ImportCSV(strings.NewReader(tt.data), "metric1", nil)
+			assert.ErrorIs(t, err, ErrInvalidCSV)
+		})
+	}
+}
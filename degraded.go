@@ -0,0 +1,119 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultDegradedThreshold is the number of consecutive write failures to degrade the storage by default.
+const defaultDegradedThreshold = 3
+
+// ErrDegraded is returned by operations writing data once the storage got degraded into read-only,
+// due to persistent failures of writing to disk. The concrete error is a *DegradedError,
+// which tells the details. See WithDegradedThreshold.
+var ErrDegraded = errors.New("storage degraded into read-only")
+
+// DegradedError describes why the storage got degraded into read-only.
+type DegradedError struct {
+	// Op is the operation that failed at last, either "wal" or "flush".
+	Op string
+	// Err is the error the operation failed with at last.
+	Err error
+	// Since is the time the storage got degraded.
+	Since time.Time
+}
+
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("storage degraded into read-only since %s due to persistent %s failures: %v",
+		e.Since.Format(time.RFC3339), e.Op, e.Err)
+}
+
+// Is makes errors.Is(err, ErrDegraded) report true.
+func (e *DegradedError) Is(target error) bool {
+	return target == ErrDegraded
+}
+
+func (e *DegradedError) Unwrap() error {
+	return e.Err
+}
+
+// writeHealth tracks consecutive failures of writing to disk, and degrades the storage into read-only
+// once they reach the threshold. It never recovers by itself since such failures, like a full disk or
+// I/O errors, need someone to take care of.
+type writeHealth struct {
+	mu sync.Mutex
+	// zero means it never degrades.
+	threshold int
+	failures  int
+	degraded  *DegradedError
+	// nil means no one is interested in degradation.
+	handler func(err *DegradedError)
+}
+
+func (h *writeHealth) succeeded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = 0
+}
+
+func (h *writeHealth) failed(op string, err error) {
+	h.mu.Lock()
+	if h.threshold == 0 || h.degraded != nil {
+		h.mu.Unlock()
+		return
+	}
+	h.failures++
+	if h.failures < h.threshold {
+		h.mu.Unlock()
+		return
+	}
+	degraded := &DegradedError{Op: op, Err: err, Since: time.Now()}
+	h.degraded = degraded
+	h.mu.Unlock()
+	if h.handler != nil {
+		h.handler(degraded)
+	}
+}
+
+// check gives back a *DegradedError if the storage has been degraded.
+func (h *writeHealth) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.degraded == nil {
+		return nil
+	}
+	return h.degraded
+}
+
+// monitoredWAL reports the results of writing to the underlying WAL to writeHealth.
+type monitoredWAL struct {
+	wal
+	health *writeHealth
+}
+
+func (w *monitoredWAL) append(op walOperation, rows []Row) error {
+	return w.report(w.wal.append(op, rows))
+}
+
+func (w *monitoredWAL) appendDelete(name string, start, end int64) error {
+	return w.report(w.wal.appendDelete(name, start, end))
+}
+
+func (w *monitoredWAL) flush() error {
+	return w.report(w.wal.flush())
+}
+
+func (w *monitoredWAL) sync() error {
+	return w.report(w.wal.sync())
+}
+
+func (w *monitoredWAL) report(err error) error {
+	if err != nil {
+		w.health.failed("wal", err)
+		return err
+	}
+	w.health.succeeded()
+	return nil
+}
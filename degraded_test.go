@@ -0,0 +1,70 @@
+package tstorage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_writeHealth(t *testing.T) {
+	var handled []*DegradedError
+	h := &writeHealth{threshold: 2, handler: func(err *DegradedError) {
+		handled = append(handled, err)
+	}}
+	cause := errors.New("no space left on device")
+
+	h.failed("wal", cause)
+	h.succeeded()
+	h.failed("flush", cause)
+	assert.NoError(t, h.check())
+
+	h.failed("wal", cause)
+	err := h.check()
+	assert.ErrorIs(t, err, ErrDegraded)
+	assert.ErrorIs(t, err, cause)
+	require.Len(t, handled, 1)
+	assert.Equal(t, "wal", handled[0].Op)
+
+	// It never recovers by itself, nor gets handled again.
+	h.succeeded()
+	h.failed("wal", cause)
+	assert.ErrorIs(t, h.check(), ErrDegraded)
+	assert.Len(t, handled, 1)
+}
+
+func Test_writeHealth_disabled(t *testing.T) {
+	h := &writeHealth{}
+	for i := 0; i < 10; i++ {
+		h.failed("wal", errors.New("failed"))
+	}
+	assert.NoError(t, h.check())
+}
+
+func Test_storage_WithDegradedThreshold(t *testing.T) {
+	injectFaults(t, fault{point: faultWALWrite, action: faultFail, after: 1})
+	var degraded *DegradedError
+	s, err := NewStorage(
+		WithDataPath(t.TempDir()),
+		WithTimestampPrecision(Seconds),
+		WithWALBufferedSize(0),
+		WithDegradedThreshold(2),
+		WithDegradedHandler(func(err *DegradedError) { degraded = err }),
+	)
+	require.NoError(t, err)
+	row := Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}
+	require.NoError(t, s.InsertRows([]Row{row}))
+
+	assert.ErrorIs(t, s.InsertRows([]Row{row}), errInjectedFault)
+	assert.Nil(t, degraded)
+	assert.ErrorIs(t, s.InsertRows([]Row{row}), errInjectedFault)
+	require.NotNil(t, degraded)
+	assert.Equal(t, "wal", degraded.Op)
+	assert.ErrorIs(t, s.InsertRows([]Row{row}), ErrDegraded)
+
+	// Reading keeps working.
+	got, err := s.Select("metric1", nil, 1600000000, 1600000001)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+}
@@ -0,0 +1,72 @@
+package tstorage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+func (s *storage) ListMetrics() ([]string, error) {
+	seen := make(map[string]struct{})
+	for _, name := range s.lookupSeries(nil, math.MinInt64, math.MaxInt64) {
+		metric, _ := unmarshalMetricName(name)
+		seen[metric] = struct{}{}
+	}
+	return sortedKeys(seen), nil
+}
+
+func (s *storage) ListLabelNames(metric string) ([]string, error) {
+	seen := make(map[string]struct{})
+	err := s.rangeLabelsOf(metric, func(labels []Label) {
+		for _, l := range labels {
+			seen[l.Name] = struct{}{}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(seen), nil
+}
+
+func (s *storage) ListLabelValues(metric, labelName string) ([]string, error) {
+	if labelName == "" {
+		return nil, fmt.Errorf("label name must be set")
+	}
+	seen := make(map[string]struct{})
+	err := s.rangeLabelsOf(metric, func(labels []Label) {
+		for _, l := range labels {
+			if l.Name == labelName {
+				seen[l.Value] = struct{}{}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(seen), nil
+}
+
+// rangeLabelsOf calls fn with labels of each series of the given metric.
+func (s *storage) rangeLabelsOf(metric string, fn func(labels []Label)) error {
+	if metric == "" {
+		return ErrEmptyMetric
+	}
+	matchers := []Matcher{{Type: MatchEqual, Name: MetricNameLabel, Value: metric}}
+	for _, name := range s.lookupSeries(matchers, math.MinInt64, math.MaxInt64) {
+		m, labels := unmarshalMetricName(name)
+		if m == metric {
+			fn(labels)
+		}
+	}
+	return nil
+}
+
+// sortedKeys gives back keys of the given set in ascending order.
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
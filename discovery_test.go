@@ -0,0 +1,50 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_discovery(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}, {Name: "dc", Value: "x"}}, DataPoint: DataPoint{Timestamp: 1600000000}},
+		{Metric: "memory", Labels: []Label{{Name: "region", Value: "r"}}, DataPoint: DataPoint{Timestamp: 1600000000}},
+	}))
+	// Series get listed no matter whether they are on disk or in memory.
+	require.NoError(t, s.Close())
+	s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000001}},
+		{Metric: "disk", DataPoint: DataPoint{Timestamp: 1600000001}},
+	}))
+
+	metrics, err := s.ListMetrics()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cpu", "disk", "memory"}, metrics)
+
+	names, err := s.ListLabelNames("cpu")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dc", "host"}, names)
+	names, err = s.ListLabelNames("disk")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	values, err := s.ListLabelValues("cpu", "host")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, values)
+	values, err = s.ListLabelValues("cpu", "region")
+	require.NoError(t, err)
+	assert.Empty(t, values)
+
+	_, err = s.ListLabelNames("")
+	assert.Error(t, err)
+	_, err = s.ListLabelValues("cpu", "")
+	assert.Error(t, err)
+}
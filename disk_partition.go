@@ -2,12 +2,16 @@ package tstorage
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"hash/crc32"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nakabonne/tstorage/internal/syscall"
@@ -25,15 +29,42 @@ var (
 // A disk partition implements a partition that uses local disk as a storage.
 // It mainly has two files, data file and meta file.
 // The data file is memory-mapped and read only; no need to lock at all.
+// Rows written after it got persisted go into the late file instead.
 type diskPartition struct {
+	// id unique within the process, which keys chunks in the chunk cache.
+	id      uint64
 	dirPath string
 	meta    meta
-	// file descriptor of data file
-	f *os.File
-	// memory-mapped file backed by f
+	// size of the data file
+	dataSize int64
+	// memory-mapped data file, which is nil until a query touches it or once it gets unmapped.
+	// Readers hold mapMu for reading while using it. See acquireData.
 	mappedFile []byte
+	mapMu      sync.RWMutex
+	// Unix time in nanoseconds the data file got used last.
+	lastUsed int64
 	// duration to store data
-	retention time.Duration
+	retention    time.Duration
+	decompressor decompressor
+	// data points appended after the partition got persisted
+	late latePoints
+	// the result of warming up, which is never used.
+	warmUpSum byte
+
+	// The partition gets opened through load, only once.
+	loadOnce sync.Once
+	loadErr  error
+	// 1 once load finished
+	loaded uint32
+	// true once the load error got reported. See storage.unreadable.
+	loadErrReported atomic.Bool
+	// time range taken from the directory name, used until the partition gets opened
+	coarseMinT int64
+	coarseMaxT int64
+
+	// The label index gets read through labelIndex, only once.
+	indexOnce sync.Once
+	index     *labelIndex
 }
 
 // meta is a mapper for a meta file, which is put for each partition.
@@ -44,6 +75,155 @@ type meta struct {
 	NumDataPoints int                   `json:"numDataPoints"`
 	Metrics       map[string]diskMetric `json:"metrics"`
 	CreatedAt     time.Time             `json:"createdAt"`
+	// Compression is the algorithm chunks were compressed with. Empty means no compression.
+	Compression Compression `json:"compression,omitempty"`
+	// FormatVersion is the version of the format the partition is written in. See MigratePartition.
+	FormatVersion int `json:"formatVersion,omitempty"`
+	// Checksum is the CRC-32 of the JSON encoding of the meta with Checksum being 0.
+	// Zero means the meta was written before checksums got introduced, which can't be verified.
+	Checksum uint32 `json:"checksum,omitempty"`
+}
+
+var metaChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum computes the checksum of the meta, ignoring the current Checksum.
+// It's computed from the re-encoded values rather than the bytes on disk, which
+// makes it independent of the formatting while still catching any altered value.
+func (m meta) checksum() (uint32, error) {
+	m.Checksum = 0
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(b, metaChecksumTable), nil
+}
+
+// marshalMeta gives back the JSON encoding of the given meta along with its checksum.
+func marshalMeta(m *meta) ([]byte, error) {
+	sum, err := m.checksum()
+	if err != nil {
+		return nil, err
+	}
+	m.Checksum = sum
+	return json.Marshal(m)
+}
+
+// unmarshalMeta decodes the meta encoded by either marshalMeta or marshalBinaryMeta.
+func unmarshalMeta(b []byte) (meta, error) {
+	if isBinaryMeta(b) {
+		return unmarshalBinaryMeta(b)
+	}
+	var m meta
+	err := json.Unmarshal(b, &m)
+	return m, err
+}
+
+// readMetaFile reads the meta file in the given directory, preferring the binary one to the JSON one.
+// It gives back an error satisfying errors.Is(err, os.ErrNotExist) if neither exists.
+func readMetaFile(dirPath string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(dirPath, binaryMetaFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return os.ReadFile(filepath.Join(dirPath, metaFileName))
+	}
+	return b, err
+}
+
+// metaExists reports whether the given directory has a meta file in either format.
+func metaExists(dirPath string) bool {
+	for _, name := range []string{binaryMetaFileName, metaFileName} {
+		if _, err := os.Stat(filepath.Join(dirPath, name)); !errors.Is(err, os.ErrNotExist) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify ensures the meta is not altered since it was written.
+func (m *meta) verify() error {
+	if m.Checksum == 0 {
+		return nil
+	}
+	sum, err := m.checksum()
+	if err != nil {
+		return err
+	}
+	if sum != m.Checksum {
+		return fmt.Errorf("checksum mismatch: want %08x, got %08x", m.Checksum, sum)
+	}
+	return nil
+}
+
+// writeMeta writes the given meta into the directory, encoded in the binary format if binary is true,
+// or in JSON otherwise. It writes to a temporary file first and then renames it, so that a partially
+// written meta file never exists.
+func writeMeta(dirPath string, m *meta, binary bool) error {
+	var (
+		b        []byte
+		err      error
+		metaPath = filepath.Join(dirPath, metaFileName)
+	)
+	if binary {
+		b, metaPath = marshalBinaryMeta(m), filepath.Join(dirPath, binaryMetaFileName)
+	} else if b, err = marshalMeta(m); err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	tmpPath := metaPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	if _, err := withFaults(faultMetaWrite, f).Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write metadata to %s: %w", tmpPath, err)
+	}
+	if err := syncFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write metadata to %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, metaPath); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, metaPath, err)
+	}
+	// The meta file is written at last, so this persists the entries of all files in the partition.
+	if err := syncDir(dirPath); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dirPath, err)
+	}
+	return nil
+}
+
+// syncFile commits the contents of the given file to stable storage.
+func syncFile(f *os.File) error {
+	if err := injectFault(faultPartitionSync); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// syncDir commits the entries of the given directory to stable storage.
+func syncDir(path string) error {
+	if err := injectFault(faultPartitionSync); err != nil {
+		return err
+	}
+	return syscall.SyncDir(path)
+}
+
+// writeFileSync writes the given bytes to the file, and then syncs it.
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := syncFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	return f.Close()
 }
 
 // diskMetric holds meta data to access actual data from the memory-mapped file.
@@ -53,6 +233,38 @@ type diskMetric struct {
 	MinTimestamp  int64  `json:"minTimestamp"`
 	MaxTimestamp  int64  `json:"maxTimestamp"`
 	NumDataPoints int64  `json:"numDataPoints"`
+	// Chunks is empty if the partition was written before chunks got introduced,
+	// in which case all data points are encoded into a single chunk from Offset.
+	Chunks []diskChunk `json:"chunks,omitempty"`
+}
+
+// validate ensures the meta is consistent with the data file of the given size,
+// so that corrupt values never lead to out of range accesses or huge allocations.
+// Any encoded data point takes one bit at least, which bounds the number of data points.
+func (m *meta) validate(dataSize int64) error {
+	if m.NumDataPoints < 0 {
+		return fmt.Errorf("negative number of data points %d", m.NumDataPoints)
+	}
+	for name, mt := range m.Metrics {
+		if mt.Offset < 0 || mt.Offset > dataSize {
+			return fmt.Errorf("offset %d for metric %q is out of the data file", mt.Offset, name)
+		}
+		if mt.NumDataPoints < 0 || mt.NumDataPoints > (dataSize-mt.Offset)*8 {
+			return fmt.Errorf("invalid number of data points %d for metric %q", mt.NumDataPoints, name)
+		}
+		for _, c := range mt.Chunks {
+			if c.Offset < 0 || c.Length < 0 || c.Offset > dataSize || c.Length > dataSize-c.Offset {
+				return fmt.Errorf("chunk at %d with length %d for metric %q is out of the data file", c.Offset, c.Length, name)
+			}
+			if c.NumDataPoints < 0 || c.NumDataPoints > c.Length*8 {
+				return fmt.Errorf("invalid number of data points %d in chunk at %d for metric %q", c.NumDataPoints, c.Offset, name)
+			}
+			if c.Interval < 0 || (c.Interval > 0 && (c.NumDataPoints < 2 || c.MinTimestamp+(c.NumDataPoints-1)*c.Interval != c.MaxTimestamp)) {
+				return fmt.Errorf("interval %d inconsistent with chunk at %d for metric %q", c.Interval, c.Offset, name)
+			}
+		}
+	}
+	return nil
 }
 
 // openDiskPartition first maps the data file into memory with memory-mapping.
@@ -60,101 +272,437 @@ func openDiskPartition(dirPath string, retention time.Duration) (partition, erro
 	if dirPath == "" {
 		return nil, fmt.Errorf("dir path is required")
 	}
-	metaFilePath := filepath.Join(dirPath, metaFileName)
-	_, err := os.Stat(metaFilePath)
-	if errors.Is(err, os.ErrNotExist) {
+	d := &diskPartition{
+		id:        nextDiskPartitionID(),
+		dirPath:   dirPath,
+		retention: retention,
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// newLazyDiskPartition gives back a disk partition that maps the data file and decodes the meta file
+// once it gets used first, taking its time range from the directory name until then.
+// It gets opened right away if the time range can't be told from the name, or if it has late data points.
+func newLazyDiskPartition(dirPath string, retention time.Duration) (partition, error) {
+	minT, maxT, ok := parsePartitionDirName(filepath.Base(dirPath))
+	if !ok {
+		return openDiskPartition(dirPath, retention)
+	}
+	if _, err := os.Stat(filepath.Join(dirPath, lateFileName)); !errors.Is(err, os.ErrNotExist) {
+		return openDiskPartition(dirPath, retention)
+	}
+	if !metaExists(dirPath) {
 		return nil, errInvalidPartition
 	}
+	return &diskPartition{
+		id:         nextDiskPartitionID(),
+		dirPath:    dirPath,
+		retention:  retention,
+		coarseMinT: minT,
+		coarseMaxT: maxT,
+	}, nil
+}
+
+// parsePartitionDirName gives back the time range the given name of partition directory tells.
+func parsePartitionDirName(name string) (minT, maxT int64, ok bool) {
+	if _, err := fmt.Sscanf(name, "p-%d-%d", &minT, &maxT); err != nil {
+		return 0, 0, false
+	}
+	if fmt.Sprintf("p-%d-%d", minT, maxT) != name || minT > maxT {
+		return 0, 0, false
+	}
+	return minT, maxT, true
+}
 
-	// Map data to the memory
-	dataPath := filepath.Join(dirPath, dataFileName)
-	f, err := os.Open(dataPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read data file: %w", err)
+// load opens the partition unless it has been opened. Once it fails, it keeps giving back the same error.
+func (d *diskPartition) load() error {
+	d.loadOnce.Do(func() {
+		d.loadErr = d.open()
+		atomic.StoreUint32(&d.loaded, 1)
+	})
+	return d.loadErr
+}
+
+// opened reports whether the partition has been opened successfully.
+func (d *diskPartition) opened() bool {
+	return atomic.LoadUint32(&d.loaded) == 1 && d.loadErr == nil
+}
+
+// unopened reports whether the given partition is a disk partition that hasn't been opened yet.
+// Such a partition is known to hold data points within its time range without opening it.
+func unopened(p partition) bool {
+	d, ok := p.(*diskPartition)
+	return ok && atomic.LoadUint32(&d.loaded) == 0
+}
+
+// open reads the meta file and the late file. The data file gets mapped into memory once a query touches it.
+func (d *diskPartition) open() error {
+	if !metaExists(d.dirPath) {
+		return errInvalidPartition
 	}
-	defer f.Close()
-	info, err := f.Stat()
+
+	info, err := os.Stat(filepath.Join(d.dirPath, dataFileName))
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch file info: %w", err)
+		return fmt.Errorf("failed to read data file: %w", err)
 	}
 	if info.Size() == 0 {
-		return nil, ErrNoDataPoints
+		return ErrNoDataPoints
+	}
+
+	// Read metadata to the heap
+	b, err := readMetaFile(d.dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	m, err := unmarshalMeta(b)
+	// A broken meta is handled as same as a missing one.
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidPartition, newCorruptionError(d.dirPath, "", fmt.Errorf("failed to decode metadata: %w", err)))
+	}
+	// Newer formats are never read, rather than taken as broken.
+	if err := m.checkVersion(); err != nil {
+		return fmt.Errorf("%s: %w", d.dirPath, err)
+	}
+	if err := m.verify(); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidPartition, newCorruptionError(d.dirPath, "", fmt.Errorf("metadata: %w", err)))
+	}
+	if err := m.validate(info.Size()); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidPartition, newCorruptionError(d.dirPath, "", fmt.Errorf("invalid metadata: %w", err)))
+	}
+	decompressor, err := newDecompressor(m.Compression)
+	if err != nil {
+		return err
 	}
-	mapped, err := syscall.Mmap(int(f.Fd()), int(info.Size()))
+	d.meta = m
+	d.dataSize = info.Size()
+	d.decompressor = decompressor
+	d.late.metrics, err = readLatePoints(d.dirPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to perform mmap: %w", err)
+		return err
 	}
+	for _, points := range d.late.metrics {
+		for _, p := range points {
+			if d.late.numPoints == 0 || p.Timestamp > d.late.maxT {
+				d.late.maxT = p.Timestamp
+			}
+			d.late.numPoints++
+		}
+	}
+	return nil
+}
 
-	// Read metadata to the heap
-	m := meta{}
-	mf, err := os.Open(metaFilePath)
+func (d *diskPartition) selectDataPoints(ctx context.Context, metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+	name := marshalMetricName(metric, labels)
+	mt, err := d.lookupMetric(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read metadata: %w", err)
+		return nil, err
 	}
-	defer mf.Close()
-	decoder := json.NewDecoder(mf)
-	if err := decoder.Decode(&m); err != nil {
-		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	points := make([]*DataPoint, 0, mt.NumDataPoints)
+	err = d.decodeDataPoints(ctx, mt, start, end, func(point DataPoint) {
+		points = append(points, &point)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return &diskPartition{
-		dirPath:    dirPath,
-		meta:       m,
-		f:          f,
-		mappedFile: mapped,
-		retention:  retention,
-	}, nil
+	late := filterValues(ctx, d.appendLatePoints(nil, name, start, end))
+	if err := chargeQueryMemory(ctx, len(late)); err != nil {
+		return nil, err
+	}
+	for i := range late {
+		points = append(points, &late[i])
+	}
+	return points, nil
+}
+
+func (d *diskPartition) appendDataPoints(ctx context.Context, dst []DataPoint, metric string, labels []Label, start, end int64) ([]DataPoint, error) {
+	name := marshalMetricName(metric, labels)
+	mt, err := d.lookupMetric(name)
+	if err != nil {
+		return dst, err
+	}
+	err = d.decodeDataPoints(ctx, mt, start, end, func(point DataPoint) {
+		dst = append(dst, point)
+	})
+	if err != nil {
+		return dst, err
+	}
+	n := len(dst)
+	dst = d.appendLatePoints(dst, name, start, end)
+	dst = dst[:n+len(filterValues(ctx, dst[n:]))]
+	return dst, chargeQueryMemory(ctx, len(dst)-n)
+}
+
+// selectAll gives back rows of all data points in the partition, including late ones, in ascending order of series,
+// and then timestamps.
+func (d *diskPartition) selectAll(ctx context.Context) ([]Row, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return selectAllRows(ctx, d, d.metricNames(), d.size())
+}
+
+// countDataPoints takes the number of data points in chunks within the range from the metadata. Only chunks
+// partially overlapping the range get decoded, unless they are at a regular interval.
+func (d *diskPartition) countDataPoints(ctx context.Context, metric string, labels []Label, start, end int64) (int64, error) {
+	name := marshalMetricName(metric, labels)
+	mt, err := d.lookupMetric(name)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	partial := &diskMetric{Name: mt.Name}
+	chunks := d.chunks(mt)
+	for _, chunk := range chunks[searchChunks(chunks, start):] {
+		if chunk.NumDataPoints == 0 {
+			continue
+		}
+		if chunk.MinTimestamp >= end {
+			break
+		}
+		switch {
+		case chunk.MinTimestamp >= start && chunk.MaxTimestamp < end:
+			n += chunk.NumDataPoints
+		case chunk.Interval > 0:
+			i, j := regularRange(chunk.MinTimestamp, chunk.Interval, int(chunk.NumDataPoints), start, end)
+			n += int64(j - i)
+		default:
+			partial.Chunks = append(partial.Chunks, chunk)
+		}
+	}
+	if len(partial.Chunks) > 0 {
+		err := d.decodeDataPoints(ctx, partial, start, end, func(DataPoint) {
+			n++
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n + d.countLatePoints(name, start, end), nil
 }
 
-func (d *diskPartition) insertRows(_ []Row) ([]Row, error) {
-	return nil, fmt.Errorf("can't insert rows into disk partition")
+// appendChunks appends chunks of the given metric overlapping the given range to dst as they are stored,
+// followed by late data points encoded into chunks holding up to chunkSize points.
+// Data of chunks are copied, so that they stay valid after the partition gets removed.
+func (d *diskPartition) appendChunks(dst []Chunk, metric string, labels []Label, start, end int64, chunkSize int) ([]Chunk, error) {
+	name := marshalMetricName(metric, labels)
+	mt, err := d.lookupMetric(name)
+	if err != nil {
+		return dst, err
+	}
+	compression := d.meta.Compression
+	if compression == "" {
+		compression = NoCompression
+	}
+	release, err := d.acquireData()
+	if err != nil {
+		return dst, err
+	}
+	defer release()
+	chunks := d.chunks(mt)
+	for _, chunk := range chunks[searchChunks(chunks, start):] {
+		if chunk.NumDataPoints == 0 {
+			continue
+		}
+		if chunk.MinTimestamp >= end {
+			break
+		}
+		b, err := d.chunkData(&chunk)
+		if err != nil {
+			return dst, newCorruptionError(d.dirPath, mt.Name, err)
+		}
+		data := make([]byte, chunk.Length)
+		copy(data, b)
+		dst = append(dst, Chunk{
+			MinTimestamp:  chunk.MinTimestamp,
+			MaxTimestamp:  chunk.MaxTimestamp,
+			NumDataPoints: int(chunk.NumDataPoints),
+			Compression:   compression,
+			Data:          data,
+		})
+	}
+	return appendEncodedChunks(dst, d.appendLatePoints(nil, name, start, end), chunkSize)
 }
 
-func (d *diskPartition) selectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+// lookupMetric gives back the meta data of the given metric.
+// The metric only late data points have is given as the one without any chunks.
+func (d *diskPartition) lookupMetric(name string) (*diskMetric, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
 	if d.expired() {
 		return nil, fmt.Errorf("this partition is expired: %w", ErrNoDataPoints)
 	}
-	name := marshalMetricName(metric, labels)
 	mt, ok := d.meta.Metrics[name]
-	if !ok {
-		return nil, ErrNoDataPoints
+	if ok {
+		return &mt, nil
 	}
-	r := bytes.NewReader(d.mappedFile)
-	if _, err := r.Seek(mt.Offset, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek: %w", err)
+	if d.hasLateMetric(name) {
+		return &diskMetric{Name: name}, nil
 	}
-	decoder, err := newSeriesDecoder(r)
+	return nil, ErrNoDataPoints
+}
+
+// decodeDataPoints decodes data points of the given metric within the given range, and then passes them to fn in order.
+// Data points the predicate carried by ctx rejects are skipped.
+func (d *diskPartition) decodeDataPoints(ctx context.Context, mt *diskMetric, start, end int64, fn func(DataPoint)) error {
+	release, err := d.acquireData()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate decoder for metric %q in %q: %w", name, d.dirPath, err)
+		return err
 	}
-
-	// TODO: Divide fixed-lengh chunks when flushing, and index it.
-	points := make([]*DataPoint, 0, mt.NumDataPoints)
-	for i := 0; i < int(mt.NumDataPoints); i++ {
-		point := &DataPoint{}
-		if err := decoder.decodePoint(point); err != nil {
-			return nil, fmt.Errorf("failed to decode point of metric %q in %q: %w", name, d.dirPath, err)
+	defer release()
+	if pred := valuePredicate(ctx); pred != nil {
+		emit := fn
+		fn = func(point DataPoint) {
+			if pred(point.Value) {
+				emit(point)
+			}
 		}
-		if point.Timestamp < start {
+	}
+	cache := chunkCacheFrom(ctx)
+	chunks := d.chunks(mt)
+	for _, chunk := range chunks[searchChunks(chunks, start):] {
+		if chunk.NumDataPoints == 0 {
 			continue
 		}
-		if point.Timestamp >= end {
+		if chunk.MinTimestamp >= end {
 			break
 		}
-		points = append(points, point)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if cache != nil {
+			if err := d.decodeCachedChunk(ctx, cache, mt, &chunk, start, end, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if chunk.Interval > 0 {
+			if err := d.decodeRegularChunk(ctx, mt, &chunk, start, end, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := chargeQueryMemory(ctx, int(chunk.NumDataPoints)); err != nil {
+			return err
+		}
+		decoder, err := d.newChunkDecoder(&chunk)
+		if err != nil {
+			return newCorruptionError(d.dirPath, mt.Name, fmt.Errorf("failed to generate decoder: %w", err))
+		}
+		var point DataPoint
+		for i := 0; i < int(chunk.NumDataPoints); i++ {
+			if err := decoder.decodePoint(&point); err != nil {
+				return newCorruptionError(d.dirPath, mt.Name, fmt.Errorf("failed to decode point: %w", err))
+			}
+			if point.Timestamp < start {
+				continue
+			}
+			if point.Timestamp >= end {
+				break
+			}
+			fn(point)
+		}
 	}
-	return points, nil
+	return nil
+}
+
+// decodeRegularChunk is like decodeDataPoints but for a single chunk at a regular interval, which
+// finds data points within the range by their indices, so that it needs no timestamp comparison and
+// stops decoding right after the last one. Data points are still decoded from the head of the chunk
+// since each of them is encoded relative to the previous one.
+func (d *diskPartition) decodeRegularChunk(ctx context.Context, mt *diskMetric, chunk *diskChunk, start, end int64, fn func(DataPoint)) error {
+	i, j := regularRange(chunk.MinTimestamp, chunk.Interval, int(chunk.NumDataPoints), start, end)
+	if i == j {
+		return nil
+	}
+	if err := chargeQueryMemory(ctx, j-i); err != nil {
+		return err
+	}
+	decoder, err := d.newChunkDecoder(chunk)
+	if err != nil {
+		return newCorruptionError(d.dirPath, mt.Name, fmt.Errorf("failed to generate decoder: %w", err))
+	}
+	var point DataPoint
+	for k := 0; k < j; k++ {
+		if err := decoder.decodePoint(&point); err != nil {
+			return newCorruptionError(d.dirPath, mt.Name, fmt.Errorf("failed to decode point: %w", err))
+		}
+		if k >= i {
+			fn(point)
+		}
+	}
+	return nil
+}
+
+// chunks gives back the list of chunks the given metric consists of.
+func (d *diskPartition) chunks(mt *diskMetric) []diskChunk {
+	if len(mt.Chunks) > 0 {
+		return mt.Chunks
+	}
+	// Partitions written before chunks got introduced hold all points in a single chunk.
+	return []diskChunk{{
+		Offset:        mt.Offset,
+		Length:        d.dataSize - mt.Offset,
+		MinTimestamp:  mt.MinTimestamp,
+		MaxTimestamp:  mt.MaxTimestamp,
+		NumDataPoints: mt.NumDataPoints,
+	}}
+}
+
+// chunkData gives back the bytes of the given chunk in the memory-mapped file, after verifying its checksum.
+func (d *diskPartition) chunkData(chunk *diskChunk) ([]byte, error) {
+	if chunk.Offset < 0 || chunk.Length < 0 || chunk.Offset+chunk.Length > int64(len(d.mappedFile)) {
+		return nil, fmt.Errorf("chunk at %d with length %d is out of the data file", chunk.Offset, chunk.Length)
+	}
+	data := d.mappedFile[chunk.Offset : chunk.Offset+chunk.Length]
+	if err := chunk.verify(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// newChunkDecoder gives back a decoder for the given chunk in the memory-mapped file.
+func (d *diskPartition) newChunkDecoder(chunk *diskChunk) (seriesDecoder, error) {
+	data, err := d.chunkData(chunk)
+	if err != nil {
+		return nil, err
+	}
+	limit := int(chunk.NumDataPoints) * maxEncodedPointSize
+	b, err := d.decompressor.decompress(nil, data, limit)
+	if err != nil {
+		return nil, err
+	}
+	return newSeriesDecoder(bytes.NewReader(b))
 }
 
 func (d *diskPartition) minTimestamp() int64 {
+	if !d.opened() {
+		return d.coarseMinT
+	}
 	return d.meta.MinTimestamp
 }
 
 func (d *diskPartition) maxTimestamp() int64 {
+	if !d.opened() {
+		// Unopened partitions never have late data points.
+		return d.coarseMaxT
+	}
+	d.late.mu.RLock()
+	defer d.late.mu.RUnlock()
+	if d.late.numPoints > 0 && d.late.maxT > d.meta.MaxTimestamp {
+		return d.late.maxT
+	}
 	return d.meta.MaxTimestamp
 }
 
 func (d *diskPartition) size() int {
-	return d.meta.NumDataPoints
+	if err := d.load(); err != nil {
+		return 0
+	}
+	return d.meta.NumDataPoints + int(d.numLatePoints())
 }
 
 // Disk partition is immutable.
@@ -170,7 +718,12 @@ func (d *diskPartition) clean() error {
 	return nil
 }
 
+// expired reports false for the partition failing to get loaded, which is up to someone to take care of
+// rather than being removed. Callers skip such a partition through storage.unreadable.
 func (d *diskPartition) expired() bool {
+	if err := d.load(); err != nil {
+		return false
+	}
 	diff := time.Since(d.meta.CreatedAt)
 	if diff > d.retention {
 		return true
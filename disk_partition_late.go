@@ -0,0 +1,265 @@
+package tstorage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// lateFileName is the name of the side-file holding rows appended to a disk partition after it got persisted.
+// Its format is the same as plaintext WAL segments. It gets merged into the data file by compaction.
+const lateFileName = "late"
+
+// latePoints holds data points appended to a disk partition after it got persisted.
+// They are kept on heap as well as in the late file until compaction merges them.
+type latePoints struct {
+	// appendMu serializes appending and sealing.
+	appendMu sync.Mutex
+	// sealed is true once the partition got replaced by compaction.
+	sealed bool
+	// successor is the partition swapped for the sealed one, into which rows get forwarded.
+	// It's nil if the partition got removed instead.
+	successor partition
+
+	mu sync.RWMutex
+	// A hash map from metric name to data points in order of insertion.
+	metrics   map[string][]DataPoint
+	numPoints int64
+	maxT      int64
+}
+
+// readLatePoints reads the late file in the given directory if any.
+func readLatePoints(dirPath string) (map[string][]DataPoint, error) {
+	metrics := make(map[string][]DataPoint)
+	path := filepath.Join(dirPath, lateFileName)
+	fd, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return metrics, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open late file: %w", err)
+	}
+	seg, err := newSegment(fd, nil)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("failed to read late file: %w", err)
+	}
+	for seg.next() {
+		rec := seg.record()
+		if rec.op != operationInsert {
+			// Only insert records are appended to late files.
+			continue
+		}
+		metrics[rec.row.Metric] = append(metrics[rec.row.Metric], rec.row.DataPoint)
+	}
+	if err := seg.close(); err != nil {
+		return nil, err
+	}
+	if seg.torn {
+		// Rows get appended after the end of the valid frames from now on.
+		if err := os.Truncate(path, seg.offset); err != nil {
+			return nil, fmt.Errorf("failed to truncate the torn frame of late file: %w", err)
+		}
+	}
+	err = seg.error()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("failed to read late file: %w", err)
+	}
+	// The last record could be cut off in the middle of writing, which is just ignored.
+	return metrics, nil
+}
+
+// insertRows appends the rows not older than the partition to the late file, and gives back the others
+// as outdated. Rows are forwarded to the successor if the partition has been replaced by compaction.
+func (d *diskPartition) insertRows(rows []Row) ([]Row, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	d.late.appendMu.Lock()
+	if d.late.sealed {
+		successor := d.late.successor
+		d.late.appendMu.Unlock()
+		if successor == nil {
+			return rows, nil
+		}
+		return successor.insertRows(rows)
+	}
+	defer d.late.appendMu.Unlock()
+
+	accepted := make([]Row, 0, len(rows))
+	outdatedRows := make([]Row, 0)
+	for i := range rows {
+		if rows[i].Timestamp < d.minTimestamp() {
+			outdatedRows = append(outdatedRows, rows[i])
+			continue
+		}
+		accepted = append(accepted, rows[i])
+	}
+	if len(accepted) == 0 {
+		return outdatedRows, nil
+	}
+	if err := d.appendLateFile(accepted); err != nil {
+		return nil, err
+	}
+
+	d.late.mu.Lock()
+	defer d.late.mu.Unlock()
+	for i := range accepted {
+		name := marshalMetricName(accepted[i].Metric, accepted[i].Labels)
+		d.late.metrics[name] = append(d.late.metrics[name], accepted[i].DataPoint)
+		if d.late.numPoints == 0 || accepted[i].Timestamp > d.late.maxT {
+			d.late.maxT = accepted[i].Timestamp
+		}
+		d.late.numPoints++
+	}
+	return outdatedRows, nil
+}
+
+func (d *diskPartition) appendLateFile(rows []Row) error {
+	path := filepath.Join(d.dirPath, lateFileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open late file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to fetch late file info: %w", err)
+	}
+	if err := writeLateRows(f, info.Size(), rows); err != nil {
+		// Cut off the rows partially written, so that ones appended later are never preceded by them.
+		f.Truncate(info.Size())
+		f.Close()
+		return fmt.Errorf("failed to append to %s: %w", path, err)
+	}
+	// Late rows never go into the WAL, hence the late file is what makes them durable.
+	if err := syncFile(f); err != nil {
+		f.Truncate(info.Size())
+		f.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if err := syncDir(d.dirPath); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", d.dirPath, err)
+		}
+	}
+	return nil
+}
+
+// writeLateRows appends the given rows to the late file of the given size. Late files written before
+// frames got introduced are appended without frames.
+func writeLateRows(f *os.File, size int64, rows []Row) error {
+	framed := true
+	if size > 0 {
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, 0); err != nil {
+			return err
+		}
+		framed = b[0] == checksummedSegmentMagic
+	}
+	w := bufio.NewWriter(withFaults(faultWALWrite, f))
+	// Appended records never refer to existing ones, which may have been cut off.
+	var prev previousRecord
+	if !framed {
+		for i := range rows {
+			if err := writeInsertRecord(w, &rows[i], &prev); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}
+	if size == 0 {
+		if err := w.WriteByte(checksummedSegmentMagic); err != nil {
+			return err
+		}
+	}
+	var frames frameWriter
+	if err := frames.writeInsertRecords(w, rows, &prev); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// seal makes the partition forward rows to the given successor from now on.
+// The given function is called while appending is blocked.
+func (d *diskPartition) seal(replace func() (successor partition, err error)) error {
+	d.late.appendMu.Lock()
+	defer d.late.appendMu.Unlock()
+	successor, err := replace()
+	if err != nil {
+		return err
+	}
+	d.late.sealed = true
+	d.late.successor = successor
+	return nil
+}
+
+// appendLatePoints appends late data points of the given metric within the given range to dst in order of timestamp.
+func (d *diskPartition) appendLatePoints(dst []DataPoint, name string, start, end int64) []DataPoint {
+	d.late.mu.RLock()
+	defer d.late.mu.RUnlock()
+	n := len(dst)
+	for _, p := range d.late.metrics[name] {
+		if p.Timestamp >= start && p.Timestamp < end {
+			dst = append(dst, p)
+		}
+	}
+	sort.SliceStable(dst[n:], func(i, j int) bool {
+		return dst[n+i].Timestamp < dst[n+j].Timestamp
+	})
+	return dst
+}
+
+// countLatePoints gives back the number of late data points of the given metric within the given range.
+func (d *diskPartition) countLatePoints(name string, start, end int64) int64 {
+	d.late.mu.RLock()
+	defer d.late.mu.RUnlock()
+	var n int64
+	for _, p := range d.late.metrics[name] {
+		if p.Timestamp >= start && p.Timestamp < end {
+			n++
+		}
+	}
+	return n
+}
+
+// hasLateMetric reports whether the given metric has late data points.
+func (d *diskPartition) hasLateMetric(name string) bool {
+	d.late.mu.RLock()
+	defer d.late.mu.RUnlock()
+	_, ok := d.late.metrics[name]
+	return ok
+}
+
+// metricNames gives back the names of all metrics including ones only late data points have.
+func (d *diskPartition) metricNames() []string {
+	if err := d.load(); err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(d.meta.Metrics))
+	for name := range d.meta.Metrics {
+		names = append(names, name)
+	}
+	d.late.mu.RLock()
+	defer d.late.mu.RUnlock()
+	for name := range d.late.metrics {
+		if _, ok := d.meta.Metrics[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (d *diskPartition) numLatePoints() int64 {
+	d.late.mu.RLock()
+	defer d.late.mu.RUnlock()
+	return d.late.numPoints
+}
@@ -0,0 +1,179 @@
+package tstorage
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDiskPartition(t *testing.T, rows []Row) *diskPartition {
+	m := newMemoryPartition(nil, time.Hour, Seconds)
+	_, err := m.insertRows(rows)
+	require.NoError(t, err)
+	dir := filepath.Join(t.TempDir(), "p-1")
+	s := &storage{compressor: &nopCompressor{}}
+	require.NoError(t, s.writePartition(dir, m.(*memoryPartition), time.Now()))
+	p, err := openDiskPartition(dir, time.Hour)
+	require.NoError(t, err)
+	return p.(*diskPartition)
+}
+
+func Test_diskPartition_insertRows(t *testing.T) {
+	d := newTestDiskPartition(t, []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20, Value: 0.1}},
+	})
+
+	outdated, err := d.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 15, Value: 0.2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 9, Value: 0.2}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 30, Value: 0.2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 11, Value: 0.2}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 9, Value: 0.2}}}, outdated)
+	assert.Equal(t, 5, d.size())
+	assert.Equal(t, int64(30), d.maxTimestamp())
+
+	want1 := []DataPoint{
+		{Timestamp: 10, Value: 0.1},
+		{Timestamp: 20, Value: 0.1},
+		{Timestamp: 11, Value: 0.2},
+		{Timestamp: 15, Value: 0.2},
+	}
+	got, err := d.appendDataPoints(context.Background(), nil, "metric1", nil, math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	assert.Equal(t, want1, got)
+	got, err = d.appendDataPoints(context.Background(), nil, "metric2", nil, math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	assert.Equal(t, []DataPoint{{Timestamp: 30, Value: 0.2}}, got)
+
+	// Late data points get read from the late file.
+	reopened, err := openDiskPartition(d.dirPath, time.Hour)
+	require.NoError(t, err)
+	got, err = reopened.appendDataPoints(context.Background(), nil, "metric1", nil, math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	assert.Equal(t, want1, got)
+	assert.Equal(t, 5, reopened.size())
+}
+
+func Test_diskPartition_appendLateFile_torn(t *testing.T) {
+	d := newTestDiskPartition(t, []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 0.1}},
+	})
+	require.NoError(t, d.appendLateFile([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 11, Value: 0.2}}}))
+	path := filepath.Join(d.dirPath, lateFileName)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// The partially written rows get cut off.
+	injectFaults(t, fault{point: faultWALWrite, action: faultShortWrite, times: 1})
+	assert.ErrorIs(t, d.appendLateFile([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 12, Value: 0.3}}}), errInjectedFault)
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), after.Size())
+	require.NoError(t, d.appendLateFile([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 13, Value: 0.4}}}))
+
+	// As if the process crashed in the middle of appending.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0x20, 0x01, 0x02})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	got, err := readLatePoints(d.dirPath)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]DataPoint{
+		marshalMetricName("metric1", nil): {{Timestamp: 11, Value: 0.2}, {Timestamp: 13, Value: 0.4}},
+	}, got)
+	after, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2*info.Size()-1, after.Size(), "the torn frame must be truncated")
+}
+
+func Test_storage_lateWrites_compaction(t *testing.T) {
+	tmpDir := t.TempDir()
+	st, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(3*time.Second),
+	)
+	require.NoError(t, err)
+	s := st.(*storage)
+	// Make partitions (min: 1, max: 3), (min: 4, max: 6), (min: 7, max: 8), and then flush the oldest one.
+	for _, ts := range [][]int64{{1, 3}, {4, 6}, {7, 8}} {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts[0], Value: 0.1}},
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts[1], Value: 0.1}},
+		}))
+	}
+	require.NoError(t, s.flushPartitions())
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+	}))
+	want := []*DataPoint{
+		{Timestamp: 1, Value: 0.1},
+		{Timestamp: 2, Value: 0.2},
+		{Timestamp: 3, Value: 0.1},
+	}
+	got, err := s.Select("metric1", nil, 1, 4)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	var d *diskPartition
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		if p, ok := iterator.value().(*diskPartition); ok {
+			d = p
+		}
+	}
+	require.NotNil(t, d)
+	assert.True(t, s.needsCompaction(d))
+	require.NoError(t, s.compactPartitions())
+	_, err = os.Stat(filepath.Join(tmpDir, "p-1-3", lateFileName))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	got, err = s.Select("metric1", nil, 1, 4)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// Rows given to the replaced partition are forwarded to the new one.
+	outdated, err := d.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}}})
+	require.NoError(t, err)
+	assert.Empty(t, outdated)
+	got, err = s.Select("metric1", nil, 3, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 3, Value: 0.1}, {Timestamp: 3, Value: 0.3}}, got)
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_lateRows_crash(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithDataPath(dir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour), WithWALBufferedSize(0)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	for _, ts := range []int64{1600000000, 1600003600, 1600007200} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	s.(*storage).flushWG.Wait()
+	require.NoError(t, s.Flush())
+	// Older than both memory partitions, hence it goes into the late file of the disk partition.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001}}}))
+	require.FileExists(t, filepath.Join(dir, "p-1600000000-1600003600", lateFileName))
+
+	want := []*DataPoint{{Timestamp: 1600000000}, {Timestamp: 1600000001}, {Timestamp: 1600003600}, {Timestamp: 1600007200}}
+	// Crash without closing twice in a row; each data point must be there once.
+	for i := 0; i < 2; i++ {
+		s, err = NewStorage(opts...)
+		require.NoError(t, err)
+		got, err := s.Select("metric1", nil, 1600000000, 1600007201)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,110 @@
+package tstorage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/nakabonne/tstorage/internal/syscall"
+)
+
+// acquireData maps the data file into memory unless it has been mapped, and keeps it mapped until the returned
+// function gets called. It must not be called again before that by the same goroutine.
+func (d *diskPartition) acquireData() (func(), error) {
+	atomic.StoreInt64(&d.lastUsed, time.Now().UnixNano())
+	for {
+		d.mapMu.RLock()
+		if d.mappedFile != nil {
+			return d.mapMu.RUnlock, nil
+		}
+		d.mapMu.RUnlock()
+
+		d.mapMu.Lock()
+		err := d.mapData()
+		d.mapMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		// Go round since it may get unmapped again in the meantime.
+	}
+}
+
+// mapData maps the data file into memory unless it has been mapped. mapMu must be held for writing.
+func (d *diskPartition) mapData() error {
+	if d.mappedFile != nil {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(d.dirPath, dataFileName))
+	if err != nil {
+		return fmt.Errorf("failed to read data file: %w", err)
+	}
+	defer f.Close()
+	if err := injectFault(faultMmap); err != nil {
+		return fmt.Errorf("failed to perform mmap: %w", err)
+	}
+	mapped, err := syscall.Mmap(int(f.Fd()), int(d.dataSize))
+	if err != nil {
+		return fmt.Errorf("failed to perform mmap: %w", err)
+	}
+	d.mappedFile = mapped
+	return nil
+}
+
+// unmapIfIdle unmaps the data file unless it has been used since the given time, and reports whether it did.
+func (d *diskPartition) unmapIfIdle(since time.Time) (bool, error) {
+	if atomic.LoadInt64(&d.lastUsed) >= since.UnixNano() {
+		return false, nil
+	}
+	return d.unmap()
+}
+
+// unmap unmaps the data file, and reports whether it did. It never waits for queries using the data file,
+// which are left mapped.
+func (d *diskPartition) unmap() (bool, error) {
+	if !d.mapMu.TryLock() {
+		return false, nil
+	}
+	defer d.mapMu.Unlock()
+	if d.mappedFile == nil {
+		return false, nil
+	}
+	if err := syscall.Munmap(d.mappedFile); err != nil {
+		return false, fmt.Errorf("failed to unmap %s: %w", d.dirPath, err)
+	}
+	d.mappedFile = nil
+	return true, nil
+}
+
+// mappedSize gives back the number of bytes of the data file mapped into memory.
+func (d *diskPartition) mappedSize() int64 {
+	d.mapMu.RLock()
+	defer d.mapMu.RUnlock()
+	return int64(len(d.mappedFile))
+}
+
+// unmapIdlePartitionsPeriodically unmaps data files of disk partitions that haven't been used for the idle timeout,
+// until the storage gets closed.
+func (s *storage) unmapIdlePartitionsPeriodically() {
+	ticker := time.NewTicker(s.mmapIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-ticker.C:
+			since := time.Now().Add(-s.mmapIdleTimeout)
+			iterator := s.partitionList.newIterator()
+			for iterator.next() {
+				d, ok := iterator.value().(*diskPartition)
+				if !ok {
+					continue
+				}
+				if _, err := d.unmapIfIdle(since); err != nil {
+					s.logger.Warn("failed to unmap idle partition", "dir", d.dirPath, "err", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package tstorage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mapped reports whether the data file of the given partition is mapped into memory.
+func mapped(d *diskPartition) bool {
+	d.mapMu.RLock()
+	defer d.mapMu.RUnlock()
+	return d.mappedFile != nil
+}
+
+func Test_diskPartition_unmapIfIdle(t *testing.T) {
+	d := newTestDiskPartition(t, []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20, Value: 0.2}},
+	})
+	// Opening reads only the meta.
+	assert.False(t, mapped(d))
+
+	queried := time.Now()
+	_, err := d.selectDataPoints(context.Background(), "metric1", nil, 0, 100)
+	require.NoError(t, err)
+	assert.True(t, mapped(d))
+
+	unmapped, err := d.unmapIfIdle(queried)
+	require.NoError(t, err)
+	assert.False(t, unmapped)
+	unmapped, err = d.unmapIfIdle(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.True(t, unmapped)
+	assert.False(t, mapped(d))
+
+	// It gets mapped again on the next query.
+	got, err := d.selectDataPoints(context.Background(), "metric1", nil, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 10, Value: 0.1}, {Timestamp: 20, Value: 0.2}}, got)
+	assert.True(t, mapped(d))
+}
+
+func Test_storage_WithMmapIdleTimeout(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}))
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithMmapIdleTimeout(20*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.Select("metric1", nil, 1600000000, 1600000001)
+	require.NoError(t, err)
+	var d *diskPartition
+	iterator := s.(*storage).partitionList.newIterator()
+	for iterator.next() {
+		if p, ok := iterator.value().(*diskPartition); ok {
+			d = p
+		}
+	}
+	require.NotNil(t, d)
+	assert.Eventually(t, func() bool {
+		return !mapped(d)
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = NewStorage(WithMmapIdleTimeout(-1))
+	assert.Error(t, err)
+}
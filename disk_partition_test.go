@@ -1,10 +1,18 @@
 package tstorage
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestOpenDiskPartition(t *testing.T) {
@@ -36,3 +44,206 @@ func TestOpenDiskPartition(t *testing.T) {
 		})
 	}
 }
+
+func FuzzOpenDiskPartition(f *testing.F) {
+	m := newMemoryPartition(nil, time.Hour, Seconds)
+	_, err := m.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+	})
+	require.NoError(f, err)
+	dir := filepath.Join(f.TempDir(), "p-1")
+	s := &storage{compressor: &nopCompressor{}}
+	require.NoError(f, s.writePartition(dir, m.(*memoryPartition), time.Now()))
+	data, err := os.ReadFile(filepath.Join(dir, dataFileName))
+	require.NoError(f, err)
+	metaJSON, err := os.ReadFile(filepath.Join(dir, metaFileName))
+	require.NoError(f, err)
+	f.Add(metaJSON, data)
+	f.Add([]byte(`{"numDataPoints":1,"metrics":{"metric1":{"name":"metric1","offset":0,"numDataPoints":1000000000000}}}`), data)
+	f.Add([]byte(`{"numDataPoints":1,"metrics":{"metric1":{"name":"metric1","chunks":[{"offset":1,"length":100,"numDataPoints":1}]}}}`), data)
+
+	f.Fuzz(func(t *testing.T, metaJSON, data []byte) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, metaFileName), metaJSON, 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, dataFileName), data, 0644))
+		p, err := openDiskPartition(dir, time.Hour)
+		if err != nil {
+			return
+		}
+		_, err = p.selectDataPoints(context.Background(), "metric1", nil, math.MinInt64, math.MaxInt64)
+		if err != nil && !errors.Is(err, ErrNoDataPoints) {
+			assert.ErrorIs(t, err, ErrCorrupted)
+		}
+	})
+}
+
+func Test_meta_checksum(t *testing.T) {
+	m := newMemoryPartition(nil, time.Hour, Seconds)
+	_, err := m.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+	})
+	require.NoError(t, err)
+	dir := filepath.Join(t.TempDir(), "p-1")
+	s := &storage{compressor: &nopCompressor{}}
+	require.NoError(t, s.writePartition(dir, m.(*memoryPartition), time.Now()))
+	_, err = os.Stat(filepath.Join(dir, metaFileName+".tmp"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	p, err := openDiskPartition(dir, time.Hour)
+	require.NoError(t, err)
+	assert.NotZero(t, p.(*diskPartition).meta.Checksum)
+
+	// Alter a value without breaking the JSON.
+	metaPath := filepath.Join(dir, metaFileName)
+	b, err := os.ReadFile(metaPath)
+	require.NoError(t, err)
+	altered := strings.Replace(string(b), `"numDataPoints":1,`, `"numDataPoints":2,`, 1)
+	require.NotEqual(t, string(b), altered)
+	require.NoError(t, os.WriteFile(metaPath, []byte(altered), 0644))
+	_, err = openDiskPartition(dir, time.Hour)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	assert.ErrorIs(t, err, errInvalidPartition)
+
+	// The meta without checksum is accepted as is.
+	altered = strings.Replace(altered, fmt.Sprintf(`,"checksum":%d`, p.(*diskPartition).meta.Checksum), "", 1)
+	require.NoError(t, os.WriteFile(metaPath, []byte(altered), 0644))
+	p, err = openDiskPartition(dir, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.size())
+}
+
+func Test_parsePartitionDirName(t *testing.T) {
+	tests := []struct {
+		name     string
+		dirName  string
+		wantMinT int64
+		wantMaxT int64
+		wantOK   bool
+	}{
+		{
+			name:     "valid name",
+			dirName:  "p-1600000001-1600003600",
+			wantMinT: 1600000001,
+			wantMaxT: 1600003600,
+			wantOK:   true,
+		},
+		{
+			name:     "negative min timestamp",
+			dirName:  "p--10-20",
+			wantMinT: -10,
+			wantMaxT: 20,
+			wantOK:   true,
+		},
+		{
+			name:    "trailing characters",
+			dirName: "p-1-2x",
+		},
+		{
+			name:    "min greater than max",
+			dirName: "p-2-1",
+		},
+		{
+			name:    "only one timestamp",
+			dirName: "p-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minT, maxT, ok := parsePartitionDirName(tt.dirName)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantMinT, minT)
+			assert.Equal(t, tt.wantMaxT, maxT)
+		})
+	}
+}
+
+func Test_newLazyDiskPartition(t *testing.T) {
+	m := newMemoryPartition(nil, time.Hour, Seconds)
+	_, err := m.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20, Value: 0.2}},
+	})
+	require.NoError(t, err)
+	dir := filepath.Join(t.TempDir(), "p-10-20")
+	s := &storage{compressor: &nopCompressor{}}
+	require.NoError(t, s.writePartition(dir, m.(*memoryPartition), time.Now()))
+
+	p, err := newLazyDiskPartition(dir, time.Hour)
+	require.NoError(t, err)
+	d := p.(*diskPartition)
+	assert.True(t, unopened(d))
+	assert.Nil(t, d.mappedFile)
+	assert.Equal(t, int64(10), d.minTimestamp())
+	assert.Equal(t, int64(20), d.maxTimestamp())
+
+	got, err := d.selectDataPoints(context.Background(), "metric1", nil, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 10, Value: 0.1}, {Timestamp: 20, Value: 0.2}}, got)
+	assert.False(t, unopened(d))
+	assert.NotNil(t, d.mappedFile)
+
+	// A partition with late data points gets opened right away.
+	_, err = d.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 30, Value: 0.3}}})
+	require.NoError(t, err)
+	p, err = newLazyDiskPartition(dir, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, unopened(p))
+	assert.Equal(t, int64(30), p.maxTimestamp())
+}
+
+func Test_newLazyDiskPartition_corrupt(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "p-10-20")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, metaFileName), []byte("{"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, dataFileName), []byte{1}, 0644))
+
+	p, err := newLazyDiskPartition(dir, time.Hour)
+	require.NoError(t, err)
+	_, err = p.selectDataPoints(context.Background(), "metric1", nil, 0, 100)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	assert.Equal(t, 0, p.size())
+}
+
+func Test_storage_writePartition_outOfOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed bool
+	}{
+		{name: "raw"},
+		{name: "compressed", compressed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+			m.compressed = tt.compressed
+			// The ones older than the first data point of the metric are out of order.
+			_, err := m.insertRows([]Row{
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 4, Value: 0.4}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+			})
+			require.NoError(t, err)
+			dir := filepath.Join(t.TempDir(), "p-1-4")
+			s := &storage{compressor: &nopCompressor{}}
+			require.NoError(t, s.writePartition(dir, m, time.Now()))
+
+			p, err := openDiskPartition(dir, time.Hour)
+			require.NoError(t, err)
+			mt := p.(*diskPartition).meta.Metrics["metric1"]
+			assert.Equal(t, int64(1), mt.MinTimestamp)
+			assert.Equal(t, int64(4), mt.MaxTimestamp)
+			assert.Equal(t, int64(4), mt.NumDataPoints)
+			got, err := p.selectDataPoints(context.Background(), "metric1", nil, 0, 5)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{
+				{Timestamp: 1, Value: 0.1},
+				{Timestamp: 2, Value: 0.2},
+				{Timestamp: 3, Value: 0.3},
+				{Timestamp: 4, Value: 0.4},
+			}, got)
+		})
+	}
+}
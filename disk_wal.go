@@ -2,17 +2,28 @@ package tstorage
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+
+	"github.com/nakabonne/tstorage/internal/syscall"
 )
 
 // diskWAL contains multiple segment files. One segment is responsible for one partition.
@@ -24,17 +35,131 @@ import (
   └── 1
 */
 type diskWAL struct {
+	diskWALOptions
 	dir          string
 	bufferedSize int
 	// Buffered-writer to the active segment
 	w *bufio.Writer
 	// File descriptor to the active segment
-	fd    *os.File
+	fd *os.File
+	// Writer to the active segment mapped into memory, set only if mmap is enabled.
+	mw    *mmapSegmentWriter
 	index uint32
 	mu    sync.Mutex
+	// the last record written to the active segment
+	prev previousRecord
+	// encoder of frames written to the active segment
+	frames frameWriter
+	// segments numbered below it were written before the WAL got opened.
+	firstIndex uint32
+	// The index of the first segment of each group, oldest first. A group consists of the segments written
+	// between punctuations, which get removed together.
+	groups []uint32
+	// Writer counting the bytes written to the active segment.
+	cw *countingWriter
+}
+
+// diskWALOptions is a set of settings shared by the WAL writer and reader.
+type diskWALOptions struct {
+	// Block cipher to encrypt segments. Nil means segments are written in plaintext.
+	block cipher.Block
+	// The number of bytes to preallocate for each segment. Zero means no preallocation.
+	// It's used only by the writer.
+	preallocSize int64
+	// Whether segments are written through memory mapping, and how often they are msynced.
+	// They are used only by the writer.
+	mmap             bool
+	mmapSyncInterval time.Duration
+	// When segments get fsynced, which is used only by the writer.
+	syncPolicy WALSyncPolicy
+	// The size at which the active segment gets rotated. Zero means no rotation by size.
+	// It's used only by the writer.
+	segmentSize int64
+	// Whether frames get compressed with snappy, which is used only by the writer.
+	compress bool
+	// Where the writer counts the bytes appended and the syncs, which is used only by the writer.
+	metrics *walMetrics
+}
+
+type diskWALOption func(*diskWALOptions)
+
+// withWALCipher makes segments encrypted with AES-CTR using the given block cipher.
+func withWALCipher(block cipher.Block) diskWALOption {
+	return func(o *diskWALOptions) {
+		o.block = block
+	}
 }
 
-func newDiskWAL(dir string, bufferedSize int) (wal, error) {
+// withWALSegmentSize makes the active segment rotated once its size exceeds the given bytes.
+func withWALSegmentSize(size int64) diskWALOption {
+	return func(o *diskWALOptions) {
+		o.segmentSize = size
+	}
+}
+
+// withWALCompression makes the payload of frames compressed with snappy unless it doesn't get smaller.
+func withWALCompression() diskWALOption {
+	return func(o *diskWALOptions) {
+		o.compress = true
+	}
+}
+
+// withWALMetrics makes the writer count the bytes appended and the syncs into the given metrics.
+func withWALMetrics(m *walMetrics) diskWALOption {
+	return func(o *diskWALOptions) {
+		o.metrics = m
+	}
+}
+
+// withWALPreallocation makes disk space of the given size preallocated for each segment,
+// and the oldest segment recycled as the next one instead of being removed.
+func withWALPreallocation(size int64) diskWALOption {
+	return func(o *diskWALOptions) {
+		o.preallocSize = size
+	}
+}
+
+// spareSegmentName is the name of the empty segment file to be recycled as the next segment.
+// Since it's always empty, readers can read it as a segment without any records.
+const spareSegmentName = "spare"
+
+// The encrypted segment starts with the header as shown below:
+/*
+   +-----------+---------+
+   | magic(1b) | IV(16b) |
+   +-----------+---------+
+*/
+// The magic byte never collides with walOperation, hence segments without header are read as plaintext.
+const encryptedSegmentMagic byte = 0xec
+
+// The checksummed segment starts with the magic byte, which comes after the encrypted segment header if any.
+// Records follow it in frames as shown below, each of which holds the records appended at a time:
+/*
+   +-----------------------+-----------+----------------------+---------+
+   | len payload(uvarints) | flags(1b) | crc32 of payload(4b) | payload |
+   +-----------------------+-----------+----------------------+---------+
+*/
+// so that a frame cut off in the middle of writing can be told apart from corruption and dropped.
+// The payload is compressed with snappy if flags has frameSnappy.
+// The magic byte never collides with walOperation, hence segments without it are read as records without frames.
+const checksummedSegmentMagic byte = 0xcc
+
+// maxWALMetricNameLen is the upper bound of the length of a metric name in records,
+// so that a corrupt length never leads to a huge allocation.
+const maxWALMetricNameLen = 16 << 20
+
+// frameSnappy is the flag of frames whose payload is compressed with snappy.
+const frameSnappy byte = 1 << 0
+
+// walFrameSize is the size of the payload at which records appended at a time get split into another frame.
+const walFrameSize = 64 << 10
+
+// maxWALFrameSize is the upper bound of the length of a frame payload, which can exceed walFrameSize by a record.
+const maxWALFrameSize = walFrameSize + maxWALMetricNameLen + 4*binary.MaxVarintLen64
+
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+func newDiskWAL(dir string, bufferedSize int, opts ...diskWALOption) (wal, error) {
 	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
 		return nil, fmt.Errorf("failed to make WAL dir: %w", err)
 	}
@@ -42,13 +167,32 @@ func newDiskWAL(dir string, bufferedSize int) (wal, error) {
 		dir:          dir,
 		bufferedSize: bufferedSize,
 	}
-	f, err := w.createSegmentFile(dir)
+	for _, opt := range opts {
+		opt(&w.diskWALOptions)
+	}
+	if w.metrics == nil {
+		w.metrics = &walMetrics{}
+	}
+	if w.mmap && w.block != nil {
+		// The zero-filled tail, which marks the end of records, would be decrypted into garbage.
+		return nil, fmt.Errorf("memory-mapped segments can't be encrypted")
+	}
+	// Never append to existing segments, they may have been written with another header.
+	files, err := os.ReadDir(dir)
 	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+	for _, f := range files {
+		if i, err := strconv.ParseUint(f.Name(), 10, 32); err == nil && uint32(i) >= w.index {
+			w.index = uint32(i) + 1
+		}
+	}
+	w.firstIndex = w.index
+	if err := w.createSegment(); err != nil {
 		return nil, err
 	}
-	w.fd = f
-	w.w = bufio.NewWriterSize(f, bufferedSize)
-
+	w.groups = []uint32{w.firstIndex}
+	w.frames.compress = w.compress
 	return w, nil
 }
 
@@ -59,42 +203,204 @@ func (w *diskWAL) append(op walOperation, rows []Row) error {
 
 	switch op {
 	case operationInsert:
-		for _, row := range rows {
-			// Write the operation type
-			if err := w.w.WriteByte(byte(op)); err != nil {
-				return fmt.Errorf("failed to write operation: %w", err)
-			}
-			name := marshalMetricName(row.Metric, row.Labels)
-			// Write the length of the metric name
-			lBuf := make([]byte, binary.MaxVarintLen64)
-			n := binary.PutUvarint(lBuf, uint64(len(name)))
-			if _, err := w.w.Write(lBuf[:n]); err != nil {
-				return fmt.Errorf("failed to write the length of the metric name: %w", err)
-			}
-			// Write the metric name
-			if _, err := w.w.WriteString(name); err != nil {
-				return fmt.Errorf("failed to write the metric name: %w", err)
-			}
-			// Write the timestamp
-			tsBuf := make([]byte, binary.MaxVarintLen64)
-			n = binary.PutVarint(tsBuf, row.DataPoint.Timestamp)
-			if _, err := w.w.Write(tsBuf[:n]); err != nil {
-				return fmt.Errorf("failed to write the timestamp: %w", err)
-			}
-			// Write the value
-			vBuf := make([]byte, binary.MaxVarintLen64)
-			n = binary.PutUvarint(vBuf, math.Float64bits(row.DataPoint.Value))
-			if _, err := w.w.Write(vBuf[:n]); err != nil {
-				return fmt.Errorf("failed to write the value: %w", err)
-			}
+		if err := w.frames.writeInsertRecords(w.w, rows, &w.prev); err != nil {
+			return err
 		}
 	default:
 		return fmt.Errorf("unknown operation %v given", op)
 	}
-	if w.bufferedSize == 0 {
-		return w.flush()
+	return w.commit()
+}
+
+// appendDelete appends the record deleting data points of the given metric within the range.
+func (w *diskWAL) appendDelete(name string, start, end int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.frames.writeDeleteRecord(w.w, name, start, end); err != nil {
+		return err
 	}
+	return w.commit()
+}
 
+// commit writes the records appended to the active segment in accordance with the sync policy,
+// and then rotates the segment if it got full.
+func (w *diskWAL) commit() error {
+	if w.syncPolicy.mode == walSyncEveryWrite {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		if err := w.syncSegment(); err != nil {
+			return err
+		}
+	} else if w.bufferedSize == 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if w.segmentSize > 0 && w.cw.n+int64(w.w.Buffered()) >= w.segmentSize {
+		// Rows appended at a time never span segments, they are written in the full one.
+		return w.rotate()
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it, and adds them to total as well.
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	total *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.total.Add(int64(n))
+	return n, err
+}
+
+// previousRecord holds the last insert record written to or read from a segment,
+// which the next record of the same metric is encoded relative to.
+type previousRecord struct {
+	name      string
+	timestamp int64
+	value     uint64
+	ok        bool
+}
+
+// recordWriter is what records get written into.
+type recordWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// frameWriter encodes records into frames of checksummed segments.
+type frameWriter struct {
+	// Whether payloads get compressed with snappy.
+	compress bool
+	buf      bytes.Buffer
+	// buffer to compress payloads into
+	compressed []byte
+}
+
+// writeInsertRecords writes the given rows to w in frames of insert records.
+func (f *frameWriter) writeInsertRecords(w io.Writer, rows []Row, prev *previousRecord) error {
+	f.buf.Reset()
+	for i := range rows {
+		if err := writeInsertRecord(&f.buf, &rows[i], prev); err != nil {
+			return err
+		}
+		if f.buf.Len() < walFrameSize && i < len(rows)-1 {
+			continue
+		}
+		if err := f.writeFrame(w, f.buf.Bytes()); err != nil {
+			return err
+		}
+		f.buf.Reset()
+	}
+	return nil
+}
+
+// writeDeleteRecord writes the given deletion to w in a frame.
+func (f *frameWriter) writeDeleteRecord(w io.Writer, name string, start, end int64) error {
+	f.buf.Reset()
+	if err := writeDeleteRecord(&f.buf, name, start, end); err != nil {
+		return err
+	}
+	return f.writeFrame(w, f.buf.Bytes())
+}
+
+// writeFrame writes the given payload as a frame.
+func (f *frameWriter) writeFrame(w io.Writer, payload []byte) error {
+	var flags byte
+	if f.compress {
+		f.compressed = snappy.Encode(f.compressed[:cap(f.compressed)], payload)
+		if len(f.compressed) < len(payload) {
+			payload = f.compressed
+			flags |= frameSnappy
+		}
+	}
+	var header [binary.MaxVarintLen64 + 5]byte
+	n := binary.PutUvarint(header[:], uint64(len(payload)))
+	header[n] = flags
+	binary.BigEndian.PutUint32(header[n+1:], crc32.Checksum(payload, walChecksumTable))
+	if _, err := w.Write(header[:n+5]); err != nil {
+		return fmt.Errorf("failed to write frame header: %w", err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return fmt.Errorf("failed to write frame payload: %w", err)
+	}
+	return nil
+}
+
+// writeInsertRecord writes the given row in the format of operationInsert records, or in the format of
+// operationInsertDelta records if it belongs to the same metric as the previous record.
+func writeInsertRecord(w recordWriter, row *Row, prev *previousRecord) error {
+	name := marshalMetricName(row.Metric, row.Labels)
+	value := math.Float64bits(row.DataPoint.Value)
+	buf := make([]byte, binary.MaxVarintLen64)
+	if prev.ok && prev.name == name {
+		if err := w.WriteByte(byte(operationInsertDelta)); err != nil {
+			return fmt.Errorf("failed to write operation: %w", err)
+		}
+		// Write the timestamp delta, which wraps around as well when reading.
+		n := binary.PutVarint(buf, row.DataPoint.Timestamp-prev.timestamp)
+		if _, err := w.Write(buf[:n]); err != nil {
+			return fmt.Errorf("failed to write the timestamp delta: %w", err)
+		}
+		// Write the value XORed with the previous one, which has leading zeros for similar values.
+		n = binary.PutUvarint(buf, value^prev.value)
+		if _, err := w.Write(buf[:n]); err != nil {
+			return fmt.Errorf("failed to write the value: %w", err)
+		}
+		prev.timestamp, prev.value = row.DataPoint.Timestamp, value
+		return nil
+	}
+
+	// Write the operation type
+	if err := w.WriteByte(byte(operationInsert)); err != nil {
+		return fmt.Errorf("failed to write operation: %w", err)
+	}
+	// Write the length of the metric name
+	n := binary.PutUvarint(buf, uint64(len(name)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return fmt.Errorf("failed to write the length of the metric name: %w", err)
+	}
+	// Write the metric name
+	if _, err := w.WriteString(name); err != nil {
+		return fmt.Errorf("failed to write the metric name: %w", err)
+	}
+	// Write the timestamp
+	n = binary.PutVarint(buf, row.DataPoint.Timestamp)
+	if _, err := w.Write(buf[:n]); err != nil {
+		return fmt.Errorf("failed to write the timestamp: %w", err)
+	}
+	// Write the value
+	n = binary.PutUvarint(buf, value)
+	if _, err := w.Write(buf[:n]); err != nil {
+		return fmt.Errorf("failed to write the value: %w", err)
+	}
+	*prev = previousRecord{name: name, timestamp: row.DataPoint.Timestamp, value: value, ok: true}
+	return nil
+}
+
+// writeDeleteRecord writes the given deletion in the format of operationDelete records.
+func writeDeleteRecord(w recordWriter, name string, start, end int64) error {
+	if err := w.WriteByte(byte(operationDelete)); err != nil {
+		return fmt.Errorf("failed to write operation: %w", err)
+	}
+	b := binary.AppendUvarint(make([]byte, 0, 3*binary.MaxVarintLen64), uint64(len(name)))
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("failed to write the length of the metric name: %w", err)
+	}
+	if _, err := w.WriteString(name); err != nil {
+		return fmt.Errorf("failed to write the metric name: %w", err)
+	}
+	b = binary.AppendVarint(b[:0], start)
+	b = binary.AppendVarint(b, end)
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("failed to write the range: %w", err)
+	}
 	return nil
 }
 
@@ -106,76 +412,266 @@ func (w *diskWAL) flush() error {
 	return nil
 }
 
-// punctuate set boundary and creates a new segment.
+// punctuate set boundary and creates a new segment, which begins a new group of segments.
 func (w *diskWAL) punctuate() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if err := w.flush(); err != nil {
+	if err := w.rotate(); err != nil {
 		return err
 	}
-	if err := w.fd.Close(); err != nil {
+	w.groups = append(w.groups, atomic.LoadUint32(&w.index)-1)
+	return nil
+}
+
+// rotate closes the active segment and creates a new one in the same group.
+func (w *diskWAL) rotate() error {
+	if err := w.flush(); err != nil {
 		return err
 	}
-	f, err := w.createSegmentFile(w.dir)
-	if err != nil {
+	if w.syncPolicy.mode != walSyncNever && w.mw == nil {
+		// Memory-mapped segments get synced when closed.
+		if err := w.syncSegment(); err != nil {
+			return err
+		}
+	}
+	if err := w.closeSegment(); err != nil {
 		return err
 	}
-	w.fd = f
-	w.w = bufio.NewWriterSize(f, w.bufferedSize)
-	return nil
+	return w.createSegment()
 }
 
-// truncateOldest removes only the oldest segment.
+// removeOldest removes the oldest group of segments, whose rows have been persisted.
+// The active group is never removed.
 func (w *diskWAL) removeOldest() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if len(w.groups) < 2 {
+		return fmt.Errorf("no segment found")
+	}
 	files, err := os.ReadDir(w.dir)
 	if err != nil {
 		return fmt.Errorf("failed to read WAL directory: %w", err)
 	}
-	if len(files) == 0 {
-		return fmt.Errorf("no segment found")
+	recycle := w.preallocSize > 0 && !hasSpareSegment(files)
+	for i := w.groups[0]; i < w.groups[1]; i++ {
+		path := filepath.Join(w.dir, strconv.Itoa(int(i)))
+		if recycle {
+			if err := recycleSegment(path, filepath.Join(w.dir, spareSegmentName)); err != nil {
+				return err
+			}
+			recycle = false
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove segment: %w", err)
+		}
 	}
-	return os.RemoveAll(filepath.Join(w.dir, files[0].Name()))
+	w.groups = w.groups[1:]
+	return nil
+}
+
+// hasSpareSegment reports whether the spare segment is in the given files.
+func hasSpareSegment(files []os.DirEntry) bool {
+	for _, f := range files {
+		if f.Name() == spareSegmentName {
+			return true
+		}
+	}
+	return false
+}
+
+// recycleSegment empties the given segment and keeps it as the spare one, in order not to
+// create and remove files every time, which churns filesystem metadata.
+func recycleSegment(path, sparePath string) error {
+	if err := os.Truncate(path, 0); err != nil {
+		return fmt.Errorf("failed to truncate segment: %w", err)
+	}
+	if err := os.Rename(path, sparePath); err != nil {
+		return fmt.Errorf("failed to recycle segment: %w", err)
+	}
+	return nil
 }
 
 // removeAll removes all segment files.
 func (w *diskWAL) removeAll() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if err := w.fd.Close(); err != nil {
+	if err := w.closeSegment(); err != nil {
 		return err
 	}
 	if err := os.RemoveAll(w.dir); err != nil {
 		return fmt.Errorf("failed to remove files under %q: %w", w.dir, err)
 	}
+	w.groups = nil
 	return os.MkdirAll(w.dir, fs.ModePerm)
 }
 
-// refresh removes all segment files and make a new segment.
-func (w *diskWAL) refresh() error {
-	if err := w.removeAll(); err != nil {
-		return err
+// closeSegment closes the active segment.
+func (w *diskWAL) closeSegment() error {
+	if w.mw != nil {
+		return w.mw.close()
 	}
+	return w.fd.Close()
+}
+
+// removeReplayed removes the segment files written before the WAL got opened, which must have been replayed.
+// Segments written since then, which hold the replayed rows as well, are kept.
+func (w *diskWAL) removeReplayed() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	files, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+	for _, f := range files {
+		i, err := strconv.ParseUint(f.Name(), 10, 32)
+		if err != nil || uint32(i) >= w.firstIndex {
+			continue
+		}
+		if err := os.Remove(filepath.Join(w.dir, f.Name())); err != nil {
+			return fmt.Errorf("failed to remove replayed segment: %w", err)
+		}
+	}
+	return nil
+}
 
+// snapshot copies the segment files into the given directory. The active segment is cut off at the end of
+// the records written so far, so that the ones appended while copying never get copied halfway.
+func (w *diskWAL) snapshot(dir string) error {
+	w.mu.Lock()
+	if err := w.flush(); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	files, err := os.ReadDir(w.dir)
+	if err != nil {
+		w.mu.Unlock()
+		return fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+	active := strconv.Itoa(int(atomic.LoadUint32(&w.index)) - 1)
+	sizes := make(map[string]int64, len(files))
+	for _, f := range files {
+		if _, err := strconv.ParseUint(f.Name(), 10, 32); err != nil {
+			// The spare segment is always empty.
+			continue
+		}
+		if f.Name() == active && w.mw != nil {
+			// The tail of memory-mapped segments is zero-filled beyond the records.
+			sizes[f.Name()] = int64(w.mw.offset)
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			w.mu.Unlock()
+			return fmt.Errorf("failed to fetch segment file info: %w", err)
+		}
+		sizes[f.Name()] = info.Size()
+	}
+	w.mu.Unlock()
+
+	// Segments never get removed while copying, since it's done only by flushing partitions.
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return fmt.Errorf("failed to make WAL dir: %w", err)
+	}
+	for name, size := range sizes {
+		if err := copyFile(filepath.Join(w.dir, name), filepath.Join(dir, name), size); err != nil {
+			return fmt.Errorf("failed to copy segment %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// createSegment creates a new segment file and makes it the active segment.
+func (w *diskWAL) createSegment() error {
 	f, err := w.createSegmentFile(w.dir)
 	if err != nil {
 		return err
 	}
+	var header, iv []byte
+	if w.block != nil {
+		iv = make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to generate IV: %w", err)
+		}
+		header = append([]byte{encryptedSegmentMagic}, iv...)
+		if _, err := f.Write(header); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write segment header: %w", err)
+		}
+	}
+	var sw io.Writer = f
+	w.mw = nil
+	if w.mmap {
+		growSize := defaultMmapWALGrowSize
+		if w.preallocSize > 0 {
+			growSize = int(w.preallocSize)
+		}
+		// Mapping starts from the end of the header.
+		mw, err := newMmapSegmentWriter(f, growSize, w.mmapSyncInterval)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		mw.syncDuration = &w.metrics.syncDuration
+		w.mw = mw
+		sw = mw
+	}
+	if w.block != nil {
+		sw = &cipher.StreamWriter{S: cipher.NewCTR(w.block, iv), W: sw}
+	}
+	if _, err := sw.Write([]byte{checksummedSegmentMagic}); err != nil {
+		if w.mw != nil {
+			w.mw.close()
+		} else {
+			f.Close()
+		}
+		return fmt.Errorf("failed to write segment header: %w", err)
+	}
+	if w.syncPolicy.mode != walSyncNever {
+		if err := w.syncDir(); err != nil {
+			if w.mw != nil {
+				w.mw.close()
+			} else {
+				f.Close()
+			}
+			return err
+		}
+	}
 	w.fd = f
-	w.w = bufio.NewWriterSize(f, w.bufferedSize)
+	w.cw = &countingWriter{w: sw, total: &w.metrics.appendedBytes}
+	w.w = bufio.NewWriterSize(withFaults(faultWALWrite, w.cw), w.bufferedSize)
+	// Records in a new segment never refer to ones in others.
+	w.prev = previousRecord{}
 	return nil
 }
 
 // createSegmentFile creates a new file with the name of the numbering index.
 func (w *diskWAL) createSegmentFile(dir string) (*os.File, error) {
 	name := strconv.Itoa(int(atomic.LoadUint32(&w.index)))
-	f, err := os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	path := filepath.Join(dir, name)
+	if w.preallocSize > 0 {
+		// Reuse the spare segment if any.
+		err := os.Rename(filepath.Join(dir, spareSegmentName), path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to reuse the spare segment: %w", err)
+		}
+	}
+	flag := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if w.mmap {
+		// Memory mapping for writing requires the file to be readable as well.
+		flag = os.O_CREATE | os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create segment file: %w", err)
 	}
+	if w.preallocSize > 0 {
+		if err := syscall.Preallocate(f, w.preallocSize); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to preallocate segment file: %w", err)
+		}
+	}
 	atomic.AddUint32(&w.index, 1)
 	return f, nil
 }
@@ -183,25 +679,33 @@ func (w *diskWAL) createSegmentFile(dir string) (*os.File, error) {
 type walRecord struct {
 	op  walOperation
 	row Row
+	// the range of operationDelete records, whose row holds only the metric name.
+	start, end int64
 }
 
 type diskWALReader struct {
+	diskWALOptions
 	dir          string
 	files        []os.DirEntry
 	rowsToInsert []Row
 }
 
-func newDiskWALReader(dir string) (*diskWALReader, error) {
+func newDiskWALReader(dir string, opts ...diskWALOption) (*diskWALReader, error) {
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read the WAL dir: %w", err)
 	}
+	sortSegmentFiles(files)
 
-	return &diskWALReader{
+	r := &diskWALReader{
 		dir:          dir,
 		files:        files,
 		rowsToInsert: make([]Row, 0),
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(&r.diskWALOptions)
+	}
+	return r, nil
 }
 
 // readAll reads all segment files and caches the result for each operation.
@@ -210,29 +714,42 @@ func (f *diskWALReader) readAll() error {
 		if file.IsDir() {
 			return fmt.Errorf("unexpected directory found under the WAL directory: %s", file.Name())
 		}
-		fd, err := os.Open(filepath.Join(f.dir, file.Name()))
+		path := filepath.Join(f.dir, file.Name())
+		fd, err := os.Open(path)
 		if err != nil {
 			return fmt.Errorf("failed to open WAL segment file: %w", err)
 		}
-		segment := &segment{
-			file: fd,
-			r:    bufio.NewReader(fd),
+		segment, err := newSegment(fd, f.block)
+		if err != nil {
+			fd.Close()
+			return fmt.Errorf("failed to read WAL segment file %q: %w", file.Name(), err)
 		}
 		for segment.next() {
 			rec := segment.record()
 			switch rec.op {
 			case operationInsert:
 				f.rowsToInsert = append(f.rowsToInsert, rec.row)
+			case operationDelete:
+				// Deleted rows never get replayed, as if they were deleted after replaying.
+				f.rowsToInsert = dropRows(f.rowsToInsert, rec.row.Metric, rec.start, rec.end)
 			}
 		}
 		if err := segment.close(); err != nil {
 			return err
 		}
 
+		if segment.torn {
+			// The last frame was cut off in the middle of writing, which is dropped so as not to be read again.
+			if err := os.Truncate(path, segment.offset); err != nil {
+				return fmt.Errorf("failed to truncate the torn frame of WAL segment file %q: %w", file.Name(), err)
+			}
+		}
+
 		err = segment.error()
 		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
-			// It is not unusual for a line to be invalid, as it may well terminate in the middle of writing to the WAL.
-			return nil
+			// It is not unusual for a record without frames to be invalid, as it may well terminate in the middle
+			// of writing to the WAL. Records in later segments are still valid.
+			continue
 		}
 		if err != nil {
 			return fmt.Errorf("encounter an error while reading WAL segment file %q: %w", file.Name(), segment.error())
@@ -241,6 +758,69 @@ func (f *diskWALReader) readAll() error {
 	return nil
 }
 
+// dropRows removes rows of the given marshaled metric name within the range in place.
+func dropRows(rows []Row, name string, start, end int64) []Row {
+	n := 0
+	for i := range rows {
+		if rows[i].Metric == name && start <= rows[i].Timestamp && rows[i].Timestamp < end {
+			continue
+		}
+		rows[n] = rows[i]
+		n++
+	}
+	return rows[:n]
+}
+
+// newSegment gives back the segment that reads the given file, which gets decrypted with the given block cipher
+// if it has the encrypted segment header, and gets read in frames if it has the checksummed segment magic.
+func newSegment(fd *os.File, block cipher.Block) (*segment, error) {
+	s := &segment{file: fd, r: bufio.NewReader(fd)}
+	b, err := s.r.Peek(1)
+	if errors.Is(err, io.EOF) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == encryptedSegmentMagic {
+		if block == nil {
+			return nil, fmt.Errorf("segment is encrypted but no encryption key given")
+		}
+		header := make([]byte, 1+aes.BlockSize)
+		if _, err := io.ReadFull(s.r, header); err != nil {
+			return nil, fmt.Errorf("failed to read segment header: %w", err)
+		}
+		// The stream cipher never changes the length, hence offsets are the same as in plaintext.
+		s.offset += int64(len(header))
+		stream := cipher.NewCTR(block, header[1:])
+		s.r = bufio.NewReader(&cipher.StreamReader{S: stream, R: s.r})
+		if b, err = s.r.Peek(1); errors.Is(err, io.EOF) {
+			return s, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b[0] == checksummedSegmentMagic {
+		s.r.Discard(1)
+		s.offset++
+		s.framed = true
+	}
+	return s, nil
+}
+
+// sortSegmentFiles sorts the given segment files in ascending order of their index.
+func sortSegmentFiles(files []os.DirEntry) {
+	sort.SliceStable(files, func(i, j int) bool {
+		x, errX := strconv.Atoi(files[i].Name())
+		y, errY := strconv.Atoi(files[j].Name())
+		if errX != nil || errY != nil {
+			return files[i].Name() < files[j].Name()
+		}
+		return x < y
+	})
+}
+
 // segment represents a segment file.
 type segment struct {
 	file *os.File
@@ -248,10 +828,126 @@ type segment struct {
 	// FIXME: Use interface to support other operation type
 	current walRecord
 	err     error
+	// the last record read, which delta records are relative to
+	prev previousRecord
+
+	// Whether records are in frames, which are set only for checksummed segments.
+	framed bool
+	// the payload of the frame being read
+	frame bytes.Reader
+	buf   []byte
+	// buffer to decompress payloads into
+	decompressed []byte
+	// offset is the end of the last frame read in the file.
+	offset int64
+	// torn is true if the last frame was cut off in the middle of writing.
+	torn bool
+}
+
+// recordReader is what records get read from.
+type recordReader interface {
+	io.Reader
+	io.ByteReader
 }
 
 func (f *segment) next() bool {
-	op, err := f.r.ReadByte()
+	if !f.framed {
+		return f.readRecord(f.r)
+	}
+	for f.frame.Len() == 0 {
+		if !f.nextFrame() {
+			return false
+		}
+	}
+	if f.readRecord(&f.frame) {
+		return true
+	}
+	// Frames have been verified, hence records in them are never cut off.
+	if f.err == nil || errors.Is(f.err, io.EOF) || errors.Is(f.err, io.ErrUnexpectedEOF) {
+		f.err = fmt.Errorf("%w: invalid record in frame ending at %d", ErrCorrupted, f.offset)
+	}
+	return false
+}
+
+// nextFrame reads the next frame and verifies its checksum. It gives back false at the end of the segment,
+// including the frame cut off in the middle of writing.
+func (f *segment) nextFrame() bool {
+	size, err := binary.ReadUvarint(f.r)
+	if errors.Is(err, io.EOF) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		f.torn = true
+		return false
+	}
+	if err != nil {
+		f.err = fmt.Errorf("%w: failed to read the length of frame: %w", ErrCorrupted, err)
+		return false
+	}
+	if size == 0 {
+		// Frames are never empty, so it's the zero-filled tail of a memory-mapped segment.
+		return false
+	}
+	if size > maxWALFrameSize {
+		f.err = fmt.Errorf("%w: too long frame length %d", ErrCorrupted, size)
+		return false
+	}
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(f.r, header); err != nil {
+		f.torn = true
+		return false
+	}
+	flags := header[0]
+	if cap(f.buf) < int(size) {
+		f.buf = make([]byte, size)
+	}
+	f.buf = f.buf[:size]
+	if _, err := io.ReadFull(f.r, f.buf); err != nil {
+		f.torn = true
+		return false
+	}
+	if want, got := binary.BigEndian.Uint32(header[1:]), crc32.Checksum(f.buf, walChecksumTable); want != got {
+		if _, err := f.r.Peek(1); errors.Is(err, io.EOF) {
+			// Only the last frame can be partially written.
+			f.torn = true
+			return false
+		}
+		f.err = fmt.Errorf("%w: checksum mismatch of frame at %d: want %08x, got %08x", ErrCorrupted, f.offset, want, got)
+		return false
+	}
+	f.offset += int64(uvarintLen(size)) + int64(len(header)) + int64(size)
+	payload := f.buf
+	switch flags {
+	case 0:
+	case frameSnappy:
+		n, err := snappy.DecodedLen(f.buf)
+		if err != nil || n > maxWALFrameSize {
+			f.err = fmt.Errorf("%w: invalid compressed frame ending at %d", ErrCorrupted, f.offset)
+			return false
+		}
+		if payload, err = snappy.Decode(f.decompressed[:cap(f.decompressed)], f.buf); err != nil {
+			f.err = fmt.Errorf("%w: failed to decompress frame ending at %d: %w", ErrCorrupted, f.offset, err)
+			return false
+		}
+		f.decompressed = payload
+	default:
+		f.err = fmt.Errorf("%w: unknown frame flags %08b", ErrCorrupted, flags)
+		return false
+	}
+	f.frame.Reset(payload)
+	// Frames in a segment are a sequence of records, hence prev is kept across them.
+	return true
+}
+
+// uvarintLen gives back the number of bytes the given value is encoded in as uvarint.
+func uvarintLen(v uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], v)
+}
+
+// readRecord reads the next record from r.
+func (f *segment) readRecord(r recordReader) bool {
+	op, err := r.ReadByte()
 	if errors.Is(err, io.EOF) {
 		return false
 	}
@@ -261,48 +957,113 @@ func (f *segment) next() bool {
 	}
 	switch walOperation(op) {
 	case operationInsert:
-		// Read the length of metric name.
-		metricLen, err := binary.ReadUvarint(f.r)
+		metric, ok := f.readMetricName(r)
+		if !ok || metric == "" {
+			// Metric names are never empty, so it's the zero-filled tail of a memory-mapped segment.
+			return false
+		}
+		// Read timestamp.
+		ts, err := binary.ReadVarint(r)
+		if err != nil {
+			f.err = recordError("failed to read timestamp", err)
+			return false
+		}
+		// Read value.
+		val, err := binary.ReadUvarint(r)
 		if err != nil {
-			f.err = fmt.Errorf("failed to read the length of metric name: %w", err)
+			f.err = recordError("failed to read value", err)
 			return false
 		}
-		// Read the metric name.
-		metric := make([]byte, int(metricLen))
-		if _, err := io.ReadFull(f.r, metric); err != nil {
-			f.err = fmt.Errorf("failed to read the metric name: %w", err)
+		f.prev = previousRecord{name: metric, timestamp: ts, value: val, ok: true}
+	case operationInsertDelta:
+		if !f.prev.ok {
+			f.err = fmt.Errorf("%w: delta record without preceding record", ErrCorrupted)
 			return false
 		}
-		// Read timestamp.
-		ts, err := binary.ReadVarint(f.r)
+		// Read timestamp delta.
+		delta, err := binary.ReadVarint(r)
 		if err != nil {
-			f.err = fmt.Errorf("failed to read timestamp: %w", err)
+			f.err = recordError("failed to read timestamp delta", err)
 			return false
 		}
-		// Read value.
-		val, err := binary.ReadUvarint(f.r)
+		// Read value XORed with the previous one.
+		xor, err := binary.ReadUvarint(r)
 		if err != nil {
-			f.err = fmt.Errorf("failed to read value: %w", err)
+			f.err = recordError("failed to read value", err)
 			return false
 		}
-		f.current = walRecord{
-			op: walOperation(op),
-			row: Row{
-				Metric: string(metric),
-				DataPoint: DataPoint{
-					Timestamp: ts,
-					Value:     math.Float64frombits(val),
-				},
-			},
+		f.prev.timestamp += delta
+		f.prev.value ^= xor
+	case operationDelete:
+		metric, ok := f.readMetricName(r)
+		if !ok {
+			return false
+		}
+		if metric == "" {
+			f.err = fmt.Errorf("%w: delete record without metric name", ErrCorrupted)
+			return false
 		}
+		start, err := binary.ReadVarint(r)
+		if err != nil {
+			f.err = recordError("failed to read start", err)
+			return false
+		}
+		end, err := binary.ReadVarint(r)
+		if err != nil {
+			f.err = recordError("failed to read end", err)
+			return false
+		}
+		// Delete records never change the previous insert record.
+		f.current = walRecord{op: operationDelete, row: Row{Metric: metric}, start: start, end: end}
+		return true
 	default:
-		f.err = fmt.Errorf("unknown operation %v found", op)
+		f.err = fmt.Errorf("%w: unknown operation %v found", ErrCorrupted, op)
 		return false
 	}
-
+	f.current = walRecord{
+		// Delta records are handled as same as the ones they are relative to.
+		op: operationInsert,
+		row: Row{
+			Metric: f.prev.name,
+			DataPoint: DataPoint{
+				Timestamp: f.prev.timestamp,
+				Value:     math.Float64frombits(f.prev.value),
+			},
+		},
+	}
 	return true
 }
 
+// readMetricName reads the metric name of a record prefixed with its length.
+func (f *segment) readMetricName(r recordReader) (string, bool) {
+	// Read the length of metric name.
+	metricLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		f.err = recordError("failed to read the length of metric name", err)
+		return "", false
+	}
+	if metricLen > maxWALMetricNameLen {
+		f.err = fmt.Errorf("%w: too long metric name length %d", ErrCorrupted, metricLen)
+		return "", false
+	}
+	// Read the metric name.
+	metric := make([]byte, int(metricLen))
+	if _, err := io.ReadFull(r, metric); err != nil {
+		f.err = recordError("failed to read the metric name", err)
+		return "", false
+	}
+	return string(metric), true
+}
+
+// recordError wraps the given error while reading a record with ErrCorrupted,
+// unless the record is just cut off, which is usual for the tail of segments.
+func recordError(msg string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+	return fmt.Errorf("%w: %s: %w", ErrCorrupted, msg, err)
+}
+
 // error gives back an error if it has been facing an error while reading.
 func (f *segment) error() error {
 	return f.err
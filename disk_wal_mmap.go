@@ -0,0 +1,134 @@
+package tstorage
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nakabonne/tstorage/internal/syscall"
+)
+
+// defaultMmapWALGrowSize is the number of bytes memory-mapped segments get extended by at a time,
+// unless the preallocation size is given.
+const defaultMmapWALGrowSize = 4 << 20
+
+// withWALMmap makes segments written through memory mapping, which are msynced when the given
+// interval has passed since the last msync at the time of writing, and when they get closed.
+func withWALMmap(syncInterval time.Duration) diskWALOption {
+	return func(o *diskWALOptions) {
+		o.mmap = true
+		o.mmapSyncInterval = syncInterval
+	}
+}
+
+// mmapSegmentWriter writes to a segment file through memory mapping, which turns appending into
+// copying into the page cache without any system call. The file gets extended by growSize at a time,
+// and its unwritten tail is filled with zeros, which readers take as the end of the segment.
+// It is not goroutine safe.
+type mmapSegmentWriter struct {
+	f        *os.File
+	mapped   []byte
+	offset   int
+	growSize int
+
+	syncInterval time.Duration
+	lastSync     time.Time
+	// observes each msync if set.
+	syncDuration *durationHistogram
+}
+
+// newMmapSegmentWriter gives back a writer appending to the given file opened for reading and writing.
+func newMmapSegmentWriter(f *os.File, growSize int, syncInterval time.Duration) (*mmapSegmentWriter, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch segment file info: %w", err)
+	}
+	w := &mmapSegmentWriter{
+		f:            f,
+		offset:       int(info.Size()),
+		growSize:     growSize,
+		syncInterval: syncInterval,
+		lastSync:     time.Now(),
+	}
+	if err := w.grow(w.offset + 1); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *mmapSegmentWriter) Write(p []byte) (int, error) {
+	if w.offset+len(p) > len(w.mapped) {
+		if err := w.grow(w.offset + len(p)); err != nil {
+			return 0, err
+		}
+	}
+	copy(w.mapped[w.offset:], p)
+	w.offset += len(p)
+	if time.Since(w.lastSync) >= w.syncInterval {
+		if err := w.sync(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// grow extends the file and maps it again, so that at least size bytes can be written.
+// Unmapping never loses written bytes since the mapping is shared with the file.
+func (w *mmapSegmentWriter) grow(size int) error {
+	newSize := len(w.mapped) + w.growSize
+	for newSize < size {
+		newSize += w.growSize
+	}
+	if w.mapped != nil {
+		if err := syscall.Munmap(w.mapped); err != nil {
+			return fmt.Errorf("failed to unmap segment: %w", err)
+		}
+		w.mapped = nil
+	}
+	if err := w.f.Truncate(int64(newSize)); err != nil {
+		return fmt.Errorf("failed to extend segment: %w", err)
+	}
+	if err := injectFault(faultMmap); err != nil {
+		return fmt.Errorf("failed to map segment: %w", err)
+	}
+	mapped, err := syscall.MmapWritable(int(w.f.Fd()), newSize)
+	if err != nil {
+		return fmt.Errorf("failed to map segment: %w", err)
+	}
+	w.mapped = mapped
+	return nil
+}
+
+// sync flushes the written bytes to the file on disk.
+func (w *mmapSegmentWriter) sync() error {
+	if err := injectFault(faultWALSync); err != nil {
+		return fmt.Errorf("failed to msync segment: %w", err)
+	}
+	started := time.Now()
+	if err := syscall.Msync(w.mapped[:w.offset]); err != nil {
+		return fmt.Errorf("failed to msync segment: %w", err)
+	}
+	w.lastSync = time.Now()
+	if w.syncDuration != nil {
+		w.syncDuration.observe(w.lastSync.Sub(started))
+	}
+	return nil
+}
+
+// close syncs and unmaps the segment, and then cuts off the unwritten tail and closes the file.
+func (w *mmapSegmentWriter) close() error {
+	if err := w.sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	if err := syscall.Munmap(w.mapped); err != nil {
+		w.f.Close()
+		return fmt.Errorf("failed to unmap segment: %w", err)
+	}
+	w.mapped = nil
+	if err := w.f.Truncate(int64(w.offset)); err != nil {
+		w.f.Close()
+		return fmt.Errorf("failed to truncate segment: %w", err)
+	}
+	return w.f.Close()
+}
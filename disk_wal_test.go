@@ -1,10 +1,14 @@
 package tstorage
 
 import (
+	"bytes"
+	"crypto/aes"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -52,23 +56,398 @@ func Test_diskWAL_append_read(t *testing.T) {
 }
 
 func Test_diskWAL_removeOldest(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.3, Timestamp: 1600000002}},
+	}
+	path := filepath.Join(t.TempDir(), "wal")
+	// Every append fills up the segment.
+	w, err := newDiskWAL(path, 4096, withWALSegmentSize(1))
+	require.NoError(t, err)
+	require.NoError(t, w.append(operationInsert, rows[:1]))
+	require.NoError(t, w.append(operationInsert, rows[1:2]))
+	require.NoError(t, w.punctuate())
+	require.NoError(t, w.append(operationInsert, rows[2:]))
+	names := func() []string {
+		files, err := os.ReadDir(path)
+		require.NoError(t, err)
+		sortSegmentFiles(files)
+		got := []string{}
+		for _, f := range files {
+			got = append(got, f.Name())
+		}
+		return got
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, names())
+
+	// The segments rotated by size get removed together.
+	require.NoError(t, w.removeOldest())
+	assert.Equal(t, []string{"3", "4"}, names())
+	// The active group is kept.
+	assert.Error(t, w.removeOldest())
+
+	reader, err := newDiskWALReader(path)
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, rows[2:], reader.rowsToInsert)
+}
+
+func Test_diskWAL_append_read_encrypted(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+	}
 	tmpDir, err := os.MkdirTemp("", "tstorage-test")
 	require.NoError(t, err)
-	for i := 0; i < 3; i++ {
-		err := os.Mkdir(filepath.Join(tmpDir, strconv.Itoa(i)), os.ModePerm)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "wal")
+
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	require.NoError(t, err)
+	wal, err := newDiskWAL(path, 4096, withWALCipher(block))
+	require.NoError(t, err)
+	require.NoError(t, wal.append(operationInsert, rows))
+	require.NoError(t, wal.flush())
+
+	// Metric names must not be written in plaintext.
+	b, err := os.ReadFile(filepath.Join(path, "0"))
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(b, []byte("metric-1")))
+
+	// Reading without the key fails.
+	reader, err := newDiskWALReader(path)
+	require.NoError(t, err)
+	assert.Error(t, reader.readAll())
+
+	reader, err = newDiskWALReader(path, withWALCipher(block))
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, rows, reader.rowsToInsert)
+}
+
+func Fuzz_segment_next(f *testing.F) {
+	tmpDir := f.TempDir()
+	wal, err := newDiskWAL(tmpDir, 0)
+	require.NoError(f, err)
+	require.NoError(f, wal.append(operationInsert, []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.2, Timestamp: -1}},
+	}))
+	require.NoError(f, wal.flush())
+	seed, err := os.ReadFile(filepath.Join(tmpDir, "0"))
+	require.NoError(f, err)
+	f.Add(seed)
+	// A record claiming a metric name of 2^63 bytes.
+	f.Add([]byte{byte(operationInsert), 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01})
+	// A delta record without preceding record.
+	f.Add([]byte{byte(operationInsertDelta), 0x02, 0x00})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		path := filepath.Join(t.TempDir(), "0")
+		require.NoError(t, os.WriteFile(path, b, 0644))
+		reader, err := newDiskWALReader(filepath.Dir(path))
+		require.NoError(t, err)
+		// It must neither panic nor try a huge allocation.
+		_ = reader.readAll()
+	})
+}
+
+func Test_diskWAL_preallocation(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.3, Timestamp: 1600000002}},
+	}
+	path := filepath.Join(t.TempDir(), "wal")
+	w, err := newDiskWAL(path, 0, withWALPreallocation(1<<20))
+	require.NoError(t, err)
+
+	require.NoError(t, w.append(operationInsert, rows[:1]))
+	require.NoError(t, w.punctuate())
+	require.NoError(t, w.append(operationInsert, rows[1:2]))
+	// The oldest one gets emptied and kept as the spare one.
+	require.NoError(t, w.removeOldest())
+	names := func() []string {
+		files, err := os.ReadDir(path)
 		require.NoError(t, err)
+		sortSegmentFiles(files)
+		got := []string{}
+		for _, f := range files {
+			got = append(got, f.Name())
+		}
+		return got
+	}
+	assert.Equal(t, []string{"1", spareSegmentName}, names())
+	info, err := os.Stat(filepath.Join(path, spareSegmentName))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	// The spare one gets reused as the next segment.
+	require.NoError(t, w.punctuate())
+	require.NoError(t, w.append(operationInsert, rows[2:]))
+	assert.Equal(t, []string{"1", "2"}, names())
+
+	reader, err := newDiskWALReader(path)
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, rows[1:], reader.rowsToInsert)
+}
+
+func Test_diskWAL_deltaRecords(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000001}},
+		{Metric: "metric-1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Value: -3.5, Timestamp: 1599999999}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.3, Timestamp: math.MinInt64}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.3, Timestamp: math.MaxInt64}},
+	}
+	want := make([]Row, len(rows))
+	for i, r := range rows {
+		want[i] = Row{Metric: marshalMetricName(r.Metric, r.Labels), DataPoint: r.DataPoint}
+	}
+	path := filepath.Join(t.TempDir(), "wal")
+	w, err := newDiskWAL(path, 4096)
+	require.NoError(t, err)
+	require.NoError(t, w.append(operationInsert, rows[:2]))
+	// The first record in a new segment never refers to the previous segment.
+	require.NoError(t, w.punctuate())
+	require.NoError(t, w.append(operationInsert, rows[2:]))
+	require.NoError(t, w.flush())
+
+	b, err := os.ReadFile(filepath.Join(path, "1"))
+	require.NoError(t, err)
+	assert.Equal(t, checksummedSegmentMagic, b[0])
+	assert.Equal(t, 2, bytes.Count(b, []byte("metric-")), "metric names must be written only when changed")
+
+	reader, err := newDiskWALReader(path)
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, want, reader.rowsToInsert)
+}
+
+func Test_diskWAL_deleteRecords(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.3, Timestamp: 1600000001}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.4, Timestamp: 1600000002}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.5, Timestamp: 1600000001}},
+	}
+	path := filepath.Join(t.TempDir(), "wal")
+	w, err := newDiskWAL(path, 4096)
+	require.NoError(t, err)
+	require.NoError(t, w.append(operationInsert, rows[:2]))
+	// Deletions apply to the records in earlier segments as well.
+	require.NoError(t, w.punctuate())
+	require.NoError(t, w.append(operationInsert, rows[2:4]))
+	require.NoError(t, w.appendDelete("metric-1", 1600000001, 1600000003))
+	// Delta records after deletions are relative to the last insert record.
+	require.NoError(t, w.append(operationInsert, rows[4:]))
+	require.NoError(t, w.flush())
+
+	reader, err := newDiskWALReader(path)
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, []Row{rows[0], rows[2], rows[4]}, reader.rowsToInsert)
+}
+
+func Test_diskWAL_mmap(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.3, Timestamp: 1600000002}},
 	}
-	w := &diskWAL{
-		dir: tmpDir,
+	tests := []struct {
+		name string
+		opts []diskWALOption
+	}{
+		{name: "msync on every write", opts: []diskWALOption{withWALMmap(0)}},
+		{name: "periodic msync", opts: []diskWALOption{withWALMmap(time.Hour)}},
+		// Segments get extended several times.
+		{name: "small growth", opts: []diskWALOption{withWALMmap(0), withWALPreallocation(8)}},
 	}
-	err = w.removeOldest()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal")
+			w, err := newDiskWAL(path, 4096, tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, w.append(operationInsert, rows[:2]))
+			require.NoError(t, w.punctuate())
+			require.NoError(t, w.append(operationInsert, rows[2:]))
+			require.NoError(t, w.flush())
+
+			// The active segment has the zero-filled tail, as if the process crashed.
+			reader, err := newDiskWALReader(path, tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, reader.readAll())
+			assert.Equal(t, rows, reader.rowsToInsert)
+
+			// The closed segment is cut off at the end of records.
+			b, err := os.ReadFile(filepath.Join(path, "0"))
+			require.NoError(t, err)
+			assert.NotZero(t, b[len(b)-1])
+			require.NoError(t, w.removeAll())
+		})
+	}
+}
+
+func Test_newDiskWAL_mmapEncrypted(t *testing.T) {
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
 	require.NoError(t, err)
-	files, err := os.ReadDir(w.dir)
+	_, err = newDiskWAL(t.TempDir(), 4096, withWALMmap(0), withWALCipher(block))
+	assert.Error(t, err)
+}
+
+func Test_diskWALReader_tornFrame(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.3, Timestamp: 1600000002}},
+	}
+	tests := []struct {
+		name string
+		// corrupt modifies the first segment, holding rows[0] and rows[1] in two frames.
+		corrupt func(b []byte, firstFrameEnd int) []byte
+		want    []Row
+		// Whether the segment gets truncated to the end of the first frame.
+		wantTruncated bool
+		wantErr       error
+	}{
+		{
+			name:    "intact",
+			corrupt: func(b []byte, _ int) []byte { return b },
+			want:    rows,
+		},
+		{
+			name:          "last frame cut off",
+			corrupt:       func(b []byte, _ int) []byte { return b[:len(b)-3] },
+			want:          []Row{rows[0], rows[2]},
+			wantTruncated: true,
+		},
+		{
+			name:          "last frame cut off in its header",
+			corrupt:       func(b []byte, firstFrameEnd int) []byte { return b[:firstFrameEnd+2] },
+			want:          []Row{rows[0], rows[2]},
+			wantTruncated: true,
+		},
+		{
+			name: "checksum mismatch of the last frame",
+			corrupt: func(b []byte, _ int) []byte {
+				b[len(b)-1] ^= 0xff
+				return b
+			},
+			want:          []Row{rows[0], rows[2]},
+			wantTruncated: true,
+		},
+		{
+			name: "checksum mismatch followed by frames",
+			corrupt: func(b []byte, firstFrameEnd int) []byte {
+				b[firstFrameEnd-1] ^= 0xff
+				return b
+			},
+			wantErr: ErrCorrupted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal")
+			w, err := newDiskWAL(path, 0)
+			require.NoError(t, err)
+			require.NoError(t, w.append(operationInsert, rows[:1]))
+			segmentPath := filepath.Join(path, "0")
+			info, err := os.Stat(segmentPath)
+			require.NoError(t, err)
+			firstFrameEnd := int(info.Size())
+			require.NoError(t, w.append(operationInsert, rows[1:2]))
+			require.NoError(t, w.punctuate())
+			require.NoError(t, w.append(operationInsert, rows[2:]))
+
+			b, err := os.ReadFile(segmentPath)
+			require.NoError(t, err)
+			b = tt.corrupt(b, firstFrameEnd)
+			require.NoError(t, os.WriteFile(segmentPath, b, 0644))
+
+			reader, err := newDiskWALReader(path)
+			require.NoError(t, err)
+			err = reader.readAll()
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, reader.rowsToInsert)
+			// The torn frame gets truncated.
+			info, err = os.Stat(segmentPath)
+			require.NoError(t, err)
+			wantSize := len(b)
+			if tt.wantTruncated {
+				wantSize = firstFrameEnd
+			}
+			assert.Equal(t, int64(wantSize), info.Size())
+		})
+	}
+}
+
+func Test_diskWALReader_unframedSegment(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.3, Timestamp: 1600000002}},
+	}
+	// Segments written before frames got introduced hold bare records.
+	path := t.TempDir()
+	var buf bytes.Buffer
+	var prev previousRecord
+	for i := range rows[:2] {
+		require.NoError(t, writeInsertRecord(&buf, &rows[i], &prev))
+	}
+	// The last record is cut off, which doesn't prevent the next segment from being read.
+	require.NoError(t, os.WriteFile(filepath.Join(path, "0"), buf.Bytes()[:buf.Len()-2], 0644))
+	buf.Reset()
+	prev = previousRecord{}
+	require.NoError(t, writeInsertRecord(&buf, &rows[2], &prev))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "1"), buf.Bytes(), 0644))
+
+	reader, err := newDiskWALReader(path)
 	require.NoError(t, err)
-	want := []string{"1", "2"}
-	got := []string{}
-	for _, f := range files {
-		got = append(got, f.Name())
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, []Row{rows[0], rows[2]}, reader.rowsToInsert)
+}
+
+func Test_diskWAL_compression(t *testing.T) {
+	rows := make([]Row, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, Row{
+			Metric:    "metric-" + strconv.Itoa(i%10),
+			Labels:    []Label{{Name: "host", Value: "host-" + strconv.Itoa(i%10)}},
+			DataPoint: DataPoint{Value: float64(i % 7), Timestamp: 1600000000 + int64(i)},
+		})
+	}
+	want := make([]Row, len(rows))
+	for i, r := range rows {
+		want[i] = Row{Metric: marshalMetricName(r.Metric, r.Labels), DataPoint: r.DataPoint}
 	}
-	assert.Equal(t, want, got)
+	path := filepath.Join(t.TempDir(), "wal")
+	plain, err := newDiskWAL(path, 4096)
+	require.NoError(t, err)
+	require.NoError(t, plain.append(operationInsert, rows))
+	require.NoError(t, plain.flush())
+	compressed, err := newDiskWAL(path, 4096, withWALCompression())
+	require.NoError(t, err)
+	require.NoError(t, compressed.append(operationInsert, rows))
+	require.NoError(t, compressed.flush())
+
+	plainInfo, err := os.Stat(filepath.Join(path, "0"))
+	require.NoError(t, err)
+	compressedInfo, err := os.Stat(filepath.Join(path, "1"))
+	require.NoError(t, err)
+	assert.Less(t, compressedInfo.Size(), plainInfo.Size()/2)
+
+	// Segments written with and without compression are read alike.
+	reader, err := newDiskWALReader(path)
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, append(want, want...), reader.rowsToInsert)
 }
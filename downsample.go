@@ -0,0 +1,80 @@
+package tstorage
+
+import (
+	"fmt"
+	"math"
+)
+
+func (s *storage) SelectDownsampled(metric string, labels []Label, start, end int64, maxPoints int, opts ...SelectOption) ([]*DataPoint, error) {
+	if maxPoints <= 0 {
+		return nil, fmt.Errorf("max points must be positive")
+	}
+	points, err := s.Select(metric, labels, start, end, ascending(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	return lttb(points, maxPoints), nil
+}
+
+// lttb reduces the given points sorted by timestamp to the given number of points with the
+// Largest-Triangle-Three-Buckets algorithm, which keeps the visual shape of the series.
+// The first and the last points are always kept, and the rest are divided into threshold-2 buckets,
+// from each of which the point forming the largest triangle with the point selected from the previous
+// bucket and the average of the next bucket is selected.
+// See: https://skemman.is/bitstream/1946/15343/3/SS_MSthesis.pdf
+func lttb(points []*DataPoint, threshold int) []*DataPoint {
+	if threshold >= len(points) {
+		return points
+	}
+	switch threshold {
+	case 1:
+		return points[:1]
+	case 2:
+		return []*DataPoint{points[0], points[len(points)-1]}
+	}
+
+	sampled := make([]*DataPoint, 0, threshold)
+	sampled = append(sampled, points[0])
+	// The size of buckets, excluding the first and the last points.
+	every := float64(len(points)-2) / float64(threshold-2)
+	// The index of the point selected from the previous bucket.
+	a := 0
+	for i := 0; i < threshold-2; i++ {
+		// The average of the next bucket, which is the last point for the last bucket.
+		nextStart := int(math.Floor(float64(i+1)*every)) + 1
+		nextEnd := int(math.Floor(float64(i+2)*every)) + 1
+		if i == threshold-3 {
+			// Avoid rounding errors from leaving the last point out.
+			nextStart, nextEnd = len(points)-1, len(points)
+		}
+		if nextEnd > len(points) {
+			nextEnd = len(points)
+		}
+		var avgX, avgY float64
+		for _, p := range points[nextStart:nextEnd] {
+			avgX += float64(p.Timestamp)
+			avgY += p.Value
+		}
+		n := float64(nextEnd - nextStart)
+		avgX /= n
+		avgY /= n
+
+		// Select the point forming the largest triangle in the current bucket.
+		bucketStart := int(math.Floor(float64(i)*every)) + 1
+		bucketEnd := nextStart
+		ax, ay := float64(points[a].Timestamp), points[a].Value
+		maxArea := -1.0
+		selected := bucketStart
+		for j := bucketStart; j < bucketEnd; j++ {
+			// Twice the area is enough for comparison.
+			area := math.Abs((ax-avgX)*(points[j].Value-ay) - (ax-float64(points[j].Timestamp))*(avgY-ay))
+			if area > maxArea {
+				maxArea = area
+				selected = j
+			}
+		}
+		sampled = append(sampled, points[selected])
+		a = selected
+	}
+	return append(sampled, points[len(points)-1])
+}
@@ -0,0 +1,68 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lttb(t *testing.T) {
+	points := []*DataPoint{
+		{Timestamp: 1, Value: 0},
+		{Timestamp: 2, Value: 1},
+		{Timestamp: 3, Value: 0},
+		{Timestamp: 4, Value: 0},
+		{Timestamp: 5, Value: 10},
+		{Timestamp: 6, Value: 0},
+		{Timestamp: 7, Value: 0},
+		{Timestamp: 8, Value: 0},
+		{Timestamp: 9, Value: -20},
+		{Timestamp: 10, Value: 0},
+	}
+	tests := []struct {
+		name      string
+		threshold int
+		want      []int64
+	}{
+		{name: "more than points", threshold: 20, want: []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{name: "one", threshold: 1, want: []int64{1}},
+		{name: "two", threshold: 2, want: []int64{1, 10}},
+		{name: "keep peaks", threshold: 4, want: []int64{1, 5, 9, 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lttb(points, tt.threshold)
+			timestamps := make([]int64, 0, len(got))
+			for _, p := range got {
+				timestamps = append(timestamps, p.Timestamp)
+			}
+			assert.Equal(t, tt.want, timestamps)
+		})
+	}
+}
+
+func Test_storage_SelectDownsampled(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	rows := make([]Row, 0, 1000)
+	for i := int64(1); i <= 1000; i++ {
+		rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i % 7)}})
+	}
+	require.NoError(t, s.InsertRows(rows))
+
+	got, err := s.SelectDownsampled("metric1", nil, 1, 1001, 100)
+	require.NoError(t, err)
+	require.Len(t, got, 100)
+	assert.Equal(t, int64(1), got[0].Timestamp)
+	assert.Equal(t, int64(1000), got[99].Timestamp)
+	for i := 1; i < len(got); i++ {
+		assert.Less(t, got[i-1].Timestamp, got[i].Timestamp)
+	}
+
+	_, err = s.SelectDownsampled("metric1", nil, 1, 1001, 0)
+	assert.Error(t, err)
+	_, err = s.SelectDownsampled("unknown", nil, 1, 1001, 100)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
@@ -0,0 +1,141 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrDuplicateTimestamp is returned when selecting data points sharing a timestamp with ErrorOnDuplicate.
+var ErrDuplicateTimestamp = errors.New("duplicate timestamp found")
+
+// DuplicatePolicy decides what selecting gives back when data points share a timestamp,
+// which happens when a timestamp is written more than once, e.g. by backfills and late writes.
+// See WithDuplicatePolicy.
+type DuplicatePolicy int
+
+const (
+	// KeepDuplicates gives back all of them in order of insertion.
+	KeepDuplicates DuplicatePolicy = iota
+	// LastWriteWins gives back only the one written last, which is the last one in order of
+	// partitions from oldest to newest, and in order of insertion within a partition.
+	LastWriteWins
+	// PreferDisk gives back only the one persisted in disk partitions if any, otherwise the one written last.
+	// If more than one are on disk, the one written last among them wins.
+	PreferDisk
+	// ErrorOnDuplicate fails selecting with ErrDuplicateTimestamp.
+	ErrorOnDuplicate
+)
+
+// resolveDuplicates walks n data points sorted by timestamp, and calls keep in ascending order
+// with the index of each data point to be given back. fromDisk tells which data points come from
+// disk partitions, which is required only for PreferDisk.
+func resolveDuplicates(n int, timestamp func(i int) int64, fromDisk []bool, policy DuplicatePolicy, keep func(i int)) error {
+	for i := 0; i < n; {
+		j := i + 1
+		for j < n && timestamp(j) == timestamp(i) {
+			j++
+		}
+		// Data points in [i, j) share the timestamp.
+		if j-i == 1 || policy == KeepDuplicates {
+			for k := i; k < j; k++ {
+				keep(k)
+			}
+			i = j
+			continue
+		}
+		switch policy {
+		case LastWriteWins:
+			keep(j - 1)
+		case PreferDisk:
+			chosen := j - 1
+			for k := j - 1; k >= i; k-- {
+				if fromDisk[k] {
+					chosen = k
+					break
+				}
+			}
+			keep(chosen)
+		case ErrorOnDuplicate:
+			return fmt.Errorf("%w: %d", ErrDuplicateTimestamp, timestamp(i))
+		default:
+			return fmt.Errorf("unknown duplicate policy %d", policy)
+		}
+		i = j
+	}
+	return nil
+}
+
+// dedupeDataPointRefs resolves data points sharing a timestamp in the given sorted points in place.
+func dedupeDataPointRefs(points []*DataPoint, fromDisk []bool, policy DuplicatePolicy) ([]*DataPoint, error) {
+	if policy == KeepDuplicates {
+		return points, nil
+	}
+	n := 0
+	err := resolveDuplicates(len(points), func(i int) int64 {
+		return points[i].Timestamp
+	}, fromDisk, policy, func(i int) {
+		points[n] = points[i]
+		n++
+	})
+	return points[:n], err
+}
+
+// dedupeDataPoints is like dedupeDataPointRefs but takes data points.
+func dedupeDataPoints(points []DataPoint, fromDisk []bool, policy DuplicatePolicy) ([]DataPoint, error) {
+	if policy == KeepDuplicates {
+		return points, nil
+	}
+	n := 0
+	err := resolveDuplicates(len(points), func(i int) int64 {
+		return points[i].Timestamp
+	}, fromDisk, policy, func(i int) {
+		points[n] = points[i]
+		n++
+	})
+	return points[:n], err
+}
+
+// taggedDataPointRefs sorts data points along with the flags telling whether they come from disk partitions.
+type taggedDataPointRefs struct {
+	points   []*DataPoint
+	fromDisk []bool
+}
+
+func (t taggedDataPointRefs) Len() int { return len(t.points) }
+func (t taggedDataPointRefs) Less(i, j int) bool {
+	return t.points[i].Timestamp < t.points[j].Timestamp
+}
+func (t taggedDataPointRefs) Swap(i, j int) {
+	t.points[i], t.points[j] = t.points[j], t.points[i]
+	t.fromDisk[i], t.fromDisk[j] = t.fromDisk[j], t.fromDisk[i]
+}
+
+// taggedDataPoints is like taggedDataPointRefs but takes data points.
+type taggedDataPoints struct {
+	points   []DataPoint
+	fromDisk []bool
+}
+
+func (t taggedDataPoints) Len() int           { return len(t.points) }
+func (t taggedDataPoints) Less(i, j int) bool { return t.points[i].Timestamp < t.points[j].Timestamp }
+func (t taggedDataPoints) Swap(i, j int) {
+	t.points[i], t.points[j] = t.points[j], t.points[i]
+	t.fromDisk[i], t.fromDisk[j] = t.fromDisk[j], t.fromDisk[i]
+}
+
+// sortTagged sorts the given data points along with their flags unless they are already sorted,
+// keeping the order of data points sharing a timestamp as sortDataPointRefs does.
+func sortTagged(data sort.Interface) {
+	if !sort.IsSorted(data) {
+		sort.Stable(data)
+	}
+}
+
+// appendDiskFlags appends n copies of the flag telling whether data points come from disk to dst.
+func appendDiskFlags(dst []bool, isDisk bool, n int) []bool {
+	for i := 0; i < n; i++ {
+		dst = append(dst, isDisk)
+	}
+	return dst
+}
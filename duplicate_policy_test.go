@@ -0,0 +1,100 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_WithDuplicatePolicy(t *testing.T) {
+	older := newTestDiskPartition(t, []Row{
+		{DataPoint: DataPoint{Timestamp: 1, Value: 0.1}, Metric: "metric1"},
+		{DataPoint: DataPoint{Timestamp: 3, Value: 0.1}, Metric: "metric1"},
+	})
+	// Written as a late data point.
+	_, err := older.insertRows([]Row{
+		{DataPoint: DataPoint{Timestamp: 3, Value: 0.15}, Metric: "metric1"},
+	})
+	require.NoError(t, err)
+	newer := newMemoryPartition(nil, 1*time.Hour, Seconds)
+	_, err = newer.insertRows([]Row{
+		{DataPoint: DataPoint{Timestamp: 2, Value: 0.2}, Metric: "metric1"},
+		{DataPoint: DataPoint{Timestamp: 3, Value: 0.2}, Metric: "metric1"},
+	})
+	require.NoError(t, err)
+	list := newPartitionList()
+	list.insert(older)
+	list.insert(newer)
+
+	tests := []struct {
+		name    string
+		policy  DuplicatePolicy
+		want    []DataPoint
+		wantErr error
+	}{
+		{
+			name:   "keep duplicates",
+			policy: KeepDuplicates,
+			want: []DataPoint{
+				{Timestamp: 1, Value: 0.1},
+				{Timestamp: 2, Value: 0.2},
+				{Timestamp: 3, Value: 0.1},
+				{Timestamp: 3, Value: 0.15},
+				{Timestamp: 3, Value: 0.2},
+			},
+		},
+		{
+			name:   "last write wins",
+			policy: LastWriteWins,
+			want: []DataPoint{
+				{Timestamp: 1, Value: 0.1},
+				{Timestamp: 2, Value: 0.2},
+				{Timestamp: 3, Value: 0.2},
+			},
+		},
+		{
+			name:   "prefer disk",
+			policy: PreferDisk,
+			want: []DataPoint{
+				{Timestamp: 1, Value: 0.1},
+				{Timestamp: 2, Value: 0.2},
+				{Timestamp: 3, Value: 0.15},
+			},
+		},
+		{
+			name:    "error on duplicate",
+			policy:  ErrorOnDuplicate,
+			wantErr: ErrDuplicateTimestamp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &storage{partitionList: list, duplicatePolicy: tt.policy}
+
+			got, err := s.Select("metric1", nil, 1, 4)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Nil(t, got)
+			} else {
+				require.NoError(t, err)
+				values := make([]DataPoint, 0, len(got))
+				for _, p := range got {
+					values = append(values, *p)
+				}
+				assert.Equal(t, tt.want, values)
+			}
+
+			dst := []DataPoint{{Timestamp: 100}}
+			gotValues, err := s.SelectInto(dst, "metric1", nil, 1, 4)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Equal(t, dst, gotValues)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, append([]DataPoint{{Timestamp: 100}}, tt.want...), gotValues)
+		})
+	}
+}
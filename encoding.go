@@ -32,6 +32,10 @@ import (
 	"math/bits"
 )
 
+// maxEncodedPointSize is the upper bound of bytes a data point takes once encoded,
+// which is reached by a delta-of-delta that doesn't fit in 12 bits along with a value with new leading and trailing zeros.
+const maxEncodedPointSize = 20
+
 type seriesEncoder interface {
 	encodePoint(point *DataPoint) error
 	flush() error
@@ -52,6 +56,9 @@ type gorillaEncoder struct {
 
 	// buffer to be used while encoding
 	buf *bstream
+	// the number of data points encoded since the last flush.
+	// Timestamps can't be used to tell it because zero is a valid timestamp.
+	numEncoded int
 
 	// Calculate the delta of delta:
 	// D = (t_n − t_n−1) − (t_n−1 − t_n−2)
@@ -80,7 +87,7 @@ func (e *gorillaEncoder) encodePoint(point *DataPoint) error {
 
 	// Borrowed from https://github.com/prometheus/prometheus/blob/39d79c3cfb86c47d6bc06a9e9317af582f1833bb/tsdb/chunkenc/xor.go#L150
 	switch {
-	case e.t0 == 0:
+	case e.numEncoded == 0:
 		// Write timestamp directly.
 		buf := make([]byte, binary.MaxVarintLen64)
 		for _, b := range buf[:binary.PutVarint(buf, point.Timestamp)] {
@@ -89,7 +96,7 @@ func (e *gorillaEncoder) encodePoint(point *DataPoint) error {
 		// Write value directly.
 		e.buf.writeBits(math.Float64bits(point.Value), 64)
 		e.t0 = point.Timestamp
-	case e.t1 == 0:
+	case e.numEncoded == 1:
 		// Write delta of timestamp.
 		tDelta = uint64(point.Timestamp - e.t0)
 
@@ -127,6 +134,7 @@ func (e *gorillaEncoder) encodePoint(point *DataPoint) error {
 	e.t = point.Timestamp
 	e.v = point.Value
 	e.tDelta = tDelta
+	e.numEncoded++
 	return nil
 }
 
@@ -140,6 +148,7 @@ func (e *gorillaEncoder) flush() error {
 	}
 
 	e.buf.reset()
+	e.numEncoded = 0
 	e.t0 = 0
 	e.t1 = 0
 	e.t = 0
@@ -361,6 +370,9 @@ func (d *gorillaDecoder) readValue() error {
 			if mbits == 0 {
 				mbits = 64
 			}
+			if int(d.leading)+int(mbits) > 64 {
+				return fmt.Errorf("invalid number of significant bits %d with %d leading zeros", mbits, d.leading)
+			}
 			d.trailing = 64 - d.leading - mbits
 		}
 
@@ -63,6 +63,23 @@ func Test_gorillaEncoder_encodePoint_decodePoint(t *testing.T) {
 			wantEncodedByteSize: 52,
 			wantErr:             false,
 		},
+		{
+			name: "data points across the epoch",
+			input: []*DataPoint{
+				{Timestamp: -120, Value: 0.1},
+				{Timestamp: -60, Value: 0.1},
+				{Timestamp: 0, Value: 0.2},
+				{Timestamp: 60, Value: 0.2},
+			},
+			want: []*DataPoint{
+				{Timestamp: -120, Value: 0.1},
+				{Timestamp: -60, Value: 0.1},
+				{Timestamp: 0, Value: 0.2},
+				{Timestamp: 60, Value: 0.2},
+			},
+			wantEncodedByteSize: 20,
+			wantErr:             false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -116,3 +133,25 @@ func Test_bitRange(t *testing.T) {
 		})
 	}
 }
+
+func Fuzz_gorillaDecoder_decodePoint(f *testing.F) {
+	var buf bytes.Buffer
+	encoder := newSeriesEncoder(&buf)
+	for _, p := range []DataPoint{{0.1, 1600000000}, {1.1, 1600000060}, {15.01, 1600000182}, {-10.8, 1600002000}} {
+		p := p
+		require.NoError(f, encoder.encodePoint(&p))
+	}
+	require.NoError(f, encoder.flush())
+	f.Add(buf.Bytes(), 4)
+
+	f.Fuzz(func(t *testing.T, b []byte, num int) {
+		decoder, err := newSeriesDecoder(bytes.NewReader(b))
+		require.NoError(t, err)
+		var p DataPoint
+		for i := 0; i < num && i < 1000; i++ {
+			if err := decoder.decodePoint(&p); err != nil {
+				return
+			}
+		}
+	})
+}
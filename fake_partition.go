@@ -1,5 +1,7 @@
 package tstorage
 
+import "context"
+
 type fakePartition struct {
 	minT      int64
 	maxT      int64
@@ -13,10 +15,18 @@ func (f *fakePartition) insertRows(_ []Row) ([]Row, error) {
 	return nil, f.err
 }
 
-func (f *fakePartition) selectDataPoints(_ string, _ []Label, _, _ int64) ([]*DataPoint, error) {
+func (f *fakePartition) selectDataPoints(_ context.Context, _ string, _ []Label, _, _ int64) ([]*DataPoint, error) {
 	return nil, f.err
 }
 
+func (f *fakePartition) appendDataPoints(_ context.Context, dst []DataPoint, _ string, _ []Label, _, _ int64) ([]DataPoint, error) {
+	return dst, f.err
+}
+
+func (f *fakePartition) countDataPoints(_ context.Context, _ string, _ []Label, _, _ int64) (int64, error) {
+	return 0, f.err
+}
+
 func (f *fakePartition) minTimestamp() int64 {
 	return f.minT
 }
@@ -40,3 +50,56 @@ func (f *fakePartition) clean() error {
 func (f *fakePartition) expired() bool {
 	return false
 }
+
+// fakePublicPartition is a Partition that returns fixed data points for any metric.
+type fakePublicPartition struct {
+	minT      int64
+	maxT      int64
+	points    []*DataPoint
+	IsExpired bool
+	cleaned   bool
+
+	err error
+}
+
+func (f *fakePublicPartition) InsertRows(rows []Row) ([]Row, error) {
+	return rows, f.err
+}
+
+func (f *fakePublicPartition) SelectDataPoints(_ string, _ []Label, start, end int64) ([]*DataPoint, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	points := make([]*DataPoint, 0, len(f.points))
+	for _, p := range f.points {
+		if p.Timestamp >= start && p.Timestamp < end {
+			points = append(points, p)
+		}
+	}
+	return points, nil
+}
+
+func (f *fakePublicPartition) MinTimestamp() int64 {
+	return f.minT
+}
+
+func (f *fakePublicPartition) MaxTimestamp() int64 {
+	return f.maxT
+}
+
+func (f *fakePublicPartition) Size() int {
+	return len(f.points)
+}
+
+func (f *fakePublicPartition) Active() bool {
+	return false
+}
+
+func (f *fakePublicPartition) Expired() bool {
+	return f.IsExpired
+}
+
+func (f *fakePublicPartition) Clean() error {
+	f.cleaned = true
+	return nil
+}
@@ -0,0 +1,169 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fault injection lets tests make file operations on the flush and WAL paths misbehave at chosen points,
+// in order to verify the recovery code keeps data consistent as if the process crashed there.
+// It's inactive unless tests install a faultInjector with setFaultInjector.
+
+// errInjectedFault is the error injected faults give back.
+var errInjectedFault = errors.New("injected fault")
+
+// faultPoint identifies a kind of file operation faults can be injected into.
+type faultPoint string
+
+const (
+	// Writes to WAL segments, including the late files of disk partitions.
+	faultWALWrite faultPoint = "wal-write"
+	// Msyncs of memory-mapped WAL segments.
+	faultWALSync faultPoint = "wal-sync"
+	// Writes to the data files of partitions being flushed.
+	faultPartitionWrite faultPoint = "partition-write"
+	// Writes to the meta files of partitions being flushed.
+	faultMetaWrite faultPoint = "meta-write"
+	// Fsyncs of files and directories of partitions being flushed.
+	faultPartitionSync faultPoint = "partition-sync"
+	// Memory mapping of data files and WAL segments.
+	faultMmap faultPoint = "mmap"
+	// Removals of disk partitions replaced by their rewrites.
+	faultPartitionRemove faultPoint = "partition-remove"
+)
+
+type faultAction int
+
+const (
+	// faultFail makes the operation fail without doing anything.
+	faultFail faultAction = iota
+	// faultShortWrite makes a write fail after writing the first half, which leaves a torn record behind.
+	faultShortWrite
+	// faultDuplicate makes a write done twice, as if it got retried after succeeding.
+	// It's the same as no fault for operations other than writes.
+	faultDuplicate
+	// faultDelay makes the operation done after the delay.
+	faultDelay
+)
+
+// fault describes a fault injected into operations at the point.
+type fault struct {
+	point  faultPoint
+	action faultAction
+	// The number of operations at the point done as usual before the fault gets injected.
+	after int
+	// The number of times the fault gets injected; zero means every time afterwards.
+	times int
+	// Only for faultDelay.
+	delay time.Duration
+}
+
+// faultInjector decides faults to be injected, counting operations at each point.
+type faultInjector struct {
+	mu       sync.Mutex
+	faults   []fault
+	ops      map[faultPoint]int
+	injected map[int]int
+}
+
+func newFaultInjector(faults ...fault) *faultInjector {
+	return &faultInjector{
+		faults:   faults,
+		ops:      make(map[faultPoint]int),
+		injected: make(map[int]int),
+	}
+}
+
+// activeFaults is the injector in use; nil means no faults get injected.
+var activeFaults atomic.Pointer[faultInjector]
+
+// setFaultInjector installs the given injector process-wide. Passing nil uninstalls it.
+func setFaultInjector(fi *faultInjector) {
+	activeFaults.Store(fi)
+}
+
+// next counts an operation at the given point, and gives back the fault to be injected into it if any.
+func (fi *faultInjector) next(point faultPoint) *fault {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	n := fi.ops[point]
+	fi.ops[point]++
+	for i := range fi.faults {
+		f := &fi.faults[i]
+		if f.point != point || n < f.after {
+			continue
+		}
+		if f.times > 0 && fi.injected[i] >= f.times {
+			continue
+		}
+		fi.injected[i]++
+		return f
+	}
+	return nil
+}
+
+// injectFault injects a fault into an operation other than writes at the given point if any.
+func injectFault(point faultPoint) error {
+	fi := activeFaults.Load()
+	if fi == nil {
+		return nil
+	}
+	f := fi.next(point)
+	if f == nil {
+		return nil
+	}
+	switch f.action {
+	case faultFail, faultShortWrite:
+		return fmt.Errorf("%s: %w", point, errInjectedFault)
+	case faultDelay:
+		time.Sleep(f.delay)
+	}
+	return nil
+}
+
+// withFaults wraps the given writer so that faults get injected into writes at the given point.
+// It gives back the writer as is unless an injector is installed, which costs nothing in production;
+// writers created beforehand never get faults.
+func withFaults(point faultPoint, w io.Writer) io.Writer {
+	if activeFaults.Load() == nil {
+		return w
+	}
+	return &faultWriter{point: point, w: w}
+}
+
+type faultWriter struct {
+	point faultPoint
+	w     io.Writer
+}
+
+func (fw *faultWriter) Write(p []byte) (int, error) {
+	fi := activeFaults.Load()
+	if fi == nil {
+		return fw.w.Write(p)
+	}
+	f := fi.next(fw.point)
+	if f == nil {
+		return fw.w.Write(p)
+	}
+	switch f.action {
+	case faultFail:
+		return 0, fmt.Errorf("%s: %w", fw.point, errInjectedFault)
+	case faultShortWrite:
+		n, err := fw.w.Write(p[:len(p)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, fmt.Errorf("%s: %w", fw.point, errInjectedFault)
+	case faultDuplicate:
+		if _, err := fw.w.Write(p); err != nil {
+			return 0, err
+		}
+	case faultDelay:
+		time.Sleep(f.delay)
+	}
+	return fw.w.Write(p)
+}
@@ -0,0 +1,122 @@
+package tstorage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// injectFaults installs an injector with the given faults during the test.
+func injectFaults(t *testing.T, faults ...fault) {
+	setFaultInjector(newFaultInjector(faults...))
+	t.Cleanup(func() { setFaultInjector(nil) })
+}
+
+func Test_faultWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		fault   fault
+		want    string
+		wantErr bool
+	}{
+		{name: "fail", fault: fault{action: faultFail}, want: "", wantErr: true},
+		{name: "short write", fault: fault{action: faultShortWrite}, want: "ab", wantErr: true},
+		{name: "duplicate", fault: fault{action: faultDuplicate}, want: "abcdabcd"},
+		{name: "delay", fault: fault{action: faultDelay, delay: time.Millisecond}, want: "abcd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fault.point = faultWALWrite
+			injectFaults(t, tt.fault)
+			var buf bytes.Buffer
+			_, err := withFaults(faultWALWrite, &buf).Write([]byte("abcd"))
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func Test_faultInjector_next(t *testing.T) {
+	fi := newFaultInjector(fault{point: faultMmap, action: faultFail, after: 1, times: 2})
+	var got []bool
+	for i := 0; i < 4; i++ {
+		got = append(got, fi.next(faultMmap) != nil)
+	}
+	assert.Equal(t, []bool{false, true, true, false}, got)
+	assert.Nil(t, fi.next(faultWALWrite))
+}
+
+func Test_storage_crash_tornWALRecord(t *testing.T) {
+	// Writers get wrapped only while an injector is installed.
+	injectFaults(t, fault{point: faultWALWrite, action: faultShortWrite, after: 1, times: 1})
+	dir := t.TempDir()
+	s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}))
+	assert.ErrorIs(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}}}), errInjectedFault)
+	setFaultInjector(nil)
+	// Crash without closing; the torn record is ignored by recovery.
+
+	s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	got, err := s.Select("metric1", nil, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_crash_flush(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault fault
+	}{
+		{name: "data file write fails", fault: fault{point: faultPartitionWrite, action: faultFail}},
+		{name: "data file torn", fault: fault{point: faultPartitionWrite, action: faultShortWrite}},
+		{name: "meta file write fails", fault: fault{point: faultMetaWrite, action: faultFail}},
+		{name: "meta file torn", fault: fault{point: faultMetaWrite, action: faultShortWrite}},
+		{name: "data file sync fails", fault: fault{point: faultPartitionSync, action: faultFail}},
+		// After the data file and the index file.
+		{name: "meta file sync fails", fault: fault{point: faultPartitionSync, action: faultFail, after: 2}},
+		{name: "partition directory sync fails", fault: fault{point: faultPartitionSync, action: faultFail, after: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			require.NoError(t, s.InsertRows([]Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+			}))
+
+			injectFaults(t, tt.fault)
+			assert.ErrorIs(t, s.Close(), errInjectedFault)
+			setFaultInjector(nil)
+			// No partial partition is left.
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			for _, e := range entries {
+				assert.False(t, partitionDirRegex.MatchString(e.Name()), e.Name())
+			}
+			// As if the process crashed in the middle of writing.
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "p-1600000000-1600000001"+flushingDirSuffix), 0755))
+
+			// Data points are recovered from the WAL kept as is.
+			s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			assert.NoDirExists(t, filepath.Join(dir, "p-1600000000-1600000001"+flushingDirSuffix))
+			got, err := s.Select("metric1", nil, 1600000000, 1600000002)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{
+				{Timestamp: 1600000000, Value: 0.1},
+				{Timestamp: 1600000001, Value: 0.2},
+			}, got)
+			require.NoError(t, s.Close())
+		})
+	}
+}
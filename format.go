@@ -0,0 +1,123 @@
+package tstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrUnsupportedFormatVersion means a disk partition is written in a format newer than the one this version
+// of tstorage knows, which never gets opened rather than read wrongly.
+var ErrUnsupportedFormatVersion = errors.New("unsupported format version")
+
+// formatVersion is the version of the format disk partitions get written in. Bump it whenever the way
+// they are encoded changes, along with adding the migration from the previous one to formatMigrations.
+//
+// Version 0 is the one before versioning, whose chunks may lack checksums or be missing at all.
+const formatVersion = 1
+
+// formatMigrations upgrades disk partitions one step at a time. The one keyed by a version upgrades
+// a partition in that version into a newer one.
+var formatMigrations = map[int]func(dirPath string) error{
+	0: rewritePartition,
+}
+
+// migratingDirSuffix is the suffix the directory of the partition being migrated gets renamed to, until the
+// migrated one takes its place. It must not match partitionDirRegex.
+const migratingDirSuffix = ".old"
+
+// checkVersion ensures the meta is in a format version that can be read.
+func (m *meta) checkVersion() error {
+	if m.FormatVersion > formatVersion {
+		return fmt.Errorf("%w %d, up to %d is supported", ErrUnsupportedFormatVersion, m.FormatVersion, formatVersion)
+	}
+	return nil
+}
+
+// MigratePartition upgrades the disk partition in the given directory, e.g. "data/p-1600000000-1600003600",
+// into the current format version in place, so that it gets the features of the latest format, such as
+// checksums of chunks. It does nothing for partitions already in the current version.
+//
+// Partitions in older versions are still readable without migration. The partition must not be opened by
+// any storage while being migrated.
+func MigratePartition(dirPath string) error {
+	for {
+		b, err := readMetaFile(dirPath)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata: %w", err)
+		}
+		m, err := unmarshalMeta(b)
+		if err != nil {
+			return newCorruptionError(dirPath, "", fmt.Errorf("failed to decode metadata: %w", err))
+		}
+		if err := m.checkVersion(); err != nil {
+			return err
+		}
+		if m.FormatVersion == formatVersion {
+			return nil
+		}
+		migrate, ok := formatMigrations[m.FormatVersion]
+		if !ok {
+			return fmt.Errorf("no migration from format version %d", m.FormatVersion)
+		}
+		if err := migrate(dirPath); err != nil {
+			return fmt.Errorf("failed to migrate %s from format version %d: %w", dirPath, m.FormatVersion, err)
+		}
+	}
+}
+
+// rewritePartition rewrites the disk partition in the given directory in the current format, folding its late
+// data points in. The original one is kept aside until the rewritten one takes its place.
+func rewritePartition(dirPath string) error {
+	part, err := openDiskPartition(dirPath, time.Duration(math.MaxInt64))
+	if err != nil {
+		return err
+	}
+	d := part.(*diskPartition)
+	rows, err := d.selectAll(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("no data points to migrate: %w", ErrNoDataPoints)
+	}
+	m := newMemoryPartition(nil, 0, Nanoseconds).(*memoryPartition)
+	if _, err := m.insertRows(rows); err != nil {
+		return err
+	}
+	c, err := newCompressor(d.meta.Compression, 0)
+	if err != nil {
+		return err
+	}
+	// Keep the format of the meta file as well.
+	_, err = os.Stat(filepath.Join(dirPath, binaryMetaFileName))
+	s := &storage{compressor: c, compression: d.meta.Compression, binaryMeta: err == nil}
+
+	tmpDir := dirPath + flushingDirSuffix
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", tmpDir, err)
+	}
+	// Keep the creation time to retain the partition as long as the original one.
+	if err := s.writePartition(tmpDir, m, d.meta.CreatedAt); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	oldDir := dirPath + migratingDirSuffix
+	if err := os.RemoveAll(oldDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", oldDir, err)
+	}
+	if err := os.Rename(dirPath, oldDir); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", dirPath, oldDir, err)
+	}
+	if err := os.Rename(tmpDir, dirPath); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpDir, dirPath, err)
+	}
+	if err := syncDir(filepath.Dir(dirPath)); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", filepath.Dir(dirPath), err)
+	}
+	return os.RemoveAll(oldDir)
+}
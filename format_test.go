@@ -0,0 +1,97 @@
+package tstorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rewriteMeta applies fn to the meta of the partition in the given directory.
+func rewriteMeta(t *testing.T, dirPath string, fn func(m *meta)) {
+	t.Helper()
+	b, err := readMetaFile(dirPath)
+	require.NoError(t, err)
+	m, err := unmarshalMeta(b)
+	require.NoError(t, err)
+	fn(&m)
+	require.NoError(t, writeMeta(dirPath, &m, isBinaryMeta(b)))
+}
+
+func Test_diskPartition_futureFormatVersion(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}))
+	require.NoError(t, s.Close())
+	dir := filepath.Join(dataPath, "p-1600000000-1600000000")
+	rewriteMeta(t, dir, func(m *meta) {
+		m.FormatVersion = formatVersion + 1
+	})
+
+	_, err = openDiskPartition(dir, time.Hour)
+	assert.ErrorIs(t, err, ErrUnsupportedFormatVersion)
+	assert.NotErrorIs(t, err, errInvalidPartition)
+	// It never gets skipped as a broken one.
+	_, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+	assert.ErrorIs(t, err, ErrUnsupportedFormatVersion)
+	assert.ErrorIs(t, MigratePartition(dir), ErrUnsupportedFormatVersion)
+}
+
+func TestMigratePartition(t *testing.T) {
+	d := newTestDiskPartition(t, []Row{
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 10, Value: 0.1}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 20, Value: 0.2}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 15, Value: 0.3}},
+	})
+	_, err := d.insertRows([]Row{{Metric: "metric2", DataPoint: DataPoint{Timestamp: 12, Value: 0.4}}})
+	require.NoError(t, err)
+	// As if it was written before versioning.
+	createdAt := d.meta.CreatedAt
+	rewriteMeta(t, d.dirPath, func(m *meta) {
+		m.FormatVersion = 0
+		for name, mt := range m.Metrics {
+			for i := range mt.Chunks {
+				mt.Chunks[i].Checksum = 0
+			}
+			m.Metrics[name] = mt
+		}
+	})
+
+	require.NoError(t, MigratePartition(d.dirPath))
+	entries, err := os.ReadDir(filepath.Dir(d.dirPath))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.NoFileExists(t, filepath.Join(d.dirPath, lateFileName))
+
+	p, err := openDiskPartition(d.dirPath, time.Hour)
+	require.NoError(t, err)
+	migrated := p.(*diskPartition)
+	assert.Equal(t, formatVersion, migrated.meta.FormatVersion)
+	assert.True(t, createdAt.Equal(migrated.meta.CreatedAt))
+	for _, mt := range migrated.meta.Metrics {
+		for _, c := range mt.Chunks {
+			assert.NotZero(t, c.Checksum)
+		}
+	}
+	got, err := migrated.selectAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []Row{
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 10, Value: 0.1}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 20, Value: 0.2}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 12, Value: 0.4}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 15, Value: 0.3}},
+	}, got)
+
+	// Nothing to do for the current version.
+	info, err := os.Stat(filepath.Join(d.dirPath, dataFileName))
+	require.NoError(t, err)
+	require.NoError(t, MigratePartition(d.dirPath))
+	after, err := os.Stat(filepath.Join(d.dirPath, dataFileName))
+	require.NoError(t, err)
+	assert.Equal(t, info.ModTime(), after.ModTime())
+}
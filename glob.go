@@ -0,0 +1,71 @@
+package tstorage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+func (s *storage) SelectGlob(pattern string, start, end int64, opts ...SelectOption) ([]Series, error) {
+	expr, err := globToRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return s.SelectSeries([]Matcher{{Type: MatchRegexp, Name: MetricNameLabel, Value: expr}}, start, end, opts...)
+}
+
+// globToRegexp converts the given glob pattern into a regular expression, which matchers fully match.
+func globToRegexp(pattern string) (string, error) {
+	if pattern == "" {
+		return "", fmt.Errorf("glob pattern must be set")
+	}
+	var b strings.Builder
+	// The number of alternations being opened.
+	depth := 0
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(`[^.]*`)
+		case '?':
+			b.WriteString(`[^.]`)
+		case '{':
+			depth++
+			b.WriteString(`(?:`)
+		case '}':
+			if depth == 0 {
+				return "", fmt.Errorf("unmatched '}' in glob pattern %q", pattern)
+			}
+			depth--
+			b.WriteByte(')')
+		case ',':
+			if depth == 0 {
+				b.WriteByte(',')
+				continue
+			}
+			b.WriteByte('|')
+		case '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j < 0 {
+				return "", fmt.Errorf("unterminated '[' in glob pattern %q", pattern)
+			}
+			class := pattern[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			if class == "" || class == "^" {
+				return "", fmt.Errorf("empty character class in glob pattern %q", pattern)
+			}
+			b.WriteByte('[')
+			// Backslashes would escape the closing bracket.
+			b.WriteString(strings.ReplaceAll(class, `\`, `\\`))
+			b.WriteByte(']')
+			i += j + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if depth > 0 {
+		return "", fmt.Errorf("unterminated '{' in glob pattern %q", pattern)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,87 @@
+package tstorage
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_globToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		wantErr   bool
+		matches   []string
+		unmatches []string
+	}{
+		{
+			pattern:   "cpu.*.usage",
+			matches:   []string{"cpu.host-1.usage", "cpu..usage"},
+			unmatches: []string{"cpu.dc.host-1.usage", "cpu.host-1.usage.max", "cpuXhost-1.usage"},
+		},
+		{
+			pattern:   "cpu.host-?",
+			matches:   []string{"cpu.host-1"},
+			unmatches: []string{"cpu.host-12", "cpu.host-."},
+		},
+		{
+			pattern:   "cpu.{user,sys{,tem}}",
+			matches:   []string{"cpu.user", "cpu.sys", "cpu.system"},
+			unmatches: []string{"cpu.idle", "cpu.users"},
+		},
+		{
+			pattern:   "disk.sd[ab].[!0-4]",
+			matches:   []string{"disk.sda.5", "disk.sdb.x"},
+			unmatches: []string{"disk.sdc.5", "disk.sda.3"},
+		},
+		{
+			pattern:   "a+b(c),d",
+			matches:   []string{"a+b(c),d"},
+			unmatches: []string{"aab(c),d"},
+		},
+		{pattern: "", wantErr: true},
+		{pattern: "cpu.{user", wantErr: true},
+		{pattern: "cpu.user}", wantErr: true},
+		{pattern: "cpu.[ab", wantErr: true},
+		{pattern: "cpu.[!]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			expr, err := globToRegexp(tt.pattern)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			re := regexp.MustCompile("^(?:" + expr + ")$")
+			for _, s := range tt.matches {
+				assert.True(t, re.MatchString(s), s)
+			}
+			for _, s := range tt.unmatches {
+				assert.False(t, re.MatchString(s), s)
+			}
+		})
+	}
+}
+
+func Test_storage_SelectGlob(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	for i, metric := range []string{"cpu.host-1.usage", "cpu.host-2.usage", "cpu.host-1.idle", "memory.host-1.usage"} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: metric, DataPoint: DataPoint{Timestamp: 1600000000, Value: float64(i)}}}))
+	}
+
+	got, err := s.SelectGlob("cpu.*.usage", 1600000000, 1600000001)
+	require.NoError(t, err)
+	assert.Equal(t, []Series{
+		{Metric: "cpu.host-1.usage", DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 0}}},
+		{Metric: "cpu.host-2.usage", DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 1}}},
+	}, got)
+
+	_, err = s.SelectGlob("disk.*", 1600000000, 1600000001)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	_, err = s.SelectGlob("cpu.{", 1600000000, 1600000001)
+	assert.Error(t, err)
+}
@@ -0,0 +1,261 @@
+// Package graphite ingests the Graphite plaintext protocol into tstorage, whose lines look like:
+//
+//	metric.path value timestamp
+//
+// Dotted paths are taken as metrics as they are by default, or mapped into metrics and labels by Template.
+package graphite
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nakabonne/tstorage"
+)
+
+const defaultBatchSize = 1000
+
+// Mapping maps a dotted path into the metric and labels of rows.
+type Mapping func(path string) (metric string, labels []tstorage.Label, err error)
+
+// Option is an optional setting for Parse and Ingest.
+type Option func(*config)
+
+type config struct {
+	mapping    Mapping
+	multiplier int64
+	batchSize  int
+}
+
+// WithMapping specifies how to map dotted paths into metrics and labels.
+// Defaults to taking paths as metrics as they are.
+func WithMapping(m Mapping) Option {
+	return func(c *config) {
+		c.mapping = m
+	}
+}
+
+// WithTimestampPrecision specifies the precision of timestamps of the storage, into which timestamps in seconds,
+// as the protocol defines, get converted. It must be the same as the one given to tstorage.WithTimestampPrecision.
+//
+// Defaults to tstorage.Nanoseconds, as the storage does.
+func WithTimestampPrecision(precision tstorage.TimestampPrecision) Option {
+	return func(c *config) {
+		switch precision {
+		case tstorage.Microseconds:
+			c.multiplier = 1e6
+		case tstorage.Milliseconds:
+			c.multiplier = 1e3
+		case tstorage.Seconds:
+			c.multiplier = 1
+		default:
+			c.multiplier = 1e9
+		}
+	}
+}
+
+// WithBatchSize specifies the number of rows Ingest inserts at a time.
+//
+// Defaults to 1000.
+func WithBatchSize(size int) Option {
+	return func(c *config) {
+		c.batchSize = size
+	}
+}
+
+func newConfig(opts []Option) (*config, error) {
+	c := &config{
+		mapping:    func(path string) (string, []tstorage.Label, error) { return path, nil, nil },
+		multiplier: 1e9,
+		batchSize:  defaultBatchSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.mapping == nil {
+		return nil, fmt.Errorf("mapping must be set")
+	}
+	if c.batchSize < 1 {
+		return nil, fmt.Errorf("batch size must be positive")
+	}
+	return c, nil
+}
+
+// Parse reads lines of the Graphite plaintext protocol from r, and gives back rows converted from them.
+// Empty lines are ignored. Rows without timestamp, or with -1 or N as it, have zero, which the storage
+// fills with the current time at insertion.
+func Parse(r io.Reader, opts ...Option) ([]tstorage.Row, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	var rows []tstorage.Row
+	err = c.readRows(r, func(row tstorage.Row) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Ingest reads lines of the Graphite plaintext protocol from r, and inserts rows converted from them into
+// the given storage in batches. It gives back the number of rows inserted, which are kept even if it fails
+// in the middle.
+func Ingest(s tstorage.Storage, r io.Reader, opts ...Option) (int, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return 0, err
+	}
+	inserted := 0
+	batch := make([]tstorage.Row, 0, c.batchSize)
+	insert := func() error {
+		if err := s.InsertRows(batch); err != nil {
+			return fmt.Errorf("failed to insert rows: %w", err)
+		}
+		inserted += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err = c.readRows(r, func(row tstorage.Row) error {
+		batch = append(batch, row)
+		if len(batch) < c.batchSize {
+			return nil
+		}
+		return insert()
+	})
+	if err != nil {
+		return inserted, err
+	}
+	if len(batch) > 0 {
+		if err := insert(); err != nil {
+			return inserted, err
+		}
+	}
+	return inserted, nil
+}
+
+// readRows calls fn with the row converted from each line read from r.
+func (c *config) readRows(r io.Reader, fn func(row tstorage.Row) error) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read line %d: %w", n, err)
+		}
+		if strings.TrimSpace(line) != "" {
+			row, err := c.parseLine(line)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			return nil
+		}
+	}
+}
+
+func (c *config) parseLine(line string) (tstorage.Row, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return tstorage.Row{}, fmt.Errorf("line must consist of path, value and optional timestamp: %q", line)
+	}
+	metric, labels, err := c.mapping(fields[0])
+	if err != nil {
+		return tstorage.Row{}, fmt.Errorf("failed to map path %q: %w", fields[0], err)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return tstorage.Row{}, fmt.Errorf("invalid value %q: %w", fields[1], err)
+	}
+	var timestamp int64
+	if len(fields) == 3 && fields[2] != "-1" && fields[2] != "N" {
+		timestamp, err = c.parseTimestamp(fields[2])
+		if err != nil {
+			return tstorage.Row{}, fmt.Errorf("invalid timestamp %q: %w", fields[2], err)
+		}
+	}
+	return tstorage.Row{
+		Metric:    metric,
+		Labels:    labels,
+		DataPoint: tstorage.DataPoint{Timestamp: timestamp, Value: value},
+	}, nil
+}
+
+// parseTimestamp converts the given timestamp in seconds into the precision of the storage.
+// Fractional seconds are accepted as well.
+func (c *config) parseTimestamp(s string) (int64, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return sec * c.multiplier, nil
+	}
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(sec * float64(c.multiplier)), nil
+}
+
+// Template gives back a Mapping following the given template, whose dot-separated parts name the parts of paths
+// at the same positions. Parts named "metric" are joined with dots into the metric. Parts with any other name
+// become labels of that name, and the ones without name are dropped. The last part of the template can be
+// suffixed with "*" to take all the rest of parts.
+//
+// For instance, "region.host.metric*" maps "us-east.host-1.cpu.idle" into the metric "cpu.idle" with
+// the labels region=us-east and host=host-1. Paths with more parts than the template are rejected.
+func Template(template string) (Mapping, error) {
+	names := strings.Split(template, ".")
+	greedy := strings.HasSuffix(names[len(names)-1], "*")
+	if greedy {
+		names[len(names)-1] = strings.TrimSuffix(names[len(names)-1], "*")
+	}
+	hasMetric := false
+	for i, name := range names {
+		if strings.Contains(name, "*") {
+			return nil, fmt.Errorf("only the last part of template can be suffixed with *: %q", template)
+		}
+		if name == "metric" {
+			hasMetric = true
+		}
+		for _, other := range names[:i] {
+			if name != "" && name != "metric" && name == other {
+				return nil, fmt.Errorf("duplicate label %q in template %q", name, template)
+			}
+		}
+	}
+	if !hasMetric {
+		return nil, fmt.Errorf("template must have metric: %q", template)
+	}
+
+	return func(path string) (string, []tstorage.Label, error) {
+		parts := strings.Split(path, ".")
+		if len(parts) > len(names) && !greedy {
+			return "", nil, fmt.Errorf("more parts than the template %q", template)
+		}
+		var metric []string
+		var labels []tstorage.Label
+		for i := 0; i < len(parts) && i < len(names); i++ {
+			values := parts[i : i+1]
+			if greedy && i == len(names)-1 {
+				values = parts[i:]
+			}
+			switch names[i] {
+			case "":
+			case "metric":
+				metric = append(metric, values...)
+			default:
+				labels = append(labels, tstorage.Label{Name: names[i], Value: strings.Join(values, ".")})
+			}
+		}
+		if len(metric) == 0 {
+			return "", nil, fmt.Errorf("no parts for metric in the template %q", template)
+		}
+		return strings.Join(metric, "."), labels, nil
+	}, nil
+}
@@ -0,0 +1,148 @@
+package graphite
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nakabonne/tstorage"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		opts    []Option
+		want    []tstorage.Row
+		wantErr bool
+	}{
+		{
+			name:  "paths as metrics",
+			input: "servers.host1.cpu 0.5 1600000000\n\nservers.host2.cpu 0.7 1600000001.5\r\n",
+			want: []tstorage.Row{
+				{Metric: "servers.host1.cpu", DataPoint: tstorage.DataPoint{Timestamp: 1600000000000000000, Value: 0.5}},
+				{Metric: "servers.host2.cpu", DataPoint: tstorage.DataPoint{Timestamp: 1600000001500000000, Value: 0.7}},
+			},
+		},
+		{
+			name:  "timestamps in seconds without the trailing newline",
+			input: "cpu 1 1600000000\ncpu 2 -1\ncpu 3",
+			opts:  []Option{WithTimestampPrecision(tstorage.Seconds)},
+			want: []tstorage.Row{
+				{Metric: "cpu", DataPoint: tstorage.DataPoint{Timestamp: 1600000000, Value: 1}},
+				{Metric: "cpu", DataPoint: tstorage.DataPoint{Value: 2}},
+				{Metric: "cpu", DataPoint: tstorage.DataPoint{Value: 3}},
+			},
+		},
+		{
+			name:    "invalid value",
+			input:   "cpu abc 1600000000\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid timestamp",
+			input:   "cpu 1 abc\n",
+			wantErr: true,
+		},
+		{
+			name:    "too many fields",
+			input:   "cpu 1 1600000000 extra\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.input), tt.opts...)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		template   string
+		path       string
+		wantMetric string
+		wantLabels []tstorage.Label
+		wantErr    bool
+	}{
+		{
+			name:       "greedy metric",
+			template:   "region.host.metric*",
+			path:       "us-east.host-1.cpu.idle",
+			wantMetric: "cpu.idle",
+			wantLabels: []tstorage.Label{{Name: "region", Value: "us-east"}, {Name: "host", Value: "host-1"}},
+		},
+		{
+			name:       "dropped and joined parts",
+			template:   ".host.metric.metric",
+			path:       "servers.host-1.cpu.idle",
+			wantMetric: "cpu.idle",
+			wantLabels: []tstorage.Label{{Name: "host", Value: "host-1"}},
+		},
+		{
+			name:       "fewer parts",
+			template:   "metric.host",
+			path:       "cpu",
+			wantMetric: "cpu",
+		},
+		{
+			name:       "greedy label",
+			template:   "metric.path*",
+			path:       "disk.var.log",
+			wantMetric: "disk",
+			wantLabels: []tstorage.Label{{Name: "path", Value: "var.log"}},
+		},
+		{
+			name:     "more parts",
+			template: "host.metric",
+			path:     "host-1.cpu.idle",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapping, err := Template(tt.template)
+			require.NoError(t, err)
+			metric, labels, err := mapping(tt.path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantMetric, metric)
+			assert.Equal(t, tt.wantLabels, labels)
+		})
+	}
+
+	for _, template := range []string{"host.region", "metric*.host", "host.host.metric"} {
+		_, err := Template(template)
+		assert.Error(t, err, template)
+	}
+}
+
+func TestIngest(t *testing.T) {
+	s, err := tstorage.NewStorage(tstorage.WithTimestampPrecision(tstorage.Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	mapping, err := Template("host.metric*")
+	require.NoError(t, err)
+
+	input := "host-1.cpu 0.1 1600000000\nhost-1.cpu 0.2 1600000001\nhost-1.cpu 0.3 1600000002\nhost-1.cpu x 1600000003\n"
+	n, err := Ingest(s, strings.NewReader(input), WithMapping(mapping), WithTimestampPrecision(tstorage.Seconds), WithBatchSize(2))
+	assert.Error(t, err)
+	// The first batch has been inserted.
+	assert.Equal(t, 2, n)
+
+	got, err := s.Select("cpu", []tstorage.Label{{Name: "host", Value: "host-1"}}, 1600000000, 1600000010)
+	require.NoError(t, err)
+	assert.Equal(t, []*tstorage.DataPoint{{Timestamp: 1600000000, Value: 0.1}, {Timestamp: 1600000001, Value: 0.2}}, got)
+}
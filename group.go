@@ -0,0 +1,75 @@
+package tstorage
+
+import (
+	"fmt"
+	"sort"
+)
+
+func (s *storage) SelectGroupedBy(matchers []Matcher, start, end int64, groupLabels []string, fn AggrFunc, opts ...SelectOption) ([]Series, error) {
+	if fn < AggrMin || fn > AggrCount {
+		return nil, fmt.Errorf("unknown aggregation function %d", int(fn))
+	}
+	series, err := s.SelectSeries(matchers, start, end, ascending(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	names := append([]string(nil), groupLabels...)
+	sort.Strings(names)
+
+	type group struct {
+		series Series
+		points []DataPoint
+	}
+	groups := make(map[string]*group)
+	for i := range series {
+		metric, labels := groupKey(&series[i], names)
+		key := marshalMetricName(metric, labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{series: Series{Metric: metric, Labels: labels}}
+			groups[key] = g
+		}
+		for _, p := range series[i].DataPoints {
+			g.points = append(g.points, *p)
+		}
+	}
+
+	grouped := make([]Series, 0, len(groups))
+	for _, g := range groups {
+		sort.SliceStable(g.points, func(i, j int) bool {
+			return g.points[i].Timestamp < g.points[j].Timestamp
+		})
+		// Steps of one unit make data points sharing a timestamp fall into the same one.
+		g.series.DataPoints = aggregate(g.points, start, 1, fn)
+		grouped = append(grouped, g.series)
+	}
+	sort.Slice(grouped, func(i, j int) bool {
+		return lessSeries(&grouped[i], &grouped[j])
+	})
+	return grouped, nil
+}
+
+// groupKey gives back the metric and labels identifying the group the given series belongs to,
+// out of the given label names in ascending order.
+func groupKey(series *Series, names []string) (string, []Label) {
+	var (
+		metric string
+		labels []Label
+	)
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		if name == MetricNameLabel {
+			metric = series.Metric
+			continue
+		}
+		for _, l := range series.Labels {
+			if l.Name == name {
+				labels = append(labels, l)
+				break
+			}
+		}
+	}
+	return metric, labels
+}
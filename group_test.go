@@ -0,0 +1,93 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectGroupedBy(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	series := []struct {
+		metric string
+		labels []Label
+	}{
+		{metric: "cpu", labels: []Label{{Name: "dc", Value: "x"}, {Name: "host", Value: "a"}, {Name: "core", Value: "0"}}},
+		{metric: "cpu", labels: []Label{{Name: "dc", Value: "x"}, {Name: "host", Value: "a"}, {Name: "core", Value: "1"}}},
+		{metric: "cpu", labels: []Label{{Name: "dc", Value: "y"}, {Name: "host", Value: "b"}, {Name: "core", Value: "0"}}},
+		{metric: "cpu", labels: []Label{{Name: "core", Value: "0"}}},
+		{metric: "memory", labels: []Label{{Name: "dc", Value: "x"}, {Name: "host", Value: "a"}}},
+	}
+	for i, ser := range series {
+		for ts := int64(1600000000); ts < 1600000002; ts++ {
+			require.NoError(t, s.InsertRows([]Row{
+				{Metric: ser.metric, Labels: ser.labels, DataPoint: DataPoint{Timestamp: ts, Value: float64(i + 1)}},
+			}))
+		}
+	}
+	cpu := []Matcher{{Type: MatchEqual, Name: MetricNameLabel, Value: "cpu"}}
+
+	tests := []struct {
+		name        string
+		matchers    []Matcher
+		groupLabels []string
+		fn          AggrFunc
+		want        []Series
+	}{
+		{
+			name:        "sum by host",
+			matchers:    cpu,
+			groupLabels: []string{"host"},
+			fn:          AggrSum,
+			want: []Series{
+				{DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 4}, {Timestamp: 1600000001, Value: 4}}},
+				{Labels: []Label{{Name: "host", Value: "a"}}, DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 3}, {Timestamp: 1600000001, Value: 3}}},
+				{Labels: []Label{{Name: "host", Value: "b"}}, DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 3}, {Timestamp: 1600000001, Value: 3}}},
+			},
+		},
+		{
+			name:        "count by dc and host",
+			matchers:    cpu,
+			groupLabels: []string{"host", "dc"},
+			fn:          AggrCount,
+			want: []Series{
+				{DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 1}, {Timestamp: 1600000001, Value: 1}}},
+				{Labels: []Label{{Name: "dc", Value: "x"}, {Name: "host", Value: "a"}}, DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 2}, {Timestamp: 1600000001, Value: 2}}},
+				{Labels: []Label{{Name: "dc", Value: "y"}, {Name: "host", Value: "b"}}, DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 1}, {Timestamp: 1600000001, Value: 1}}},
+			},
+		},
+		{
+			name:        "max by metric",
+			matchers:    []Matcher{{Type: MatchEqual, Name: "dc", Value: "x"}},
+			groupLabels: []string{MetricNameLabel},
+			fn:          AggrMax,
+			want: []Series{
+				{Metric: "cpu", DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 2}, {Timestamp: 1600000001, Value: 2}}},
+				{Metric: "memory", DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 5}, {Timestamp: 1600000001, Value: 5}}},
+			},
+		},
+		{
+			name:     "without grouping labels",
+			matchers: cpu,
+			fn:       AggrAvg,
+			want: []Series{
+				{DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 2.5}, {Timestamp: 1600000001, Value: 2.5}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SelectGroupedBy(tt.matchers, 1600000000, 1600000002, tt.groupLabels, tt.fn)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = s.SelectGroupedBy(cpu, 1600000000, 1600000002, []string{"host"}, AggrFunc(100))
+	assert.Error(t, err)
+	_, err = s.SelectGroupedBy([]Matcher{{Type: MatchEqual, Name: MetricNameLabel, Value: "disk"}}, 1600000000, 1600000002, nil, AggrSum)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
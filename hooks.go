@@ -0,0 +1,78 @@
+package tstorage
+
+import "time"
+
+// FlushInfo describes a memory partition flushed to disk, which is given to the function specified by WithOnFlush.
+type FlushInfo struct {
+	// Dir is the directory of the disk partition the memory partition got flushed into, which is empty
+	// if it held no data points to be flushed.
+	Dir string
+	// MinTimestamp and MaxTimestamp are the time range of data points in the memory partition.
+	MinTimestamp int64
+	MaxTimestamp int64
+	// DataPoints is the number of data points in the memory partition.
+	DataPoints int64
+	// Duration is the time taken to flush it.
+	Duration time.Duration
+	// Err is non-nil if flushing failed, in which case the memory partition stays in memory until the next flush
+	// unless Dir is set.
+	Err error
+}
+
+// PartitionInfo describes a partition, which is given to the functions specified by WithOnPartitionCreated
+// and WithOnPartitionRemoved.
+type PartitionInfo struct {
+	// Dir is the directory of the disk partition, which is empty for memory partitions.
+	Dir string
+	// MinTimestamp and MaxTimestamp are the time range of data points in the partition, which are zero if
+	// it holds none.
+	MinTimestamp int64
+	MaxTimestamp int64
+	// DataPoints is the number of data points in the partition. Disk partitions not opened yet due to
+	// WithLazyOpen have zero, since taking it would open them.
+	DataPoints int64
+}
+
+// hooks holds the functions called on events in the lifecycle of partitions, each of which may be nil.
+type hooks struct {
+	onFlush            func(FlushInfo)
+	onPartitionCreated func(PartitionInfo)
+	onPartitionRemoved func(PartitionInfo)
+}
+
+func (h *hooks) flushed(info FlushInfo) {
+	if h.onFlush != nil {
+		h.onFlush(info)
+	}
+}
+
+func (h *hooks) partitionCreated(p partition) {
+	if h.onPartitionCreated != nil {
+		h.onPartitionCreated(newPartitionInfo(p))
+	}
+}
+
+func (h *hooks) partitionRemoved(info PartitionInfo) {
+	if h.onPartitionRemoved != nil {
+		h.onPartitionRemoved(info)
+	}
+}
+
+// newPartitionInfo describes the given partition.
+func newPartitionInfo(p partition) PartitionInfo {
+	var info PartitionInfo
+	if d, ok := p.(*diskPartition); ok {
+		info.Dir = d.dirPath
+		if unopened(d) {
+			info.MinTimestamp = d.minTimestamp()
+			info.MaxTimestamp = d.maxTimestamp()
+			return info
+		}
+	}
+	if n := p.size(); n > 0 {
+		info.DataPoints = int64(n)
+		info.MinTimestamp = p.minTimestamp()
+		info.MaxTimestamp = p.maxTimestamp()
+	}
+	return info
+}
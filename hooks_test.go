@@ -0,0 +1,74 @@
+package tstorage
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_hooks(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		mu      sync.Mutex
+		flushed []FlushInfo
+		created []PartitionInfo
+	)
+	s, err := NewStorage(
+		WithDataPath(dir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+		WithOnFlush(func(info FlushInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			flushed = append(flushed, info)
+		}),
+		WithOnPartitionCreated(func(info PartitionInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			created = append(created, info)
+		}),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	for _, ts := range []int64{1600000000, 1600003600, 1600007200} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	s.(*storage).flushWG.Wait()
+	require.NoError(t, s.Flush())
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The head partition opened at first and the one rolled over into, both of which were empty then.
+	assert.Equal(t, []PartitionInfo{{}, {}}, created)
+	require.Len(t, flushed, 1)
+	assert.NoError(t, flushed[0].Err)
+	assert.Equal(t, filepath.Join(dir, "p-1600000000-1600003600"), flushed[0].Dir)
+	assert.Equal(t, int64(1600000000), flushed[0].MinTimestamp)
+	assert.Equal(t, int64(1600003600), flushed[0].MaxTimestamp)
+	assert.Equal(t, int64(2), flushed[0].DataPoints)
+}
+
+func Test_storage_hooks_removed(t *testing.T) {
+	var removed []PartitionInfo
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithPartitionMaxPoints(1),
+		WithMaxInMemoryPartitions(3),
+		WithOnPartitionRemoved(func(info PartitionInfo) {
+			removed = append(removed, info)
+		}),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	for ts := int64(1); ts <= 4; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	s.(*storage).flushWG.Wait()
+	require.NoError(t, s.(*storage).flushPartitions())
+
+	assert.Equal(t, []PartitionInfo{{MinTimestamp: 1, MaxTimestamp: 1, DataPoints: 1}}, removed)
+}
@@ -0,0 +1,69 @@
+package tstorage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// shrinkIfIdle shrinks the buffers of the metric to fit the data points it holds, unless it has got any data point
+// since the last call, and reports whether it did. Buffers of metrics without data points get freed.
+func (m *memoryMetric) shrinkIfIdle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := atomic.LoadInt64(&m.size) + int64(len(m.outOfOrderPoints))
+	idle := n == m.pointsAtLastSweep
+	m.pointsAtLastSweep = n
+	if !idle || (cap(m.points) == len(m.points) && cap(m.outOfOrderPoints) == len(m.outOfOrderPoints)) {
+		return false
+	}
+	m.points = shrinkDataPointRefs(m.points)
+	m.outOfOrderPoints = shrinkDataPointRefs(m.outOfOrderPoints)
+	return true
+}
+
+// shrinkDataPointRefs gives back a copy of the given data points without any spare capacity, which is nil if empty.
+func shrinkDataPointRefs(points []*DataPoint) []*DataPoint {
+	if len(points) == 0 {
+		return nil
+	}
+	if cap(points) == len(points) {
+		return points
+	}
+	shrunk := make([]*DataPoint, len(points))
+	copy(shrunk, points)
+	return shrunk
+}
+
+// shrinkIdleMetrics shrinks buffers of metrics that haven't got any data point since the last call,
+// and gives back the number of metrics shrunk.
+func (m *memoryPartition) shrinkIdleMetrics() int {
+	var n int
+	m.rangeMetrics(func(mt *memoryMetric) bool {
+		if mt.shrinkIfIdle() {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// shrinkIdleSeriesPeriodically shrinks buffers of series in memory partitions that have been idle for
+// the idle series timeout, until the storage gets closed.
+func (s *storage) shrinkIdleSeriesPeriodically() {
+	// Series unchanged between two ticks have been idle for the interval at least.
+	ticker := time.NewTicker(s.idleSeriesTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-ticker.C:
+			iterator := s.partitionList.newIterator()
+			for iterator.next() {
+				if m, ok := iterator.value().(*memoryPartition); ok {
+					m.shrinkIdleMetrics()
+				}
+			}
+		}
+	}
+}
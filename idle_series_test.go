@@ -0,0 +1,64 @@
+package tstorage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_memoryPartition_shrinkIdleMetrics(t *testing.T) {
+	m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	_, err := m.insertRows([]Row{
+		{Metric: "idle", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "idle", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "active", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+	})
+	require.NoError(t, err)
+	// The first sweep only takes the number of data points.
+	assert.Zero(t, m.shrinkIdleMetrics())
+
+	_, err = m.insertRows([]Row{{Metric: "active", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, m.shrinkIdleMetrics())
+	idle, ok := m.lookupMetric("idle")
+	require.True(t, ok)
+	assert.Equal(t, 2, cap(idle.points))
+	assert.Nil(t, idle.outOfOrderPoints)
+	active, ok := m.lookupMetric("active")
+	require.True(t, ok)
+	assert.Equal(t, 1000, cap(active.points))
+	// Nothing left to shrink.
+	assert.Equal(t, 1, m.shrinkIdleMetrics())
+	assert.Zero(t, m.shrinkIdleMetrics())
+
+	// Shrunk ones keep working.
+	_, err = m.insertRows([]Row{
+		{Metric: "idle", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+		{Metric: "idle", DataPoint: DataPoint{Timestamp: 0, Value: 0.4}},
+	})
+	require.NoError(t, err)
+	got, err := m.selectDataPoints(context.Background(), "idle", nil, 0, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 0.1}, {Timestamp: 2, Value: 0.2}, {Timestamp: 3, Value: 0.3}}, got)
+}
+
+func Test_storage_WithIdleSeriesTimeout(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithIdleSeriesTimeout(10*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000}}}))
+	head := s.(*storage).partitionList.getHead().(*memoryPartition)
+	mt, ok := head.lookupMetric(marshalMetricName("metric1", nil))
+	require.True(t, ok)
+	assert.Eventually(t, func() bool {
+		mt.mu.RLock()
+		defer mt.mu.RUnlock()
+		return cap(mt.points) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = NewStorage(WithIdleSeriesTimeout(-1))
+	assert.Error(t, err)
+}
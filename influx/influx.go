@@ -0,0 +1,194 @@
+// Package influx converts the InfluxDB line protocol into rows of tstorage, so that agents speaking it,
+// such as Telegraf, can write into tstorage-based applications.
+//
+// Each line turns into a row for each numeric field, whose metric is the measurement and the field key
+// joined with an underscore. A field keyed "value" takes the measurement as is. Tags become labels.
+// String fields are skipped since they can't be stored as data points.
+package influx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nakabonne/tstorage"
+)
+
+// Parse reads lines of the InfluxDB line protocol from r, and gives back rows converted from them.
+// Empty lines and comments starting with '#' are ignored.
+//
+// Timestamps are put into rows as they are, hence they must be written in the same precision as the storage's.
+// Rows without timestamp have zero, which the storage fills with the current time at insertion.
+func Parse(r io.Reader) ([]tstorage.Row, error) {
+	var rows []tstorage.Row
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read line %d: %w", n, err)
+		}
+		rows, err = appendRows(rows, line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			return rows, nil
+		}
+	}
+}
+
+// ParseLine converts a single line of the InfluxDB line protocol into rows.
+func ParseLine(line string) ([]tstorage.Row, error) {
+	return appendRows(nil, line)
+}
+
+func appendRows(dst []tstorage.Row, line string) ([]tstorage.Row, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if trimmed := strings.TrimSpace(line); trimmed == "" || trimmed[0] == '#' {
+		return dst, nil
+	}
+	// Sections may be separated by more than one space.
+	var sections []string
+	for _, s := range splitUnescaped(line, ' ', true) {
+		if s != "" {
+			sections = append(sections, s)
+		}
+	}
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("line must consist of measurement, fields and optional timestamp: %q", line)
+	}
+
+	series := splitUnescaped(sections[0], ',', false)
+	measurement := unescape(series[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("measurement must be set")
+	}
+	labels := make([]tstorage.Label, 0, len(series)-1)
+	for _, tag := range series[1:] {
+		key, value, err := splitPair(tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %w", tag, err)
+		}
+		labels = append(labels, tstorage.Label{Name: key, Value: value})
+	}
+
+	var timestamp int64
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q: %w", sections[2], err)
+		}
+		timestamp = ts
+	}
+
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		key, raw, err := splitPair(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %q: %w", field, err)
+		}
+		value, ok, err := parseFieldValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of field %q: %w", key, err)
+		}
+		if !ok {
+			continue
+		}
+		metric := measurement
+		if key != "value" {
+			metric = measurement + "_" + key
+		}
+		dst = append(dst, tstorage.Row{
+			Metric:    metric,
+			Labels:    labels,
+			DataPoint: tstorage.DataPoint{Timestamp: timestamp, Value: value},
+		})
+	}
+	return dst, nil
+}
+
+// parseFieldValue gives back the value of the given field as a float, which isn't ok for strings.
+func parseFieldValue(raw string) (value float64, ok bool, err error) {
+	if raw == "" {
+		return 0, false, fmt.Errorf("empty value")
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	switch raw[len(raw)-1] {
+	case '"':
+		if len(raw) < 2 || raw[0] != '"' {
+			return 0, false, fmt.Errorf("unterminated string %s", raw)
+		}
+		return 0, false, nil
+	case 'i':
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return float64(v), err == nil, err
+	case 'u':
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		return float64(v), err == nil, err
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	return v, err == nil, err
+}
+
+// splitPair splits the given key=value at the first unescaped '=', and then unescapes the key.
+// The value is unescaped as well unless it's a quoted string.
+func splitPair(s string) (key, value string, err error) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			key, value = unescape(s[:i]), s[i+1:]
+			if key == "" {
+				return "", "", fmt.Errorf("key must be set")
+			}
+			if !strings.HasPrefix(value, `"`) {
+				value = unescape(value)
+			}
+			return key, value, nil
+		}
+	}
+	return "", "", fmt.Errorf("'=' not found")
+}
+
+// splitUnescaped splits the given string at each separator not escaped with a backslash.
+// Separators within double-quoted values, which follow '=', are kept as well if quoted is true.
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var parts []string
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case quoted && c == '"' && (inQuotes || (i > 0 && s[i-1] == '=')):
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescape removes backslashes escaping the special characters of the line protocol.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`,= \"`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package influx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nakabonne/tstorage"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []tstorage.Row
+		wantErr bool
+	}{
+		{
+			name: "tags and fields",
+			line: "cpu,host=a,region=us usage=0.5,idle=90i 1600000000000000000",
+			want: []tstorage.Row{
+				{
+					Metric:    "cpu_usage",
+					Labels:    []tstorage.Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}},
+					DataPoint: tstorage.DataPoint{Timestamp: 1600000000000000000, Value: 0.5},
+				},
+				{
+					Metric:    "cpu_idle",
+					Labels:    []tstorage.Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}},
+					DataPoint: tstorage.DataPoint{Timestamp: 1600000000000000000, Value: 90},
+				},
+			},
+		},
+		{
+			name: "value field without timestamp",
+			line: "temperature value=21.5",
+			want: []tstorage.Row{
+				{Metric: "temperature", Labels: []tstorage.Label{}, DataPoint: tstorage.DataPoint{Value: 21.5}},
+			},
+		},
+		{
+			name: "escaped characters",
+			line: `my\ cpu,host\=name=a\,b\ c value=1u 1`,
+			want: []tstorage.Row{
+				{
+					Metric:    "my cpu",
+					Labels:    []tstorage.Label{{Name: "host=name", Value: "a,b c"}},
+					DataPoint: tstorage.DataPoint{Timestamp: 1, Value: 1},
+				},
+			},
+		},
+		{
+			name: "strings skipped and booleans",
+			line: `status,host=a message="up, and \"running\"",ok=t 1`,
+			want: []tstorage.Row{
+				{
+					Metric:    "status_ok",
+					Labels:    []tstorage.Label{{Name: "host", Value: "a"}},
+					DataPoint: tstorage.DataPoint{Timestamp: 1, Value: 1},
+				},
+			},
+		},
+		{
+			name: "comment",
+			line: "# cpu value=1",
+		},
+		{
+			name:    "no fields",
+			line:    "cpu,host=a",
+			wantErr: true,
+		},
+		{
+			name:    "invalid field value",
+			line:    "cpu value=abc",
+			wantErr: true,
+		},
+		{
+			name:    "invalid timestamp",
+			line:    "cpu value=1 abc",
+			wantErr: true,
+		},
+		{
+			name:    "tag without value",
+			line:    "cpu,host value=1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	input := "cpu,host=a value=1 1\n\n# comment\r\ncpu,host=b value=2 2\r\nmem value=3 3"
+	got, err := Parse(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	assert.Equal(t, "b", got[1].Labels[0].Value)
+	assert.Equal(t, tstorage.DataPoint{Timestamp: 3, Value: 3}, got[2].DataPoint)
+
+	_, err = Parse(strings.NewReader("cpu value=1 1\ncpu value=x 2\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+}
+
+func TestParse_insert(t *testing.T) {
+	s, err := tstorage.NewStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	rows, err := Parse(strings.NewReader("cpu,host=a usage=0.5 1600000000\ncpu,host=a usage=0.7 1600000001\n"))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows(rows))
+	got, err := s.Select("cpu_usage", []tstorage.Label{{Name: "host", Value: "a"}}, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*tstorage.DataPoint{{Timestamp: 1600000000, Value: 0.5}, {Timestamp: 1600000001, Value: 0.7}}, got)
+}
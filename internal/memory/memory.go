@@ -0,0 +1,27 @@
+package memory
+
+import (
+	"github.com/nakabonne/tstorage/internal/cgroup"
+)
+
+// Total returns the number of bytes of memory available to the process, which is the smaller of
+// the physical memory and the limit of the cgroup. It returns 0 if neither can be determined.
+func Total() int64 {
+	return smaller(sysTotal(), cgroup.GetMemoryLimit())
+}
+
+// Allowed returns the given percent of Total.
+func Allowed(percent float64) int64 {
+	return int64(float64(Total()) * percent / 100)
+}
+
+// smaller returns the smaller of the given sizes, ignoring unknown ones given as 0.
+func smaller(x, y int64) int64 {
+	if x <= 0 {
+		return y
+	}
+	if y <= 0 || x < y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package memory
+
+import "syscall"
+
+func sysTotal() int64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+	return int64(uint64(info.Totalram) * uint64(info.Unit))
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package memory
+
+func sysTotal() int64 {
+	return 0
+}
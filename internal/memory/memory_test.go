@@ -0,0 +1,19 @@
+package memory
+
+import (
+	"testing"
+)
+
+func TestSmaller(t *testing.T) {
+	f := func(x, y, want int64) {
+		t.Helper()
+		if got := smaller(x, y); got != want {
+			t.Fatalf("unexpected result, got: %d, want %d", got, want)
+		}
+	}
+	f(1, 2, 1)
+	f(2, 1, 1)
+	f(0, 2, 2)
+	f(2, 0, 2)
+	f(0, 0, 0)
+}
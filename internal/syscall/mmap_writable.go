@@ -0,0 +1,25 @@
+package syscall
+
+import "errors"
+
+// ErrMmapWritableUnsupported is returned where writable memory mapping is not supported.
+var ErrMmapWritableUnsupported = errors.New("writable memory mapping is not supported on this platform")
+
+// MmapWritable maps the file of the given descriptor into memory with read and write access, so that
+// writes to the returned bytes go to the file. The file must be opened for reading and writing.
+func MmapWritable(fd, length int) ([]byte, error) {
+	return mmapWritable(fd, length)
+}
+
+// Msync flushes changes made to the bytes mapped by MmapWritable to the file, and waits for it.
+func Msync(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return msync(b)
+}
+
+// Munmap unmaps the bytes mapped by Mmap or MmapWritable.
+func Munmap(b []byte) error {
+	return munmap(b)
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!openbsd,!dragonfly
+
+package syscall
+
+func mmapWritable(_, _ int) ([]byte, error) {
+	return nil, ErrMmapWritableUnsupported
+}
+
+func msync(_ []byte) error {
+	return ErrMmapWritableUnsupported
+}
+
+func munmap(_ []byte) error {
+	return ErrMmapWritableUnsupported
+}
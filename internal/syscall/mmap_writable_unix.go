@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd || openbsd || dragonfly
+// +build linux darwin freebsd openbsd dragonfly
+
+package syscall
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func mmapWritable(fd, length int) ([]byte, error) {
+	return syscall.Mmap(
+		fd,
+		0,
+		length,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED,
+	)
+}
+
+func msync(b []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
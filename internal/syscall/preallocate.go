@@ -0,0 +1,9 @@
+package syscall
+
+import "os"
+
+// Preallocate allocates disk space of the given size for the given file without changing its size,
+// so that subsequent writes don't have to allocate blocks. It does nothing where it's not supported.
+func Preallocate(f *os.File, size int64) error {
+	return preallocate(f, size)
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package syscall
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which allocates disk space without changing the file size.
+const fallocKeepSize = 0x1
+
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) {
+		// Preallocation is just an optimization.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,7 @@
+package syscall
+
+// SyncDir commits the entries of the given directory to stable storage, so that files created, renamed or
+// removed in it survive power loss. It does nothing where directories can't be synced.
+func SyncDir(path string) error {
+	return syncDir(path)
+}
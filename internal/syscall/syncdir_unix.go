@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package syscall
+
+import "os"
+
+func syncDir(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package syscall
+
+// Directories can't be opened for syncing on Windows, so just do nothing.
+func syncDir(_ string) error {
+	return nil
+}
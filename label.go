@@ -71,3 +71,40 @@ func marshalMetricName(metric string, labels []Label) string {
 	}
 	return string(out)
 }
+
+// unmarshalMetricName gives back the metric and labels the given name was built from by marshalMetricName.
+func unmarshalMetricName(name string) (string, []Label) {
+	b := []byte(name)
+	if len(b) < 2 {
+		return name, nil
+	}
+	readString := func() (string, bool) {
+		if len(b) < 2 {
+			return "", false
+		}
+		n := int(encoding.UnmarshalUint16(b))
+		if len(b) < 2+n {
+			return "", false
+		}
+		s := string(b[2 : 2+n])
+		b = b[2+n:]
+		return s, true
+	}
+	metric, ok := readString()
+	if !ok {
+		return name, nil
+	}
+	var labels []Label
+	for len(b) > 0 {
+		labelName, ok := readString()
+		if !ok {
+			return name, nil
+		}
+		labelValue, ok := readString()
+		if !ok {
+			return name, nil
+		}
+		labels = append(labels, Label{Name: labelName, Value: labelValue})
+	}
+	return metric, labels
+}
@@ -0,0 +1,324 @@
+package tstorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// indexFileName is the name of the file persisting the label index of a disk partition.
+// Partitions written before it got introduced don't have it, whose index is built from the meta instead.
+const indexFileName = "index"
+
+// indexMagic is put at the head of index files.
+var indexMagic = []byte("TSIDX\x01")
+
+// labelIndex is an inverted index from label name and value to series holding the label, which lets
+// matchers narrow down series without looking into all of them. The metric name is indexed as the label
+// named MetricNameLabel. The zero value is ready to use.
+type labelIndex struct {
+	mu sync.RWMutex
+	// Marshaled names of series, whose indices are IDs of them.
+	series []string
+	// A hash map from label name to a hash map from its value to IDs of series in ascending order.
+	postings map[string]map[string][]uint32
+}
+
+// add indexes the series of the given marshaled name. It must be called only once for a series.
+func (ix *labelIndex) add(name string) {
+	metric, labels := unmarshalMetricName(name)
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	id := uint32(len(ix.series))
+	ix.series = append(ix.series, name)
+	ix.addPosting(MetricNameLabel, metric, id)
+	for _, l := range labels {
+		ix.addPosting(l.Name, l.Value, id)
+	}
+}
+
+// addPosting appends the given ID, which must be greater than the ones given before. It must be called with mu held.
+func (ix *labelIndex) addPosting(labelName, labelValue string, id uint32) {
+	if ix.postings == nil {
+		ix.postings = make(map[string]map[string][]uint32)
+	}
+	values, ok := ix.postings[labelName]
+	if !ok {
+		values = make(map[string][]uint32)
+		ix.postings[labelName] = values
+	}
+	values[labelValue] = append(values[labelValue], id)
+}
+
+// lookup gives back the marshaled names of series that possibly satisfy all the given matchers.
+// Matchers matching the empty value match series without the label as well, which the index
+// can't narrow down, hence the caller still has to match the series given back.
+func (ix *labelIndex) lookup(matchers []Matcher) []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	var ids []uint32
+	narrowed := false
+	for i := range matchers {
+		m := &matchers[i]
+		if m.Matches("") {
+			continue
+		}
+		var matched []uint32
+		if m.Type == MatchEqual {
+			matched = ix.postings[m.Name][m.Value]
+		} else {
+			// A series has only one value for a label, so postings of different values never overlap.
+			for value, postings := range ix.postings[m.Name] {
+				if m.Matches(value) {
+					matched = append(matched, postings...)
+				}
+			}
+			sort.Slice(matched, func(i, j int) bool { return matched[i] < matched[j] })
+		}
+		if narrowed {
+			ids = intersectPostings(ids, matched)
+		} else {
+			ids, narrowed = matched, true
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+	}
+	if !narrowed {
+		return append([]string(nil), ix.series...)
+	}
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, ix.series[id])
+	}
+	return names
+}
+
+// intersectPostings gives back IDs both the given ones in ascending order have.
+func intersectPostings(a, b []uint32) []uint32 {
+	out := make([]uint32, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// newLabelIndex builds an index of the given series, whose IDs are assigned in ascending order of name.
+func newLabelIndex(names []string) *labelIndex {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	ix := &labelIndex{}
+	for _, name := range sorted {
+		ix.add(name)
+	}
+	return ix
+}
+
+// writeIndex writes the given index into the directory.
+// The index file consists of the magic, series names and then postings:
+//
+//	series:   uvarint count, and then uvarint length and bytes of each name
+//	postings: uvarint count of label names, and then for each of them:
+//	          uvarint length and bytes of the name, uvarint count of values, and then for each of them:
+//	          uvarint length and bytes of the value, uvarint count of IDs, and then uvarint deltas of IDs
+func writeIndex(dirPath string, ix *labelIndex) error {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	path := filepath.Join(dirPath, indexFileName)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		w.Write(buf[:n])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		w.WriteString(s)
+	}
+
+	w.Write(indexMagic)
+	putUvarint(uint64(len(ix.series)))
+	for _, name := range ix.series {
+		putString(name)
+	}
+	// Sort to make the file deterministic.
+	labelNames := make([]string, 0, len(ix.postings))
+	for name := range ix.postings {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	putUvarint(uint64(len(labelNames)))
+	for _, name := range labelNames {
+		putString(name)
+		values := make([]string, 0, len(ix.postings[name]))
+		for value := range ix.postings[name] {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		putUvarint(uint64(len(values)))
+		for _, value := range values {
+			putString(value)
+			ids := ix.postings[name][value]
+			putUvarint(uint64(len(ids)))
+			var prev uint32
+			for _, id := range ids {
+				putUvarint(uint64(id - prev))
+				prev = id
+			}
+		}
+	}
+	// Errors of bufio.Writer are sticky, which Flush gives back.
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write index to %s: %w", path, err)
+	}
+	if err := syncFile(f); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// readIndex reads the index file in the given directory.
+func readIndex(dirPath string) (*labelIndex, error) {
+	b, err := os.ReadFile(filepath.Join(dirPath, indexFileName))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, indexMagic) {
+		return nil, fmt.Errorf("unknown index format")
+	}
+	r := bytes.NewReader(b[len(indexMagic):])
+	// Counts are bounded by the remaining bytes since every item takes one byte at least,
+	// so that corrupt ones never lead to huge allocations.
+	readCount := func() (uint64, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, err
+		}
+		if n > uint64(r.Len()) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return n, nil
+	}
+	readString := func() (string, error) {
+		n, err := readCount()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	numSeries, err := readCount()
+	if err != nil {
+		return nil, err
+	}
+	ix := &labelIndex{
+		series:   make([]string, 0, numSeries),
+		postings: make(map[string]map[string][]uint32),
+	}
+	for i := uint64(0); i < numSeries; i++ {
+		name, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		ix.series = append(ix.series, name)
+	}
+	numNames, err := readCount()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numNames; i++ {
+		name, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		numValues, err := readCount()
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string][]uint32, numValues)
+		for j := uint64(0); j < numValues; j++ {
+			value, err := readString()
+			if err != nil {
+				return nil, err
+			}
+			numIDs, err := readCount()
+			if err != nil {
+				return nil, err
+			}
+			ids := make([]uint32, 0, numIDs)
+			var id uint64
+			for k := uint64(0); k < numIDs; k++ {
+				delta, err := binary.ReadUvarint(r)
+				if err != nil {
+					return nil, err
+				}
+				id += delta
+				if id >= numSeries {
+					return nil, fmt.Errorf("series ID %d out of range", id)
+				}
+				ids = append(ids, uint32(id))
+			}
+			values[value] = ids
+		}
+		ix.postings[name] = values
+	}
+	return ix, nil
+}
+
+// labelIndex gives back the index of series in the data file, reading the index file at the first call.
+// It builds one from the meta instead if the index file is missing or broken, since it's redundant.
+func (d *diskPartition) labelIndex() *labelIndex {
+	d.indexOnce.Do(func() {
+		if ix, err := readIndex(d.dirPath); err == nil {
+			d.index = ix
+			return
+		}
+		names := make([]string, 0, len(d.meta.Metrics))
+		for name := range d.meta.Metrics {
+			names = append(names, name)
+		}
+		d.index = newLabelIndex(names)
+	})
+	return d.index
+}
+
+// lookupSeries gives back the marshaled names of series that possibly satisfy all the given matchers,
+// including ones only late data points have.
+func (d *diskPartition) lookupSeries(matchers []Matcher) []string {
+	if err := d.load(); err != nil {
+		return nil
+	}
+	names := d.labelIndex().lookup(matchers)
+	d.late.mu.RLock()
+	defer d.late.mu.RUnlock()
+	for name := range d.late.metrics {
+		if _, ok := d.meta.Metrics[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
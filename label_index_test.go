@@ -0,0 +1,121 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLabelIndex() *labelIndex {
+	return newLabelIndex([]string{
+		marshalMetricName("cpu", []Label{{Name: "host", Value: "a"}}),
+		marshalMetricName("cpu", []Label{{Name: "host", Value: "b"}, {Name: "dc", Value: "x"}}),
+		marshalMetricName("memory", []Label{{Name: "host", Value: "a"}}),
+		"disk",
+	})
+}
+
+func Test_labelIndex_lookup(t *testing.T) {
+	tests := []struct {
+		name     string
+		matchers []Matcher
+		want     []string
+	}{
+		{
+			name:     "equal",
+			matchers: []Matcher{{Type: MatchEqual, Name: "host", Value: "a"}},
+			want: []string{
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "a"}}),
+				marshalMetricName("memory", []Label{{Name: "host", Value: "a"}}),
+			},
+		},
+		{
+			name: "intersection",
+			matchers: []Matcher{
+				{Type: MatchEqual, Name: MetricNameLabel, Value: "cpu"},
+				{Type: MatchRegexp, Name: "dc", Value: "x|y"},
+			},
+			want: []string{marshalMetricName("cpu", []Label{{Name: "host", Value: "b"}, {Name: "dc", Value: "x"}})},
+		},
+		{
+			name:     "no such value",
+			matchers: []Matcher{{Type: MatchEqual, Name: "host", Value: "z"}},
+			want:     nil,
+		},
+		{
+			name:     "matchers matching the empty value never narrow down",
+			matchers: []Matcher{{Type: MatchNotEqual, Name: "host", Value: "a"}},
+			want:     newTestLabelIndex().series,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.matchers {
+				require.NoError(t, tt.matchers[i].compile())
+			}
+			got := newTestLabelIndex().lookup(tt.matchers)
+			assert.ElementsMatch(t, tt.want, got)
+		})
+	}
+}
+
+func Test_writeIndex_readIndex(t *testing.T) {
+	dir := t.TempDir()
+	ix := newTestLabelIndex()
+	require.NoError(t, writeIndex(dir, ix))
+	got, err := readIndex(dir)
+	require.NoError(t, err)
+	assert.Equal(t, ix.series, got.series)
+	assert.Equal(t, ix.postings, got.postings)
+
+	// Broken files never lead to huge allocations.
+	b, err := os.ReadFile(filepath.Join(dir, indexFileName))
+	require.NoError(t, err)
+	broken := append(append([]byte(nil), indexMagic...), 0xff, 0xff, 0xff, 0xff, 0x0f)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, indexFileName), broken, 0o644))
+	_, err = readIndex(dir)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, indexFileName), b[:len(b)-1], 0o644))
+	_, err = readIndex(dir)
+	assert.Error(t, err)
+}
+
+func Test_storage_SelectSeries_diskPartitions(t *testing.T) {
+	tests := []struct {
+		name        string
+		removeIndex bool
+	}{
+		{name: "with index file"},
+		{name: "without index file", removeIndex: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			require.NoError(t, s.InsertRows([]Row{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.2}},
+			}))
+			require.NoError(t, s.Close())
+			paths, err := filepath.Glob(filepath.Join(dir, "p-*", indexFileName))
+			require.NoError(t, err)
+			require.Len(t, paths, 1)
+			if tt.removeIndex {
+				require.NoError(t, os.Remove(paths[0]))
+			}
+
+			s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			defer s.Close()
+			got, err := s.SelectSeries([]Matcher{{Type: MatchRegexp, Name: "host", Value: "b.*"}}, 1600000000, 1600000001)
+			require.NoError(t, err)
+			assert.Equal(t, []Series{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 0.2}}},
+			}, got)
+		})
+	}
+}
@@ -52,3 +52,35 @@ func TestMarshalMetricName(t *testing.T) {
 		})
 	}
 }
+
+func TestUnmarshalMetricName(t *testing.T) {
+	tests := []struct {
+		name       string
+		metric     string
+		labels     []Label
+		wantLabels []Label
+	}{
+		{
+			name:   "only metric",
+			metric: "metric1",
+		},
+		{
+			name:   "invalid labels only",
+			metric: "metric1",
+			labels: []Label{{Name: "name1"}},
+		},
+		{
+			name:       "multiple labels",
+			metric:     "metric1",
+			labels:     []Label{{Name: "b", Value: "2"}, {Name: "a", Value: "1"}},
+			wantLabels: []Label{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metric, labels := unmarshalMetricName(marshalMetricName(tt.metric, tt.labels))
+			assert.Equal(t, tt.metric, metric)
+			assert.Equal(t, tt.wantLabels, labels)
+		})
+	}
+}
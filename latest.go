@@ -0,0 +1,44 @@
+package tstorage
+
+import (
+	"context"
+	"math"
+)
+
+func (s *storage) GetLatest(metric string, labels []Label) (*DataPoint, error) {
+	if s.closed.Load() {
+		return nil, ErrClosed
+	}
+	if metric == "" {
+		return nil, ErrEmptyMetric
+	}
+	if s.tombstones.isEmpty() {
+		// The newest partition holding the series has the latest data point, since older partitions
+		// only accept data points older than all of the newer one.
+		name := marshalMetricName(metric, labels)
+		iterator := s.partitionList.newIterator()
+		for iterator.next() {
+			m, ok := iterator.value().(*memoryPartition)
+			if !ok {
+				break
+			}
+			mt, ok := m.lookupMetric(name)
+			if !ok {
+				continue
+			}
+			if latest, ok := mt.latestPoint(); ok {
+				return latest, nil
+			}
+			break
+		}
+	}
+	// Select on this storage directly, since routing to rollups by the start doesn't make sense here.
+	ctx, cancel := s.newQueryContext(context.Background(), []SelectOption{SelectLimit(1)})
+	defer cancel()
+	points, err := s.selectDataPoints(ctx, metric, labels, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		s.reportCorruption(err)
+		return nil, queryError(err)
+	}
+	return points[0], nil
+}
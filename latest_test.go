@@ -0,0 +1,69 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_GetLatest(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "in-memory",
+		},
+		{
+			name: "compressed head",
+			opts: []Option{WithCompressedHead()},
+		},
+		{
+			name: "on disk",
+			opts: []Option{WithDataPath(t.TempDir())},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(append([]Option{WithTimestampPrecision(Seconds), WithPartitionMaxPoints(2)}, tt.opts...)...)
+			require.NoError(t, err)
+			defer s.Close()
+			labels := []Label{{Name: "host", Value: "host-1"}}
+			for ts := int64(1600000000); ts < 1600000005; ts++ {
+				require.NoError(t, s.InsertRows([]Row{
+					{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}},
+				}))
+			}
+			// Newer partitions hold only another series.
+			require.NoError(t, s.InsertRows([]Row{
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000005}},
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000006}},
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000007}},
+			}))
+			s.(*storage).flushWG.Wait()
+
+			got, err := s.GetLatest("metric1", labels)
+			require.NoError(t, err)
+			assert.Equal(t, &DataPoint{Timestamp: 1600000004, Value: 1600000004}, got)
+
+			// An out-of-order data point sharing the timestamp was written last.
+			require.NoError(t, s.InsertRows([]Row{
+				{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000004, Value: 1}},
+			}))
+			got, err = s.GetLatest("metric1", labels)
+			require.NoError(t, err)
+			assert.Equal(t, &DataPoint{Timestamp: 1600000004, Value: 1}, got)
+
+			require.NoError(t, s.Delete("metric1", labels, 1600000003, 1600000005))
+			got, err = s.GetLatest("metric1", labels)
+			require.NoError(t, err)
+			assert.Equal(t, &DataPoint{Timestamp: 1600000002, Value: 1600000002}, got)
+
+			_, err = s.GetLatest("metric1", nil)
+			assert.ErrorIs(t, err, ErrNoDataPoints)
+			_, err = s.GetLatest("", nil)
+			assert.ErrorIs(t, err, ErrEmptyMetric)
+		})
+	}
+}
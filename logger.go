@@ -1,15 +1,83 @@
 package tstorage
 
-// TODO: Think about another abstraction way
+import (
+	"fmt"
+	"strings"
+)
 
 // Logger is a logging interface
 type Logger interface {
 	Printf(format string, v ...interface{})
 }
 
+// LeveledLogger is a structured logging interface with severities, where keyvals are alternating keys and
+// values giving the context of the message, such as "err", err. *slog.Logger satisfies it as is, and other
+// structured loggers such as zap's SugaredLogger do with a thin wrapper. Give it to WithLogger via Leveled.
+type LeveledLogger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Leveled adapts the given leveled logger to Logger, so that WithLogger accepts it. The storage logs to it at
+// the severity of each message, such as Error for flush failures and Warn for dropped rows.
+func Leveled(logger LeveledLogger) Logger {
+	return &leveledLogger{LeveledLogger: logger}
+}
+
+type leveledLogger struct {
+	LeveledLogger
+}
+
+// Printf logs at Info, for those using the adapter as a Logger.
+func (l *leveledLogger) Printf(format string, v ...interface{}) {
+	l.Info(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+// printfLogger gives leveled messages to a Logger only having Printf, prefixed with their severity and
+// followed by their keys and values, e.g. "ERROR failed to sync WAL err=...".
+type printfLogger struct {
+	Logger
+}
+
+func (l *printfLogger) Debug(msg string, keyvals ...interface{}) { l.log("DEBUG", msg, keyvals) }
+func (l *printfLogger) Info(msg string, keyvals ...interface{})  { l.log("INFO", msg, keyvals) }
+func (l *printfLogger) Warn(msg string, keyvals ...interface{})  { l.log("WARN", msg, keyvals) }
+func (l *printfLogger) Error(msg string, keyvals ...interface{}) { l.log("ERROR", msg, keyvals) }
+
+func (l *printfLogger) log(level, msg string, keyvals []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=", keyvals[i])
+		if i+1 < len(keyvals) {
+			fmt.Fprint(&b, keyvals[i+1])
+		} else {
+			b.WriteString("(MISSING)")
+		}
+	}
+	l.Printf("%s\n", b.String())
+}
+
+// leveledFrom gives back the leveled logger the storage logs to, out of the one given by WithLogger.
+func leveledFrom(logger Logger) LeveledLogger {
+	if l, ok := logger.(LeveledLogger); ok {
+		return l
+	}
+	return &printfLogger{Logger: logger}
+}
+
 type nopLogger struct{}
 
 func (l *nopLogger) Printf(_ string, _ ...interface{}) {
 	// Do nothing
 	return
 }
+
+func (l *nopLogger) Debug(_ string, _ ...interface{}) {}
+func (l *nopLogger) Info(_ string, _ ...interface{})  {}
+func (l *nopLogger) Warn(_ string, _ ...interface{})  {}
+func (l *nopLogger) Error(_ string, _ ...interface{}) {}
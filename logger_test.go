@@ -0,0 +1,71 @@
+package tstorage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) { l.log("debug", msg, keyvals) }
+func (l *recordingLogger) Info(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals) }
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{})  { l.log("warn", msg, keyvals) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.log("error", msg, keyvals) }
+
+func (l *recordingLogger) log(level, msg string, keyvals []interface{}) {
+	l.Printf("%s: %s %v", level, msg, keyvals)
+}
+
+func Test_printfLogger(t *testing.T) {
+	l := &recordingLogger{}
+	// Hide the leveled methods.
+	leveled := leveledFrom(struct{ Logger }{l})
+	leveled.Error("failed to sync WAL", "err", fmt.Errorf("disk full"), "segment")
+	leveled.Info("warmed up disk partitions", "pages", 3)
+	assert.Equal(t, []string{
+		"ERROR failed to sync WAL err=disk full segment=(MISSING)\n",
+		"INFO warmed up disk partitions pages=3\n",
+	}, l.lines)
+}
+
+func TestLeveled(t *testing.T) {
+	l := &recordingLogger{}
+	logger := Leveled(l)
+	leveledFrom(logger).Warn("dropped rows", "rows", 2)
+	logger.Printf("verbose %d\n", 1)
+	assert.Equal(t, []string{"warn: dropped rows [rows 2]", "info: verbose 1 []"}, l.lines)
+}
+
+func Test_storage_logDroppedRows(t *testing.T) {
+	l := &recordingLogger{}
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithLogger(Leveled(l)))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000}}}))
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1500000000}}}))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	assert.Condition(t, func() bool {
+		for _, line := range l.lines {
+			if strings.HasPrefix(line, "warn: dropped rows older than all partitions [rows 1]") {
+				return true
+			}
+		}
+		return false
+	}, "lines: %v", l.lines)
+}
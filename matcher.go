@@ -0,0 +1,239 @@
+package tstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// MetricNameLabel is the label name matchers use to match the metric name.
+const MetricNameLabel = "__name__"
+
+// MatchType is the operator a Matcher uses to match label values.
+type MatchType int
+
+const (
+	// MatchEqual matches values equal to the given one.
+	MatchEqual MatchType = iota
+	// MatchNotEqual matches values not equal to the given one.
+	MatchNotEqual
+	// MatchRegexp matches values the given regular expression fully matches.
+	MatchRegexp
+	// MatchNotRegexp matches values the given regular expression doesn't fully match.
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	default:
+		return fmt.Sprintf("MatchType(%d)", int(t))
+	}
+}
+
+// Matcher matches series whose label of the name has a value satisfying the operator.
+// A series without the label is taken as having the empty value, hence MatchNotEqual with
+// a non-empty value matches series without the label. Give MetricNameLabel as the name
+// to match the metric name.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	// compiled from Value for regular expression types.
+	re *regexp.Regexp
+}
+
+// NewMatcher gives back a Matcher, which fails if the value is an invalid regular expression
+// for regular expression types.
+func NewMatcher(t MatchType, name, value string) (Matcher, error) {
+	m := Matcher{Type: t, Name: name, Value: value}
+	if err := m.compile(); err != nil {
+		return Matcher{}, err
+	}
+	return m, nil
+}
+
+// compile validates the matcher, and then compiles the regular expression if not yet.
+func (m *Matcher) compile() error {
+	if m.Name == "" {
+		return fmt.Errorf("label name of matcher must be set")
+	}
+	switch m.Type {
+	case MatchEqual, MatchNotEqual:
+		return nil
+	case MatchRegexp, MatchNotRegexp:
+		if m.re != nil {
+			return nil
+		}
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid regular expression of matcher for %q: %w", m.Name, err)
+		}
+		m.re = re
+		return nil
+	default:
+		return fmt.Errorf("unknown match type %d", int(m.Type))
+	}
+}
+
+// Matches reports whether the given label value satisfies the matcher.
+func (m *Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re != nil && m.re.MatchString(value)
+	case MatchNotRegexp:
+		return m.re != nil && !m.re.MatchString(value)
+	default:
+		return false
+	}
+}
+
+func (m Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+// matchesSeries reports whether the series of the given metric and labels satisfies all matchers.
+func matchesSeries(matchers []Matcher, metric string, labels []Label) bool {
+	for i := range matchers {
+		m := &matchers[i]
+		var value string
+		if m.Name == MetricNameLabel {
+			value = metric
+		} else {
+			for j := range labels {
+				if labels[j].Name == m.Name {
+					value = labels[j].Value
+					break
+				}
+			}
+		}
+		if !m.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Series is a series of data points along with the metric and labels identifying it.
+type Series struct {
+	Metric string
+	// Labels are in ascending order of name.
+	Labels     []Label
+	DataPoints []*DataPoint
+}
+
+func (s *storage) SelectSeries(matchers []Matcher, start, end int64, opts ...SelectOption) ([]Series, error) {
+	if s.closed.Load() {
+		return nil, ErrClosed
+	}
+	defer s.metrics.queryDuration.observeSince(time.Now())
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("at least one matcher must be given")
+	}
+	if start >= end {
+		return nil, errInvalidRange(start, end)
+	}
+	// Compile copies not to modify the given ones.
+	compiled := make([]Matcher, len(matchers))
+	copy(compiled, matchers)
+	for i := range compiled {
+		if err := compiled[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := s.newQueryContext(context.Background(), opts)
+	defer cancel()
+	var series []Series
+	for _, name := range s.lookupSeries(compiled, start, end) {
+		if err := ctx.Err(); err != nil {
+			return nil, queryError(err)
+		}
+		metric, labels := unmarshalMetricName(name)
+		if !matchesSeries(compiled, metric, labels) {
+			continue
+		}
+		points, err := s.selectDataPoints(ctx, metric, labels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			s.reportCorruption(err)
+			return nil, queryError(err)
+		}
+		series = append(series, Series{Metric: metric, Labels: labels, DataPoints: points})
+	}
+	if len(series) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return lessSeries(&series[i], &series[j])
+	})
+	return series, nil
+}
+
+// lessSeries reports whether a precedes b in ascending order of metric, and then labels.
+func lessSeries(a, b *Series) bool {
+	if a.Metric != b.Metric {
+		return a.Metric < b.Metric
+	}
+	for i := 0; i < len(a.Labels) && i < len(b.Labels); i++ {
+		if a.Labels[i].Name != b.Labels[i].Name {
+			return a.Labels[i].Name < b.Labels[i].Name
+		}
+		if a.Labels[i].Value != b.Labels[i].Value {
+			return a.Labels[i].Value < b.Labels[i].Value
+		}
+	}
+	return len(a.Labels) < len(b.Labels)
+}
+
+// lookupSeries gives back the marshaled names of series in partitions overlapping the given range that
+// possibly satisfy all the given matchers, looking them up with the label index of each partition.
+// User-defined partitions are never looked into since they can't list series.
+func (s *storage) lookupSeries(matchers []Matcher, start, end int64) []string {
+	seen := make(map[string]struct{})
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		part := iterator.value()
+		if part == nil || (!unopened(part) && part.size() == 0) {
+			continue
+		}
+		if part.maxTimestamp() < start {
+			break
+		}
+		if part.minTimestamp() >= end {
+			continue
+		}
+		switch p := part.(type) {
+		case *memoryPartition:
+			for _, name := range p.index.lookup(matchers) {
+				seen[name] = struct{}{}
+			}
+		case *diskPartition:
+			for _, name := range p.lookupSeries(matchers) {
+				seen[name] = struct{}{}
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	return names
+}
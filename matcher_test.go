@@ -0,0 +1,107 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcher_Matches(t *testing.T) {
+	tests := []struct {
+		name      string
+		matchType MatchType
+		value     string
+		target    string
+		want      bool
+	}{
+		{name: "equal", matchType: MatchEqual, value: "a", target: "a", want: true},
+		{name: "not equal to the same", matchType: MatchNotEqual, value: "a", target: "a", want: false},
+		{name: "not equal to missing", matchType: MatchNotEqual, value: "a", target: "", want: true},
+		{name: "regexp", matchType: MatchRegexp, value: "a|b", target: "b", want: true},
+		{name: "regexp is anchored", matchType: MatchRegexp, value: "a", target: "ab", want: false},
+		{name: "not regexp", matchType: MatchNotRegexp, value: "a.*", target: "ba", want: true},
+		{name: "not regexp matching", matchType: MatchNotRegexp, value: "a.*", target: "ab", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMatcher(tt.matchType, "host", tt.value)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, m.Matches(tt.target))
+		})
+	}
+}
+
+func TestNewMatcher_invalid(t *testing.T) {
+	_, err := NewMatcher(MatchRegexp, "host", "(")
+	assert.Error(t, err)
+	_, err = NewMatcher(MatchEqual, "", "a")
+	assert.Error(t, err)
+}
+
+func Test_storage_SelectSeries(t *testing.T) {
+	s, err := NewStorage(WithDataPath(t.TempDir()), WithTimestampPrecision(Seconds), WithPartitionMaxPoints(2))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.2}},
+	}))
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "c"}, {Name: "dc", Value: "x"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.3}},
+		{Metric: "memory", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.4}},
+	}))
+
+	tests := []struct {
+		name     string
+		matchers []Matcher
+		want     []Series
+		wantErr  error
+	}{
+		{
+			name:     "by metric name",
+			matchers: []Matcher{{Type: MatchEqual, Name: MetricNameLabel, Value: "memory"}},
+			want: []Series{
+				{Metric: "memory", Labels: []Label{{Name: "host", Value: "a"}}, DataPoints: []*DataPoint{{Timestamp: 1600000001, Value: 0.4}}},
+			},
+		},
+		{
+			name: "by regexp and not equal",
+			matchers: []Matcher{
+				{Type: MatchEqual, Name: MetricNameLabel, Value: "cpu"},
+				{Type: MatchRegexp, Name: "host", Value: "a|c"},
+				{Type: MatchNotEqual, Name: "dc", Value: "y"},
+			},
+			want: []Series{
+				{Metric: "cpu", Labels: []Label{{Name: "dc", Value: "x"}, {Name: "host", Value: "c"}}, DataPoints: []*DataPoint{{Timestamp: 1600000001, Value: 0.3}}},
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}},
+			},
+		},
+		{
+			name:     "by not regexp across metrics",
+			matchers: []Matcher{{Type: MatchNotRegexp, Name: "host", Value: "[ac]"}},
+			want: []Series{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoints: []*DataPoint{{Timestamp: 1600000000, Value: 0.2}}},
+			},
+		},
+		{
+			name:     "no series",
+			matchers: []Matcher{{Type: MatchEqual, Name: "host", Value: "z"}},
+			wantErr:  ErrNoDataPoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SelectSeries(tt.matchers, 1600000000, 1600000002)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = s.SelectSeries([]Matcher{{Type: MatchRegexp, Name: "host", Value: "("}}, 1600000000, 1600000002)
+	assert.Error(t, err)
+}
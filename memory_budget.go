@@ -0,0 +1,75 @@
+package tstorage
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// memoryBudgetCheckInterval is the interval the memory usage gets checked against the budget at.
+const memoryBudgetCheckInterval = time.Second
+
+// memoryUsage gives back the approximate number of bytes memory partitions and mapped data files take,
+// along with disk partitions whose data files are mapped.
+func (s *storage) memoryUsage() (int64, []*diskPartition) {
+	var used int64
+	var mapped []*diskPartition
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		switch p := iterator.value().(type) {
+		case *memoryPartition:
+			used += int64(p.size()) * memoryPointSize
+		case *diskPartition:
+			if n := p.mappedSize(); n > 0 {
+				used += n
+				mapped = append(mapped, p)
+			}
+		}
+	}
+	return used, mapped
+}
+
+// enforceMemoryBudget unmaps data files of disk partitions from the least recently used one while the memory usage
+// exceeds the budget. Memory partitions are never evicted, hence the usage may stay over the budget.
+func (s *storage) enforceMemoryBudget() error {
+	used, mapped := s.memoryUsage()
+	if used <= s.memoryBudget {
+		return nil
+	}
+	lastUsed := make(map[*diskPartition]int64, len(mapped))
+	for _, d := range mapped {
+		lastUsed[d] = atomic.LoadInt64(&d.lastUsed)
+	}
+	sort.Slice(mapped, func(i, j int) bool {
+		return lastUsed[mapped[i]] < lastUsed[mapped[j]]
+	})
+	for _, d := range mapped {
+		if used <= s.memoryBudget {
+			break
+		}
+		unmapped, err := d.unmap()
+		if err != nil {
+			return err
+		}
+		if unmapped {
+			used -= d.dataSize
+		}
+	}
+	return nil
+}
+
+// enforceMemoryBudgetPeriodically keeps the memory usage within the budget until the storage gets closed.
+func (s *storage) enforceMemoryBudgetPeriodically() {
+	ticker := time.NewTicker(memoryBudgetCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-ticker.C:
+			if err := s.enforceMemoryBudget(); err != nil {
+				s.logger.Warn("failed to keep memory usage within the budget", "err", err)
+			}
+		}
+	}
+}
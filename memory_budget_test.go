@@ -0,0 +1,53 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_enforceMemoryBudget(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionMaxPoints(1))
+	require.NoError(t, err)
+	for ts := int64(1600000000); ts < 1600000003; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}}}))
+	}
+	require.NoError(t, s.Close())
+
+	st, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer st.Close()
+	s = st
+	// Query from the newest one, so that it's the least recently used one.
+	var parts []*diskPartition
+	for ts := int64(1600000002); ts >= 1600000000; ts-- {
+		_, err := s.Select("metric1", nil, ts, ts+1)
+		require.NoError(t, err)
+	}
+	iterator := st.(*storage).partitionList.newIterator()
+	for iterator.next() {
+		if d, ok := iterator.value().(*diskPartition); ok {
+			parts = append(parts, d)
+		}
+	}
+	require.Len(t, parts, 3)
+	used, mappedParts := st.(*storage).memoryUsage()
+	assert.Len(t, mappedParts, 3)
+	// The budget holds all but the newest one.
+	st.(*storage).memoryBudget = used - 1
+	require.NoError(t, st.(*storage).enforceMemoryBudget())
+	assert.False(t, mapped(parts[0]))
+	assert.True(t, mapped(parts[1]))
+	assert.True(t, mapped(parts[2]))
+
+	s, err = NewStorage(WithAllowedMemoryPercent(50))
+	require.NoError(t, err)
+	assert.Positive(t, s.(*storage).memoryBudget)
+	require.NoError(t, s.Close())
+	_, err = NewStorage(WithMaxMemoryBytes(-1))
+	assert.Error(t, err)
+	_, err = NewStorage(WithAllowedMemoryPercent(101))
+	assert.Error(t, err)
+}
@@ -0,0 +1,145 @@
+package tstorage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// compressedChunkSize is the number of data points at which the open chunk of compressedPoints gets sealed.
+// Sealed chunks allow to skip decoding data points out of the range to be selected.
+const compressedChunkSize = 120
+
+// compressedPoints holds in-order data points of a metric Gorilla-encoded in heap, which takes
+// a fraction of the memory raw data points take at the cost of decoding them on every read.
+// Data points are appended to the open chunk, which gets sealed once it gets full.
+// It is not goroutine safe; the caller has to lock it.
+type compressedPoints struct {
+	sealed []compressedChunk
+	// the chunk being appended to
+	open    compressedChunk
+	encoder *gorillaEncoder
+}
+
+// compressedChunk is a run of Gorilla-encoded data points.
+type compressedChunk struct {
+	data          []byte
+	minTimestamp  int64
+	maxTimestamp  int64
+	numDataPoints int
+}
+
+func newCompressedMemoryMetric(name string) *memoryMetric {
+	return &memoryMetric{
+		name:             name,
+		compressed:       newCompressedPoints(),
+		outOfOrderPoints: make([]*DataPoint, 0),
+	}
+}
+
+func newCompressedPoints() *compressedPoints {
+	return &compressedPoints{
+		encoder: &gorillaEncoder{
+			// Bytes are taken from the buffer directly instead.
+			w:   io.Discard,
+			buf: &bstream{stream: make([]byte, 0)},
+		},
+	}
+}
+
+// append encodes the given point, which must be newer than all points held.
+func (c *compressedPoints) append(point *DataPoint) error {
+	if err := c.encoder.encodePoint(point); err != nil {
+		return err
+	}
+	if c.open.numDataPoints == 0 {
+		c.open.minTimestamp = point.Timestamp
+	}
+	c.open.maxTimestamp = point.Timestamp
+	c.open.numDataPoints++
+	if c.open.numDataPoints < compressedChunkSize {
+		return nil
+	}
+	// Copy to get rid of the spare capacity the buffer has.
+	c.open.data = append([]byte(nil), c.encoder.buf.bytes()...)
+	c.sealed = append(c.sealed, c.open)
+	c.open = compressedChunk{}
+	return c.encoder.flush()
+}
+
+// appendPoints decodes data points within the given range, and then appends them to dst.
+func (c *compressedPoints) appendPoints(dst []DataPoint, start, end int64) ([]DataPoint, error) {
+	var err error
+	for _, chunk := range c.chunks() {
+		if chunk.numDataPoints == 0 || chunk.maxTimestamp < start || chunk.minTimestamp >= end {
+			continue
+		}
+		n := len(dst)
+		if dst, err = chunk.appendAll(dst); err != nil {
+			return dst[:n], err
+		}
+		// Drop data points out of the range, which are at both ends since they are in order.
+		ps := dst[n:]
+		i := sort.Search(len(ps), func(i int) bool { return ps[i].Timestamp >= start })
+		j := sort.Search(len(ps), func(j int) bool { return ps[j].Timestamp >= end })
+		dst = append(dst[:n], ps[i:j]...)
+	}
+	return dst, nil
+}
+
+// appendAll decodes all data points, and then appends them to dst.
+func (c *compressedPoints) appendAll(dst []DataPoint) ([]DataPoint, error) {
+	var err error
+	for _, chunk := range c.chunks() {
+		if dst, err = chunk.appendAll(dst); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// countPoints gives back the number of data points within the given range. Only chunks partially
+// overlapping the range get decoded.
+func (c *compressedPoints) countPoints(start, end int64) (int64, error) {
+	var n int64
+	var buf []DataPoint
+	for _, chunk := range c.chunks() {
+		if chunk.numDataPoints == 0 || chunk.maxTimestamp < start || chunk.minTimestamp >= end {
+			continue
+		}
+		if chunk.minTimestamp >= start && chunk.maxTimestamp < end {
+			n += int64(chunk.numDataPoints)
+			continue
+		}
+		var err error
+		if buf, err = chunk.appendAll(buf[:0]); err != nil {
+			return 0, err
+		}
+		for _, p := range buf {
+			if p.Timestamp >= start && p.Timestamp < end {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// chunks gives back all chunks including the open one.
+func (c *compressedPoints) chunks() []compressedChunk {
+	open := c.open
+	open.data = c.encoder.buf.bytes()
+	return append(c.sealed[:len(c.sealed):len(c.sealed)], open)
+}
+
+// appendAll decodes all data points in the chunk, and then appends them to dst.
+func (c *compressedChunk) appendAll(dst []DataPoint) ([]DataPoint, error) {
+	decoder := &gorillaDecoder{br: newBReader(c.data)}
+	var point DataPoint
+	for i := 0; i < c.numDataPoints; i++ {
+		if err := decoder.decodePoint(&point); err != nil {
+			return dst, fmt.Errorf("failed to decode point: %w", err)
+		}
+		dst = append(dst, point)
+	}
+	return dst, nil
+}
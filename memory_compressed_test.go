@@ -0,0 +1,101 @@
+package tstorage
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_compressedPoints(t *testing.T) {
+	c := newCompressedPoints()
+	want := make([]DataPoint, 0, 300)
+	for i := 0; i < 300; i++ {
+		p := DataPoint{Timestamp: int64(i*10 + i%3), Value: float64(i) * 0.5}
+		require.NoError(t, c.append(&p))
+		want = append(want, p)
+	}
+	assert.Len(t, c.sealed, 300/compressedChunkSize)
+
+	got, err := c.appendAll(nil)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	tests := []struct {
+		name       string
+		start, end int64
+		want       []DataPoint
+	}{
+		{name: "all", start: math.MinInt64, end: math.MaxInt64, want: want},
+		{name: "across chunks", start: 1000, end: 2500, want: want[100:250]},
+		{name: "within the open chunk", start: 2900, end: 2950, want: want[290:295]},
+		{name: "out of range", start: 5000, end: 6000, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.appendPoints([]DataPoint{{Timestamp: -1}}, tt.start, tt.end)
+			require.NoError(t, err)
+			assert.Equal(t, append([]DataPoint{{Timestamp: -1}}, tt.want...), got)
+		})
+	}
+}
+
+func Test_memoryPartition_compressed(t *testing.T) {
+	m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	m.compressed = true
+	_, err := m.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 4, Value: 0.4}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 4, m.size())
+
+	// The out-of-order one gets merged in.
+	got, err := m.selectDataPoints(context.Background(), "metric1", nil, 1, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 0.1}, {Timestamp: 2, Value: 0.2}, {Timestamp: 3, Value: 0.3}}, got)
+	gotValues, err := m.appendDataPoints(context.Background(), nil, "metric1", nil, 3, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []DataPoint{{Timestamp: 3, Value: 0.3}, {Timestamp: 4, Value: 0.4}}, gotValues)
+
+	mt, ok := m.lookupMetric("metric1")
+	require.True(t, ok)
+	var encoded []DataPoint
+	encoder := fakeEncoder{encodePointFunc: func(p *DataPoint) error {
+		encoded = append(encoded, *p)
+		return nil
+	}}
+	require.NoError(t, mt.encodeAllPoints(&encoder))
+	assert.Equal(t, []DataPoint{
+		{Timestamp: 1, Value: 0.1},
+		{Timestamp: 2, Value: 0.2},
+		{Timestamp: 3, Value: 0.3},
+		{Timestamp: 4, Value: 0.4},
+	}, encoded)
+}
+
+func Test_storage_WithCompressedHead(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithCompressedHead())
+	require.NoError(t, err)
+	for i := int64(1); i <= 500; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}}}))
+	}
+	got, err := s.Select("metric1", nil, 1600000100, 1600000200)
+	require.NoError(t, err)
+	require.Len(t, got, 100)
+	assert.Equal(t, &DataPoint{Timestamp: 1600000100, Value: 100}, got[0])
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	got, err = s.Select("metric1", nil, 1600000001, 1600000501)
+	require.NoError(t, err)
+	assert.Len(t, got, 500)
+}
@@ -1,11 +1,15 @@
 package tstorage
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 // A memoryPartition implements a partition to store data points on heap.
@@ -13,42 +17,73 @@ import (
 type memoryPartition struct {
 	// The number of data points
 	numPoints int64
+	// The number of series
+	numSeries int64
 	// minT is immutable.
 	minT int64
 	maxT int64
 
-	// A hash map from metric name to memoryMetric.
-	metrics sync.Map
+	// Metrics sharded by the hash of their name, so that writers of distinct metrics rarely contend.
+	shards [metricShardsNum]metricShard
 
 	// Write ahead log.
 	wal wal
 	// The timestamp range of partitions after which they get persisted
-	partitionDuration  int64
+	partitionDuration int64
+	// The number of data points after which it gets persisted. Zero means no limit.
+	maxPoints          int64
 	timestampPrecision TimestampPrecision
 	once               sync.Once
+	// Whether to hold data points Gorilla-encoded. See WithCompressedHead.
+	compressed bool
+
+	// Inverted index of series held, to which they get added on creation.
+	index labelIndex
+	// The in-memory mode applies the retention from it.
+	createdAt time.Time
+}
+
+// metricShardsNum is the number of shards of metrics in a memory partition, which must be a power of two.
+const metricShardsNum = 256
+
+// metricShard holds part of the metrics in a memory partition.
+type metricShard struct {
+	mu sync.RWMutex
+	// A hash map from the hash of metric name to memoryMetric.
+	// Keying by the 64-bit hash instead of the marshaled name, which can be long
+	// for label-heavy series, saves both memory and the cost of comparison.
+	metrics map[uint64]*memoryMetric
+	// A hash map from metric name to memoryMetric, which holds only metrics
+	// whose hash collides with the one of another metric held in metrics.
+	collidedMetrics map[string]*memoryMetric
+}
+
+// lookup gives back the metric with the given name and its hash. It must be called with mu held.
+func (s *metricShard) lookup(hash uint64, name string) (*memoryMetric, bool) {
+	mt, ok := s.metrics[hash]
+	if !ok {
+		return nil, false
+	}
+	if mt.name == name {
+		return mt, true
+	}
+	mt, ok = s.collidedMetrics[name]
+	return mt, ok
 }
 
+// memoryPointSize is the approximate number of bytes a data point occupies in memory partitions,
+// which consists of DataPoint itself and the pointer to it.
+const memoryPointSize = 24
+
 func newMemoryPartition(wal wal, partitionDuration time.Duration, precision TimestampPrecision) partition {
 	if wal == nil {
 		wal = &nopWAL{}
 	}
-	var d int64
-	switch precision {
-	case Nanoseconds:
-		d = partitionDuration.Nanoseconds()
-	case Microseconds:
-		d = partitionDuration.Microseconds()
-	case Milliseconds:
-		d = partitionDuration.Milliseconds()
-	case Seconds:
-		d = int64(partitionDuration.Seconds())
-	default:
-		d = partitionDuration.Nanoseconds()
-	}
 	return &memoryPartition{
-		partitionDuration:  d,
+		partitionDuration:  toPrecision(partitionDuration, precision),
 		wal:                wal,
 		timestampPrecision: precision,
+		createdAt:          time.Now(),
 	}
 }
 
@@ -57,42 +92,46 @@ func (m *memoryPartition) insertRows(rows []Row) ([]Row, error) {
 	if len(rows) == 0 {
 		return nil, fmt.Errorf("no rows given")
 	}
-	// FIXME: Just emitting log is enough
-	err := m.wal.append(operationInsert, rows)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write to WAL: %w", err)
-	}
-
 	// Set min timestamp at only first.
 	m.once.Do(func() {
-		min := rows[0].Timestamp
+		min, max := rows[0].Timestamp, rows[0].Timestamp
 		for i := range rows {
 			row := rows[i]
 			if row.Timestamp < min {
 				min = row.Timestamp
 			}
+			if row.Timestamp > max {
+				max = row.Timestamp
+			}
 		}
 		atomic.StoreInt64(&m.minT, min)
+		// The initial max must be given as well since timestamps can be negative.
+		atomic.StoreInt64(&m.maxT, max)
 	})
 
-	outdatedRows := make([]Row, 0)
+	rows, outdatedRows := splitOutdatedRows(rows, m.minTimestamp())
+	if len(rows) == 0 {
+		return outdatedRows, nil
+	}
+	// Only rows held by the partition get logged, so that each row is in the WAL once. Outdated rows are
+	// logged by the memory partition accepting them, or made durable by the late file of a disk partition.
+	if err := m.wal.append(operationInsert, rows); err != nil {
+		return nil, fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
 	maxTimestamp := rows[0].Timestamp
 	var rowsNum int64
 	for i := range rows {
 		row := rows[i]
-		if row.Timestamp < m.minTimestamp() {
-			outdatedRows = append(outdatedRows, row)
-			continue
-		}
-		if row.Timestamp == 0 {
-			row.Timestamp = toUnix(time.Now(), m.timestampPrecision)
-		}
 		if row.Timestamp > maxTimestamp {
 			maxTimestamp = row.Timestamp
 		}
 		name := marshalMetricName(row.Metric, row.Labels)
 		mt := m.getMetric(name)
-		mt.insertPoint(&row.DataPoint)
+		if err := mt.insertPoint(&row.DataPoint); err != nil {
+			atomic.AddInt64(&m.numPoints, rowsNum)
+			return nil, fmt.Errorf("failed to insert a data point that metric is %q: %w", row.Metric, err)
+		}
 		rowsNum++
 	}
 	atomic.AddInt64(&m.numPoints, rowsNum)
@@ -105,6 +144,27 @@ func (m *memoryPartition) insertRows(rows []Row) ([]Row, error) {
 	return outdatedRows, nil
 }
 
+// splitOutdatedRows splits the given rows into ones not older than minT and the others, keeping their order.
+// The given slice is given back as is if none is older.
+func splitOutdatedRows(rows []Row, minT int64) (accepted, outdated []Row) {
+	for i := range rows {
+		if rows[i].Timestamp >= minT {
+			continue
+		}
+		accepted = append(make([]Row, 0, len(rows)), rows[:i]...)
+		outdated = make([]Row, 0, len(rows)-i)
+		for j := i; j < len(rows); j++ {
+			if rows[j].Timestamp < minT {
+				outdated = append(outdated, rows[j])
+			} else {
+				accepted = append(accepted, rows[j])
+			}
+		}
+		return accepted, outdated
+	}
+	return rows, []Row{}
+}
+
 func toUnix(t time.Time, precision TimestampPrecision) int64 {
 	switch precision {
 	case Nanoseconds:
@@ -120,25 +180,233 @@ func toUnix(t time.Time, precision TimestampPrecision) int64 {
 	}
 }
 
-func (m *memoryPartition) selectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
-	name := marshalMetricName(metric, labels)
-	mt := m.getMetric(name)
-	return mt.selectPoints(start, end), nil
+// toPrecision converts the given duration into the number of the given precision's units.
+func toPrecision(d time.Duration, precision TimestampPrecision) int64 {
+	switch precision {
+	case Nanoseconds:
+		return d.Nanoseconds()
+	case Microseconds:
+		return d.Microseconds()
+	case Milliseconds:
+		return d.Milliseconds()
+	case Seconds:
+		return int64(d.Seconds())
+	default:
+		return d.Nanoseconds()
+	}
+}
+
+func (m *memoryPartition) selectDataPoints(ctx context.Context, metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+	mt, ok := m.lookupMetric(marshalMetricName(metric, labels))
+	if !ok {
+		return []*DataPoint{}, nil
+	}
+	if mt.compressed != nil {
+		decoded, err := mt.appendCompressedPoints(nil, start, end)
+		if err != nil {
+			return nil, err
+		}
+		points := make([]*DataPoint, len(decoded))
+		for i := range decoded {
+			points[i] = &decoded[i]
+		}
+		points = filterValueRefs(ctx, mergeDataPointRefs(points, mt.selectOutOfOrderPoints(start, end)))
+		if err := chargeQueryMemory(ctx, len(points)); err != nil {
+			return nil, err
+		}
+		return points, nil
+	}
+	points := filterValueRefs(ctx, mergeDataPointRefs(mt.selectPoints(start, end), mt.selectOutOfOrderPoints(start, end)))
+	if err := chargeQueryMemory(ctx, len(points)); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func (m *memoryPartition) appendDataPoints(ctx context.Context, dst []DataPoint, metric string, labels []Label, start, end int64) ([]DataPoint, error) {
+	mt, ok := m.lookupMetric(marshalMetricName(metric, labels))
+	if !ok {
+		return dst, nil
+	}
+	n := len(dst)
+	if mt.compressed != nil {
+		var err error
+		if dst, err = mt.appendCompressedPoints(dst, start, end); err != nil {
+			return dst[:n], err
+		}
+	} else {
+		for _, p := range mt.selectPoints(start, end) {
+			dst = append(dst, *p)
+		}
+	}
+	if outOfOrder := mt.selectOutOfOrderPoints(start, end); len(outOfOrder) > 0 {
+		inOrder := append([]DataPoint(nil), dst[n:]...)
+		dst = dst[:n]
+		var i, j int
+		for i < len(inOrder) && j < len(outOfOrder) {
+			// The in-order one precedes on ties since it must have been inserted earlier.
+			if outOfOrder[j].Timestamp < inOrder[i].Timestamp {
+				dst = append(dst, *outOfOrder[j])
+				j++
+			} else {
+				dst = append(dst, inOrder[i])
+				i++
+			}
+		}
+		dst = append(dst, inOrder[i:]...)
+		for _, p := range outOfOrder[j:] {
+			dst = append(dst, *p)
+		}
+	}
+	dst = dst[:n+len(filterValues(ctx, dst[n:]))]
+	if err := chargeQueryMemory(ctx, len(dst)-n); err != nil {
+		return dst[:n], err
+	}
+	return dst, nil
+}
+
+func (m *memoryPartition) countDataPoints(_ context.Context, metric string, labels []Label, start, end int64) (int64, error) {
+	mt, ok := m.lookupMetric(marshalMetricName(metric, labels))
+	if !ok {
+		return 0, nil
+	}
+	return mt.countPoints(start, end)
+}
+
+// selectAll gives back rows of all data points in the partition, in ascending order of series, and then timestamps.
+func (m *memoryPartition) selectAll(ctx context.Context) ([]Row, error) {
+	var names []string
+	m.rangeMetrics(func(mt *memoryMetric) bool {
+		names = append(names, mt.name)
+		return true
+	})
+	return selectAllRows(ctx, m, names, m.size())
+}
+
+// selectAllRows gives back rows of all data points of the given series in the partition, whose metric and labels
+// are unmarshaled from the names. The capacity of the rows is given as the hint.
+func selectAllRows(ctx context.Context, p partition, names []string, hint int) ([]Row, error) {
+	sort.Strings(names)
+	rows := make([]Row, 0, hint)
+	var points []DataPoint
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		metric, labels := unmarshalMetricName(name)
+		var err error
+		points, err = p.appendDataPoints(ctx, points[:0], metric, labels, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select data points of %q: %w", metric, err)
+		}
+		// Late and out-of-order ones may follow the others.
+		sort.SliceStable(points, func(i, j int) bool {
+			return points[i].Timestamp < points[j].Timestamp
+		})
+		for _, p := range points {
+			rows = append(rows, Row{Metric: metric, Labels: labels, DataPoint: p})
+		}
+	}
+	return rows, nil
+}
+
+// shard gives back the shard holding metrics with the given hash.
+func (m *memoryPartition) shard(hash uint64) *metricShard {
+	return &m.shards[hash&(metricShardsNum-1)]
 }
 
 // getMetric gives back the reference to the metrics list whose name is the given one.
 // If none, it creates a new one.
 func (m *memoryPartition) getMetric(name string) *memoryMetric {
-	value, ok := m.metrics.Load(name)
-	if !ok {
-		value = &memoryMetric{
-			name:             name,
-			points:           make([]*DataPoint, 0, 1000),
-			outOfOrderPoints: make([]*DataPoint, 0),
+	hash := xxhash.Sum64String(name)
+	s := m.shard(hash)
+	s.mu.RLock()
+	mt, ok := s.lookup(hash, name)
+	s.mu.RUnlock()
+	if ok {
+		return mt
+	}
+
+	s.mu.Lock()
+	// Another writer may have created it in the meantime.
+	if mt, ok := s.lookup(hash, name); ok {
+		s.mu.Unlock()
+		return mt
+	}
+	mt = m.newMetric(name)
+	if _, taken := s.metrics[hash]; !taken {
+		if s.metrics == nil {
+			s.metrics = make(map[uint64]*memoryMetric)
+		}
+		s.metrics[hash] = mt
+	} else {
+		// The hash is already taken by another metric.
+		if s.collidedMetrics == nil {
+			s.collidedMetrics = make(map[string]*memoryMetric)
 		}
-		m.metrics.Store(name, value)
+		s.collidedMetrics[name] = mt
 	}
-	return value.(*memoryMetric)
+	s.mu.Unlock()
+	atomic.AddInt64(&m.numSeries, 1)
+	m.index.add(name)
+	return mt
+}
+
+// newMetric gives back a new metric that holds data points in the way the partition does.
+func (m *memoryPartition) newMetric(name string) *memoryMetric {
+	if m.compressed {
+		return newCompressedMemoryMetric(name)
+	}
+	return newMemoryMetric(name)
+}
+
+// lookupMetric gives back the reference to the metrics list whose name is the given one.
+// Unlike getMetric, it never creates a new one.
+func (m *memoryPartition) lookupMetric(name string) (*memoryMetric, bool) {
+	hash := xxhash.Sum64String(name)
+	s := m.shard(hash)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lookup(hash, name)
+}
+
+// rangeMetrics calls f sequentially for each metric. If f returns false, it stops the iteration.
+// Like sync.Map.Range, metrics created while iterating may or may not be visited.
+func (m *memoryPartition) rangeMetrics(f func(mt *memoryMetric) bool) {
+	var metrics []*memoryMetric
+	for i := range m.shards {
+		s := &m.shards[i]
+		// Call f without holding the lock, which may create metrics.
+		s.mu.RLock()
+		metrics = metrics[:0]
+		for _, mt := range s.metrics {
+			metrics = append(metrics, mt)
+		}
+		for _, mt := range s.collidedMetrics {
+			metrics = append(metrics, mt)
+		}
+		s.mu.RUnlock()
+		for _, mt := range metrics {
+			if !f(mt) {
+				return
+			}
+		}
+	}
+}
+
+// deletePoints removes data points of the given metric within the given range, where start is inclusive
+// and end is exclusive. It gives back the number of data points removed.
+func (m *memoryPartition) deletePoints(name string, start, end int64) (int, error) {
+	mt, ok := m.lookupMetric(name)
+	if !ok {
+		return 0, nil
+	}
+	n, err := mt.deletePoints(start, end)
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&m.numPoints, -int64(n))
+	return n, nil
 }
 
 func (m *memoryPartition) minTimestamp() int64 {
@@ -154,6 +422,9 @@ func (m *memoryPartition) size() int {
 }
 
 func (m *memoryPartition) active() bool {
+	if m.maxPoints > 0 && int64(m.size()) >= m.maxPoints {
+		return false
+	}
 	return m.maxTimestamp()-m.minTimestamp()+1 < m.partitionDuration
 }
 
@@ -167,6 +438,14 @@ func (m *memoryPartition) expired() bool {
 	return false
 }
 
+func newMemoryMetric(name string) *memoryMetric {
+	return &memoryMetric{
+		name:             name,
+		points:           make([]*DataPoint, 0, 1000),
+		outOfOrderPoints: make([]*DataPoint, 0),
+	}
+}
+
 // memoryMetric has a list of ordered data points that belong to the memoryMetric
 type memoryMetric struct {
 	name         string
@@ -177,10 +456,15 @@ type memoryMetric struct {
 	points           []*DataPoint
 	outOfOrderPoints []*DataPoint
 	mu               sync.RWMutex
+	// compressed holds in-order points instead of points if not nil.
+	compressed *compressedPoints
+	// tells whether timestamps of points are at a regular interval.
+	interval intervalTracker
+	// the number of data points held at the last sweep for idle series, which is guarded by mu.
+	pointsAtLastSweep int64
 }
 
-func (m *memoryMetric) insertPoint(point *DataPoint) {
-	size := atomic.LoadInt64(&m.size)
+func (m *memoryMetric) insertPoint(point *DataPoint) error {
 	// TODO: Consider to stop using mutex every time.
 	//   Instead, fix the capacity of points slice, kind of like:
 	/*
@@ -191,24 +475,193 @@ func (m *memoryMetric) insertPoint(point *DataPoint) {
 	*/
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	// Take the size under the lock, since deletePoints may shrink points in the meantime.
+	size := atomic.LoadInt64(&m.size)
+
+	if m.compressed != nil {
+		if size > 0 && atomic.LoadInt64(&m.maxTimestamp) >= point.Timestamp {
+			m.outOfOrderPoints = append(m.outOfOrderPoints, point)
+			return nil
+		}
+		if err := m.compressed.append(point); err != nil {
+			return err
+		}
+		if size == 0 {
+			atomic.StoreInt64(&m.minTimestamp, point.Timestamp)
+		}
+		atomic.StoreInt64(&m.maxTimestamp, point.Timestamp)
+		atomic.AddInt64(&m.size, 1)
+		return nil
+	}
 
 	// First insertion
-	if size == 0 {
+	if len(m.points) == 0 {
 		m.points = append(m.points, point)
+		m.interval.add(point.Timestamp)
 		atomic.StoreInt64(&m.minTimestamp, point.Timestamp)
 		atomic.StoreInt64(&m.maxTimestamp, point.Timestamp)
 		atomic.AddInt64(&m.size, 1)
-		return
+		return nil
 	}
 	// Insert point in order
-	if m.points[size-1].Timestamp < point.Timestamp {
+	if m.points[len(m.points)-1].Timestamp < point.Timestamp {
 		m.points = append(m.points, point)
+		m.interval.add(point.Timestamp)
 		atomic.StoreInt64(&m.maxTimestamp, point.Timestamp)
 		atomic.AddInt64(&m.size, 1)
-		return
+		return nil
 	}
 
 	m.outOfOrderPoints = append(m.outOfOrderPoints, point)
+	return nil
+}
+
+// deletePoints removes data points within the given range, and gives back the number of them.
+// Slices of points are rebuilt instead of modified in place since readers may still hold them.
+func (m *memoryMetric) deletePoints(start, end int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var removed int
+	keep := func(points []*DataPoint) []*DataPoint {
+		kept := make([]*DataPoint, 0, len(points))
+		for _, p := range points {
+			if start <= p.Timestamp && p.Timestamp < end {
+				removed++
+				continue
+			}
+			kept = append(kept, p)
+		}
+		return kept
+	}
+	outOfOrderPoints := keep(m.outOfOrderPoints)
+
+	var points []*DataPoint
+	if m.compressed != nil {
+		decoded, err := m.compressed.appendAll(nil)
+		if err != nil {
+			return 0, err
+		}
+		points = make([]*DataPoint, len(decoded))
+		for i := range decoded {
+			points[i] = &decoded[i]
+		}
+	} else {
+		points = m.points
+	}
+	points = keep(points)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if m.compressed != nil {
+		compressed := newCompressedPoints()
+		for _, p := range points {
+			if err := compressed.append(p); err != nil {
+				return 0, err
+			}
+		}
+		m.compressed = compressed
+	} else {
+		m.points = points
+		m.interval = intervalTracker{}
+		for _, p := range points {
+			m.interval.add(p.Timestamp)
+		}
+	}
+	m.outOfOrderPoints = outOfOrderPoints
+	if len(points) > 0 {
+		atomic.StoreInt64(&m.minTimestamp, points[0].Timestamp)
+		atomic.StoreInt64(&m.maxTimestamp, points[len(points)-1].Timestamp)
+	}
+	atomic.StoreInt64(&m.size, int64(len(points)))
+	return removed, nil
+}
+
+// countPoints gives back the number of data points within the given range, including out-of-order ones.
+func (m *memoryMetric) countPoints(start, end int64) (int64, error) {
+	var n int64
+	if m.compressed == nil {
+		n = int64(len(m.selectPoints(start, end)))
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.compressed != nil {
+		var err error
+		if n, err = m.compressed.countPoints(start, end); err != nil {
+			return 0, err
+		}
+	}
+	for _, p := range m.outOfOrderPoints {
+		if p.Timestamp >= start && p.Timestamp < end {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// latestPoint gives back a copy of the latest data point, which is the tail of in-order ones.
+// It isn't ok if they are compressed, or if an out-of-order data point shares the timestamp,
+// since which one comes last depends on the duplicate policy.
+func (m *memoryMetric) latestPoint() (*DataPoint, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.compressed != nil || len(m.points) == 0 {
+		return nil, false
+	}
+	latest := *m.points[len(m.points)-1]
+	for _, p := range m.outOfOrderPoints {
+		if p.Timestamp == latest.Timestamp {
+			return nil, false
+		}
+	}
+	return &latest, true
+}
+
+// selectOutOfOrderPoints gives back out-of-order data points within the given range in ascending order of
+// timestamp, keeping the order of insertion among ones sharing a timestamp.
+func (m *memoryMetric) selectOutOfOrderPoints(start, end int64) []*DataPoint {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var points []*DataPoint
+	for _, p := range m.outOfOrderPoints {
+		if start <= p.Timestamp && p.Timestamp < end {
+			points = append(points, p)
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Timestamp < points[j].Timestamp
+	})
+	return points
+}
+
+// mergeDataPointRefs merges the out-of-order data points into the in-order ones, both of which are in
+// ascending order. The given in-order slice is given back as is if there are no out-of-order ones.
+func mergeDataPointRefs(inOrder, outOfOrder []*DataPoint) []*DataPoint {
+	if len(outOfOrder) == 0 {
+		return inOrder
+	}
+	merged := make([]*DataPoint, 0, len(inOrder)+len(outOfOrder))
+	var i, j int
+	for i < len(inOrder) && j < len(outOfOrder) {
+		// The in-order one precedes on ties since it must have been inserted earlier.
+		if outOfOrder[j].Timestamp < inOrder[i].Timestamp {
+			merged = append(merged, outOfOrder[j])
+			j++
+		} else {
+			merged = append(merged, inOrder[i])
+			i++
+		}
+	}
+	merged = append(merged, inOrder[i:]...)
+	return append(merged, outOfOrder[j:]...)
+}
+
+// appendCompressedPoints decodes in-order data points within the given range, and then appends them to dst.
+func (m *memoryMetric) appendCompressedPoints(dst []DataPoint, start, end int64) ([]DataPoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.compressed.appendPoints(dst, start, end)
 }
 
 // selectPoints returns a new slice by re-slicing with [startIdx:endIdx].
@@ -224,6 +677,15 @@ func (m *memoryMetric) selectPoints(start, end int64) []*DataPoint {
 
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	// Load them again since deletions may have shrunk points in the meantime.
+	size = atomic.LoadInt64(&m.size)
+	minTimestamp = atomic.LoadInt64(&m.minTimestamp)
+	maxTimestamp = atomic.LoadInt64(&m.maxTimestamp)
+	if interval := m.interval.regularInterval(); interval > 0 {
+		// Points appended after size was loaded are at the interval as well.
+		startIdx, endIdx = regularRange(minTimestamp, interval, int(size), start, end)
+		return m.points[startIdx:endIdx]
+	}
 	if start <= minTimestamp {
 		startIdx = 0
 	} else {
@@ -246,20 +708,36 @@ func (m *memoryMetric) selectPoints(start, end int64) []*DataPoint {
 
 // encodeAllPoints uses the given seriesEncoder to encode all metric data points in order by timestamp,
 // including outOfOrderPoints.
+// Points sharing a timestamp are encoded in order of insertion; the in-order one
+// always precedes out-of-order ones since it must have been inserted earlier.
 func (m *memoryMetric) encodeAllPoints(encoder seriesEncoder) error {
-	sort.Slice(m.outOfOrderPoints, func(i, j int) bool {
+	// Lock exclusively since out-of-order points get sorted in place.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	points := m.points
+	if m.compressed != nil {
+		decoded, err := m.compressed.appendAll(nil)
+		if err != nil {
+			return err
+		}
+		points = make([]*DataPoint, len(decoded))
+		for i := range decoded {
+			points[i] = &decoded[i]
+		}
+	}
+	sort.SliceStable(m.outOfOrderPoints, func(i, j int) bool {
 		return m.outOfOrderPoints[i].Timestamp < m.outOfOrderPoints[j].Timestamp
 	})
 
 	var oi, pi int
-	for oi < len(m.outOfOrderPoints) && pi < len(m.points) {
-		if m.outOfOrderPoints[oi].Timestamp < m.points[pi].Timestamp {
+	for oi < len(m.outOfOrderPoints) && pi < len(points) {
+		if m.outOfOrderPoints[oi].Timestamp < points[pi].Timestamp {
 			if err := encoder.encodePoint(m.outOfOrderPoints[oi]); err != nil {
 				return err
 			}
 			oi++
 		} else {
-			if err := encoder.encodePoint(m.points[pi]); err != nil {
+			if err := encoder.encodePoint(points[pi]); err != nil {
 				return err
 			}
 			pi++
@@ -271,8 +749,8 @@ func (m *memoryMetric) encodeAllPoints(encoder seriesEncoder) error {
 		}
 		oi++
 	}
-	for pi < len(m.points) {
-		if err := encoder.encodePoint(m.points[pi]); err != nil {
+	for pi < len(points) {
+		if err := encoder.encodePoint(points[pi]); err != nil {
 			return err
 		}
 		pi++
@@ -1,10 +1,14 @@
 package tstorage
 
 import (
+	"context"
 	"fmt"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -59,7 +63,7 @@ func Test_memoryPartition_InsertRows(t *testing.T) {
 			assert.Equal(t, tt.wantErr, err != nil)
 			assert.Equal(t, tt.wantOutOfOrderRows, gotOutOfOrder)
 
-			got, _ := tt.memoryPartition.selectDataPoints("metric1", nil, 0, 4)
+			got, _ := tt.memoryPartition.selectDataPoints(context.Background(), "metric1", nil, 0, 4)
 			assert.Equal(t, tt.wantDataPoints, got)
 		})
 	}
@@ -120,6 +124,29 @@ func Test_memoryPartition_SelectDataPoints(t *testing.T) {
 				{Timestamp: 4, Value: 0.1},
 			},
 		},
+		{
+			name:   "select out-of-order points",
+			metric: "metric1",
+			start:  2,
+			end:    5,
+			memoryPartition: func() *memoryPartition {
+				m := newMemoryPartition(nil, 0, "").(*memoryPartition)
+				m.insertRows([]Row{
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: 4, Value: 0.1}},
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.2}},
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: 4, Value: 0.2}},
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+				})
+				return m
+			}(),
+			want: []*DataPoint{
+				{Timestamp: 2, Value: 0.2},
+				{Timestamp: 3, Value: 0.2},
+				{Timestamp: 4, Value: 0.1},
+				{Timestamp: 4, Value: 0.2},
+			},
+		},
 		{
 			name:   "select all points",
 			metric: "metric1",
@@ -152,7 +179,7 @@ func Test_memoryPartition_SelectDataPoints(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, _ := tt.memoryPartition.selectDataPoints(tt.metric, tt.labels, tt.start, tt.end)
+			got, _ := tt.memoryPartition.selectDataPoints(context.Background(), tt.metric, tt.labels, tt.start, tt.end)
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -233,3 +260,206 @@ func Test_toUnix(t *testing.T) {
 		})
 	}
 }
+
+func Test_memoryPartition_active_maxPoints(t *testing.T) {
+	m := newMemoryPartition(nil, 1*time.Hour, Seconds).(*memoryPartition)
+	m.maxPoints = 2
+	_, err := m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}})
+	require.NoError(t, err)
+	assert.True(t, m.active())
+	_, err = m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2}}})
+	require.NoError(t, err)
+	assert.False(t, m.active())
+}
+
+func Test_memoryMetric_EncodeAllPoints_equalTimestamps(t *testing.T) {
+	mt := memoryMetric{
+		points: []*DataPoint{
+			{Timestamp: 1, Value: 0.1},
+			{Timestamp: 2, Value: 0.1},
+		},
+		// In order of insertion
+		outOfOrderPoints: []*DataPoint{
+			{Timestamp: 2, Value: 0.2},
+			{Timestamp: 1, Value: 0.2},
+			{Timestamp: 2, Value: 0.3},
+			{Timestamp: 1, Value: 0.3},
+		},
+	}
+	got := make([]DataPoint, 0, 6)
+	encoder := fakeEncoder{
+		encodePointFunc: func(p *DataPoint) error {
+			got = append(got, *p)
+			return nil
+		},
+	}
+	err := mt.encodeAllPoints(&encoder)
+	require.NoError(t, err)
+	assert.Equal(t, []DataPoint{
+		{Timestamp: 1, Value: 0.1},
+		{Timestamp: 1, Value: 0.2},
+		{Timestamp: 1, Value: 0.3},
+		{Timestamp: 2, Value: 0.1},
+		{Timestamp: 2, Value: 0.2},
+		{Timestamp: 2, Value: 0.3},
+	}, got)
+}
+
+func Test_memoryPartition_getMetric_hashCollision(t *testing.T) {
+	m := newMemoryPartition(nil, 1*time.Hour, Seconds).(*memoryPartition)
+	// Simulate that "metric1" has been stored with the same hash as "metric2".
+	hash := xxhash.Sum64String("metric2")
+	m.shard(hash).metrics = map[uint64]*memoryMetric{hash: newMemoryMetric("metric1")}
+
+	_, err := m.insertRows([]Row{
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1, Value: 0.2}},
+	})
+	require.NoError(t, err)
+
+	mt, ok := m.lookupMetric("metric2")
+	require.True(t, ok)
+	assert.Equal(t, "metric2", mt.name)
+	got, err := m.selectDataPoints(context.Background(), "metric2", nil, 1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 0.2}}, got)
+
+	_, ok = m.lookupMetric("metric3")
+	assert.False(t, ok)
+
+	var names []string
+	m.rangeMetrics(func(mt *memoryMetric) bool {
+		names = append(names, mt.name)
+		return true
+	})
+	assert.ElementsMatch(t, []string{"metric1", "metric2"}, names)
+}
+
+func Test_memoryPartition_deletePoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed bool
+	}{
+		{name: "raw"},
+		{name: "compressed", compressed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+			m.compressed = tt.compressed
+			_, err := m.insertRows([]Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 4, Value: 0.4}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 5, Value: 0.5}},
+			})
+			require.NoError(t, err)
+
+			n, err := m.deletePoints(marshalMetricName("metric1", nil), 2, 4)
+			require.NoError(t, err)
+			assert.Equal(t, 2, n)
+			assert.Equal(t, 3, m.size())
+			n, err = m.deletePoints(marshalMetricName("metric2", nil), 0, 10)
+			require.NoError(t, err)
+			assert.Equal(t, 0, n)
+
+			got, err := m.selectDataPoints(context.Background(), "metric1", nil, 0, 10)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 0.1}, {Timestamp: 4, Value: 0.4}, {Timestamp: 5, Value: 0.5}}, got)
+
+			// Inserting keeps working after deleting all of them.
+			_, err = m.deletePoints(marshalMetricName("metric1", nil), 0, 10)
+			require.NoError(t, err)
+			assert.Equal(t, 0, m.size())
+			_, err = m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 6, Value: 0.6}}})
+			require.NoError(t, err)
+			got, err = m.selectDataPoints(context.Background(), "metric1", nil, 0, 10)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{{Timestamp: 6, Value: 0.6}}, got)
+		})
+	}
+}
+
+func Test_memoryPartition_deletePoints_concurrentInserts(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed bool
+	}{
+		{name: "raw"},
+		{name: "compressed", compressed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+			m.compressed = tt.compressed
+			name := marshalMetricName("metric1", nil)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for ts := int64(1); ts <= 5000; ts++ {
+					_, err := m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}})
+					assert.NoError(t, err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					_, err := m.deletePoints(name, 0, 10000)
+					assert.NoError(t, err)
+				}
+			}()
+			wg.Wait()
+
+			// Whatever got deleted, inserting keeps working in order.
+			_, err := m.deletePoints(name, 0, 10000)
+			require.NoError(t, err)
+			_, err = m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10000}}})
+			require.NoError(t, err)
+			got, err := m.selectDataPoints(context.Background(), "metric1", nil, 0, 10001)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{{Timestamp: 10000}}, got)
+		})
+	}
+}
+
+func Test_partition_selectAll(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed bool
+	}{
+		{name: "raw"},
+		{name: "compressed", compressed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+			m.compressed = tt.compressed
+			_, err := m.insertRows([]Row{
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+				{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+			})
+			require.NoError(t, err)
+			want := []Row{
+				{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+				{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+			}
+			got, err := m.selectAll(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+
+			dir := filepath.Join(t.TempDir(), "p-1-3")
+			s := &storage{compressor: &nopCompressor{}}
+			require.NoError(t, s.writePartition(dir, m, time.Now()))
+			p, err := openDiskPartition(dir, time.Hour)
+			require.NoError(t, err)
+			got, err = p.(*diskPartition).selectAll(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
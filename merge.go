@@ -0,0 +1,176 @@
+package tstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *storage) Merge(dataPath string) error {
+	if dataPath == "" {
+		return fmt.Errorf("data path is required")
+	}
+	if err := s.beginWrite(); err != nil {
+		return err
+	}
+	defer s.wg.Done()
+	for _, dir := range s.dataPaths {
+		same, err := samePath(dataPath, dir)
+		if err != nil {
+			return err
+		}
+		if same {
+			return fmt.Errorf("can't merge the data path %q into itself", dataPath)
+		}
+	}
+	rows, createdAt, err := s.readDataPath(dataPath)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	// Rows older than all partitions would be dropped by InsertRows.
+	minT, ok := s.oldestTimestamp()
+	var olderRows, newerRows []Row
+	for i := range rows {
+		if ok && rows[i].Timestamp < minT {
+			olderRows = append(olderRows, rows[i])
+		} else {
+			newerRows = append(newerRows, rows[i])
+		}
+	}
+	if len(olderRows) > 0 {
+		if err := s.insertOldestPartition(olderRows, createdAt); err != nil {
+			return fmt.Errorf("failed to insert the partition older than all: %w", err)
+		}
+	}
+	if len(newerRows) > 0 {
+		if err := s.insertRows(context.Background(), newerRows, false); err != nil {
+			return fmt.Errorf("failed to insert rows: %w", err)
+		}
+	}
+	return nil
+}
+
+// readDataPath reads all data points under the given data path as rows, along with the oldest creation time of disk partitions found.
+func (s *storage) readDataPath(dataPath string) ([]Row, time.Time, error) {
+	dirs, err := os.ReadDir(dataPath)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to open data directory: %w", err)
+	}
+	createdAt := time.Now()
+	var rows []Row
+	for _, e := range dirs {
+		if !e.IsDir() || !partitionDirRegex.MatchString(e.Name()) {
+			continue
+		}
+		path := filepath.Join(dataPath, e.Name())
+		part, err := openDiskPartition(path, s.retention)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if errors.Is(err, errInvalidPartition) {
+			s.reportCorruption(err)
+			s.logger.Warn("skipped the invalid partition to be merged", "err", err)
+			continue
+		}
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to open disk partition for %s: %w", path, err)
+		}
+		d := part.(*diskPartition)
+		if d.expired() {
+			continue
+		}
+		if d.meta.CreatedAt.Before(createdAt) {
+			createdAt = d.meta.CreatedAt
+		}
+		all, err := d.selectAll(context.Background())
+		if err != nil {
+			s.reportCorruption(err)
+			return nil, time.Time{}, fmt.Errorf("failed to read data points in %s: %w", path, err)
+		}
+		rows = append(rows, all...)
+	}
+
+	walOpts, err := s.walOptions()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	reader, err := newDiskWALReader(filepath.Join(dataPath, walDirName), walOpts...)
+	if errors.Is(err, os.ErrNotExist) {
+		return rows, createdAt, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if err := reader.readAll(); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read WAL: %w", err)
+	}
+	return append(rows, reader.rowsToInsert...), createdAt, nil
+}
+
+// oldestTimestamp gives back the min timestamp of the oldest partition that holds data points.
+func (s *storage) oldestTimestamp() (int64, bool) {
+	var minT int64
+	var found bool
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		part := iterator.value()
+		if part.size() == 0 {
+			continue
+		}
+		if !found || part.minTimestamp() < minT {
+			minT = part.minTimestamp()
+			found = true
+		}
+	}
+	return minT, found
+}
+
+// insertOldestPartition puts a partition holding the given rows, which are older than all partitions, to the tail.
+// In the in-memory mode, it goes away at the next flush as other memory partitions do.
+func (s *storage) insertOldestPartition(rows []Row, createdAt time.Time) error {
+	m := newMemoryPartition(nil, s.partitionDuration, s.timestampPrecision).(*memoryPartition)
+	if _, err := m.insertRows(rows); err != nil {
+		return err
+	}
+	if s.inMemoryMode() {
+		m.createdAt = createdAt
+		s.partitionList.insertTail(m)
+		s.hooks.partitionCreated(m)
+		return nil
+	}
+
+	dir := s.newPartitionDir(m.minTimestamp(), m.maxTimestamp())
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("partition %s already exists", dir)
+	}
+	if err := s.commitPartition(dir, m, createdAt); err != nil {
+		return err
+	}
+	part, err := openDiskPartition(dir, s.retention)
+	if err != nil {
+		return err
+	}
+	s.partitionList.insertTail(part)
+	s.hooks.partitionCreated(part)
+	return nil
+}
+
+// samePath reports whether the given paths point to the same directory.
+func samePath(x, y string) (bool, error) {
+	xi, err := os.Stat(x)
+	if err != nil {
+		return false, err
+	}
+	yi, err := os.Stat(y)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(xi, yi), nil
+}
@@ -0,0 +1,63 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Merge(t *testing.T) {
+	labels := []Label{{Name: "host", Value: "host-1"}}
+
+	// The other storage has flushed partitions older than and overlapping with the storage,
+	// and rows left in WAL.
+	otherDir := t.TempDir()
+	other, err := NewStorage(WithDataPath(otherDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, other.InsertRows([]Row{
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000015, Value: 0.1}},
+	}))
+	require.NoError(t, other.Close())
+	other, err = NewStorage(WithDataPath(otherDir), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+	require.NoError(t, err)
+	require.NoError(t, other.InsertRows([]Row{
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000030, Value: 0.1}},
+	}))
+	// Leave it unclosed to keep the rows in WAL.
+
+	dir := t.TempDir()
+	s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000010, Value: 0.2}},
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000020, Value: 0.2}},
+	}))
+	require.NoError(t, s.Close())
+	s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+
+	require.Error(t, s.Merge(dir))
+	require.NoError(t, s.Merge(otherDir))
+
+	want := []*DataPoint{
+		{Timestamp: 1600000000, Value: 0.1},
+		{Timestamp: 1600000010, Value: 0.2},
+		{Timestamp: 1600000015, Value: 0.1},
+		{Timestamp: 1600000020, Value: 0.2},
+		{Timestamp: 1600000030, Value: 0.1},
+	}
+	got, err := s.Select("metric1", labels, 1600000000, 1600000031)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// Merged data points are persisted.
+	require.NoError(t, s.Close())
+	s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	got, err = s.Select("metric1", labels, 1600000000, 1600000031)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	require.NoError(t, s.Close())
+}
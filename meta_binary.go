@@ -0,0 +1,205 @@
+package tstorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"time"
+)
+
+// binaryMetaFileName is the name of the meta file encoded in the binary format. See WithBinaryMeta.
+const binaryMetaFileName = "meta"
+
+// binaryMetaMagic begins binary meta files.
+var binaryMetaMagic = []byte("TSMETA1")
+
+// marshalBinaryMeta encodes the given meta in the binary format, which consists of:
+//
+//	magic, minTimestamp, maxTimestamp, numDataPoints, createdAt, compression, formatVersion, metrics, crc32
+//
+// with integers as varints and strings prefixed with their length. Metrics are in ascending order of name,
+// each of which is encoded as the length of the prefix shared with the previous one followed by the rest.
+// Chunks are encoded relative to the previous one, since they are mostly contiguous. The trailing CRC-32
+// covers everything before it, hence Checksum of the meta is left as is.
+func marshalBinaryMeta(m *meta) []byte {
+	names := make([]string, 0, len(m.Metrics))
+	for name := range m.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := append([]byte(nil), binaryMetaMagic...)
+	b = binary.AppendVarint(b, m.MinTimestamp)
+	b = binary.AppendVarint(b, m.MaxTimestamp)
+	b = binary.AppendUvarint(b, uint64(m.NumDataPoints))
+	b = binary.AppendVarint(b, m.CreatedAt.UnixNano())
+	b = appendBinaryString(b, string(m.Compression))
+	b = binary.AppendUvarint(b, uint64(m.FormatVersion))
+	b = binary.AppendUvarint(b, uint64(len(names)))
+	var prev string
+	for _, name := range names {
+		shared := 0
+		for shared < len(prev) && shared < len(name) && prev[shared] == name[shared] {
+			shared++
+		}
+		b = binary.AppendUvarint(b, uint64(shared))
+		b = appendBinaryString(b, name[shared:])
+		prev = name
+
+		mt := m.Metrics[name]
+		b = binary.AppendVarint(b, mt.Offset)
+		b = binary.AppendVarint(b, mt.MinTimestamp)
+		b = binary.AppendVarint(b, mt.MaxTimestamp-mt.MinTimestamp)
+		b = binary.AppendUvarint(b, uint64(mt.NumDataPoints))
+		b = binary.AppendUvarint(b, uint64(len(mt.Chunks)))
+		offset, t := mt.Offset, mt.MinTimestamp
+		for _, c := range mt.Chunks {
+			b = binary.AppendVarint(b, c.Offset-offset)
+			b = binary.AppendVarint(b, c.Length)
+			b = binary.AppendVarint(b, c.MinTimestamp-t)
+			b = binary.AppendVarint(b, c.MaxTimestamp-c.MinTimestamp)
+			b = binary.AppendVarint(b, c.NumDataPoints)
+			b = binary.AppendVarint(b, c.Interval)
+			b = binary.BigEndian.AppendUint32(b, c.Checksum)
+			offset, t = c.Offset+c.Length, c.MaxTimestamp
+		}
+	}
+	return binary.BigEndian.AppendUint32(b, crc32.Checksum(b, metaChecksumTable))
+}
+
+func appendBinaryString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// isBinaryMeta reports whether the given meta file is encoded in the binary format.
+func isBinaryMeta(b []byte) bool {
+	return bytes.HasPrefix(b, binaryMetaMagic)
+}
+
+// unmarshalBinaryMeta decodes the meta encoded by marshalBinaryMeta.
+func unmarshalBinaryMeta(b []byte) (meta, error) {
+	if !isBinaryMeta(b) || len(b) < len(binaryMetaMagic)+4 {
+		return meta{}, fmt.Errorf("not a binary meta")
+	}
+	body := b[:len(b)-4]
+	if want, got := binary.BigEndian.Uint32(b[len(b)-4:]), crc32.Checksum(body, metaChecksumTable); want != got {
+		return meta{}, fmt.Errorf("checksum mismatch: want %08x, got %08x", want, got)
+	}
+
+	d := &binaryMetaDecoder{b: body[len(binaryMetaMagic):]}
+	var m meta
+	m.MinTimestamp = d.varint()
+	m.MaxTimestamp = d.varint()
+	m.NumDataPoints = int(d.uvarint())
+	m.CreatedAt = time.Unix(0, d.varint())
+	m.Compression = Compression(d.string())
+	m.FormatVersion = int(d.uvarint())
+	numMetrics := d.count()
+	m.Metrics = make(map[string]diskMetric, numMetrics)
+	var prev string
+	for i := 0; i < numMetrics && d.err == nil; i++ {
+		shared := int(d.uvarint())
+		if shared > len(prev) {
+			return meta{}, fmt.Errorf("invalid length %d of the prefix shared with %q", shared, prev)
+		}
+		name := prev[:shared] + d.string()
+		prev = name
+
+		mt := diskMetric{Name: name}
+		mt.Offset = d.varint()
+		mt.MinTimestamp = d.varint()
+		mt.MaxTimestamp = mt.MinTimestamp + d.varint()
+		mt.NumDataPoints = int64(d.uvarint())
+		if n := d.count(); n > 0 {
+			mt.Chunks = make([]diskChunk, n)
+		}
+		offset, t := mt.Offset, mt.MinTimestamp
+		for j := range mt.Chunks {
+			c := &mt.Chunks[j]
+			c.Offset = offset + d.varint()
+			c.Length = d.varint()
+			c.MinTimestamp = t + d.varint()
+			c.MaxTimestamp = c.MinTimestamp + d.varint()
+			c.NumDataPoints = d.varint()
+			c.Interval = d.varint()
+			c.Checksum = d.uint32()
+			offset, t = c.Offset+c.Length, c.MaxTimestamp
+		}
+		m.Metrics[name] = mt
+	}
+	if d.err != nil {
+		return meta{}, d.err
+	}
+	if len(d.b) > 0 {
+		return meta{}, fmt.Errorf("%d trailing bytes", len(d.b))
+	}
+	return m, nil
+}
+
+// binaryMetaDecoder reads values from a binary meta, whose error is sticky.
+type binaryMetaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *binaryMetaDecoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("unexpected end of binary meta")
+	}
+	d.b = nil
+}
+
+func (d *binaryMetaDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *binaryMetaDecoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *binaryMetaDecoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *binaryMetaDecoder) string() string {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.fail()
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+// count reads the number of elements that follow, which can't exceed the rest of bytes since each of them
+// takes a byte at least, so that corrupt ones never lead to huge allocations.
+func (d *binaryMetaDecoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
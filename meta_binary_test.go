@@ -0,0 +1,95 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_marshalBinaryMeta(t *testing.T) {
+	m := meta{
+		MinTimestamp:  -10,
+		MaxTimestamp:  100,
+		NumDataPoints: 6,
+		CreatedAt:     time.Unix(1600000000, 123),
+		Compression:   Zstd,
+		FormatVersion: formatVersion,
+		Metrics: map[string]diskMetric{
+			"cpu": {Name: "cpu", Offset: 0, MinTimestamp: -10, MaxTimestamp: 100, NumDataPoints: 4, Chunks: []diskChunk{
+				{Offset: 0, Length: 20, MinTimestamp: -10, MaxTimestamp: 0, NumDataPoints: 2, Interval: 10, Checksum: 0xdeadbeef},
+				{Offset: 20, Length: 15, MinTimestamp: 50, MaxTimestamp: 100, NumDataPoints: 2, Checksum: 1},
+			}},
+			"cpu_idle": {Name: "cpu_idle", Offset: 35, MinTimestamp: 5, MaxTimestamp: 5, NumDataPoints: 1, Chunks: []diskChunk{
+				{Offset: 35, Length: 10, MinTimestamp: 5, MaxTimestamp: 5, NumDataPoints: 1},
+			}},
+			// Written before chunks got introduced.
+			"mem": {Name: "mem", Offset: 45, MinTimestamp: 7, MaxTimestamp: 7, NumDataPoints: 1},
+		},
+	}
+	b := marshalBinaryMeta(&m)
+	got, err := unmarshalMeta(b)
+	require.NoError(t, err)
+	assert.True(t, m.CreatedAt.Equal(got.CreatedAt))
+	got.CreatedAt = m.CreatedAt
+	assert.Equal(t, m, got)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "bit flipped", data: func() []byte {
+			c := append([]byte(nil), b...)
+			c[len(binaryMetaMagic)+3] ^= 1
+			return c
+		}()},
+		{name: "truncated", data: b[:len(b)-5]},
+		{name: "magic only", data: binaryMetaMagic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := unmarshalMeta(tt.data)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestWithBinaryMeta(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithBinaryMeta(), WithChunkSize(2))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000002, Value: 0.3}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.4}},
+	}))
+	require.NoError(t, s.Close())
+	dir := filepath.Join(dataPath, "p-1600000000-1600000002")
+	assert.FileExists(t, filepath.Join(dir, binaryMetaFileName))
+	assert.NoFileExists(t, filepath.Join(dir, metaFileName))
+
+	// Read without the option as well.
+	s, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", []Label{{Name: "host", Value: "a"}}, 1600000000, 1600000003)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1600000000, Value: 0.1},
+		{Timestamp: 1600000001, Value: 0.2},
+		{Timestamp: 1600000002, Value: 0.3},
+	}, got)
+
+	// A broken one is taken as a broken partition as a JSON one is.
+	b, err := os.ReadFile(filepath.Join(dir, binaryMetaFileName))
+	require.NoError(t, err)
+	b[len(b)-1] ^= 1
+	require.NoError(t, os.WriteFile(filepath.Join(dir, binaryMetaFileName), b, 0644))
+	_, err = openDiskPartition(dir, time.Hour)
+	assert.ErrorIs(t, err, errInvalidPartition)
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
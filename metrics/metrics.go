@@ -0,0 +1,86 @@
+// Package metrics exposes the self-metrics of tstorage in the Prometheus text exposition format, so that
+// Prometheus can scrape the insert rate, insert errors, write-timeout rejections, flush durations, partition
+// counts, query latencies and WAL fsync latencies of a storage without applications wiring each figure of Stats by hand.
+//
+// It writes the format directly, so that embedding tstorage never pulls in the Prometheus client library.
+// Applications already exposing a registry can register the prometheus.Collector of the metrics/prometheus
+// module instead, which names metrics the same way.
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/nakabonne/tstorage"
+)
+
+// contentType is the content type of the text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler gives back an http.Handler serving the self-metrics of the given storage on every request.
+// It responds with 500 Internal Server Error if they fail to be written.
+func Handler(s tstorage.Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// Buffer them so that a failure can still be told by the status code.
+		var b bytes.Buffer
+		if err := Write(&b, s.Stats()); err != nil {
+			http.Error(w, fmt.Sprintf("failed to write metrics: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		// Failing here means the client has gone away, with no one left to tell.
+		_, _ = w.Write(b.Bytes())
+	})
+}
+
+// Write writes the given stats in the Prometheus text exposition format, with metric names prefixed
+// with "tstorage_".
+func Write(w io.Writer, stats tstorage.Stats) error {
+	bw := bufio.NewWriter(w)
+	writeCounter(bw, "tstorage_inserted_rows_total", "Number of rows inserted.", stats.InsertedRows)
+	writeCounter(bw, "tstorage_insert_errors_total", "Number of inserts that failed.", stats.InsertErrors)
+	writeCounter(bw, "tstorage_write_timeouts_total", "Number of inserts rejected due to the write timeout.", stats.WriteTimeouts)
+	writeHistogram(bw, "tstorage_flush_duration_seconds", "Time taken to flush a memory partition to disk.", stats.FlushDuration)
+	writeHistogram(bw, "tstorage_query_duration_seconds", "Latency of queries.", stats.QueryDuration)
+	writeCounter(bw, "tstorage_wal_appended_bytes_total", "Number of bytes appended to WAL segments.", stats.WALAppendedBytes)
+	writeHistogram(bw, "tstorage_wal_sync_duration_seconds", "Time taken to fsync the active WAL segment.", stats.WALSyncDuration)
+
+	writeHeader(bw, "tstorage_partitions", "Number of partitions.", "gauge")
+	fmt.Fprintf(bw, "tstorage_partitions{type=\"memory\"} %d\n", stats.MemoryPartitions)
+	fmt.Fprintf(bw, "tstorage_partitions{type=\"disk\"} %d\n", stats.DiskPartitions)
+	writeGauge(bw, "tstorage_data_points", "Number of data points in opened partitions.", stats.DataPoints)
+	writeGauge(bw, "tstorage_head_series", "Number of series in the head partition.", stats.HeadSeries)
+	writeGauge(bw, "tstorage_wal_bytes", "Number of bytes WAL segments take on disk.", stats.WALBytes)
+	writeGauge(bw, "tstorage_wal_segments", "Number of WAL segment files on disk.", int64(stats.WALSegments))
+	writeGauge(bw, "tstorage_disk_bytes", "Number of bytes all files under the data paths take.", stats.DiskBytes)
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeCounter(w io.Writer, name, help string, v int64) {
+	writeHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %d\n", name, v)
+}
+
+func writeGauge(w io.Writer, name, help string, v int64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", name, v)
+}
+
+func writeHistogram(w io.Writer, name, help string, h tstorage.Histogram) {
+	writeHeader(w, name, help, "histogram")
+	for i, bound := range h.Buckets {
+		le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.Sum.Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nakabonne/tstorage"
+)
+
+func TestWrite(t *testing.T) {
+	var b strings.Builder
+	require.NoError(t, Write(&b, tstorage.Stats{
+		MemoryPartitions: 1,
+		DiskPartitions:   2,
+		InsertedRows:     10,
+		WriteTimeouts:    1,
+		WALSegments:      3,
+		WALAppendedBytes: 4096,
+		QueryDuration: tstorage.Histogram{
+			Buckets: []time.Duration{time.Millisecond, time.Second},
+			Counts:  []uint64{1, 2},
+			Count:   3,
+			Sum:     1500 * time.Millisecond,
+		},
+	}))
+	got := b.String()
+	for _, want := range []string{
+		"# TYPE tstorage_inserted_rows_total counter\ntstorage_inserted_rows_total 10\n",
+		"tstorage_write_timeouts_total 1\n",
+		"# TYPE tstorage_query_duration_seconds histogram\n" +
+			"tstorage_query_duration_seconds_bucket{le=\"0.001\"} 1\n" +
+			"tstorage_query_duration_seconds_bucket{le=\"1\"} 2\n" +
+			"tstorage_query_duration_seconds_bucket{le=\"+Inf\"} 3\n" +
+			"tstorage_query_duration_seconds_sum 1.5\n" +
+			"tstorage_query_duration_seconds_count 3\n",
+		"tstorage_partitions{type=\"memory\"} 1\ntstorage_partitions{type=\"disk\"} 2\n",
+		"tstorage_wal_segments 3\n",
+		"tstorage_wal_appended_bytes_total 4096\n",
+		"tstorage_wal_sync_duration_seconds_count 0\n",
+	} {
+		assert.Contains(t, got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s, err := tstorage.NewStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]tstorage.Row{{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 1600000000}}}))
+
+	rec := httptest.NewRecorder()
+	Handler(s).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, contentType, rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "tstorage_inserted_rows_total 1\n")
+	assert.Contains(t, rec.Body.String(), "tstorage_data_points 1\n")
+}
@@ -0,0 +1,89 @@
+// Package prometheus provides a prometheus.Collector exporting the self-metrics of tstorage, for applications
+// that already expose a Prometheus registry. It's a module of its own, so that the Prometheus client library
+// never becomes a dependency of tstorage itself. Metrics are named as metrics.Write names them.
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nakabonne/tstorage"
+)
+
+// Collector collects the self-metrics of a storage, taking its Stats on every collection.
+type Collector struct {
+	storage tstorage.Storage
+
+	insertedRows     *prometheus.Desc
+	insertErrors     *prometheus.Desc
+	writeTimeouts    *prometheus.Desc
+	flushDuration    *prometheus.Desc
+	queryDuration    *prometheus.Desc
+	walAppendedBytes *prometheus.Desc
+	walSyncDuration  *prometheus.Desc
+	partitions       *prometheus.Desc
+	dataPoints       *prometheus.Desc
+	headSeries       *prometheus.Desc
+	walBytes         *prometheus.Desc
+	walSegments      *prometheus.Desc
+	diskBytes        *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector gives back a Collector of the given storage, which is meant to be registered once.
+func NewCollector(s tstorage.Storage) *Collector {
+	return &Collector{
+		storage:          s,
+		insertedRows:     prometheus.NewDesc("tstorage_inserted_rows_total", "Number of rows inserted.", nil, nil),
+		insertErrors:     prometheus.NewDesc("tstorage_insert_errors_total", "Number of inserts that failed.", nil, nil),
+		writeTimeouts:    prometheus.NewDesc("tstorage_write_timeouts_total", "Number of inserts rejected due to the write timeout.", nil, nil),
+		flushDuration:    prometheus.NewDesc("tstorage_flush_duration_seconds", "Time taken to flush a memory partition to disk.", nil, nil),
+		queryDuration:    prometheus.NewDesc("tstorage_query_duration_seconds", "Latency of queries.", nil, nil),
+		walAppendedBytes: prometheus.NewDesc("tstorage_wal_appended_bytes_total", "Number of bytes appended to WAL segments.", nil, nil),
+		walSyncDuration:  prometheus.NewDesc("tstorage_wal_sync_duration_seconds", "Time taken to fsync the active WAL segment.", nil, nil),
+		partitions:       prometheus.NewDesc("tstorage_partitions", "Number of partitions.", []string{"type"}, nil),
+		dataPoints:       prometheus.NewDesc("tstorage_data_points", "Number of data points in opened partitions.", nil, nil),
+		headSeries:       prometheus.NewDesc("tstorage_head_series", "Number of series in the head partition.", nil, nil),
+		walBytes:         prometheus.NewDesc("tstorage_wal_bytes", "Number of bytes WAL segments take on disk.", nil, nil),
+		walSegments:      prometheus.NewDesc("tstorage_wal_segments", "Number of WAL segment files on disk.", nil, nil),
+		diskBytes:        prometheus.NewDesc("tstorage_disk_bytes", "Number of bytes all files under the data paths take.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.insertedRows, c.insertErrors, c.writeTimeouts, c.flushDuration, c.queryDuration, c.walAppendedBytes,
+		c.walSyncDuration, c.partitions, c.dataPoints, c.headSeries, c.walBytes, c.walSegments, c.diskBytes,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.storage.Stats()
+	ch <- prometheus.MustNewConstMetric(c.insertedRows, prometheus.CounterValue, float64(stats.InsertedRows))
+	ch <- prometheus.MustNewConstMetric(c.insertErrors, prometheus.CounterValue, float64(stats.InsertErrors))
+	ch <- prometheus.MustNewConstMetric(c.writeTimeouts, prometheus.CounterValue, float64(stats.WriteTimeouts))
+	ch <- constHistogram(c.flushDuration, stats.FlushDuration)
+	ch <- constHistogram(c.queryDuration, stats.QueryDuration)
+	ch <- prometheus.MustNewConstMetric(c.walAppendedBytes, prometheus.CounterValue, float64(stats.WALAppendedBytes))
+	ch <- constHistogram(c.walSyncDuration, stats.WALSyncDuration)
+	ch <- prometheus.MustNewConstMetric(c.partitions, prometheus.GaugeValue, float64(stats.MemoryPartitions), "memory")
+	ch <- prometheus.MustNewConstMetric(c.partitions, prometheus.GaugeValue, float64(stats.DiskPartitions), "disk")
+	ch <- prometheus.MustNewConstMetric(c.dataPoints, prometheus.GaugeValue, float64(stats.DataPoints))
+	ch <- prometheus.MustNewConstMetric(c.headSeries, prometheus.GaugeValue, float64(stats.HeadSeries))
+	ch <- prometheus.MustNewConstMetric(c.walBytes, prometheus.GaugeValue, float64(stats.WALBytes))
+	ch <- prometheus.MustNewConstMetric(c.walSegments, prometheus.GaugeValue, float64(stats.WALSegments))
+	ch <- prometheus.MustNewConstMetric(c.diskBytes, prometheus.GaugeValue, float64(stats.DiskBytes))
+}
+
+// constHistogram converts the given histogram into a metric in seconds.
+func constHistogram(desc *prometheus.Desc, h tstorage.Histogram) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Buckets))
+	for i, bound := range h.Buckets {
+		buckets[bound.Seconds()] = h.Counts[i]
+	}
+	return prometheus.MustNewConstHistogram(desc, h.Count, h.Sum.Seconds(), buckets)
+}
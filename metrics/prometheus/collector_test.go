@@ -0,0 +1,57 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nakabonne/tstorage"
+)
+
+func TestCollector(t *testing.T) {
+	s, err := tstorage.NewStorage(tstorage.WithTimestampPrecision(tstorage.Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]tstorage.Row{
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 1600000000}},
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 1600000001}},
+	}))
+	_, err = s.Select("metric1", nil, 1600000000, 1600000002)
+	require.NoError(t, err)
+
+	c := NewCollector(s)
+	descs := make(chan *prometheus.Desc, 100)
+	c.Describe(descs)
+	close(descs)
+	assert.Len(t, descs, 13)
+
+	// The pedantic registry checks collected metrics are consistent with the described ones.
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(c))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			switch {
+			case m.GetCounter() != nil:
+				got[f.GetName()] = m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				got[f.GetName()] = float64(m.GetHistogram().GetSampleCount())
+			case len(m.GetLabel()) > 0:
+				got[f.GetName()+"{"+m.GetLabel()[0].GetValue()+"}"] = m.GetGauge().GetValue()
+			default:
+				got[f.GetName()] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	assert.Equal(t, 2.0, got["tstorage_inserted_rows_total"])
+	assert.Equal(t, 0.0, got["tstorage_insert_errors_total"])
+	assert.Equal(t, 1.0, got["tstorage_query_duration_seconds"])
+	assert.Equal(t, 1.0, got["tstorage_partitions{memory}"])
+	assert.Equal(t, 0.0, got["tstorage_partitions{disk}"])
+	assert.Equal(t, 2.0, got["tstorage_data_points"])
+	assert.Equal(t, 1.0, got["tstorage_head_series"])
+}
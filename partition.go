@@ -1,5 +1,7 @@
 package tstorage
 
+import "context"
+
 // partition is a chunk of time-series data with the timestamp range.
 // A partition acts as a fully independent database containing all data
 // points for its time range.
@@ -22,7 +24,13 @@ type partition interface {
 	// Read operations
 	//
 	// selectDataPoints gives back certain metric's data points within the given range.
-	selectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error)
+	// It may give up in the middle and return the context's error once ctx is done.
+	selectDataPoints(ctx context.Context, metric string, labels []Label, start, end int64) ([]*DataPoint, error)
+	// appendDataPoints is like selectDataPoints but appends copies of data points to dst and gives back the result.
+	appendDataPoints(ctx context.Context, dst []DataPoint, metric string, labels []Label, start, end int64) ([]DataPoint, error)
+	// countDataPoints gives back the number of certain metric's data points within the given range,
+	// which is taken from the metadata as far as possible.
+	countDataPoints(ctx context.Context, metric string, labels []Label, start, end int64) (int64, error)
 	// minTimestamp returns the minimum Unix timestamp in milliseconds.
 	minTimestamp() int64
 	// maxTimestamp returns the maximum Unix timestamp in milliseconds.
@@ -34,3 +42,100 @@ type partition interface {
 	// expired means it should get removed.
 	expired() bool
 }
+
+// Partition is the extension point to plug a custom partition backend into the storage,
+// such as object storage, remote shards or test fakes.
+// Register them with WithPartitions.
+//
+// The lifecycle contract is as follows:
+//   - Registered partitions are put into the partition list in order of MinTimestamp
+//     when NewStorage is called, alongside the partitions read from the data path.
+//     MinTimestamp identifies a partition within the list, so it must be unique and immutable.
+//   - The storage always puts a new memory partition in front of them as the head.
+//     InsertRows may still get called with out-of-order rows while a registered partition
+//     is one of the writable partitions; give back rows you don't accept as outdatedRows.
+//   - Registered partitions never get flushed. The storage calls Clean and forgets
+//     about it once Expired reports true.
+//
+// All methods must be goroutine safe.
+type Partition interface {
+	// InsertRows ingests the given rows and gives back the rows it didn't accept.
+	InsertRows(rows []Row) (outdatedRows []Row, err error)
+	// SelectDataPoints gives back certain metric's data points within the given range, in ascending order.
+	// Return ErrNoDataPoints if there are no data points for the metric.
+	SelectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error)
+	// MinTimestamp returns the minimum Unix timestamp the partition holds.
+	MinTimestamp() int64
+	// MaxTimestamp returns the maximum Unix timestamp the partition holds.
+	MaxTimestamp() int64
+	// Size returns the number of data points the partition holds.
+	Size() int
+	// Active reports whether the partition is able to become the head partition.
+	Active() bool
+	// Expired reports whether the partition should get removed.
+	Expired() bool
+	// Clean releases everything managed by the partition. It gets called after
+	// the partition is removed from the storage.
+	Clean() error
+}
+
+// publicPartition adapts a user-defined Partition to the partition interface.
+type publicPartition struct {
+	p Partition
+}
+
+func (p *publicPartition) insertRows(rows []Row) ([]Row, error) {
+	return p.p.InsertRows(rows)
+}
+
+func (p *publicPartition) clean() error {
+	return p.p.Clean()
+}
+
+func (p *publicPartition) selectDataPoints(ctx context.Context, metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+	points, err := p.p.SelectDataPoints(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	points = filterValueRefs(ctx, points)
+	if err := chargeQueryMemory(ctx, len(points)); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func (p *publicPartition) countDataPoints(ctx context.Context, metric string, labels []Label, start, end int64) (int64, error) {
+	points, err := p.p.SelectDataPoints(metric, labels, start, end)
+	return int64(len(points)), err
+}
+
+func (p *publicPartition) appendDataPoints(ctx context.Context, dst []DataPoint, metric string, labels []Label, start, end int64) ([]DataPoint, error) {
+	points, err := p.selectDataPoints(ctx, metric, labels, start, end)
+	if err != nil {
+		return dst, err
+	}
+	for _, point := range points {
+		dst = append(dst, *point)
+	}
+	return dst, nil
+}
+
+func (p *publicPartition) minTimestamp() int64 {
+	return p.p.MinTimestamp()
+}
+
+func (p *publicPartition) maxTimestamp() int64 {
+	return p.p.MaxTimestamp()
+}
+
+func (p *publicPartition) size() int {
+	return p.p.Size()
+}
+
+func (p *publicPartition) active() bool {
+	return p.p.Active()
+}
+
+func (p *publicPartition) expired() bool {
+	return p.p.Expired()
+}
@@ -16,6 +16,8 @@ import (
 type partitionList interface {
 	// insert appends a new node to the head.
 	insert(partition partition)
+	// insertTail appends a new node to the tail, which must be older than all partitions.
+	insertTail(partition partition)
 	// remove eliminates the given partition from the list.
 	remove(partition partition) error
 	// swap replaces the old partition with the new one.
@@ -27,6 +29,12 @@ type partitionList interface {
 	// newIterator gives back the iterator object fot this list.
 	// If you need to inspect all nodes within the list, use this one.
 	newIterator() partitionIterator
+	// appendPartitions appends all partitions to dst in order of newest to oldest, and gives back the result.
+	// Unlike newIterator, it doesn't allocate as long as dst has enough capacity.
+	appendPartitions(dst []partition) []partition
+	// generation gives back the number of times partitions have been inserted, removed or swapped,
+	// which tells whether the list still holds the same partitions.
+	generation() uint64
 
 	String() string
 }
@@ -52,6 +60,7 @@ type partitionIterator interface {
 
 type partitionListImpl struct {
 	numPartitions int64
+	gen           uint64
 	head          *partitionNode
 	tail          *partitionNode
 	mu            sync.RWMutex
@@ -83,6 +92,27 @@ func (p *partitionListImpl) insert(partition partition) {
 
 	p.setHead(node)
 	atomic.AddInt64(&p.numPartitions, 1)
+	atomic.AddUint64(&p.gen, 1)
+}
+
+func (p *partitionListImpl) insertTail(partition partition) {
+	node := &partitionNode{
+		val: partition,
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.head == nil {
+		p.head = node
+	} else {
+		last := p.head
+		for next := last.getNext(); next != nil; next = last.getNext() {
+			last = next
+		}
+		last.setNext(node)
+	}
+	p.tail = node
+	atomic.AddInt64(&p.numPartitions, 1)
+	atomic.AddUint64(&p.gen, 1)
 }
 
 func (p *partitionListImpl) remove(target partition) error {
@@ -117,6 +147,7 @@ func (p *partitionListImpl) remove(target partition) error {
 			prev.setNext(next)
 		}
 		atomic.AddInt64(&p.numPartitions, -1)
+		atomic.AddUint64(&p.gen, 1)
 
 		if err := current.value().clean(); err != nil {
 			return fmt.Errorf("failed to clean resources managed by partition to be removed: %w", err)
@@ -162,6 +193,7 @@ func (p *partitionListImpl) swap(old, new partition) error {
 			// swapping the middle node
 			prev.setNext(newNode)
 		}
+		atomic.AddUint64(&p.gen, 1)
 		return nil
 	}
 
@@ -189,6 +221,21 @@ func (p *partitionListImpl) newIterator() partitionIterator {
 	}
 }
 
+func (p *partitionListImpl) appendPartitions(dst []partition) []partition {
+	p.mu.RLock()
+	node := p.head
+	p.mu.RUnlock()
+	for node != nil {
+		dst = append(dst, node.value())
+		node = node.getNext()
+	}
+	return dst
+}
+
+func (p *partitionListImpl) generation() uint64 {
+	return atomic.LoadUint64(&p.gen)
+}
+
 func (p *partitionListImpl) setHead(node *partitionNode) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -45,6 +45,7 @@ func Test_partitionList_Remove(t *testing.T) {
 			},
 			wantPartitionList: partitionListImpl{
 				numPartitions: 1,
+				gen:           1,
 				head: &partitionNode{
 					val: &fakePartition{
 						minT: 2,
@@ -83,6 +84,7 @@ func Test_partitionList_Remove(t *testing.T) {
 			},
 			wantPartitionList: partitionListImpl{
 				numPartitions: 1,
+				gen:           1,
 				head: &partitionNode{
 					val: &fakePartition{
 						minT: 1,
@@ -126,6 +128,7 @@ func Test_partitionList_Remove(t *testing.T) {
 			},
 			wantPartitionList: partitionListImpl{
 				numPartitions: 2,
+				gen:           1,
 				head: &partitionNode{
 					val: &fakePartition{
 						minT: 1,
@@ -189,11 +192,12 @@ func Test_partitionList_Remove(t *testing.T) {
 			wantErr: true,
 		},
 	}
-	for _, tt := range tests {
+	for i := range tests {
+		tt := &tests[i]
 		t.Run(tt.name, func(t *testing.T) {
 			err := tt.partitionList.remove(tt.target)
 			assert.Equal(t, tt.wantErr, err != nil)
-			assert.Equal(t, tt.wantPartitionList, tt.partitionList)
+			assert.Equal(t, &tt.wantPartitionList, &tt.partitionList)
 		})
 	}
 }
@@ -241,6 +245,7 @@ func Test_partitionList_Swap(t *testing.T) {
 			},
 			wantPartitionList: partitionListImpl{
 				numPartitions: 2,
+				gen:           1,
 				head: &partitionNode{
 					val: &fakePartition{
 						minT: 100,
@@ -287,6 +292,7 @@ func Test_partitionList_Swap(t *testing.T) {
 			},
 			wantPartitionList: partitionListImpl{
 				numPartitions: 2,
+				gen:           1,
 				head: &partitionNode{
 					val: &fakePartition{
 						minT: 1,
@@ -339,6 +345,7 @@ func Test_partitionList_Swap(t *testing.T) {
 			},
 			wantPartitionList: partitionListImpl{
 				numPartitions: 3,
+				gen:           1,
 				head: &partitionNode{
 					val: &fakePartition{
 						minT: 1,
@@ -406,11 +413,26 @@ func Test_partitionList_Swap(t *testing.T) {
 			wantErr: true,
 		},
 	}
-	for _, tt := range tests {
+	for i := range tests {
+		tt := &tests[i]
 		t.Run(tt.name, func(t *testing.T) {
 			err := tt.partitionList.swap(tt.old, tt.new)
 			assert.Equal(t, tt.wantErr, err != nil)
-			assert.Equal(t, tt.wantPartitionList, tt.partitionList)
+			assert.Equal(t, &tt.wantPartitionList, &tt.partitionList)
 		})
 	}
 }
+
+func Test_partitionList_insertTail(t *testing.T) {
+	list := newPartitionList()
+	list.insertTail(&fakePartition{minT: 2})
+	list.insert(&fakePartition{minT: 3})
+	list.insertTail(&fakePartition{minT: 1})
+
+	assert.Equal(t, 3, list.size())
+	var got []int64
+	for _, p := range list.appendPartitions(nil) {
+		got = append(got, p.minTimestamp())
+	}
+	assert.Equal(t, []int64{3, 2, 1}, got)
+}
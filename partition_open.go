@@ -0,0 +1,135 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// listPartitionDirs gives back the paths to the partition directories in all data directories.
+// Directories left by flushes that were interrupted get removed, and ones left by compactions
+// get finished or removed. See finishCompaction.
+func (s *storage) listPartitionDirs() ([]string, error) {
+	var paths []string
+	for _, dir := range s.dataPaths {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open data directory: %w", err)
+		}
+		var finished bool
+		for _, e := range entries {
+			if e.IsDir() && strings.HasPrefix(e.Name(), compactingDirPrefix) {
+				// Left by a compaction that was interrupted.
+				if err := s.finishCompaction(filepath.Join(dir, e.Name())); err != nil {
+					return nil, err
+				}
+				finished = true
+			}
+		}
+		if finished {
+			// Finishing them renames and removes partition directories.
+			if entries, err = os.ReadDir(dir); err != nil {
+				return nil, fmt.Errorf("failed to open data directory: %w", err)
+			}
+		}
+		for _, e := range entries {
+			if e.IsDir() && strings.HasPrefix(e.Name(), "p-") && strings.HasSuffix(e.Name(), flushingDirSuffix) {
+				// Left by a flush that was interrupted.
+				if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+					return nil, fmt.Errorf("failed to remove %s: %w", e.Name(), err)
+				}
+				continue
+			}
+			if !e.IsDir() || !partitionDirRegex.MatchString(e.Name()) {
+				continue
+			}
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// finishCompaction replaces the partition with the rewrite left in the given directory if it's complete,
+// or removes the rewrite otherwise, in which case the partition is kept as is.
+func (s *storage) finishCompaction(tmpDir string) error {
+	_, err := os.Stat(filepath.Join(tmpDir, compactedFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", tmpDir, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", tmpDir, err)
+	}
+	if err := promoteCompacted(tmpDir); err != nil {
+		return fmt.Errorf("failed to finish the compaction left in %s: %w", tmpDir, err)
+	}
+	s.logger.Info("finished the compaction that was interrupted", "dir", tmpDir)
+	return nil
+}
+
+// openPartitions opens disk partitions in the given directories, and gives them back in no particular order.
+// They get opened concurrently by up to openConcurrency workers since opening one takes a couple of system
+// calls and decoding the meta, while failures are handled in the order of the paths as if they got opened
+// one by one.
+func (s *storage) openPartitions(paths []string) ([]partition, error) {
+	open := openDiskPartition
+	if s.lazyOpen {
+		open = newLazyDiskPartition
+	}
+	s.startup.update(func(p *StartupProgress) {
+		p.PartitionsTotal = len(paths)
+	})
+	parts := make([]partition, len(paths))
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, s.openConcurrency)
+	for i := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			parts[i], errs[i] = open(paths[i], s.retention)
+			s.startup.update(func(p *StartupProgress) {
+				switch {
+				case errs[i] == nil:
+					p.PartitionsOpened++
+				case s.skippedPartition(errs[i]):
+					p.PartitionsSkipped++
+				}
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	partitions := make([]partition, 0, len(paths))
+	for i, err := range errs {
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		s.reportCorruption(err)
+		if errors.Is(err, errInvalidPartition) {
+			if errors.Is(err, ErrCorrupted) {
+				s.logger.Error("skipped the corrupt partition", "err", err)
+			}
+			// It should be recovered by WAL
+			continue
+		}
+		if err != nil && s.bestEffortOpen {
+			s.logger.Error("skipped the partition that failed to open", "dir", paths[i], "err", err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open disk partition for %s: %w", paths[i], err)
+		}
+		partitions = append(partitions, parts[i])
+	}
+	return partitions, nil
+}
@@ -0,0 +1,571 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nakabonne/tstorage"
+)
+
+// Expr is a parsed expression. See Parse for the syntax.
+type Expr interface {
+	fmt.Stringer
+	expr()
+}
+
+// numberExpr is a number literal.
+type numberExpr struct {
+	value float64
+}
+
+// selectorExpr selects series satisfying all the matchers, either at each step or within the range before it.
+type selectorExpr struct {
+	matchers []tstorage.Matcher
+	// zero means an instant selector.
+	window time.Duration
+}
+
+// funcExpr applies the function to the range selector.
+type funcExpr struct {
+	name string
+	arg  *selectorExpr
+}
+
+// aggrExpr aggregates series of the argument into one for each group.
+type aggrExpr struct {
+	fn tstorage.AggrFunc
+	// empty means aggregating all series into one.
+	by  []string
+	arg Expr
+}
+
+// binaryExpr applies the arithmetic operator to both sides.
+type binaryExpr struct {
+	op       byte
+	lhs, rhs Expr
+}
+
+func (*numberExpr) expr()   {}
+func (*selectorExpr) expr() {}
+func (*funcExpr) expr()     {}
+func (*aggrExpr) expr()     {}
+func (*binaryExpr) expr()   {}
+
+func (e *numberExpr) String() string {
+	return strconv.FormatFloat(e.value, 'g', -1, 64)
+}
+
+func (e *selectorExpr) String() string {
+	var b strings.Builder
+	var matchers []string
+	for _, m := range e.matchers {
+		if m.Name == tstorage.MetricNameLabel && m.Type == tstorage.MatchEqual && b.Len() == 0 {
+			b.WriteString(m.Value)
+			continue
+		}
+		matchers = append(matchers, m.String())
+	}
+	if len(matchers) > 0 || b.Len() == 0 {
+		b.WriteString("{" + strings.Join(matchers, ", ") + "}")
+	}
+	if e.window > 0 {
+		b.WriteString("[" + e.window.String() + "]")
+	}
+	return b.String()
+}
+
+func (e *funcExpr) String() string {
+	return e.name + "(" + e.arg.String() + ")"
+}
+
+func (e *aggrExpr) String() string {
+	if len(e.by) == 0 {
+		return e.fn.String() + "(" + e.arg.String() + ")"
+	}
+	return e.fn.String() + " by (" + strings.Join(e.by, ", ") + ") (" + e.arg.String() + ")"
+}
+
+func (e *binaryExpr) String() string {
+	return "(" + e.lhs.String() + " " + string(e.op) + " " + e.rhs.String() + ")"
+}
+
+var aggrFuncs = map[string]tstorage.AggrFunc{
+	"sum":   tstorage.AggrSum,
+	"avg":   tstorage.AggrAvg,
+	"min":   tstorage.AggrMin,
+	"max":   tstorage.AggrMax,
+	"count": tstorage.AggrCount,
+}
+
+var rangeFuncs = map[string]bool{
+	"rate":     true,
+	"increase": true,
+}
+
+// Parse parses the given expression, which consists of:
+//
+//	selectors:    metric, metric{label="value", ...} with =, !=, =~ and !~, or {__name__="metric", ...}
+//	functions:    rate(selector[5m]) and increase(selector[5m])
+//	aggregations: sum, avg, min, max and count, optionally grouped like sum by (host) (expr) or sum(expr) by (host)
+//	arithmetic:   +, -, * and / between numbers and expressions, along with parentheses
+//
+// Durations consist of a number and a unit, which is one of ms, s, m, h, d and w, such as 1h30m.
+func Parse(input string) (Expr, error) {
+	p := &parser{lexer: lexer{input: input}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return e, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokDuration
+	// one of + - * / ( ) { } [ ] , = != =~ !~
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of input"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+type lexer struct {
+	input string
+	pos   int
+	// whether a duration is expected, which follows '['.
+	inBrackets bool
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	c := l.input[l.pos]
+	switch {
+	case l.inBrackets && isDigit(c):
+		for l.pos < len(l.input) && (isDigit(l.input[l.pos]) || isLetter(l.input[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokDuration, text: l.input[start:l.pos], pos: start}, nil
+	case isDigit(c) || (c == '.' && l.pos+1 < len(l.input) && isDigit(l.input[l.pos+1])):
+		for l.pos < len(l.input) && (isDigit(l.input[l.pos]) || l.input[l.pos] == '.') {
+			l.pos++
+		}
+		if l.pos < len(l.input) && (l.input[l.pos] == 'e' || l.input[l.pos] == 'E') {
+			l.pos++
+			if l.pos < len(l.input) && (l.input[l.pos] == '+' || l.input[l.pos] == '-') {
+				l.pos++
+			}
+			for l.pos < len(l.input) && isDigit(l.input[l.pos]) {
+				l.pos++
+			}
+		}
+		return token{kind: tokNumber, text: l.input[start:l.pos], pos: start}, nil
+	case isLetter(c) || c == '_' || c == ':':
+		for l.pos < len(l.input) && isIdentChar(l.input[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.input[start:l.pos], pos: start}, nil
+	case c == '"' || c == '\'':
+		return l.lexString(c)
+	case c == '!' || c == '=':
+		l.pos++
+		if l.pos < len(l.input) && (l.input[l.pos] == '=' || l.input[l.pos] == '~') && !(c == '=' && l.input[l.pos] == '=') {
+			l.pos++
+		} else if c == '!' {
+			return token{}, fmt.Errorf("unexpected character '!' at %d", start)
+		}
+		return token{kind: tokOp, text: l.input[start:l.pos], pos: start}, nil
+	case strings.IndexByte("+-*/(){}[],", c) >= 0:
+		l.pos++
+		switch c {
+		case '[':
+			l.inBrackets = true
+		case ']':
+			l.inBrackets = false
+		}
+		return token{kind: tokOp, text: string(c), pos: start}, nil
+	default:
+		return token{}, fmt.Errorf("unexpected character %q at %d", c, start)
+	}
+}
+
+// lexString reads a string quoted with the given character, which allows the escape sequences Go does.
+func (l *lexer) lexString(quote byte) (token, error) {
+	start := l.pos
+	for l.pos++; l.pos < len(l.input); l.pos++ {
+		switch l.input[l.pos] {
+		case '\\':
+			l.pos++
+		case quote:
+			l.pos++
+			body := l.input[start+1 : l.pos-1]
+			if quote == '\'' {
+				// Requote to let strconv unescape it.
+				body = strings.ReplaceAll(strings.ReplaceAll(body, `\'`, `'`), `"`, `\"`)
+			}
+			s, err := strconv.Unquote(`"` + body + `"`)
+			if err != nil {
+				return token{}, fmt.Errorf("invalid string at %d: %w", start, err)
+			}
+			return token{kind: tokString, text: s, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unterminated string at %d", start)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isIdentChar reports whether c can be in metric and label names. Dots are allowed for Graphite-style names.
+func isIdentChar(c byte) bool {
+	return isLetter(c) || isDigit(c) || c == '_' || c == ':' || c == '.'
+}
+
+type parser struct {
+	lexer lexer
+	tok   token
+}
+
+func (p *parser) next() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+// expect consumes the given operator.
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("expected %q but got %s", op, p.tok)
+	}
+	return p.next()
+}
+
+// parseExpr parses additions and subtractions of terms.
+func (p *parser) parseExpr() (Expr, error) {
+	lhs, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.tok.text[0]
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		rhs, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryExpr{op: op, lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+// parseTerm parses multiplications and divisions of unary expressions.
+func (p *parser) parseTerm() (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*") || p.isOp("/") {
+		op := p.tok.text[0]
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryExpr{op: op, lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if !p.isOp("-") {
+		return p.parsePrimary()
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	e, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := e.(*numberExpr); ok {
+		return &numberExpr{value: -n.value}, nil
+	}
+	return &binaryExpr{op: '*', lhs: &numberExpr{value: -1}, rhs: e}, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	switch {
+	case p.tok.kind == tokNumber:
+		v, err := strconv.ParseFloat(p.tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", p.tok)
+		}
+		return &numberExpr{value: v}, p.next()
+	case p.isOp("("):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case p.isOp("{"):
+		return p.parseSelector("")
+	case p.tok.kind == tokIdent:
+		name := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if fn, ok := aggrFuncs[name]; ok && (p.isOp("(") || (p.tok.kind == tokIdent && p.tok.text == "by")) {
+			return p.parseAggregation(fn)
+		}
+		if rangeFuncs[name] && p.isOp("(") {
+			return p.parseFunction(name)
+		}
+		return p.parseSelector(name)
+	default:
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+}
+
+func (p *parser) parseAggregation(fn tstorage.AggrFunc) (Expr, error) {
+	e := &aggrExpr{fn: fn}
+	grouped := false
+	if p.tok.kind == tokIdent && p.tok.text == "by" {
+		by, err := p.parseGrouping()
+		if err != nil {
+			return nil, err
+		}
+		e.by, grouped = by, true
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	arg, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	e.arg = arg
+	if !grouped && p.tok.kind == tokIdent && p.tok.text == "by" {
+		if e.by, err = p.parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// parseGrouping parses "by (label, ...)".
+func (p *parser) parseGrouping() ([]string, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	by := make([]string, 0)
+	for !p.isOp(")") {
+		if p.tok.kind != tokIdent {
+			return nil, p.errorf("expected label name but got %s", p.tok)
+		}
+		by = append(by, p.tok.text)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if !p.isOp(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return by, p.expect(")")
+}
+
+func (p *parser) parseFunction(name string) (Expr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	arg, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := arg.(*selectorExpr)
+	if !ok || sel.window == 0 {
+		return nil, p.errorf("%s takes a range selector like metric[5m]", name)
+	}
+	return &funcExpr{name: name, arg: sel}, p.expect(")")
+}
+
+// parseSelector parses the matchers and the range following the given metric, which may be empty.
+func (p *parser) parseSelector(metric string) (Expr, error) {
+	e := &selectorExpr{}
+	if metric != "" {
+		e.matchers = append(e.matchers, tstorage.Matcher{Type: tstorage.MatchEqual, Name: tstorage.MetricNameLabel, Value: metric})
+	}
+	if p.isOp("{") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.isOp("}") {
+			m, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			e.matchers = append(e.matchers, m)
+			if !p.isOp(",") {
+				break
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+	}
+	if len(e.matchers) == 0 {
+		return nil, p.errorf("selector must have at least one matcher")
+	}
+	if p.isOp("[") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokDuration {
+			return nil, p.errorf("expected duration but got %s", p.tok)
+		}
+		window, err := parseDuration(p.tok.text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		e.window = window
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (p *parser) parseMatcher() (tstorage.Matcher, error) {
+	if p.tok.kind != tokIdent {
+		return tstorage.Matcher{}, p.errorf("expected label name but got %s", p.tok)
+	}
+	name := p.tok.text
+	if err := p.next(); err != nil {
+		return tstorage.Matcher{}, err
+	}
+	var t tstorage.MatchType
+	switch {
+	case p.isOp("="):
+		t = tstorage.MatchEqual
+	case p.isOp("!="):
+		t = tstorage.MatchNotEqual
+	case p.isOp("=~"):
+		t = tstorage.MatchRegexp
+	case p.isOp("!~"):
+		t = tstorage.MatchNotRegexp
+	default:
+		return tstorage.Matcher{}, p.errorf("expected match operator but got %s", p.tok)
+	}
+	if err := p.next(); err != nil {
+		return tstorage.Matcher{}, err
+	}
+	if p.tok.kind != tokString {
+		return tstorage.Matcher{}, p.errorf("expected string but got %s", p.tok)
+	}
+	m, err := tstorage.NewMatcher(t, name, p.tok.text)
+	if err != nil {
+		return tstorage.Matcher{}, p.errorf("%v", err)
+	}
+	return m, p.next()
+}
+
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// parseDuration parses the given duration like 1h30m, which has to be positive.
+func parseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	for rest := s; rest != ""; {
+		i := 0
+		for i < len(rest) && isDigit(rest[i]) {
+			i++
+		}
+		j := i
+		for j < len(rest) && isLetter(rest[j]) {
+			j++
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		unit, ok := durationUnits[rest[i:j]]
+		if err != nil || !ok {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d += time.Duration(n) * unit
+		rest = rest[j:]
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,119 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "metric",
+			input: "cpu",
+			want:  "cpu",
+		},
+		{
+			name:  "matchers",
+			input: `cpu{host="a", region=~'us-.*', env!="dev"}`,
+			want:  `cpu{host="a", region=~"us-.*", env!="dev"}`,
+		},
+		{
+			name:  "matchers without metric",
+			input: `{__name__=~"cpu.*",host!~"b"}`,
+			want:  `{__name__=~"cpu.*", host!~"b"}`,
+		},
+		{
+			name:  "rate",
+			input: "rate(http_requests[1h30m])",
+			want:  "rate(http_requests[1h30m0s])",
+		},
+		{
+			name:  "aggregation with grouping first",
+			input: "sum by (host) (rate(requests[5m]))",
+			want:  "sum by (host) (rate(requests[5m0s]))",
+		},
+		{
+			name:  "aggregation with grouping last",
+			input: "avg(cpu) by (host, region)",
+			want:  "avg by (host, region) (cpu)",
+		},
+		{
+			name:  "aggregation named like a metric",
+			input: "count",
+			want:  "count",
+		},
+		{
+			name:  "precedence",
+			input: "1 + 2 * cpu / -4 - (mem - 1)",
+			want:  "((1 + ((2 * cpu) / -4)) - (mem - 1))",
+		},
+		{
+			name:  "negated expression",
+			input: "-cpu",
+			want:  "(-1 * cpu)",
+		},
+		{
+			name:  "dotted metric",
+			input: "servers.host1.cpu",
+			want:  "servers.host1.cpu",
+		},
+		{
+			name:    "empty",
+			input:   "",
+			wantErr: true,
+		},
+		{
+			name:    "empty selector",
+			input:   "{}",
+			wantErr: true,
+		},
+		{
+			name:    "rate without range",
+			input:   "rate(cpu)",
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			input:   "rate(cpu[5x])",
+			wantErr: true,
+		},
+		{
+			name:    "invalid regular expression",
+			input:   `cpu{host=~"("}`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated string",
+			input:   `cpu{host="a}`,
+			wantErr: true,
+		},
+		{
+			name:    "trailing tokens",
+			input:   "cpu mem",
+			wantErr: true,
+		},
+		{
+			name:    "unbalanced parentheses",
+			input:   "(cpu + 1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
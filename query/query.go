@@ -0,0 +1,452 @@
+// Package query evaluates a small PromQL-like expression language against tstorage, so that applications
+// embedding it get a query language without building their own. See Parse for the syntax.
+//
+// Expressions are evaluated at each step within a range, as range queries of Prometheus are.
+// Unlike Prometheus, rate and increase don't extrapolate, and binary operations between series only
+// match ones with exactly the same labels.
+package query
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nakabonne/tstorage"
+)
+
+const defaultLookbackDelta = 5 * time.Minute
+
+// Option is an optional setting for Eval and Query.
+type Option func(*config)
+
+type config struct {
+	// the duration of one unit of timestamps.
+	unit     time.Duration
+	lookback time.Duration
+}
+
+// WithTimestampPrecision specifies the precision of timestamps of the storage, in which durations in
+// expressions and steps get counted. It must be the same as the one given to tstorage.WithTimestampPrecision.
+//
+// Defaults to tstorage.Nanoseconds, as the storage does.
+func WithTimestampPrecision(precision tstorage.TimestampPrecision) Option {
+	return func(c *config) {
+		switch precision {
+		case tstorage.Microseconds:
+			c.unit = time.Microsecond
+		case tstorage.Milliseconds:
+			c.unit = time.Millisecond
+		case tstorage.Seconds:
+			c.unit = time.Second
+		default:
+			c.unit = time.Nanosecond
+		}
+	}
+}
+
+// WithLookbackDelta specifies how far selectors without range look back for the latest data point at each step.
+//
+// Defaults to 5m.
+func WithLookbackDelta(d time.Duration) Option {
+	return func(c *config) {
+		c.lookback = d
+	}
+}
+
+// toUnits converts the given duration into the number of units of timestamps.
+func (c *config) toUnits(d time.Duration) int64 {
+	return int64(d / c.unit)
+}
+
+// Query parses the given expression, and then evaluates it. See Eval.
+func Query(r tstorage.Reader, input string, start, end int64, step time.Duration, opts ...Option) ([]tstorage.Series, error) {
+	e, err := Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	return Eval(r, e, start, end, step, opts...)
+}
+
+// Eval evaluates the given expression at each step from start until end, and then gives back series of
+// the results, whose data points are timestamped at the steps. Steps without results are left out,
+// and so are series without any results. Series are in ascending order of metric and labels.
+//
+// Series given back keep the metric only if they come from selectors as they are.
+// A number as the whole expression gives back a series without metric and labels.
+func Eval(r tstorage.Reader, e Expr, start, end int64, step time.Duration, opts ...Option) ([]tstorage.Series, error) {
+	c := &config{unit: time.Nanosecond, lookback: defaultLookbackDelta}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if start >= end {
+		return nil, fmt.Errorf("start %d must be less than end %d", start, end)
+	}
+	width := c.toUnits(step)
+	if width <= 0 {
+		return nil, fmt.Errorf("step must be at least one unit of the timestamp precision")
+	}
+	if c.toUnits(c.lookback) <= 0 {
+		return nil, fmt.Errorf("lookback delta must be at least one unit of the timestamp precision")
+	}
+	ev := &evaluator{reader: r, config: c, start: start, width: width, numSteps: int((end-start-1)/width + 1)}
+	res, err := ev.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]tstorage.Series, 0, len(res.series))
+	for i := range res.series {
+		if s := ev.toSeries(&res.series[i]); len(s.DataPoints) > 0 {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return lessSeries(&out[i], &out[j])
+	})
+	return out, nil
+}
+
+// series holds results of an expression at each step.
+type series struct {
+	metric string
+	labels []tstorage.Label
+	values []float64
+	// whether each of values is present.
+	ok []bool
+}
+
+// result is either a number or a set of series.
+type result struct {
+	series []series
+	// whether it's a number, which is held as the only series.
+	scalar bool
+}
+
+type evaluator struct {
+	reader   tstorage.Reader
+	config   *config
+	start    int64
+	width    int64
+	numSteps int
+}
+
+func (ev *evaluator) stepAt(i int) int64 {
+	return ev.start + int64(i)*ev.width
+}
+
+func (ev *evaluator) newSeries(metric string, labels []tstorage.Label) series {
+	return series{metric: metric, labels: labels, values: make([]float64, ev.numSteps), ok: make([]bool, ev.numSteps)}
+}
+
+func (ev *evaluator) toSeries(s *series) tstorage.Series {
+	out := tstorage.Series{Metric: s.metric, Labels: s.labels}
+	for i, ok := range s.ok {
+		if ok {
+			out.DataPoints = append(out.DataPoints, &tstorage.DataPoint{Timestamp: ev.stepAt(i), Value: s.values[i]})
+		}
+	}
+	return out
+}
+
+func (ev *evaluator) eval(e Expr) (result, error) {
+	switch e := e.(type) {
+	case *numberExpr:
+		s := ev.newSeries("", nil)
+		for i := range s.values {
+			s.values[i], s.ok[i] = e.value, true
+		}
+		return result{series: []series{s}, scalar: true}, nil
+	case *selectorExpr:
+		if e.window > 0 {
+			return result{}, fmt.Errorf("range selector %s must be given to a function like rate", e)
+		}
+		s, err := ev.evalSelector(e)
+		return result{series: s}, err
+	case *funcExpr:
+		s, err := ev.evalFunc(e)
+		return result{series: s}, err
+	case *aggrExpr:
+		s, err := ev.evalAggregation(e)
+		return result{series: s}, err
+	case *binaryExpr:
+		return ev.evalBinary(e)
+	default:
+		return result{}, fmt.Errorf("unknown expression %s", e)
+	}
+}
+
+// selectSeries selects series the given selector matches, along with data points back to the given duration
+// before the first step.
+func (ev *evaluator) selectSeries(e *selectorExpr, lookback time.Duration) ([]tstorage.Series, error) {
+	end := ev.stepAt(ev.numSteps-1) + 1
+	series, err := ev.reader.SelectSeries(e.matchers, ev.start-ev.config.toUnits(lookback), end)
+	if err != nil && err != tstorage.ErrNoDataPoints {
+		return nil, fmt.Errorf("failed to select %s: %w", e, err)
+	}
+	return series, nil
+}
+
+// evalSelector gives back the latest value within the lookback delta at each step.
+func (ev *evaluator) evalSelector(e *selectorExpr) ([]series, error) {
+	selected, err := ev.selectSeries(e, ev.config.lookback)
+	if err != nil {
+		return nil, err
+	}
+	lookback := ev.config.toUnits(ev.config.lookback)
+	out := make([]series, 0, len(selected))
+	for _, sel := range selected {
+		s := ev.newSeries(sel.Metric, sel.Labels)
+		j := 0
+		for i := 0; i < ev.numSteps; i++ {
+			t := ev.stepAt(i)
+			for j < len(sel.DataPoints) && sel.DataPoints[j].Timestamp <= t {
+				j++
+			}
+			// The latest one at or before the step.
+			if j > 0 && sel.DataPoints[j-1].Timestamp > t-lookback {
+				s.values[i], s.ok[i] = sel.DataPoints[j-1].Value, true
+			}
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// evalFunc gives back increases, taking decreases as counter resets, between data points within the window
+// before each step, which are divided by the window in seconds for rate.
+func (ev *evaluator) evalFunc(e *funcExpr) ([]series, error) {
+	selected, err := ev.selectSeries(e.arg, e.arg.window)
+	if err != nil {
+		return nil, err
+	}
+	window := ev.config.toUnits(e.arg.window)
+	if window <= 0 {
+		return nil, fmt.Errorf("range of %s must be at least one unit of the timestamp precision", e)
+	}
+	out := make([]series, 0, len(selected))
+	for _, sel := range selected {
+		s := ev.newSeries("", sel.Labels)
+		points := sel.DataPoints
+		var from, to int
+		for i := 0; i < ev.numSteps; i++ {
+			t := ev.stepAt(i)
+			// Data points within (t-window, t].
+			for from < len(points) && points[from].Timestamp <= t-window {
+				from++
+			}
+			for to < len(points) && points[to].Timestamp <= t {
+				to++
+			}
+			if to-from < 2 {
+				continue
+			}
+			var increase float64
+			for k := from + 1; k < to; k++ {
+				if d := points[k].Value - points[k-1].Value; d >= 0 {
+					increase += d
+				} else {
+					increase += points[k].Value
+				}
+			}
+			if e.name == "rate" {
+				increase /= e.arg.window.Seconds()
+			}
+			s.values[i], s.ok[i] = increase, true
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// evalAggregation aggregates values of series in each group at each step.
+func (ev *evaluator) evalAggregation(e *aggrExpr) ([]series, error) {
+	arg, err := ev.eval(e.arg)
+	if err != nil {
+		return nil, err
+	}
+	if arg.scalar {
+		return nil, fmt.Errorf("%s takes series rather than a number", e.fn)
+	}
+	names := append([]string(nil), e.by...)
+	sort.Strings(names)
+
+	type group struct {
+		series series
+		counts []int
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	for _, s := range arg.series {
+		metric, labels := groupKey(&s, names)
+		key := labelsKey(metric, labels)
+		g, ok := index[key]
+		if !ok {
+			g = &group{series: ev.newSeries(metric, labels), counts: make([]int, ev.numSteps)}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		for i, ok := range s.ok {
+			if !ok {
+				continue
+			}
+			v, n := s.values[i], g.counts[i]
+			acc := &g.series.values[i]
+			switch {
+			case e.fn == tstorage.AggrCount:
+				*acc++
+			case n == 0:
+				*acc = v
+			case e.fn == tstorage.AggrMin:
+				*acc = math.Min(*acc, v)
+			case e.fn == tstorage.AggrMax:
+				*acc = math.Max(*acc, v)
+			default:
+				*acc += v
+			}
+			g.counts[i]++
+			g.series.ok[i] = true
+		}
+	}
+	out := make([]series, 0, len(groups))
+	for _, g := range groups {
+		if e.fn == tstorage.AggrAvg {
+			for i, n := range g.counts {
+				if n > 0 {
+					g.series.values[i] /= float64(n)
+				}
+			}
+		}
+		out = append(out, g.series)
+	}
+	return out, nil
+}
+
+// evalBinary applies the operator to each pair of values at each step. Numbers are applied to all series,
+// and series of both sides are matched by their labels.
+func (ev *evaluator) evalBinary(e *binaryExpr) (result, error) {
+	lhs, err := ev.eval(e.lhs)
+	if err != nil {
+		return result{}, err
+	}
+	rhs, err := ev.eval(e.rhs)
+	if err != nil {
+		return result{}, err
+	}
+	apply := func(l, r *series, labels []tstorage.Label) series {
+		s := ev.newSeries("", labels)
+		for i := range s.values {
+			if l.ok[i] && r.ok[i] {
+				s.values[i], s.ok[i] = applyOp(e.op, l.values[i], r.values[i]), true
+			}
+		}
+		return s
+	}
+	switch {
+	case lhs.scalar && rhs.scalar:
+		return result{series: []series{apply(&lhs.series[0], &rhs.series[0], nil)}, scalar: true}, nil
+	case lhs.scalar:
+		out := make([]series, 0, len(rhs.series))
+		for i := range rhs.series {
+			out = append(out, apply(&lhs.series[0], &rhs.series[i], rhs.series[i].labels))
+		}
+		return result{series: out}, nil
+	case rhs.scalar:
+		out := make([]series, 0, len(lhs.series))
+		for i := range lhs.series {
+			out = append(out, apply(&lhs.series[i], &rhs.series[0], lhs.series[i].labels))
+		}
+		return result{series: out}, nil
+	}
+	byLabels := make(map[string]*series, len(rhs.series))
+	for i := range rhs.series {
+		key := labelsKey("", rhs.series[i].labels)
+		if _, ok := byLabels[key]; ok {
+			return result{}, fmt.Errorf("more than one series on the right side of %s share labels %s", e, key)
+		}
+		byLabels[key] = &rhs.series[i]
+	}
+	out := make([]series, 0, len(lhs.series))
+	seen := make(map[string]struct{}, len(lhs.series))
+	for i := range lhs.series {
+		key := labelsKey("", lhs.series[i].labels)
+		r, ok := byLabels[key]
+		if !ok {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			return result{}, fmt.Errorf("more than one series on the left side of %s share labels %s", e, key)
+		}
+		seen[key] = struct{}{}
+		out = append(out, apply(&lhs.series[i], r, lhs.series[i].labels))
+	}
+	return result{series: out}, nil
+}
+
+func applyOp(op byte, l, r float64) float64 {
+	switch op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	default:
+		return l / r
+	}
+}
+
+// groupKey gives back the metric and labels identifying the group the given series belongs to,
+// out of the given label names in ascending order.
+func groupKey(s *series, names []string) (string, []tstorage.Label) {
+	var (
+		metric string
+		labels []tstorage.Label
+	)
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		if name == tstorage.MetricNameLabel {
+			metric = s.metric
+			continue
+		}
+		for _, l := range s.labels {
+			if l.Name == name {
+				labels = append(labels, l)
+				break
+			}
+		}
+	}
+	return metric, labels
+}
+
+// labelsKey gives back a string identifying the given metric and labels in ascending order of name.
+func labelsKey(metric string, labels []tstorage.Label) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("%q{", metric))
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(fmt.Sprintf("%s=%q", l.Name, l.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// lessSeries reports whether a precedes b in ascending order of metric, and then labels.
+func lessSeries(a, b *tstorage.Series) bool {
+	if a.Metric != b.Metric {
+		return a.Metric < b.Metric
+	}
+	for i := 0; i < len(a.Labels) && i < len(b.Labels); i++ {
+		if a.Labels[i].Name != b.Labels[i].Name {
+			return a.Labels[i].Name < b.Labels[i].Name
+		}
+		if a.Labels[i].Value != b.Labels[i].Value {
+			return a.Labels[i].Value < b.Labels[i].Value
+		}
+	}
+	return len(a.Labels) < len(b.Labels)
+}
@@ -0,0 +1,190 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nakabonne/tstorage"
+)
+
+const base int64 = 1600000000
+
+func newTestStorage(t *testing.T) tstorage.Storage {
+	t.Helper()
+	s, err := tstorage.NewStorage(tstorage.WithTimestampPrecision(tstorage.Seconds))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	var rows []tstorage.Row
+	for i := int64(0); i <= 120; i += 10 {
+		rows = append(rows,
+			tstorage.Row{Metric: "requests", Labels: []tstorage.Label{{Name: "host", Value: "a"}}, DataPoint: tstorage.DataPoint{Timestamp: base + i, Value: float64(i)}},
+			tstorage.Row{Metric: "requests", Labels: []tstorage.Label{{Name: "host", Value: "b"}}, DataPoint: tstorage.DataPoint{Timestamp: base + i, Value: float64(2 * i)}},
+		)
+	}
+	rows = append(rows,
+		tstorage.Row{Metric: "cpu", Labels: []tstorage.Label{{Name: "host", Value: "a"}}, DataPoint: tstorage.DataPoint{Timestamp: base, Value: 1}},
+		tstorage.Row{Metric: "cpu", Labels: []tstorage.Label{{Name: "host", Value: "a"}}, DataPoint: tstorage.DataPoint{Timestamp: base + 60, Value: 3}},
+		tstorage.Row{Metric: "cpu", Labels: []tstorage.Label{{Name: "host", Value: "b"}}, DataPoint: tstorage.DataPoint{Timestamp: base + 30, Value: 5}},
+		tstorage.Row{Metric: "resets", DataPoint: tstorage.DataPoint{Timestamp: base + 30, Value: 10}},
+		tstorage.Row{Metric: "resets", DataPoint: tstorage.DataPoint{Timestamp: base + 40, Value: 20}},
+		tstorage.Row{Metric: "resets", DataPoint: tstorage.DataPoint{Timestamp: base + 50, Value: 5}},
+	)
+	require.NoError(t, s.InsertRows(rows))
+	return s
+}
+
+func points(values ...float64) []*tstorage.DataPoint {
+	// Steps of the tests are at 60s, 90s and 120s after base.
+	var out []*tstorage.DataPoint
+	for i, v := range values {
+		out = append(out, &tstorage.DataPoint{Timestamp: base + 60 + int64(i)*30, Value: v})
+	}
+	return out
+}
+
+func TestQuery(t *testing.T) {
+	s := newTestStorage(t)
+	hostA := []tstorage.Label{{Name: "host", Value: "a"}}
+	hostB := []tstorage.Label{{Name: "host", Value: "b"}}
+	tests := []struct {
+		name    string
+		input   string
+		opts    []Option
+		want    []tstorage.Series
+		wantErr bool
+	}{
+		{
+			name:  "instant selector",
+			input: "cpu",
+			want: []tstorage.Series{
+				{Metric: "cpu", Labels: hostA, DataPoints: points(3, 3, 3)},
+				{Metric: "cpu", Labels: hostB, DataPoints: points(5, 5, 5)},
+			},
+		},
+		{
+			name:  "instant selector with short lookback",
+			input: `cpu{host=~"a|b"}`,
+			opts:  []Option{WithLookbackDelta(45 * time.Second)},
+			want: []tstorage.Series{
+				{Metric: "cpu", Labels: hostA, DataPoints: points(3, 3)},
+				{Metric: "cpu", Labels: hostB, DataPoints: points(5)},
+			},
+		},
+		{
+			name:  "increase",
+			input: `increase(requests{host="a"}[1m])`,
+			want: []tstorage.Series{
+				{Labels: hostA, DataPoints: points(50, 50, 50)},
+			},
+		},
+		{
+			name:  "rate",
+			input: "rate(requests[50s])",
+			want: []tstorage.Series{
+				{Labels: hostA, DataPoints: points(0.8, 0.8, 0.8)},
+				{Labels: hostB, DataPoints: points(1.6, 1.6, 1.6)},
+			},
+		},
+		{
+			name:  "increase over a counter reset",
+			input: "increase(resets[31s])",
+			want: []tstorage.Series{
+				{DataPoints: points(15)},
+			},
+		},
+		{
+			name:  "sum",
+			input: "sum(increase(requests[1m]))",
+			want: []tstorage.Series{
+				{DataPoints: points(150, 150, 150)},
+			},
+		},
+		{
+			name:  "max by metric",
+			input: `max by (__name__) ({__name__=~"cpu|requests"})`,
+			want: []tstorage.Series{
+				{Metric: "cpu", DataPoints: points(5, 5, 5)},
+				{Metric: "requests", DataPoints: points(120, 180, 240)},
+			},
+		},
+		{
+			name:  "count and avg by host",
+			input: "count(cpu) by (host) + avg by (host) (requests)",
+			want: []tstorage.Series{
+				{Labels: hostA, DataPoints: points(61, 91, 121)},
+				{Labels: hostB, DataPoints: points(121, 181, 241)},
+			},
+		},
+		{
+			name:  "series matched by labels",
+			input: "requests - cpu * 2",
+			want: []tstorage.Series{
+				{Labels: hostA, DataPoints: points(54, 84, 114)},
+				{Labels: hostB, DataPoints: points(110, 170, 230)},
+			},
+		},
+		{
+			name:  "numbers",
+			input: "(1 + 2) / 4",
+			want: []tstorage.Series{
+				{DataPoints: points(0.75, 0.75, 0.75)},
+			},
+		},
+		{
+			name:  "no series",
+			input: "unknown",
+			want:  []tstorage.Series{},
+		},
+		{
+			name:    "range selector out of function",
+			input:   "cpu[1m]",
+			wantErr: true,
+		},
+		{
+			name:    "aggregating a number",
+			input:   "sum(1)",
+			wantErr: true,
+		},
+		{
+			name:    "series sharing labels",
+			input:   "cpu + {__name__=~\"cpu|requests\"}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithTimestampPrecision(tstorage.Seconds)}, tt.opts...)
+			got, err := Query(s, tt.input, base+60, base+121, 30*time.Second, opts...)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, len(tt.want), len(got))
+			for i := range tt.want {
+				assert.Equal(t, tt.want[i].Metric, got[i].Metric)
+				assert.Equal(t, tt.want[i].Labels, got[i].Labels)
+				require.Equal(t, len(tt.want[i].DataPoints), len(got[i].DataPoints))
+				for j, p := range tt.want[i].DataPoints {
+					assert.Equal(t, p.Timestamp, got[i].DataPoints[j].Timestamp)
+					assert.InDelta(t, p.Value, got[i].DataPoints[j].Value, 1e-9)
+				}
+			}
+		})
+	}
+}
+
+func TestEval_invalidRange(t *testing.T) {
+	s := newTestStorage(t)
+	e, err := Parse("cpu")
+	require.NoError(t, err)
+
+	_, err = Eval(s, e, base+60, base+60, time.Second, WithTimestampPrecision(tstorage.Seconds))
+	assert.Error(t, err)
+	_, err = Eval(s, e, base, base+60, time.Millisecond, WithTimestampPrecision(tstorage.Seconds))
+	assert.Error(t, err)
+}
@@ -0,0 +1,36 @@
+package tstorage
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type queryBudgetKey struct{}
+
+// queryBudget tracks the number of bytes materialized by a query.
+type queryBudget struct {
+	limit int64
+	used  int64
+}
+
+// withQueryBudget gives back a context that carries the budget of the given bytes.
+// Giving 0 means no limit.
+func withQueryBudget(ctx context.Context, limit int64) context.Context {
+	if limit <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, queryBudgetKey{}, &queryBudget{limit: limit})
+}
+
+// chargeQueryMemory accounts for the given number of data points materialized by the query,
+// and gives back ErrQueryMemoryLimitExceeded once it exceeds the budget carried by ctx.
+func chargeQueryMemory(ctx context.Context, numPoints int) error {
+	b, ok := ctx.Value(queryBudgetKey{}).(*queryBudget)
+	if !ok {
+		return nil
+	}
+	if atomic.AddInt64(&b.used, int64(numPoints)*memoryPointSize) > b.limit {
+		return ErrQueryMemoryLimitExceeded
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Select_memoryLimit(t *testing.T) {
+	part := newMemoryPartition(nil, 1*time.Hour, Seconds)
+	_, err := part.insertRows([]Row{
+		{DataPoint: DataPoint{Timestamp: 1}, Metric: "metric1"},
+		{DataPoint: DataPoint{Timestamp: 2}, Metric: "metric1"},
+	})
+	require.NoError(t, err)
+	list := newPartitionList()
+	list.insert(part)
+	s := &storage{partitionList: list, queryMemoryLimit: memoryPointSize}
+
+	_, err = s.Select("metric1", nil, 1, 3)
+	assert.ErrorIs(t, err, ErrQueryMemoryLimitExceeded)
+
+	got, err := s.Select("metric1", nil, 1, 3, SelectMemoryLimit(2*memoryPointSize))
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+
+	got, err = s.Select("metric1", nil, 1, 2)
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+}
@@ -0,0 +1,142 @@
+package tstorage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// queryCache is an LRU cache of the results of queries over disk partitions, bounded by the approximate number
+// of bytes the data points take. A nil cache caches nothing.
+//
+// Results are keyed by the generation of the partition list, so that ones over partitions since swapped or
+// removed never get hit. Changes to disk partitions that keep the list as is, such as late writes and deletions,
+// have to invalidate the whole cache instead.
+type queryCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	// epoch is bumped every time the cache gets invalidated, in order to reject results of queries
+	// that began before that.
+	epoch   uint64
+	lru     *list.List
+	entries map[queryCacheKey]*list.Element
+}
+
+type queryCacheKey struct {
+	name       string
+	start      int64
+	end        int64
+	generation uint64
+}
+
+type queryCacheEntry struct {
+	key    queryCacheKey
+	points []DataPoint
+}
+
+func newQueryCache(maxBytes int64) *queryCache {
+	return &queryCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[queryCacheKey]*list.Element),
+	}
+}
+
+// get gives back the data points cached for the given key, which must not be modified.
+func (c *queryCache) get(key queryCacheKey) ([]DataPoint, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*queryCacheEntry).points, true
+}
+
+// currentEpoch gives back the epoch to be passed to put, which must be taken before the query begins.
+func (c *queryCache) currentEpoch() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// put caches the given data points for the key, which must not be modified afterwards, unless the cache got
+// invalidated since the given epoch or they don't fit in the cache at all. The least recently used results
+// get evicted to make room for them.
+func (c *queryCache) put(key queryCacheKey, epoch uint64, points []DataPoint) {
+	if c == nil {
+		return
+	}
+	size := int64(len(points)) * memoryPointSize
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch {
+		return
+	}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	for c.bytes+size > c.maxBytes {
+		c.evict(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&queryCacheEntry{key: key, points: points})
+	c.bytes += size
+}
+
+func (c *queryCache) evict(e *list.Element) {
+	entry := c.lru.Remove(e).(*queryCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.points)) * memoryPointSize
+}
+
+// invalidate drops all cached results, along with rejecting results of queries in progress.
+func (c *queryCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.lru.Init()
+	c.entries = make(map[queryCacheKey]*list.Element)
+	c.bytes = 0
+}
+
+// queryCacheKey gives back the key to cache the result of the query over the given partitions, taken from
+// the partition list in the given generation. Only queries over disk partitions without any value predicate
+// are cacheable, since memory partitions keep changing. Memory partitions out of range must not be able to
+// accept data points within the range either, which empty ones can.
+func (s *storage) queryCacheKey(ctx context.Context, metric string, labels []Label, start, end int64, parts []partition, generation uint64) (queryCacheKey, bool) {
+	if s.queryCache == nil || valuePredicate(ctx) != nil {
+		return queryCacheKey{}, false
+	}
+	for _, part := range parts {
+		if _, ok := part.(*diskPartition); !ok {
+			return queryCacheKey{}, false
+		}
+	}
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		m, ok := iterator.value().(*memoryPartition)
+		if ok && (m.size() == 0 || m.minTimestamp() <= end) {
+			return queryCacheKey{}, false
+		}
+	}
+	return queryCacheKey{
+		name:       marshalMetricName(metric, labels),
+		start:      start,
+		end:        end,
+		generation: generation,
+	}, true
+}
@@ -0,0 +1,97 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_queryCache(t *testing.T) {
+	c := newQueryCache(3 * memoryPointSize)
+	key1 := queryCacheKey{name: "metric1", start: 1, end: 10}
+	key2 := queryCacheKey{name: "metric2", start: 1, end: 10}
+	key3 := queryCacheKey{name: "metric3", start: 1, end: 10}
+
+	c.put(key1, c.currentEpoch(), []DataPoint{{Timestamp: 1}})
+	c.put(key2, c.currentEpoch(), []DataPoint{{Timestamp: 2}, {Timestamp: 3}})
+	got, ok := c.get(key1)
+	require.True(t, ok)
+	assert.Equal(t, []DataPoint{{Timestamp: 1}}, got)
+
+	// The least recently used one gets evicted.
+	c.put(key3, c.currentEpoch(), []DataPoint{{Timestamp: 4}})
+	_, ok = c.get(key2)
+	assert.False(t, ok)
+	_, ok = c.get(key1)
+	assert.True(t, ok)
+
+	// Ones not fitting in the cache never get cached.
+	c.put(key2, c.currentEpoch(), make([]DataPoint, 4))
+	_, ok = c.get(key2)
+	assert.False(t, ok)
+
+	// Results of queries that began before invalidation get rejected.
+	epoch := c.currentEpoch()
+	c.invalidate()
+	_, ok = c.get(key1)
+	assert.False(t, ok)
+	c.put(key1, epoch, []DataPoint{{Timestamp: 1}})
+	_, ok = c.get(key1)
+	assert.False(t, ok)
+
+	var nilCache *queryCache
+	nilCache.put(key1, nilCache.currentEpoch(), []DataPoint{{Timestamp: 1}})
+	_, ok = nilCache.get(key1)
+	assert.False(t, ok)
+}
+
+func Test_storage_WithQueryCache(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionMaxPoints(3))
+	require.NoError(t, err)
+	for ts := int64(1600000000); ts < 1600000006; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}}}))
+	}
+	require.NoError(t, s.Close())
+
+	st, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithQueryCache(1<<20))
+	require.NoError(t, err)
+	defer st.Close()
+	s = st
+	cache := st.(*storage).queryCache
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000010, Value: 0.1}}}))
+
+	got, err := s.Select("metric1", nil, 1600000000, 1600000006)
+	require.NoError(t, err)
+	assert.Len(t, got, 6)
+	assert.Len(t, cache.entries, 1)
+	// Results given back never share the cached data points.
+	got[0].Value = 1
+	points, err := s.SelectInto(nil, "metric1", nil, 1600000000, 1600000006, SelectDescending())
+	require.NoError(t, err)
+	assert.Equal(t, DataPoint{Timestamp: 1600000005, Value: 0.1}, points[0])
+	assert.Equal(t, DataPoint{Timestamp: 1600000000, Value: 0.1}, points[5])
+
+	// Late writes into disk partitions invalidate results.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}}}))
+	assert.Empty(t, cache.entries)
+	got, err = s.Select("metric1", nil, 1600000000, 1600000006)
+	require.NoError(t, err)
+	assert.Len(t, got, 7)
+
+	// So do deletions.
+	require.NoError(t, s.Delete("metric1", nil, 1600000000, 1600000003))
+	got, err = s.Select("metric1", nil, 1600000000, 1600000006)
+	require.NoError(t, err)
+	assert.Len(t, got, 3)
+
+	// Ranges memory partitions may hold never get cached.
+	cache.invalidate()
+	_, err = s.Select("metric1", nil, 1600000000, 1600000011)
+	require.NoError(t, err)
+	assert.Empty(t, cache.entries)
+
+	_, err = NewStorage(WithQueryCache(-1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package tstorage
+
+import (
+	"context"
+	"sync"
+)
+
+// selectPartitions selects data points of the given metric from each of the given partitions, and gives back
+// the results and the errors in the same order as the partitions.
+//
+// Disk partitions get decoded concurrently as long as query workers shared across queries are available,
+// while the rest get decoded by the calling goroutine, so that a query never waits for the others to
+// release workers.
+func (s *storage) selectPartitions(ctx context.Context, parts []partition, metric string, labels []Label, start, end int64) ([][]*DataPoint, []error) {
+	results := make([][]*DataPoint, len(parts))
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		if _, ok := part.(*diskPartition); ok {
+			select {
+			case s.queryWorkers <- struct{}{}:
+				wg.Add(1)
+				go func(i int) {
+					defer func() {
+						<-s.queryWorkers
+						wg.Done()
+					}()
+					results[i], errs[i] = parts[i].selectDataPoints(ctx, metric, labels, start, end)
+				}(i)
+				continue
+			default:
+			}
+		}
+		results[i], errs[i] = part.selectDataPoints(ctx, metric, labels, start, end)
+	}
+	wg.Wait()
+	return results, errs
+}
@@ -0,0 +1,37 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_WithQueryConcurrency(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionMaxPoints(3))
+	require.NoError(t, err)
+	for ts := int64(1600000000); ts < 1600000020; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+	}
+	require.NoError(t, s.Close())
+
+	var want []*DataPoint
+	for _, n := range []int{0, 1, 4} {
+		s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithQueryConcurrency(n))
+		require.NoError(t, err)
+		got, err := s.Select("metric1", nil, 1600000000, 1600000020)
+		require.NoError(t, err)
+		require.Len(t, got, 20)
+		if want == nil {
+			want = got
+		}
+		assert.Equal(t, want, got, "concurrency %d", n)
+		// All workers get released.
+		assert.Zero(t, len(s.(*storage).queryWorkers))
+		require.NoError(t, s.Close())
+	}
+
+	_, err = NewStorage(WithQueryConcurrency(-1))
+	assert.Error(t, err)
+}
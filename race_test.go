@@ -0,0 +1,7 @@
+//go:build race
+
+package tstorage
+
+// raceEnabled reports whether the race detector is on, under which sync.Pool drops items at random
+// and so allocations can't be counted.
+const raceEnabled = true
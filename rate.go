@@ -0,0 +1,50 @@
+package tstorage
+
+import (
+	"fmt"
+	"time"
+)
+
+func (s *storage) Delta(metric string, labels []Label, start, end int64, window time.Duration, opts ...SelectOption) ([]*DataPoint, error) {
+	width := toPrecision(window, s.timestampPrecision)
+	if width <= 0 {
+		return nil, fmt.Errorf("window must be at least one unit of the timestamp precision")
+	}
+	points, err := s.SelectInto(nil, metric, labels, start, end, ascending(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	return counterDeltas(points, start, width), nil
+}
+
+func (s *storage) Rate(metric string, labels []Label, start, end int64, window time.Duration, opts ...SelectOption) ([]*DataPoint, error) {
+	deltas, err := s.Delta(metric, labels, start, end, window, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deltas {
+		d.Value /= window.Seconds()
+	}
+	return deltas, nil
+}
+
+// counterDeltas sums up increases of the counter between consecutive data points sorted by timestamp,
+// for each window of the given width counted from start. A decrease is taken as a reset to zero,
+// hence the value after it is the increase as it is.
+func counterDeltas(points []DataPoint, start, width int64) []*DataPoint {
+	out := make([]*DataPoint, 0)
+	var last *DataPoint
+	for i := 1; i < len(points); i++ {
+		increase := points[i].Value - points[i-1].Value
+		if increase < 0 {
+			increase = points[i].Value
+		}
+		window := start + (points[i].Timestamp-start)/width*width
+		if last == nil || last.Timestamp != window {
+			last = &DataPoint{Timestamp: window}
+			out = append(out, last)
+		}
+		last.Value += increase
+	}
+	return out
+}
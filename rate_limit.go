@@ -0,0 +1,139 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by InsertRows when rows exceed the ingest rate limit of their metric.
+// The concrete error is a *RateLimitError, which tells the details. See WithMetricRateLimit.
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimitError describes a metric whose data points got rejected due to its ingest rate limit.
+type RateLimitError struct {
+	Metric string
+	// The limit in data points per second.
+	Limit float64
+	// The number of data points rejected.
+	Rejected int
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%d data points of metric %q exceed the rate limit of %g points/sec", e.Rejected, e.Metric, e.Limit)
+}
+
+// Is makes errors.Is(err, ErrRateLimited) report true.
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// tokenBucket allows events at the rate, with bursts of up to burst events.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// refill adds tokens accumulated since the last refill.
+func (b *tokenBucket) refill(now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = b.burst
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// rateLimiter limits the ingest rate of each metric it has a bucket for.
+// The zero value limits nothing.
+type rateLimiter struct {
+	mu sync.Mutex
+	// A hash map from metric name without labels to its bucket.
+	buckets map[string]*tokenBucket
+}
+
+func (r *rateLimiter) setLimit(metric string, pointsPerSec float64, burst int) {
+	if r.buckets == nil {
+		r.buckets = make(map[string]*tokenBucket)
+	}
+	r.buckets[metric] = &tokenBucket{rate: pointsPerSec, burst: float64(burst)}
+}
+
+// validate ensures all limits are valid.
+func (r *rateLimiter) validate() error {
+	for metric, b := range r.buckets {
+		if b.rate <= 0 {
+			return fmt.Errorf("rate limit of metric %q must be positive", metric)
+		}
+		if b.burst < 1 {
+			return fmt.Errorf("burst of metric %q must be positive", metric)
+		}
+	}
+	return nil
+}
+
+// allow consumes tokens for the given rows, or consumes nothing and gives back a *RateLimitError
+// if any metric runs out of tokens, so that a batch is either accepted or rejected as a whole.
+func (r *rateLimiter) allow(rows []Row) error {
+	counts := r.count(rows)
+	if counts == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for metric, n := range counts {
+		b := r.buckets[metric]
+		b.refill(now)
+		if b.tokens < float64(n) {
+			return &RateLimitError{Metric: metric, Limit: b.rate, Rejected: n}
+		}
+	}
+	for metric, n := range counts {
+		r.buckets[metric].tokens -= float64(n)
+	}
+	return nil
+}
+
+// refund gives back tokens allow consumed for the given rows, which didn't get inserted after all.
+func (r *rateLimiter) refund(rows []Row) {
+	counts := r.count(rows)
+	if counts == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for metric, n := range counts {
+		b := r.buckets[metric]
+		b.tokens += float64(n)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+}
+
+// count gives back the number of the given rows for each metric having a limit, or nil if none.
+func (r *rateLimiter) count(rows []Row) map[string]int {
+	if len(r.buckets) == 0 {
+		return nil
+	}
+	var counts map[string]int
+	for i := range rows {
+		if _, ok := r.buckets[rows[i].Metric]; !ok {
+			continue
+		}
+		if counts == nil {
+			counts = make(map[string]int)
+		}
+		counts[rows[i].Metric]++
+	}
+	return counts
+}
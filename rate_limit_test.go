@@ -0,0 +1,118 @@
+package tstorage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_tokenBucket_refill(t *testing.T) {
+	b := &tokenBucket{rate: 10, burst: 5}
+	now := time.Now()
+	b.refill(now)
+	assert.Equal(t, 5.0, b.tokens)
+
+	b.tokens = 0
+	b.refill(now.Add(200 * time.Millisecond))
+	assert.InDelta(t, 2.0, b.tokens, 1e-9)
+
+	// Never exceeds the burst.
+	b.refill(now.Add(time.Hour))
+	assert.Equal(t, 5.0, b.tokens)
+}
+
+func Test_rateLimiter_allow(t *testing.T) {
+	var r rateLimiter
+	r.setLimit("limited", 1, 3)
+	require.NoError(t, r.validate())
+
+	row := func(metric string) Row {
+		return Row{Metric: metric, DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}
+	}
+	assert.NoError(t, r.allow([]Row{row("limited"), row("limited"), row("other")}))
+
+	// The batch is rejected as a whole, without consuming tokens.
+	err := r.allow([]Row{row("limited"), row("limited")})
+	var rateErr *RateLimitError
+	require.True(t, errors.As(err, &rateErr))
+	assert.Equal(t, &RateLimitError{Metric: "limited", Limit: 1, Rejected: 2}, rateErr)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.NoError(t, r.allow([]Row{row("limited")}))
+
+	// Metrics without limits are never rejected.
+	assert.NoError(t, r.allow([]Row{row("other"), row("other"), row("other"), row("other")}))
+}
+
+func Test_rateLimiter_validate(t *testing.T) {
+	tests := []struct {
+		name         string
+		pointsPerSec float64
+		burst        int
+		wantErr      bool
+	}{
+		{name: "valid", pointsPerSec: 0.5, burst: 1},
+		{name: "zero rate", pointsPerSec: 0, burst: 1, wantErr: true},
+		{name: "zero burst", pointsPerSec: 1, burst: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r rateLimiter
+			r.setLimit("metric1", tt.pointsPerSec, tt.burst)
+			assert.Equal(t, tt.wantErr, r.validate() != nil)
+		})
+	}
+}
+
+func Test_storage_WithMetricRateLimit(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithMetricRateLimit("metric1", 0.001, 2))
+	require.NoError(t, err)
+	defer s.Close()
+
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "host-1"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.1}},
+	}
+	require.NoError(t, s.InsertRows(rows))
+	err = s.InsertRows(rows[:1])
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	_, err = NewStorage(WithMetricRateLimit("metric1", -1, 1))
+	assert.Error(t, err)
+}
+
+func Test_storage_WithMetricRateLimit_overloaded(t *testing.T) {
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithMetricRateLimit("metric1", 0.001, 1),
+		WithWriteConcurrency(1, 1),
+		WithWriteTimeout(time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	rows := []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}
+
+	// Rows rejected for lack of workers give their tokens back.
+	workers := s.(*storage).workers
+	require.True(t, workers.acquire(context.Background(), time.Second))
+	assert.ErrorIs(t, s.InsertRows(rows), ErrOverloaded)
+	workers.release(0)
+	assert.NoError(t, s.InsertRows(rows))
+	assert.ErrorIs(t, s.InsertRows(rows), ErrRateLimited)
+}
+
+func Test_storage_WithMetricRateLimit_seriesLimit(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithMetricRateLimit("metric1", 0.001, 2), WithMaxSeries(1))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000}}}))
+
+	// Rows rejected for the series limit give their tokens back, which leaves the last one to a valid write.
+	err = s.InsertRows([]Row{{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000001}}})
+	assert.ErrorIs(t, err, ErrTooManySeries)
+	assert.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001}}}))
+	assert.ErrorIs(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000002}}}), ErrRateLimited)
+}
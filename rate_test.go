@@ -0,0 +1,94 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_counterDeltas(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []DataPoint
+		want   []*DataPoint
+	}{
+		{
+			name:   "empty",
+			points: []DataPoint{},
+			want:   []*DataPoint{},
+		},
+		{
+			name:   "single data point",
+			points: []DataPoint{{Timestamp: 10, Value: 1}},
+			want:   []*DataPoint{},
+		},
+		{
+			name: "monotonic",
+			points: []DataPoint{
+				{Timestamp: 10, Value: 1},
+				{Timestamp: 15, Value: 3},
+				{Timestamp: 22, Value: 6},
+				// Nothing within 30-39.
+				{Timestamp: 41, Value: 10},
+			},
+			want: []*DataPoint{
+				{Timestamp: 10, Value: 2},
+				{Timestamp: 20, Value: 3},
+				{Timestamp: 40, Value: 4},
+			},
+		},
+		{
+			name: "counter reset",
+			points: []DataPoint{
+				{Timestamp: 10, Value: 5},
+				{Timestamp: 12, Value: 8},
+				{Timestamp: 14, Value: 2},
+				{Timestamp: 16, Value: 4},
+			},
+			want: []*DataPoint{
+				{Timestamp: 10, Value: 7},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, counterDeltas(tt.points, 10, 10))
+		})
+	}
+}
+
+func Test_storage_Rate(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	value := 0.0
+	for ts := int64(1600000000); ts < 1600000120; ts += 10 {
+		value += 5
+		if ts == 1600000080 {
+			// The counter has restarted.
+			value = 5
+		}
+		require.NoError(t, s.InsertRows([]Row{{Metric: "requests_total", DataPoint: DataPoint{Timestamp: ts, Value: value}}}))
+	}
+
+	got, err := s.Delta("requests_total", nil, 1600000000, 1600000120, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1600000000, Value: 25},
+		{Timestamp: 1600000060, Value: 30},
+	}, got)
+
+	got, err = s.Rate("requests_total", nil, 1600000000, 1600000120, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1600000000, Value: 25.0 / 60},
+		{Timestamp: 1600000060, Value: 0.5},
+	}, got)
+
+	_, err = s.Rate("requests_total", nil, 1600000000, 1600000120, time.Millisecond)
+	assert.Error(t, err)
+	_, err = s.Delta("unknown", nil, 1600000000, 1600000120, time.Minute)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
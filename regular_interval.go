@@ -0,0 +1,57 @@
+package tstorage
+
+// Fixed-rate series, such as sensors sampled periodically, have timestamps at a regular interval.
+// Runs of such timestamps are described by (min timestamp, interval, count), which lets the
+// index of a timestamp be computed arithmetically rather than by searching or decoding.
+
+// regularIndex gives back the number of timestamps less than t among n timestamps at minT+k*interval.
+// The interval must be positive.
+func regularIndex(minT, interval int64, n int, t int64) int {
+	if n == 0 || t <= minT {
+		return 0
+	}
+	if t > minT+int64(n-1)*interval {
+		return n
+	}
+	return int((t-minT-1)/interval) + 1
+}
+
+// regularRange gives back the range [i, j) of indices of timestamps within [start, end)
+// among n timestamps at minT+k*interval. The interval must be positive.
+func regularRange(minT, interval int64, n int, start, end int64) (int, int) {
+	i := regularIndex(minT, interval, n, start)
+	j := regularIndex(minT, interval, n, end)
+	if j < i {
+		j = i
+	}
+	return i, j
+}
+
+// intervalTracker detects whether timestamps given in order are at a regular interval.
+// The zero value is ready to use.
+type intervalTracker struct {
+	n         int
+	last      int64
+	interval  int64
+	irregular bool
+}
+
+func (t *intervalTracker) add(timestamp int64) {
+	switch {
+	case t.n == 1:
+		t.interval = timestamp - t.last
+	case t.n > 1 && timestamp-t.last != t.interval:
+		t.irregular = true
+	}
+	t.last = timestamp
+	t.n++
+}
+
+// regularInterval gives back the interval if all timestamps given so far are at a regular
+// positive interval, otherwise 0. At least two timestamps are required to have one.
+func (t *intervalTracker) regularInterval() int64 {
+	if t.n < 2 || t.irregular || t.interval <= 0 {
+		return 0
+	}
+	return t.interval
+}
@@ -0,0 +1,99 @@
+package tstorage
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_regularRange(t *testing.T) {
+	// Timestamps: 10, 15, 20, 25
+	tests := []struct {
+		name       string
+		start, end int64
+		wantI      int
+		wantJ      int
+	}{
+		{name: "whole range", start: math.MinInt64, end: math.MaxInt64, wantI: 0, wantJ: 4},
+		{name: "exact bounds", start: 15, end: 25, wantI: 1, wantJ: 3},
+		{name: "between timestamps", start: 11, end: 21, wantI: 1, wantJ: 3},
+		{name: "before all", start: 0, end: 10, wantI: 0, wantJ: 0},
+		{name: "after all", start: 26, end: 30, wantI: 4, wantJ: 4},
+		{name: "no timestamp within", start: 16, end: 19, wantI: 2, wantJ: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, j := regularRange(10, 5, 4, tt.start, tt.end)
+			assert.Equal(t, tt.wantI, i)
+			assert.Equal(t, tt.wantJ, j)
+		})
+	}
+}
+
+func Test_intervalTracker(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamps []int64
+		want       int64
+	}{
+		{name: "no timestamp", want: 0},
+		{name: "single timestamp", timestamps: []int64{1}, want: 0},
+		{name: "regular", timestamps: []int64{-10, 0, 10, 20}, want: 10},
+		{name: "irregular", timestamps: []int64{0, 10, 21, 30}, want: 0},
+		{name: "duplicate", timestamps: []int64{1, 1}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tracker intervalTracker
+			for _, ts := range tt.timestamps {
+				tracker.add(ts)
+			}
+			assert.Equal(t, tt.want, tracker.regularInterval())
+		})
+	}
+}
+
+func Test_regularInterval_select(t *testing.T) {
+	rows := make([]Row, 0, 100)
+	for i := int64(0); i < 100; i++ {
+		rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1000 + i*15, Value: float64(i)}})
+	}
+	m := newMemoryPartition(nil, time.Hour, Seconds)
+	_, err := m.insertRows(rows)
+	require.NoError(t, err)
+	dir := filepath.Join(t.TempDir(), "p-1")
+	s := &storage{compressor: &nopCompressor{}, chunkSize: 30}
+	require.NoError(t, s.writePartition(dir, m.(*memoryPartition), time.Now()))
+	p, err := openDiskPartition(dir, time.Hour)
+	require.NoError(t, err)
+	d := p.(*diskPartition)
+	for _, c := range d.meta.Metrics["metric1"].Chunks {
+		assert.Equal(t, int64(15), c.Interval)
+	}
+
+	ranges := [][2]int64{{0, 5000}, {1000, 1015}, {1001, 1500}, {1450, 1451}, {1200, 2485}, {2486, 3000}}
+	for _, r := range ranges {
+		var want []*DataPoint
+		for i := range rows {
+			if rows[i].Timestamp >= r[0] && rows[i].Timestamp < r[1] {
+				want = append(want, &DataPoint{Timestamp: rows[i].Timestamp, Value: rows[i].Value})
+			}
+		}
+		for _, part := range []partition{m, d} {
+			got, err := part.selectDataPoints(context.Background(), "metric1", nil, r[0], r[1])
+			if len(want) == 0 {
+				if err == nil {
+					assert.Empty(t, got)
+				}
+				continue
+			}
+			require.NoError(t, err)
+			assert.Equal(t, want, got, "range %v", r)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RestoreStorage rebuilds the data path from the snapshot taken by Storage.Snapshot, so that
+// NewStorage with WithDataPath(dataPath) opens the data as of the snapshot. The data path must not
+// exist or be empty, and the snapshot directory is left as it is.
+//
+// Every partition in the snapshot gets validated before anything is written, hence a *CorruptionError
+// is returned without touching the data path if the snapshot turns out to be broken.
+func RestoreStorage(snapshotDir, dataPath string) error {
+	info, err := os.Stat(snapshotDir)
+	if err != nil {
+		return fmt.Errorf("failed to stat snapshot directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("snapshot %s is not a directory", snapshotDir)
+	}
+	entries, err := os.ReadDir(dataPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("data directory %s is not empty", dataPath)
+	}
+
+	if err := validateSnapshot(snapshotDir); err != nil {
+		return err
+	}
+
+	// Build it in a temporary directory and then rename it, so that the data path never holds a partial one.
+	tmpDir := filepath.Clean(dataPath) + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", tmpDir, err)
+	}
+	if err := restore(snapshotDir, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to restore from %s: %w", snapshotDir, err)
+	}
+	// Rename never replaces a non-empty directory, which has been checked to be empty.
+	if err := os.Remove(dataPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to remove %s: %w", dataPath, err)
+	}
+	if err := os.Rename(tmpDir, dataPath); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpDir, dataPath, err)
+	}
+	return nil
+}
+
+// listSnapshot gives back the names of partition directories and rollup directories in the snapshot.
+func listSnapshot(snapshotDir string) (partitions, rollups []string, err error) {
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+	for _, e := range entries {
+		switch {
+		case !e.IsDir():
+		case partitionDirRegex.MatchString(e.Name()):
+			partitions = append(partitions, e.Name())
+		case strings.HasPrefix(e.Name(), rollupDirPrefix):
+			rollups = append(rollups, e.Name())
+		}
+	}
+	return partitions, rollups, nil
+}
+
+// validateSnapshot validates the partitions and tombstones in the snapshot, and then the ones of rollups.
+func validateSnapshot(snapshotDir string) error {
+	partitions, rollups, err := listSnapshot(snapshotDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range partitions {
+		if err := validatePartitionDir(filepath.Join(snapshotDir, name)); err != nil {
+			return err
+		}
+	}
+	// Loading tombstones without changing anything validates them.
+	var tombstones tombstoneSet
+	if err := tombstones.load(snapshotDir); err != nil {
+		return err
+	}
+	for _, name := range rollups {
+		if err := validateSnapshot(filepath.Join(snapshotDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore copies the partitions, the WAL, tombstones and rollups in the snapshot into the given directory.
+// Files that get appended once opened, namely late files and WAL segments, are copied so that the snapshot
+// stays intact, while the others are hard-linked if possible.
+func restore(snapshotDir, dir string) error {
+	partitions, rollups, err := listSnapshot(snapshotDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, walDirName), fs.ModePerm); err != nil {
+		return err
+	}
+	for _, name := range partitions {
+		src, dst := filepath.Join(snapshotDir, name), filepath.Join(dir, name)
+		if err := os.Mkdir(dst, fs.ModePerm); err != nil {
+			return err
+		}
+		files, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			if f.Name() == lateFileName {
+				err = copyFile(filepath.Join(src, f.Name()), filepath.Join(dst, f.Name()), -1)
+			} else {
+				err = linkOrCopyFile(filepath.Join(src, f.Name()), filepath.Join(dst, f.Name()))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	segments, err := os.ReadDir(filepath.Join(snapshotDir, walDirName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, f := range segments {
+		if f.IsDir() {
+			continue
+		}
+		if err := copyFile(filepath.Join(snapshotDir, walDirName, f.Name()), filepath.Join(dir, walDirName, f.Name()), -1); err != nil {
+			return err
+		}
+	}
+	err = copyFile(filepath.Join(snapshotDir, tombstonesFileName), filepath.Join(dir, tombstonesFileName), -1)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, name := range rollups {
+		if err := restore(filepath.Join(snapshotDir, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePartitionDir ensures the disk partition in the given directory can be opened, without mapping
+// the data file into memory.
+func validatePartitionDir(dirPath string) error {
+	info, err := os.Stat(filepath.Join(dirPath, dataFileName))
+	if err != nil {
+		return newCorruptionError(dirPath, "", fmt.Errorf("failed to stat data file: %w", err))
+	}
+	b, err := readMetaFile(dirPath)
+	if err != nil {
+		return newCorruptionError(dirPath, "", fmt.Errorf("failed to read metadata: %w", err))
+	}
+	m, err := unmarshalMeta(b)
+	if err != nil {
+		return newCorruptionError(dirPath, "", fmt.Errorf("failed to decode metadata: %w", err))
+	}
+	if err := m.checkVersion(); err != nil {
+		return fmt.Errorf("%s: %w", dirPath, err)
+	}
+	if err := m.verify(); err != nil {
+		return newCorruptionError(dirPath, "", fmt.Errorf("metadata: %w", err))
+	}
+	if err := m.validate(info.Size()); err != nil {
+		return newCorruptionError(dirPath, "", fmt.Errorf("invalid metadata: %w", err))
+	}
+	if _, err := readLatePoints(dirPath); err != nil {
+		return newCorruptionError(dirPath, "", err)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package tstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// rollupDirPrefix is the prefix of the directories under the data path holding rollups.
+// It must not match partitionDirRegex so that they never get opened as partitions.
+const rollupDirPrefix = "rollup-"
+
+// rollup is a coarser resolution of data points, kept in a storage of its own. See WithRollup.
+type rollup struct {
+	step      time.Duration
+	retention time.Duration
+	fn        AggrFunc
+	storage   *storage
+}
+
+func rollupDirName(step time.Duration) string {
+	return rollupDirPrefix + step.String()
+}
+
+// openRollups validates the rollups given, and then opens a storage for each of them, which is put in
+// a directory under the data path unless the in-memory mode.
+func (s *storage) openRollups() error {
+	sort.Slice(s.rollups, func(i, j int) bool {
+		return s.rollups[i].step < s.rollups[j].step
+	})
+	for i := range s.rollups {
+		r := &s.rollups[i]
+		if toPrecision(r.step, s.timestampPrecision) <= 0 {
+			return fmt.Errorf("rollup step must be at least one unit of the timestamp precision")
+		}
+		if i > 0 && r.step == s.rollups[i-1].step {
+			return fmt.Errorf("duplicate rollup step %s", r.step)
+		}
+		if r.retention <= 0 {
+			return fmt.Errorf("rollup retention must be positive")
+		}
+		if r.fn < AggrMin || r.fn > AggrCount {
+			return fmt.Errorf("unknown aggregation function %d", int(r.fn))
+		}
+		opts := []Option{
+			WithTimestampPrecision(s.timestampPrecision),
+			WithPartitionDuration(s.partitionDuration),
+			WithRetention(r.retention),
+			WithLogger(Leveled(s.logger)),
+		}
+		if !s.inMemoryMode() {
+			opts = append(opts,
+				WithDataPath(filepath.Join(s.dataPath, rollupDirName(r.step))),
+				WithWALBufferedSize(s.walBufferedSize),
+			)
+		}
+		rs, err := NewStorage(opts...)
+		if err != nil {
+			return fmt.Errorf("failed to open rollup for %s: %w", r.step, err)
+		}
+		r.storage = rs.(*storage)
+	}
+	return nil
+}
+
+// rollUp inserts data points in the given memory partition into the rollups, aggregating them per step.
+// Failures are just logged, since they must not prevent raw data points from being flushed.
+func (s *storage) rollUp(m *memoryPartition) {
+	if len(s.rollups) == 0 {
+		return
+	}
+	rows := make([][]Row, len(s.rollups))
+	var points []DataPoint
+	m.rangeMetrics(func(mt *memoryMetric) bool {
+		var err error
+		points, err = m.appendDataPoints(context.Background(), points[:0], mt.name, nil, math.MinInt64, math.MaxInt64)
+		if err != nil || len(points) == 0 {
+			return true
+		}
+		metric, labels := unmarshalMetricName(mt.name)
+		for i := range s.rollups {
+			width := toPrecision(s.rollups[i].step, s.timestampPrecision)
+			for _, p := range aggregate(points, alignDown(points[0].Timestamp, width), width, s.rollups[i].fn) {
+				rows[i] = append(rows[i], Row{Metric: metric, Labels: labels, DataPoint: *p})
+			}
+		}
+		return true
+	})
+	for i := range s.rollups {
+		if len(rows[i]) == 0 {
+			continue
+		}
+		if err := s.rollups[i].storage.InsertRows(rows[i]); err != nil {
+			s.logger.Error("failed to roll up data points", "step", s.rollups[i].step, "err", err)
+		}
+	}
+}
+
+// alignDown gives back the greatest multiple of the given width not greater than t.
+func alignDown(t, width int64) int64 {
+	aligned := t / width * width
+	if aligned > t {
+		aligned -= width
+	}
+	return aligned
+}
+
+// rollupFor gives back the storage of the finest rollup holding data points as old as the given start,
+// along with the boundary, the oldest timestamp raw data points reach in the given range. Data points
+// older than the boundary should be selected from the rollup, and the rest from raw data points.
+// Nil means raw data points cover the whole range.
+func (s *storage) rollupFor(start, end int64) (*storage, int64) {
+	if len(s.rollups) == 0 || start >= end {
+		return nil, 0
+	}
+	boundary := end
+	if oldest, ok := s.oldestTimestamp(); ok {
+		if oldest <= start {
+			return nil, 0
+		}
+		boundary = min(oldest, end)
+	}
+	for i := range s.rollups {
+		if oldest, ok := s.rollups[i].storage.oldestTimestamp(); ok && oldest <= start {
+			return s.rollups[i].storage, boundary
+		}
+	}
+	// None of them reaches there, so the coarsest one holds the oldest data points.
+	coarsest := s.rollups[len(s.rollups)-1].storage
+	if _, ok := coarsest.oldestTimestamp(); !ok {
+		return nil, 0
+	}
+	return coarsest, boundary
+}
+
+// selectStitched selects data points older than the boundary from the given rollup, and the rest from
+// raw data points, putting them together in the order the given options tell.
+func (s *storage) selectStitched(parent context.Context, rs *storage, boundary int64, metric string, labels []Label, start, end int64, opts []SelectOption) ([]*DataPoint, error) {
+	parts := unordered(opts)
+	points, err := rs.SelectCtx(parent, metric, labels, start, boundary, parts...)
+	if err != nil && !errors.Is(err, ErrNoDataPoints) {
+		return nil, err
+	}
+	if boundary < end {
+		newer, err := s.selectRaw(parent, metric, labels, boundary, end, parts)
+		if err != nil && !errors.Is(err, ErrNoDataPoints) {
+			return nil, err
+		}
+		points = append(points, newer...)
+	}
+	if len(points) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	return selectOrderOf(opts).apply(points), nil
+}
+
+// selectIntoStitched is like selectStitched but appends data points to dst, as SelectInto does.
+func (s *storage) selectIntoStitched(dst []DataPoint, rs *storage, boundary int64, metric string, labels []Label, start, end int64, opts []SelectOption) ([]DataPoint, error) {
+	n := len(dst)
+	parts := unordered(opts)
+	dst, err := rs.SelectInto(dst, metric, labels, start, boundary, parts...)
+	if err != nil && !errors.Is(err, ErrNoDataPoints) {
+		return dst[:n], err
+	}
+	if boundary < end {
+		dst, err = s.selectInto(dst, metric, labels, boundary, end, parts)
+		if err != nil && !errors.Is(err, ErrNoDataPoints) {
+			return dst[:n], err
+		}
+	}
+	if len(dst) == n {
+		return dst, ErrNoDataPoints
+	}
+	points := dst[n:]
+	order := selectOrderOf(opts)
+	if order.limit > 0 && len(points) > order.limit {
+		points = points[:copy(points, points[len(points)-order.limit:])]
+	}
+	if order.descending {
+		reverseDataPoints(points)
+	}
+	return dst[:n+len(points)], nil
+}
+
+// reaggregation gives back the function to aggregate data points of a rollup made with from into ones made
+// with to over coarser steps, which gives the same result as aggregating raw data points. False means it can't.
+func reaggregation(from, to AggrFunc) (AggrFunc, bool) {
+	switch {
+	case from != to || from == AggrAvg:
+		// The average of averages isn't the average unless weighed by the counts, which rollups don't keep.
+		return 0, false
+	case from == AggrCount:
+		return AggrSum, true
+	default:
+		return from, true
+	}
+}
+
+// rollupForAggregation gives back the coarsest rollup whose data points can be aggregated again into the given
+// step with the given function, so that long ranges don't have to go through all raw data points. Data points in
+// [start, rollupEnd) should be selected from it and ones in [rawStart, end) from raw data points, which are disjoint.
+// Nil means raw data points should be aggregated.
+func (s *storage) rollupForAggregation(start, end, width int64, fn AggrFunc) (rs *storage, rollupEnd, rawStart int64, refn AggrFunc) {
+	if len(s.rollups) == 0 {
+		return nil, 0, 0, fn
+	}
+	// Rollups are made when memory partitions are flushed or evicted, so persisted data points are the ones
+	// rolled up, while unflushed ones are the rest.
+	var unflushedMinT, persistedMinT int64
+	var unflushed, persisted bool
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		part := iterator.value()
+		if part.size() == 0 {
+			continue
+		}
+		if _, ok := part.(*memoryPartition); ok {
+			if !unflushed || part.minTimestamp() < unflushedMinT {
+				unflushedMinT, unflushed = part.minTimestamp(), true
+			}
+		} else if !persisted || part.minTimestamp() < persistedMinT {
+			persistedMinT, persisted = part.minTimestamp(), true
+		}
+	}
+	for i := len(s.rollups) - 1; i >= 0; i-- {
+		r := &s.rollups[i]
+		step := toPrecision(r.step, s.timestampPrecision)
+		if width%step != 0 || alignDown(start, step) != start {
+			continue
+		}
+		refn, ok := reaggregation(r.fn, fn)
+		if !ok {
+			continue
+		}
+		if oldest, ok := r.storage.oldestTimestamp(); !ok || oldest > start {
+			continue
+		}
+		if !persisted {
+			// None of the data points rolled up are left raw, so both are selected as a whole.
+			return r.storage, end, start, refn
+		}
+		// Steps before the oldest unflushed data point have been wholly rolled up, and raw data points
+		// from there on are still on disk unless expired.
+		boundary := end
+		if unflushed {
+			boundary = min(alignDown(unflushedMinT, step), end)
+		}
+		if boundary <= start || persistedMinT > boundary {
+			continue
+		}
+		return r.storage, boundary, boundary, refn
+	}
+	return nil, 0, 0, fn
+}
+
+// selectForAggregation selects data points to be aggregated into the given step with the given function,
+// from rollups as far as they can serve. The function to aggregate the selected data points with is given back.
+func (s *storage) selectForAggregation(metric string, labels []Label, start, end, width int64, fn AggrFunc, opts []SelectOption) ([]DataPoint, AggrFunc, error) {
+	if selectOrderOf(opts).limit > 0 {
+		// The limit is on raw data points.
+		points, err := s.SelectInto(nil, metric, labels, start, end, ascending(opts)...)
+		return points, fn, err
+	}
+	rs, rollupEnd, rawStart, refn := s.rollupForAggregation(start, end, width, fn)
+	if rs == nil {
+		points, err := s.SelectInto(nil, metric, labels, start, end, ascending(opts)...)
+		return points, fn, err
+	}
+	parts := unordered(opts)
+	points, err := rs.SelectInto(nil, metric, labels, start, rollupEnd, parts...)
+	if err != nil && !errors.Is(err, ErrNoDataPoints) {
+		return nil, fn, err
+	}
+	if rawStart < end {
+		n := len(points)
+		points, err = s.selectInto(points, metric, labels, rawStart, end, parts)
+		if err != nil && !errors.Is(err, ErrNoDataPoints) {
+			return nil, fn, err
+		}
+		if fn == AggrCount {
+			// Each raw data point counts as one when summed up along with counts rolled up.
+			for i := n; i < len(points); i++ {
+				points[i].Value = 1
+			}
+		}
+	}
+	if len(points) == 0 {
+		return nil, fn, ErrNoDataPoints
+	}
+	sortDataPoints(points)
+	return points, refn, nil
+}
+
+// closeRollups closes the storages of all rollups.
+func (s *storage) closeRollups() error {
+	for i := range s.rollups {
+		if err := s.rollups[i].storage.Close(); err != nil {
+			return fmt.Errorf("failed to close rollup for %s: %w", s.rollups[i].step, err)
+		}
+	}
+	return nil
+}
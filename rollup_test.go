@@ -0,0 +1,261 @@
+package tstorage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Aligned to hours.
+const rollupTestStart = int64(1599998400)
+
+func insertRollupTestRows(t *testing.T, s Storage, hours int) {
+	// Insert hour by hour to have a partition for each hour, along with WithPartitionMaxPoints(120).
+	for h := int64(0); h < int64(hours); h++ {
+		var rows []Row
+		for ts := rollupTestStart + h*3600; ts < rollupTestStart+(h+1)*3600; ts += 30 {
+			rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts - rollupTestStart)}})
+		}
+		require.NoError(t, s.InsertRows(rows))
+	}
+}
+
+func Test_storage_rollup_inMemory(t *testing.T) {
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithPartitionMaxPoints(120),
+		WithMaxInMemoryPartitions(3),
+		WithRollup(time.Hour, 24*time.Hour, AggrMax),
+		WithRollup(time.Minute, time.Hour, AggrAvg),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	insertRollupTestRows(t, s, 5)
+	s.(*storage).flushWG.Wait()
+	require.NoError(t, s.(*storage).flushPartitions())
+
+	// Raw data points within the first two hours have been evicted, which the finest rollup covers.
+	got, err := s.Select("metric1", nil, rollupTestStart, rollupTestStart+180)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: rollupTestStart, Value: 15},
+		{Timestamp: rollupTestStart + 60, Value: 75},
+		{Timestamp: rollupTestStart + 120, Value: 135},
+	}, got)
+	dst, err := s.SelectInto(nil, "metric1", nil, rollupTestStart+3540, rollupTestStart+3660)
+	require.NoError(t, err)
+	assert.Equal(t, []DataPoint{
+		{Timestamp: rollupTestStart + 3540, Value: 3555},
+		{Timestamp: rollupTestStart + 3600, Value: 3615},
+	}, dst)
+
+	// Raw data points are selected once they cover the start.
+	got, err = s.Select("metric1", nil, 2*3600+rollupTestStart, 2*3600+rollupTestStart+60)
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+
+	// The coarsest one is the last resort.
+	s.(*storage).rollups[0].storage.Delete("metric1", nil, rollupTestStart, rollupTestStart+2*3600)
+	got, err = s.Select("metric1", nil, rollupTestStart, rollupTestStart+2*3600)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: rollupTestStart, Value: 3570},
+		{Timestamp: rollupTestStart + 3600, Value: 7170},
+	}, got)
+}
+
+func Test_storage_rollup_acrossBoundary(t *testing.T) {
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithPartitionMaxPoints(120),
+		WithMaxInMemoryPartitions(3),
+		WithRollup(time.Hour, 24*time.Hour, AggrMax),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	insertRollupTestRows(t, s, 5)
+	s.(*storage).flushWG.Wait()
+	require.NoError(t, s.(*storage).flushPartitions())
+
+	// The first two hours have been rolled up, and the rest including the head hasn't been flushed yet.
+	got, err := s.Select("metric1", nil, rollupTestStart+3600, rollupTestStart+5*3600)
+	require.NoError(t, err)
+	require.Len(t, got, 1+3*120)
+	assert.Equal(t, &DataPoint{Timestamp: rollupTestStart + 3600, Value: 7170}, got[0])
+	assert.Equal(t, &DataPoint{Timestamp: rollupTestStart + 2*3600, Value: 7200}, got[1])
+	assert.Equal(t, &DataPoint{Timestamp: rollupTestStart + 5*3600 - 30, Value: 5*3600 - 30}, got[len(got)-1])
+
+	dst, err := s.SelectInto(nil, "metric1", nil, rollupTestStart+3600, rollupTestStart+2*3600+60, SelectDescending())
+	require.NoError(t, err)
+	assert.Equal(t, []DataPoint{
+		{Timestamp: rollupTestStart + 2*3600 + 30, Value: 7230},
+		{Timestamp: rollupTestStart + 2*3600, Value: 7200},
+		{Timestamp: rollupTestStart + 3600, Value: 7170},
+	}, dst)
+	got, err = s.Select("metric1", nil, rollupTestStart, rollupTestStart+2*3600+60, SelectLimit(3))
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: rollupTestStart + 3600, Value: 7170},
+		{Timestamp: rollupTestStart + 2*3600, Value: 7200},
+		{Timestamp: rollupTestStart + 2*3600 + 30, Value: 7230},
+	}, got)
+
+	// The boundary moves along once another hour gets rolled up by the flush following the rollover.
+	var rows []Row
+	for ts := rollupTestStart + 5*3600; ts < rollupTestStart+6*3600; ts += 30 {
+		rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts - rollupTestStart)}})
+	}
+	require.NoError(t, s.InsertRows(rows))
+	s.(*storage).flushWG.Wait()
+	got, err = s.Select("metric1", nil, rollupTestStart+3600, rollupTestStart+6*3600)
+	require.NoError(t, err)
+	require.Len(t, got, 2+3*120)
+	assert.Equal(t, &DataPoint{Timestamp: rollupTestStart + 2*3600, Value: 10770}, got[1])
+	assert.Equal(t, &DataPoint{Timestamp: rollupTestStart + 3*3600, Value: 10800}, got[2])
+	assert.Equal(t, &DataPoint{Timestamp: rollupTestStart + 6*3600 - 30, Value: 6*3600 - 30}, got[len(got)-1])
+}
+
+func Test_storage_rollup_aggregated(t *testing.T) {
+	t.Run("in-memory", func(t *testing.T) {
+		s, err := NewStorage(
+			WithTimestampPrecision(Seconds),
+			WithPartitionMaxPoints(120),
+			WithMaxInMemoryPartitions(3),
+			WithRollup(time.Hour, 24*time.Hour, AggrCount),
+		)
+		require.NoError(t, err)
+		defer s.Close()
+		insertRollupTestRows(t, s, 5)
+		s.(*storage).flushWG.Wait()
+
+		// Counts of the first two hours evicted are summed up along with the raw data points left.
+		got, err := s.SelectAggregated("metric1", nil, rollupTestStart, rollupTestStart+5*3600, 5*time.Hour, AggrCount)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{{Timestamp: rollupTestStart, Value: 600}}, got)
+		got, err = s.SelectAggregated("metric1", nil, rollupTestStart, rollupTestStart+5*3600, 2*time.Hour, AggrCount, SelectDescending())
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{
+			{Timestamp: rollupTestStart, Value: 240},
+			{Timestamp: rollupTestStart + 2*3600, Value: 240},
+			{Timestamp: rollupTestStart + 4*3600, Value: 120},
+		}, got)
+	})
+
+	t.Run("on disk", func(t *testing.T) {
+		s, err := NewStorage(
+			WithDataPath(t.TempDir()),
+			WithTimestampPrecision(Seconds),
+			WithPartitionMaxPoints(120),
+			WithRollup(time.Minute, 24*time.Hour, AggrAvg),
+			WithRollup(time.Hour, 24*time.Hour, AggrMax),
+		)
+		require.NoError(t, err)
+		defer s.Close()
+		insertRollupTestRows(t, s, 4)
+		s.(*storage).flushWG.Wait()
+		require.NoError(t, s.(*storage).flushPartitions())
+
+		// Make the rollup distinguishable from raw data points.
+		rs := s.(*storage).rollups[1].storage
+		require.NoError(t, rs.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: rollupTestStart, Value: 100000}}}))
+
+		// The first two hours flushed come from the rollup, and the rest from raw data points.
+		got, err := s.SelectAggregated("metric1", nil, rollupTestStart, rollupTestStart+4*3600, 2*time.Hour, AggrMax)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{
+			{Timestamp: rollupTestStart, Value: 100000},
+			{Timestamp: rollupTestStart + 2*3600, Value: 4*3600 - 30},
+		}, got)
+
+		// Neither averages nor unaligned steps can be aggregated again.
+		got, err = s.SelectAggregated("metric1", nil, rollupTestStart, rollupTestStart+4*3600, 2*time.Hour, AggrAvg)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{
+			{Timestamp: rollupTestStart, Value: 3585},
+			{Timestamp: rollupTestStart + 2*3600, Value: 10785},
+		}, got)
+		got, err = s.SelectAggregated("metric1", nil, rollupTestStart+1800, rollupTestStart+4*3600, 2*time.Hour, AggrMax)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{
+			{Timestamp: rollupTestStart + 1800, Value: 9000 - 30},
+			{Timestamp: rollupTestStart + 9000, Value: 4*3600 - 30},
+		}, got)
+	})
+}
+
+func Test_storage_rollup_onDisk(t *testing.T) {
+	dataPath := t.TempDir()
+	opts := []Option{
+		WithDataPath(dataPath),
+		WithTimestampPrecision(Seconds),
+		WithPartitionMaxPoints(120),
+		WithRollup(time.Hour, 24*time.Hour, AggrCount),
+	}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	insertRollupTestRows(t, s, 4)
+	s.(*storage).flushWG.Wait()
+	require.NoError(t, s.Close())
+
+	// All data points have been rolled up by the flush on closing.
+	rs, err := NewStorage(WithDataPath(filepath.Join(dataPath, "rollup-1h0m0s")), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	got, err := rs.Select("metric1", nil, rollupTestStart, rollupTestStart+4*3600)
+	require.NoError(t, err)
+	require.NoError(t, rs.Close())
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: rollupTestStart, Value: 120},
+		{Timestamp: rollupTestStart + 3600, Value: 120},
+		{Timestamp: rollupTestStart + 2*3600, Value: 120},
+		{Timestamp: rollupTestStart + 3*3600, Value: 120},
+	}, got)
+
+	// Rollups are taken in snapshots, and then restored as well.
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	snapshotDir := filepath.Join(t.TempDir(), "snapshot")
+	require.NoError(t, s.Snapshot(snapshotDir))
+	require.NoError(t, s.Close())
+	restored := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, RestoreStorage(snapshotDir, restored))
+	assert.DirExists(t, filepath.Join(restored, "rollup-1h0m0s"))
+	s, err = NewStorage(append(opts, WithDataPath(restored))...)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err = s.(*storage).rollups[0].storage.Select("metric1", nil, rollupTestStart, rollupTestStart+4*3600)
+	require.NoError(t, err)
+	assert.Len(t, got, 4)
+}
+
+func Test_WithRollup_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "step finer than precision",
+			opts: []Option{WithTimestampPrecision(Seconds), WithRollup(time.Millisecond, time.Hour, AggrAvg)},
+		},
+		{
+			name: "duplicate step",
+			opts: []Option{WithRollup(time.Minute, time.Hour, AggrAvg), WithRollup(time.Minute, 2*time.Hour, AggrMax)},
+		},
+		{
+			name: "no retention",
+			opts: []Option{WithRollup(time.Minute, 0, AggrAvg)},
+		},
+		{
+			name: "unknown function",
+			opts: []Option{WithRollup(time.Minute, time.Hour, AggrFunc(100))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewStorage(tt.opts...)
+			assert.Error(t, err)
+		})
+	}
+}
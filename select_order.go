@@ -0,0 +1,79 @@
+package tstorage
+
+import "context"
+
+type selectOrderKey struct{}
+
+// selectOrder tells how to order and limit data points selected. See SelectDescending and SelectLimit.
+type selectOrder struct {
+	// zero means no limit.
+	limit      int
+	descending bool
+}
+
+// withSelectOrder gives back a context that carries the given order.
+func withSelectOrder(ctx context.Context, order selectOrder) context.Context {
+	if order == (selectOrder{}) {
+		return ctx
+	}
+	return context.WithValue(ctx, selectOrderKey{}, order)
+}
+
+// selectOrderFrom gives back the order carried by ctx, which is the ascending one without limit if none.
+func selectOrderFrom(ctx context.Context) selectOrder {
+	order, _ := ctx.Value(selectOrderKey{}).(selectOrder)
+	return order
+}
+
+// apply keeps the latest data points up to the limit out of the given ones in ascending order,
+// and then reverses them if descending.
+func (o selectOrder) apply(points []*DataPoint) []*DataPoint {
+	if o.limit > 0 && len(points) > o.limit {
+		points = points[len(points)-o.limit:]
+	}
+	if o.descending {
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+	return points
+}
+
+// coveredBy reports whether the given data points in ascending order already hold all the latest ones
+// up to the limit, that is, partitions whose data points are older than the given max timestamp can't
+// hold any of them.
+func (o selectOrder) coveredBy(points []*DataPoint, maxT int64) bool {
+	return o.limit > 0 && len(points) >= o.limit && maxT < points[len(points)-o.limit].Timestamp
+}
+
+// ascending gives back the given options followed by one overriding SelectDescending, for Select variants
+// that work on data points in ascending order.
+func ascending(opts []SelectOption) []SelectOption {
+	return append(opts[:len(opts):len(opts)], func(o *selectOptions) {
+		o.order.descending = false
+	})
+}
+
+// unordered gives back the given options followed by one overriding SelectDescending and SelectLimit,
+// for selecting parts of a range that get ordered once put together. See selectOrderOf.
+func unordered(opts []SelectOption) []SelectOption {
+	return append(opts[:len(opts):len(opts)], func(o *selectOptions) {
+		o.order = selectOrder{}
+	})
+}
+
+// selectOrderOf gives back the order the given options tell.
+func selectOrderOf(opts []SelectOption) selectOrder {
+	var o selectOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.order
+}
+
+// reverseDataPoints reverses the order of the given data points in place.
+func reverseDataPoints(points []DataPoint) {
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+}
@@ -0,0 +1,78 @@
+package tstorage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectLimit(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithPartitionMaxPoints(2))
+	require.NoError(t, err)
+	defer s.Close()
+	for ts := int64(1); ts <= 6; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+	}
+	s.(*storage).flushWG.Wait()
+
+	tests := []struct {
+		name string
+		opts []SelectOption
+		want []DataPoint
+	}{
+		{
+			name: "descending",
+			opts: []SelectOption{SelectDescending()},
+			want: []DataPoint{{6, 6}, {5, 5}, {4, 4}, {3, 3}, {2, 2}, {1, 1}},
+		},
+		{
+			name: "latest ones",
+			opts: []SelectOption{SelectLimit(3)},
+			want: []DataPoint{{4, 4}, {5, 5}, {6, 6}},
+		},
+		{
+			name: "latest ones in descending order",
+			opts: []SelectOption{SelectLimit(3), SelectDescending()},
+			want: []DataPoint{{6, 6}, {5, 5}, {4, 4}},
+		},
+		{
+			name: "limit more than data points",
+			opts: []SelectOption{SelectLimit(10)},
+			want: []DataPoint{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 5}, {6, 6}},
+		},
+		{
+			name: "along with predicate",
+			opts: []SelectOption{SelectLimit(2), SelectWhere(ValueLessThan(5))},
+			want: []DataPoint{{3, 3}, {4, 4}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SelectInto(nil, "metric1", nil, 0, 10, tt.opts...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			refs, err := s.Select("metric1", nil, 0, 10, tt.opts...)
+			require.NoError(t, err)
+			require.Len(t, refs, len(tt.want))
+			for i := range refs {
+				assert.Equal(t, tt.want[i], *refs[i])
+			}
+		})
+	}
+
+	// Aggregation is done in ascending order anyway.
+	got, err := s.SelectAggregated("metric1", nil, 0, 10, 3*time.Second, AggrSum, SelectDescending())
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 0, Value: 3}, {Timestamp: 3, Value: 12}, {Timestamp: 6, Value: 6}}, got)
+
+	// Partitions older than the latest data points are never looked into.
+	s.(*storage).partitionList.insertTail(&fakePartition{minT: -10, maxT: 0, numPoints: 1, err: errors.New("unexpected")})
+	_, err = s.Select("metric1", nil, -10, 10, SelectLimit(3))
+	assert.NoError(t, err)
+	_, err = s.Select("metric1", nil, -10, 10)
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package tstorage
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram is a distribution of durations laid out as histograms of Prometheus are, which Stats reports
+// latencies in.
+type Histogram struct {
+	// Buckets are the upper bounds of buckets in ascending order, and Counts are the cumulative numbers of
+	// observations less than or equal to each of them.
+	Buckets []time.Duration
+	Counts  []uint64
+	// Count and Sum are the number and the total of all observations.
+	Count uint64
+	Sum   time.Duration
+}
+
+// histogramBuckets are the upper bounds of buckets every Histogram has.
+var histogramBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// durationHistogram observes durations concurrently without locking.
+type durationHistogram struct {
+	// counts holds the number of observations in each bucket, not cumulative, along with ones above the last bucket.
+	counts [len(histogramBuckets) + 1]atomic.Uint64
+	sum    atomic.Int64
+}
+
+// observeSince observes the time elapsed since the given one, which is meant to be deferred.
+func (h *durationHistogram) observeSince(started time.Time) {
+	h.observe(time.Since(started))
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBuckets) && d > histogramBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Quantile estimates the duration below which the given fraction of observations fall, such as 0.99 for the
+// 99th percentile, by interpolating linearly within the bucket holding it as histogram_quantile of Prometheus
+// does. Observations above the last bucket are taken as the last bucket. It gives back 0 if nothing is observed.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 || len(h.Buckets) == 0 {
+		return 0
+	}
+	if q < 0 {
+		q = 0
+	} else if q > 1 {
+		q = 1
+	}
+	rank := q * float64(h.Count)
+	var lower time.Duration
+	var below uint64
+	for i, upper := range h.Buckets {
+		if float64(h.Counts[i]) >= rank {
+			inBucket := h.Counts[i] - below
+			if inBucket == 0 {
+				return upper
+			}
+			fraction := (rank - float64(below)) / float64(inBucket)
+			return lower + time.Duration(fraction*float64(upper-lower))
+		}
+		lower, below = upper, h.Counts[i]
+	}
+	return h.Buckets[len(h.Buckets)-1]
+}
+
+func (h *durationHistogram) snapshot() Histogram {
+	hist := Histogram{
+		Buckets: append([]time.Duration(nil), histogramBuckets[:]...),
+		Counts:  make([]uint64, len(histogramBuckets)),
+		Sum:     time.Duration(h.sum.Load()),
+	}
+	for i := range h.counts {
+		hist.Count += h.counts[i].Load()
+		if i < len(hist.Counts) {
+			hist.Counts[i] = hist.Count
+		}
+	}
+	return hist
+}
+
+// selfMetrics counts what the storage has done since it started, which Stats reports.
+type selfMetrics struct {
+	insertedRows  atomic.Int64
+	insertErrors  atomic.Int64
+	writeTimeouts atomic.Int64
+	flushDuration durationHistogram
+	queryDuration durationHistogram
+	wal           walMetrics
+}
+
+// walMetrics counts what the WAL has done since it got opened, which Stats reports.
+type walMetrics struct {
+	// appendedBytes is the number of bytes written to segments, not including their headers.
+	appendedBytes atomic.Int64
+	// syncDuration observes each fsync, or msync, of the active segment.
+	syncDuration durationHistogram
+}
+
+// countInsert counts rows given by producers, which are counted as inserted only if err is nil.
+func (m *selfMetrics) countInsert(numRows int, err error) {
+	if err != nil {
+		m.insertErrors.Add(1)
+		if errors.Is(err, ErrOverloaded) {
+			m.writeTimeouts.Add(1)
+		}
+		return
+	}
+	m.insertedRows.Add(int64(numRows))
+}
@@ -0,0 +1,61 @@
+package tstorage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_durationHistogram(t *testing.T) {
+	var h durationHistogram
+	h.observe(50 * time.Microsecond)
+	h.observe(time.Millisecond)
+	h.observe(2 * time.Millisecond)
+	h.observe(time.Minute)
+
+	got := h.snapshot()
+	assert.Equal(t, histogramBuckets[:], got.Buckets)
+	assert.Equal(t, []uint64{1, 1, 2, 3, 3, 3, 3, 3, 3, 3, 3}, got.Counts)
+	assert.Equal(t, uint64(4), got.Count)
+	assert.Equal(t, time.Minute+3*time.Millisecond+50*time.Microsecond, got.Sum)
+
+	assert.Equal(t, 100*time.Microsecond, got.Quantile(0.25))
+	assert.Equal(t, 750*time.Microsecond, got.Quantile(0.375))
+	assert.Equal(t, 5*time.Millisecond, got.Quantile(0.75))
+	// Observations above the last bucket are taken as the last bucket.
+	assert.Equal(t, 10*time.Second, got.Quantile(1))
+	assert.Zero(t, Histogram{}.Quantile(0.5))
+}
+
+func Test_selfMetrics_countInsert(t *testing.T) {
+	var m selfMetrics
+	m.countInsert(3, nil)
+	m.countInsert(2, fmt.Errorf("%w: busy", ErrOverloaded))
+	m.countInsert(2, ErrRateLimited)
+	assert.Equal(t, int64(3), m.insertedRows.Load())
+	assert.Equal(t, int64(2), m.insertErrors.Load())
+	assert.Equal(t, int64(1), m.writeTimeouts.Load())
+}
+
+func Test_storage_Stats_selfMetrics(t *testing.T) {
+	s, err := NewStorage(WithDataPath(t.TempDir()), WithTimestampPrecision(Seconds), WithPartitionMaxPoints(2))
+	require.NoError(t, err)
+	defer s.Close()
+	for ts := int64(1600000000); ts < 1600000004; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	require.NoError(t, s.Flush())
+	_, err = s.Select("metric1", nil, 1600000000, 1600000004)
+	require.NoError(t, err)
+	_, err = s.SelectInto(nil, "metric1", nil, 1600000000, 1600000004)
+	require.NoError(t, err)
+
+	stats := s.Stats()
+	assert.Equal(t, int64(4), stats.InsertedRows)
+	assert.Zero(t, stats.InsertErrors)
+	assert.Equal(t, uint64(2), stats.QueryDuration.Count)
+	assert.Positive(t, stats.FlushDuration.Count)
+}
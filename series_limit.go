@@ -0,0 +1,56 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrTooManySeries is returned when inserting rows would create series beyond the limit. See WithMaxSeries.
+var ErrTooManySeries = errors.New("too many series")
+
+// SeriesLimitError describes the series whose creation got rejected by the limit of WithMaxSeries.
+// It matches ErrTooManySeries with errors.Is.
+type SeriesLimitError struct {
+	// Metric and Labels identify the series rejected.
+	Metric string
+	Labels []Label
+	// Limit is the max number of series.
+	Limit int
+}
+
+func (e *SeriesLimitError) Error() string {
+	return fmt.Sprintf("%v: metric %q would exceed the limit of %d series", ErrTooManySeries, e.Metric, e.Limit)
+}
+
+func (e *SeriesLimitError) Is(target error) bool {
+	return target == ErrTooManySeries
+}
+
+// checkSeriesLimit ensures that inserting the given rows keeps the number of series held by the partition within
+// the given limit. Rows older than the partition are out of scope since they go into older partitions.
+// Concurrent inserts may exceed the limit slightly, as series get counted before they get created.
+func (m *memoryPartition) checkSeriesLimit(rows []Row, limit int) error {
+	numSeries := atomic.LoadInt64(&m.numSeries)
+	var created map[string]struct{}
+	for i := range rows {
+		if m.size() > 0 && rows[i].Timestamp < m.minTimestamp() {
+			continue
+		}
+		name := marshalMetricName(rows[i].Metric, rows[i].Labels)
+		if _, ok := created[name]; ok {
+			continue
+		}
+		if _, ok := m.lookupMetric(name); ok {
+			continue
+		}
+		if numSeries+int64(len(created)) >= int64(limit) {
+			return &SeriesLimitError{Metric: rows[i].Metric, Labels: rows[i].Labels, Limit: limit}
+		}
+		if created == nil {
+			created = make(map[string]struct{})
+		}
+		created[name] = struct{}{}
+	}
+	return nil
+}
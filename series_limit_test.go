@@ -0,0 +1,43 @@
+package tstorage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_WithMaxSeries(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithMaxSeries(2))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000001}},
+	}))
+	// None of rows get inserted if any of them exceeds the limit.
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000002}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "c"}}, DataPoint: DataPoint{Timestamp: 1600000002}},
+	})
+	assert.ErrorIs(t, err, ErrTooManySeries)
+	var limitErr *SeriesLimitError
+	require.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, []Label{{Name: "host", Value: "c"}}, limitErr.Labels)
+	assert.Equal(t, 2, limitErr.Limit)
+	_, err = s.Select("metric1", []Label{{Name: "host", Value: "b"}}, 1600000000, 1600000003)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+
+	// Existing series keep accepting data points.
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000003}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000003}},
+	}))
+	err = s.InsertRows([]Row{{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000004}}})
+	assert.ErrorIs(t, err, ErrTooManySeries)
+
+	_, err = NewStorage(WithMaxSeries(-1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,153 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+func (s *storage) Snapshot(dir string) error {
+	if s.inMemoryMode() {
+		return fmt.Errorf("snapshot isn't available in the in-memory mode")
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("snapshot directory %s already exists", dir)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to stat snapshot directory: %w", err)
+	}
+	// Flush inactive partitions first to lessen the WAL to be copied.
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if err := s.beginWrite(); err != nil {
+		return err
+	}
+	defer s.wg.Done()
+
+	// Take it in a temporary directory and then rename it, so that the snapshot directory always holds a whole snapshot.
+	tmpDir := dir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", tmpDir, err)
+	}
+	if err := s.snapshot(tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to take snapshot: %w", err)
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpDir, dir, err)
+	}
+	return nil
+}
+
+// snapshot copies disk partitions, the WAL, tombstones and rollups into the given directory in the layout of a data path.
+// Partitions never get flushed, compacted or removed meanwhile, so that every data point is either in
+// the copied partitions or in the copied WAL, which covers the memory partitions.
+func (s *storage) snapshot(dir string) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return fmt.Errorf("failed to make directory: %w", err)
+	}
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		d, ok := iterator.value().(*diskPartition)
+		if !ok {
+			continue
+		}
+		if err := d.snapshot(filepath.Join(dir, filepath.Base(d.dirPath))); err != nil {
+			return fmt.Errorf("failed to copy partition %s: %w", d.dirPath, err)
+		}
+	}
+	if err := s.wal.snapshot(filepath.Join(dir, walDirName)); err != nil {
+		return fmt.Errorf("failed to copy WAL: %w", err)
+	}
+	if err := s.tombstones.snapshot(dir); err != nil {
+		return err
+	}
+	for i := range s.rollups {
+		r := &s.rollups[i]
+		if err := r.storage.snapshot(filepath.Join(dir, rollupDirName(r.step))); err != nil {
+			return fmt.Errorf("failed to copy rollup for %s: %w", r.step, err)
+		}
+	}
+	return nil
+}
+
+// snapshot copies the files of the partition into the given directory. Files never modified once written
+// are hard-linked if possible, while the late file, which gets appended, is copied as of now.
+func (d *diskPartition) snapshot(dir string) error {
+	if err := os.Mkdir(dir, fs.ModePerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(d.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == lateFileName {
+			continue
+		}
+		if err := linkOrCopyFile(filepath.Join(d.dirPath, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	d.late.appendMu.Lock()
+	defer d.late.appendMu.Unlock()
+	err = copyFile(filepath.Join(d.dirPath, lateFileName), filepath.Join(dir, lateFileName), -1)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// snapshot copies the file persisting tombstones into the given directory if any.
+func (ts *tombstoneSet) snapshot(dir string) error {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if ts.path == "" {
+		return nil
+	}
+	err := copyFile(ts.path, filepath.Join(dir, tombstonesFileName), -1)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy tombstones: %w", err)
+	}
+	return nil
+}
+
+// linkOrCopyFile hard-links the given file, or copies it where hard links aren't available,
+// such as across filesystems.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst, -1)
+}
+
+// copyFile copies up to size bytes of the src file into the dst file. A negative size means the whole file.
+func copyFile(src, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = in
+	if size >= 0 {
+		r = io.LimitReader(in, size)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,118 @@
+package tstorage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Snapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "buffered WAL",
+		},
+		{
+			name: "memory-mapped WAL",
+			opts: []Option{WithMmapWAL(time.Hour), WithWALPreallocSize(1 << 20)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}, tt.opts...)
+			s, err := NewStorage(append([]Option{WithDataPath(t.TempDir())}, opts...)...)
+			require.NoError(t, err)
+			defer s.Close()
+			insert := func(ts int64) {
+				require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+			}
+			for _, ts := range []int64{1600000000, 1600003600, 1600007200, 1600010800} {
+				insert(ts)
+			}
+			// Goes into the late file of the flushed partition.
+			insert(1600000010)
+			require.NoError(t, s.Delete("metric1", nil, 1600003600, 1600003601))
+			s.(*storage).flushWG.Wait()
+
+			dir := filepath.Join(t.TempDir(), "snapshot")
+			require.NoError(t, s.Snapshot(dir))
+			assert.Error(t, s.Snapshot(dir), "already exists")
+			// Written after the snapshot.
+			insert(1600010810)
+
+			want := []*DataPoint{
+				{Timestamp: 1600000000, Value: 1600000000},
+				{Timestamp: 1600000010, Value: 1600000010},
+				{Timestamp: 1600007200, Value: 1600007200},
+				{Timestamp: 1600010800, Value: 1600010800},
+			}
+			snapshot, err := NewStorage(append([]Option{WithDataPath(dir)}, opts...)...)
+			require.NoError(t, err)
+			got, err := snapshot.Select("metric1", nil, 1600000000, 1600020000)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+			require.NoError(t, snapshot.Close())
+		})
+	}
+}
+
+func Test_storage_Snapshot_inMemory(t *testing.T) {
+	s, err := NewStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Error(t, s.Snapshot(filepath.Join(t.TempDir(), "snapshot")))
+}
+
+func Test_RestoreStorage(t *testing.T) {
+	opts := []Option{WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}
+	s, err := NewStorage(append([]Option{WithDataPath(t.TempDir())}, opts...)...)
+	require.NoError(t, err)
+	defer s.Close()
+	for _, ts := range []int64{1600000000, 1600003600, 1600007200, 1600010800, 1600000010} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	snapshotDir := filepath.Join(t.TempDir(), "snapshot")
+	require.NoError(t, s.Snapshot(snapshotDir))
+
+	dataPath := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, RestoreStorage(snapshotDir, dataPath))
+	assert.Error(t, RestoreStorage(snapshotDir, dataPath), "not empty")
+
+	restored, err := NewStorage(append([]Option{WithDataPath(dataPath)}, opts...)...)
+	require.NoError(t, err)
+	// Writes to the restored one never change the snapshot.
+	require.NoError(t, restored.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000020}}}))
+	got, err := restored.Select("metric1", nil, 1600000000, 1600020000)
+	require.NoError(t, err)
+	assert.Len(t, got, 6)
+	require.NoError(t, restored.Close())
+
+	again := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, RestoreStorage(snapshotDir, again))
+	restored, err = NewStorage(append([]Option{WithDataPath(again)}, opts...)...)
+	require.NoError(t, err)
+	got, err = restored.Select("metric1", nil, 1600000000, 1600020000)
+	require.NoError(t, err)
+	assert.Len(t, got, 5)
+	require.NoError(t, restored.Close())
+}
+
+func Test_RestoreStorage_corrupted(t *testing.T) {
+	snapshotDir := t.TempDir()
+	partDir := filepath.Join(snapshotDir, "p-1-2")
+	require.NoError(t, os.Mkdir(partDir, fs.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(partDir, dataFileName), []byte{0x01}, fs.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(partDir, metaFileName), []byte("{broken"), fs.ModePerm))
+
+	dataPath := filepath.Join(t.TempDir(), "data")
+	err := RestoreStorage(snapshotDir, dataPath)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	assert.NoDirExists(t, dataPath)
+}
@@ -0,0 +1,62 @@
+package tstorage
+
+import (
+	"errors"
+	"sync"
+)
+
+// StartupStage represents what NewStorage is doing. See StartupProgress.
+type StartupStage int
+
+const (
+	// StartupOpeningPartitions means disk partitions are being opened.
+	StartupOpeningPartitions StartupStage = iota
+	// StartupReplayingWAL means rows in the WAL are being replayed.
+	StartupReplayingWAL
+	// StartupDone means NewStorage is about to return the storage.
+	StartupDone
+)
+
+// StartupProgress describes how far NewStorage has got. See WithStartupProgress.
+type StartupProgress struct {
+	Stage StartupStage
+	// PartitionsTotal is the number of disk partitions found in the data directory.
+	PartitionsTotal int
+	// PartitionsOpened is the number of disk partitions opened so far.
+	PartitionsOpened int
+	// PartitionsSkipped is the number of disk partitions skipped so far, such as empty or corrupt ones.
+	PartitionsSkipped int
+	// WALRowsReplayed is the number of rows replayed from the WAL.
+	WALRowsReplayed int
+}
+
+// startupReporter passes the progress of start-up to the user-defined function.
+type startupReporter struct {
+	mu       sync.Mutex
+	fn       func(StartupProgress)
+	progress StartupProgress
+}
+
+// update applies the given change to the progress, and then reports it.
+// Reports are serialized even if it gets called concurrently.
+func (r *startupReporter) update(change func(p *StartupProgress)) {
+	if r.fn == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	change(&r.progress)
+	r.fn(r.progress)
+}
+
+// skippedPartition reports whether NewStorage goes on without the partition that failed to open with the given error.
+func (s *storage) skippedPartition(err error) bool {
+	return errors.Is(err, ErrNoDataPoints) || errors.Is(err, errInvalidPartition) || s.bestEffortOpen
+}
+
+// reportStartupDone reports that NewStorage is done.
+func (s *storage) reportStartupDone() {
+	s.startup.update(func(p *StartupProgress) {
+		p.Stage = StartupDone
+	})
+}
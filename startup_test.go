@@ -0,0 +1,53 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithStartupProgress(t *testing.T) {
+	tmpDir := t.TempDir()
+	m := newMemoryPartition(nil, time.Hour, Seconds)
+	_, err := m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}})
+	require.NoError(t, err)
+	s := &storage{compressor: &nopCompressor{}}
+	require.NoError(t, s.writePartition(filepath.Join(tmpDir, "p-1600000000-1600000000"), m.(*memoryPartition), time.Now()))
+	// A partition without meta file gets skipped.
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "p-broken"), os.ModePerm))
+
+	wal, err := newDiskWAL(filepath.Join(tmpDir, walDirName), 4096)
+	require.NoError(t, err)
+	require.NoError(t, wal.append(operationInsert, []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000002, Value: 0.3}},
+	}))
+	require.NoError(t, wal.flush())
+
+	var got []StartupProgress
+	storage, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithStartupProgress(func(progress StartupProgress) {
+			got = append(got, progress)
+		}),
+	)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	require.NotEmpty(t, got)
+	assert.Equal(t, StartupProgress{
+		Stage:             StartupDone,
+		PartitionsTotal:   2,
+		PartitionsOpened:  1,
+		PartitionsSkipped: 1,
+		WALRowsReplayed:   2,
+	}, got[len(got)-1])
+	for i := 1; i < len(got); i++ {
+		assert.LessOrEqual(t, got[i-1].Stage, got[i].Stage)
+	}
+}
@@ -0,0 +1,127 @@
+package tstorage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// Stats describes the state of a storage at some point, which is meant for health dashboards. See Storage.Stats.
+type Stats struct {
+	// MemoryPartitions and DiskPartitions are the numbers of partitions held in memory and on disk respectively.
+	// User-defined partitions given by WithPartitions are counted in neither.
+	MemoryPartitions int
+	DiskPartitions   int
+	// DataPoints is the number of data points in all partitions. Disk partitions not opened yet due to
+	// WithLazyOpen aren't counted, since taking it would open them.
+	DataPoints int64
+	// HeadSeries is the number of series in the head partition, which is the one WithMaxSeries limits.
+	HeadSeries int64
+	// HeadMinTimestamp and HeadMaxTimestamp are the time range of data points in the head partition,
+	// which are zero if it holds none.
+	HeadMinTimestamp int64
+	HeadMaxTimestamp int64
+	// WALBytes is the number of bytes WAL segments take on disk.
+	WALBytes int64
+	// DiskBytes is the number of bytes all files under the data paths take, which includes WALBytes.
+	DiskBytes int64
+	// WALSegments is the number of WAL segment files on disk.
+	WALSegments int
+
+	// InsertedRows is the number of rows InsertRows and InsertRowsCtx have ingested since the storage started,
+	// and InsertErrors is the number of calls of them that failed.
+	InsertedRows int64
+	InsertErrors int64
+	// WriteTimeouts is the number of calls of InsertRows and InsertRowsCtx that failed with ErrOverloaded,
+	// which InsertErrors includes.
+	WriteTimeouts int64
+	// FlushDuration is the distribution of the time taken to flush each memory partition to disk.
+	FlushDuration Histogram
+	// QueryDuration is the distribution of the latency of Select, SelectCtx, SelectInto and SelectSeries,
+	// which the other ways of selecting data points are built on.
+	QueryDuration Histogram
+	// WALAppendedBytes is the number of bytes appended to WAL segments since the storage started.
+	WALAppendedBytes int64
+	// WALSyncDuration is the distribution of the time taken to fsync the active WAL segment, or msync it with
+	// WithMmapWAL, whose Count is the number of syncs. High latencies of it tell disk latency is the bottleneck
+	// of ingestion, especially with WALSyncEveryWrite.
+	WALSyncDuration Histogram
+}
+
+func (s *storage) Stats() Stats {
+	stats := Stats{
+		InsertedRows:  s.metrics.insertedRows.Load(),
+		InsertErrors:  s.metrics.insertErrors.Load(),
+		WriteTimeouts: s.metrics.writeTimeouts.Load(),
+		FlushDuration: s.metrics.flushDuration.snapshot(),
+		QueryDuration: s.metrics.queryDuration.snapshot(),
+
+		WALAppendedBytes: s.metrics.wal.appendedBytes.Load(),
+		WALSyncDuration:  s.metrics.wal.syncDuration.snapshot(),
+	}
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		switch p := iterator.value().(type) {
+		case *memoryPartition:
+			stats.MemoryPartitions++
+			stats.DataPoints += int64(p.size())
+		case *diskPartition:
+			stats.DiskPartitions++
+			if !unopened(p) {
+				stats.DataPoints += int64(p.size())
+			}
+		default:
+			stats.DataPoints += int64(p.size())
+		}
+	}
+	if head, ok := s.partitionList.getHead().(*memoryPartition); ok {
+		stats.HeadSeries = atomic.LoadInt64(&head.numSeries)
+		if head.size() > 0 {
+			stats.HeadMinTimestamp = head.minTimestamp()
+			stats.HeadMaxTimestamp = head.maxTimestamp()
+		}
+	}
+	if s.inMemoryMode() {
+		return stats
+	}
+	walDir := filepath.Join(s.dataPath, walDirName)
+	stats.WALBytes = dirSize(walDir)
+	stats.WALSegments = countSegments(walDir)
+	for _, dir := range s.dataPaths {
+		stats.DiskBytes += dirSize(dir)
+	}
+	return stats
+}
+
+// countSegments gives back the number of WAL segment files in the given directory, which leaves out the spare one.
+func countSegments(dir string) int {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var n int
+	for _, f := range files {
+		if _, err := strconv.ParseUint(f.Name(), 10, 32); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// dirSize gives back the total size of files under the given directory. Files removed while walking it,
+// such as ones of partitions being removed, are just skipped.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,54 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Stats(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionMaxPoints(2))
+	require.NoError(t, err)
+	for ts := int64(1600000000); ts < 1600000005; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000005}}}))
+	require.NoError(t, s.Flush())
+	defer s.Close()
+
+	stats := s.Stats()
+	assert.Equal(t, 1, stats.MemoryPartitions)
+	assert.Equal(t, 2, stats.DiskPartitions)
+	assert.Equal(t, int64(6), stats.DataPoints)
+	assert.Equal(t, int64(2), stats.HeadSeries)
+	assert.Equal(t, int64(1600000004), stats.HeadMinTimestamp)
+	assert.Equal(t, int64(1600000005), stats.HeadMaxTimestamp)
+	assert.Positive(t, stats.WALBytes)
+	assert.Greater(t, stats.DiskBytes, stats.WALBytes)
+	assert.Equal(t, 1, stats.WALSegments)
+	assert.Positive(t, stats.WALAppendedBytes)
+
+	m, err := NewStorage()
+	require.NoError(t, err)
+	defer m.Close()
+	stats = m.Stats()
+	assert.Equal(t, 1, stats.MemoryPartitions)
+	assert.Zero(t, stats.DataPoints)
+	assert.Zero(t, stats.DiskBytes)
+}
+
+func Test_storage_Stats_walSync(t *testing.T) {
+	s, err := NewStorage(WithDataPath(t.TempDir()), WithTimestampPrecision(Seconds), WithWALSync(WALSyncEveryWrite))
+	require.NoError(t, err)
+	defer s.Close()
+	for ts := int64(1600000000); ts < 1600000003; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(3), stats.WALSyncDuration.Count)
+	assert.Positive(t, stats.WALSyncDuration.Sum)
+	assert.Positive(t, stats.WALAppendedBytes)
+}
@@ -1,31 +1,53 @@
 package tstorage
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/aes"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nakabonne/tstorage/internal/cgroup"
-	"github.com/nakabonne/tstorage/internal/timerpool"
+	"github.com/nakabonne/tstorage/internal/memory"
 )
 
 var (
 	ErrNoDataPoints = errors.New("no data points found")
+	// ErrQueryTimeout is returned when selecting takes longer than the query timeout.
+	// See WithQueryTimeout and SelectTimeout.
+	ErrQueryTimeout = errors.New("query timed out")
+	// ErrQueryMemoryLimitExceeded is returned when selecting materializes more data points than the memory limit.
+	// See WithQueryMemoryLimit and SelectMemoryLimit.
+	ErrQueryMemoryLimitExceeded = errors.New("query memory limit exceeded")
+	// ErrCorrupted is returned when data on disk, such as partitions and WAL segments, turns out to be broken.
+	ErrCorrupted = errors.New("data corrupted")
+	// ErrClosed is returned by operations called after Close has begun.
+	ErrClosed = errors.New("storage closed")
+	// ErrOverloaded is returned when inserting has to wait for busy workers longer than the write timeout.
+	// See WithWriteTimeout.
+	ErrOverloaded = errors.New("storage overloaded")
+	// ErrInvalidTimestampRange is returned when the given start isn't less than the given end.
+	ErrInvalidTimestampRange = errors.New("invalid timestamp range")
 
 	// Limit the concurrency for data ingestion to GOMAXPROCS, since this operation
 	// is CPU bound, so there is no sense in running more than GOMAXPROCS concurrent
 	// goroutines on data ingestion path.
 	defaultWorkersLimit = cgroup.AvailableCPUs()
+	// Writers may wait for I/O rather than burn CPU though, so the limit is allowed to grow up to
+	// this many times as many when the write latency tells so.
+	defaultWorkersCeiling = 4 * defaultWorkersLimit
 
-	partitionDirRegex = regexp.MustCompile(`^p-.+`)
+	// Partition directories never have dots, which temporary ones do.
+	partitionDirRegex = regexp.MustCompile(`^p-[^.]+$`)
 )
 
 // TimestampPrecision represents precision of timestamps. See WithTimestampPrecision
@@ -53,10 +75,78 @@ const (
 type Storage interface {
 	Reader
 	// InsertRows ingests the given rows to the time-series storage.
-	// If the timestamp is empty, it uses the machine's local timestamp in UTC.
+	// If the timestamp is empty, it uses the machine's local timestamp in UTC unless WithZeroTimestampAllowed is given.
+	// Negative timestamps, that is, ones before 1970, are accepted as is.
 	// The precision of timestamps is nanoseconds by default. It can be changed using WithTimestampPrecision.
+	// Rows exceeding the limit given by WithMetricRateLimit are rejected with a *RateLimitError.
+	// A *DegradedError is returned once the storage got degraded into read-only; see WithDegradedThreshold.
+	// ErrClosed is returned once Close has begun.
 	InsertRows(rows []Row) error
+	// InsertRowsCtx is like InsertRows but gives up once the given context is done before the rows get
+	// written, including while waiting for busy workers, and then gives back the error of the context.
+	InsertRowsCtx(ctx context.Context, rows []Row) error
+	// ValidateRows checks the given rows without ingesting anything, so that bad payloads can be
+	// rejected before committing to the WAL. It gives back a RowError for each row InsertRows would
+	// reject, drop or alter, hence nil means all rows are going to be stored as they are.
+	ValidateRows(rows []Row) []RowError
+	// Merge folds data points another storage persisted under the given data path, namely ones in its
+	// disk partitions and the ones left in its WAL, into the storage. It's useful to consolidate
+	// per-process databases into one. The other storage must have been closed, and files under the
+	// data path are left as they are.
+	//
+	// Data points older than all partitions go into a new partition, while the others get inserted as
+	// if they were written by InsertRows, as late writes if needed. Data points sharing a timestamp
+	// with existing ones are kept as is; use WithDuplicatePolicy to resolve them at query time.
+	Merge(dataPath string) error
+	// BulkLoad streams rows in the bulk-load format written by BulkWriter into the storage, which is
+	// way faster than InsertRows for initial migrations of historical data. Rows don't have to be ordered.
+	//
+	// Rows older than all partitions skip the WAL and get written into new partitions directly, which
+	// become visible once all rows got loaded. The others get inserted as if they were written by InsertRows.
+	// If it fails, the new partitions are removed while rows inserted by the latter way are kept.
+	BulkLoad(r io.Reader) error
+	// ExportCSV writes data points of the given metric and labels within the given start-end range to w as CSV,
+	// with a "timestamp,value" header followed by a record for each data point, which suits interchange
+	// with spreadsheets and pandas. ErrNoDataPoints will be returned without writing anything if no data points found.
+	ExportCSV(w io.Writer, metric string, labels []Label, start, end int64) error
+	// ImportCSV reads CSV in the format written by ExportCSV, where the header is optional, and inserts
+	// the data points as the given metric and labels with InsertRows in batches. Batches inserted before
+	// an error are kept. ErrInvalidCSV will be returned if the data doesn't follow the format.
+	ImportCSV(r io.Reader, metric string, labels []Label) error
+	// Delete marks data points of the given metric and labels within the given start-end range as deleted,
+	// which hides them from queries right away. Keep in mind that start is inclusive, end is exclusive.
+	// Data points written within the range afterwards are hidden as well as long as the deletion is kept.
+	//
+	// Deletions stay reversible with Undelete for the grace period given by WithDeleteGracePeriod,
+	// and then data points get physically removed from disk partitions at the next compaction.
+	// Without the grace period, data points in memory partitions are removed right away.
+	Delete(metric string, labels []Label, start, end int64) error
+	// Undelete reverts all deletions of the given metric and labels made within the grace period.
+	// ErrNothingToUndelete will be returned if there is no such deletion.
+	Undelete(metric string, labels []Label) error
+	// Flush persists all inactive memory partitions into disk partitions on demand, which otherwise stay
+	// in memory until the head partition gets rolled over enough times. The head partition is never flushed
+	// since it's still being written; its data points are kept in the WAL. It does nothing in the in-memory mode.
+	// A *DegradedError is returned once the storage got degraded into read-only, and ErrClosed once Close has begun.
+	Flush() error
+	// FlushCtx is like Flush but gives up once the given context is done, and then gives back the error of it.
+	// Partitions flushed until then are kept on disk.
+	FlushCtx(ctx context.Context) error
+	// Snapshot copies the data into the given directory, which must not exist, without stopping ingestion.
+	// Inactive memory partitions get flushed first, and then disk partitions are hard-linked, or copied where
+	// hard links aren't available, along with the WAL holding data points in the other memory partitions.
+	// The snapshot is crash-consistent, so that it can be opened as the data path of another storage as if
+	// the storage crashed at that time, or restored with RestoreStorage. Data points in memory partitions are
+	// missing if the WAL is disabled.
+	// It's not available in the in-memory mode.
+	Snapshot(dir string) error
+	// Stats gives back the current state of the storage, such as the numbers of partitions and data points
+	// and the disk usage, which is meant for health dashboards. Taking it walks the data directories.
+	Stats() Stats
 	// Close gracefully shutdowns by flushing any unwritten data to the underlying disk partition.
+	// It waits for writes in progress to be done, while rejecting new writes, e.g. inserts, merges, bulk loads and
+	// deletes, and selects with ErrClosed.
+	// It's safe to call more than once, even concurrently; all calls give back the result of the first one.
 	Close() error
 }
 
@@ -65,7 +155,155 @@ type Reader interface {
 	// Select gives back a list of data points that matches a set of the given metric and
 	// labels within the given start-end range. Keep in mind that start is inclusive, end is exclusive,
 	// and both must be Unix timestamp. ErrNoDataPoints will be returned if no data points found.
-	Select(metric string, labels []Label, start, end int64) (points []*DataPoint, err error)
+	// ErrInvalidTimestampRange will be returned unless start is less than end,
+	// and ErrClosed will be returned once Close has begun.
+	//
+	// Data points are in ascending order of timestamp. Data points sharing a timestamp are
+	// returned in order of insertion, so that repeated queries return identical results,
+	// unless they get resolved into one by WithDuplicatePolicy.
+	Select(metric string, labels []Label, start, end int64, opts ...SelectOption) (points []*DataPoint, err error)
+	// SelectCtx is like Select but gives up once the given context is done, and then gives back the error of
+	// the context. The query timeout given by WithQueryTimeout or SelectTimeout still applies.
+	SelectCtx(ctx context.Context, metric string, labels []Label, start, end int64, opts ...SelectOption) (points []*DataPoint, err error)
+	// SelectInto is like Select but appends copies of data points to dst and gives back the extended slice.
+	// Passing the previous result as dst[:0] allows to query repeatedly without allocating.
+	// ErrNoDataPoints will be returned along with dst as is if no data points found.
+	SelectInto(dst []DataPoint, metric string, labels []Label, start, end int64, opts ...SelectOption) ([]DataPoint, error)
+	// SelectColumns is like Select but gives back timestamps and values of data points as separate slices
+	// of the same length, which suits analytical callers scanning a column at a time.
+	SelectColumns(metric string, labels []Label, start, end int64, opts ...SelectOption) (timestamps []int64, values []float64, err error)
+	// SelectChunks gives back an iterator over chunks holding data points of the given metric and labels
+	// within the given range as encoded, so that they can be passed around without decoding.
+	// Chunks overlapping the range are given back as a whole, hence they may hold data points out of the range.
+	//
+	// Chunks are given back from the oldest partition, in ascending order within a partition.
+	// Chunks from different partitions may overlap, and no duplicate policy is applied.
+	// Chunks persisted on disk are compressed with the algorithm specified at the time,
+	// while others are encoded on the fly without compression.
+	SelectChunks(metric string, labels []Label, start, end int64) (ChunkIterator, error)
+	// SelectDownsampled is like Select but reduces data points to at most maxPoints with the
+	// Largest-Triangle-Three-Buckets algorithm, which gives charts a visually faithful reduction,
+	// unlike averaging at fixed steps. The first and the last data points are always kept.
+	SelectDownsampled(metric string, labels []Label, start, end int64, maxPoints int, opts ...SelectOption) ([]*DataPoint, error)
+	// SelectAggregated is like Select but aggregates data points within each step into one with the given
+	// function, so that callers don't have to pull all data points to reduce them. Steps are counted from start,
+	// and the aggregated data points are timestamped at the beginning of their steps. Steps without data points
+	// are omitted. The step must be at least one unit of the timestamp precision.
+	SelectAggregated(metric string, labels []Label, start, end int64, step time.Duration, fn AggrFunc, opts ...SelectOption) ([]*DataPoint, error)
+	// Delta gives back how much the counter of the given metric and labels increased within each window,
+	// taking a decrease in value as a counter reset, after which the counter is assumed to have restarted from zero.
+	// Windows are counted from start, and the deltas are timestamped at the beginning of their windows.
+	// The increase between two consecutive data points counts toward the window holding the latter one,
+	// hence windows without data points, and the window holding only the first data point, are omitted.
+	// The window must be at least one unit of the timestamp precision.
+	Delta(metric string, labels []Label, start, end int64, window time.Duration, opts ...SelectOption) ([]*DataPoint, error)
+	// Rate is like Delta but gives back the per-second average rate of increase within each window,
+	// which is the delta divided by the window length.
+	Rate(metric string, labels []Label, start, end int64, window time.Duration, opts ...SelectOption) ([]*DataPoint, error)
+	// GetLatest gives back the latest data point of the given metric and labels, which is taken from the tail
+	// of the memory partition without scanning any range as long as it's there.
+	// ErrNoDataPoints will be returned if no data points found.
+	GetLatest(metric string, labels []Label) (*DataPoint, error)
+	// Count gives back the number of data points of the given metric and labels within the given range,
+	// which is taken from the metadata of partitions without decoding data points as far as possible.
+	// Only chunks partially overlapping the range get decoded. Data points are looked into as Select does
+	// instead if the series has deletions, or if WithDuplicatePolicy resolves duplicates.
+	Count(metric string, labels []Label, start, end int64) (int64, error)
+	// Exists reports whether the storage holds any data point of the given metric and labels, which is
+	// answered from the metadata of partitions as Count is.
+	Exists(metric string, labels []Label) bool
+	// SelectSeries gives back all series satisfying all the given matchers, along with their data points
+	// within the given start-end range, unlike Select which requires the exact set of labels.
+	// Series are in ascending order of metric and labels, and ones without data points within the range are
+	// left out. ErrNoDataPoints will be returned if no series found.
+	SelectSeries(matchers []Matcher, start, end int64, opts ...SelectOption) ([]Series, error)
+	// SelectGroupedBy is like SelectSeries but gives back one series for each distinct combination of values of
+	// the given labels, like `sum by (host)(...)` of PromQL. Data points of series in a group sharing a timestamp
+	// get aggregated into one with the given function, hence series are supposed to be written at aligned timestamps.
+	//
+	// Series given back have only the grouping labels, leaving out ones series don't have. Their metric is
+	// left empty unless MetricNameLabel is one of the grouping labels.
+	SelectGroupedBy(matchers []Matcher, start, end int64, groupLabels []string, fn AggrFunc, opts ...SelectOption) ([]Series, error)
+	// SelectGlob is like SelectSeries but selects series whose metric name matches the given glob pattern,
+	// for Graphite-style dotted metric names. The pattern is resolved against the index of metric names.
+	// In the pattern, '*' matches any characters but dots, '?' matches any single character but a dot,
+	// '[...]' matches a character in the class, which is negated by '[!...]', and '{a,b}' matches any of
+	// the comma-separated alternatives. For instance, "cpu.*.usage" matches "cpu.host-1.usage".
+	SelectGlob(pattern string, start, end int64, opts ...SelectOption) ([]Series, error)
+	// ListMetrics gives back the names of all metrics in ascending order, so that UIs can let users
+	// choose one without keeping track of what got inserted.
+	//
+	// Metrics whose data points are all deleted may still be listed until partitions holding them go away.
+	ListMetrics() ([]string, error)
+	// ListLabelNames gives back the names of all labels series of the given metric have, in ascending order.
+	ListLabelNames(metric string) ([]string, error)
+	// ListLabelValues gives back all values of the given label series of the given metric have, in ascending order.
+	ListLabelValues(metric, labelName string) ([]string, error)
+}
+
+// SelectOption is an optional setting for Select.
+type SelectOption func(*selectOptions)
+
+type selectOptions struct {
+	timeout     time.Duration
+	memoryLimit int64
+	predicate   ValuePredicate
+	order       selectOrder
+}
+
+// SelectTimeout overrides the timeout given by WithQueryTimeout for the call.
+// Giving 0 means no timeout.
+func SelectTimeout(timeout time.Duration) SelectOption {
+	return func(o *selectOptions) {
+		o.timeout = timeout
+	}
+}
+
+// SelectMemoryLimit overrides the memory limit given by WithQueryMemoryLimit for the call.
+// Giving 0 means no limit.
+func SelectMemoryLimit(bytes int64) SelectOption {
+	return func(o *selectOptions) {
+		o.memoryLimit = bytes
+	}
+}
+
+// SelectWhere selects only data points whose values satisfy the given predicate, such as ValueGreaterThan(100).
+// The predicate gets evaluated while decoding each partition, so that rejected data points are never materialized.
+// Giving it more than once selects data points satisfying all of them.
+//
+// Keep in mind that it's evaluated before duplicates get resolved by WithDuplicatePolicy, and before
+// Select variants aggregating data points, such as SelectAggregated, do aggregation.
+func SelectWhere(pred ValuePredicate) SelectOption {
+	return func(o *selectOptions) {
+		if pred == nil {
+			return
+		}
+		if prev := o.predicate; prev != nil {
+			o.predicate = func(value float64) bool { return prev(value) && pred(value) }
+			return
+		}
+		o.predicate = pred
+	}
+}
+
+// SelectDescending gives back data points in descending order of timestamp, instead of ascending.
+// Select variants working on data points in ascending order, such as SelectAggregated, ignore it.
+func SelectDescending() SelectOption {
+	return func(o *selectOptions) {
+		o.order.descending = true
+	}
+}
+
+// SelectLimit gives back only the latest n data points, such as the latest 100 ones, either in ascending
+// or descending order. Partitions are looked into from the newest one, and older ones are never decoded
+// once the limit is met. Giving 0 or less means no limit.
+func SelectLimit(n int) SelectOption {
+	return func(o *selectOptions) {
+		if n < 0 {
+			n = 0
+		}
+		o.order.limit = n
+	}
 }
 
 // Row includes a data point along with properties to identify a kind of metrics.
@@ -97,6 +335,21 @@ type Option func(*storage)
 func WithDataPath(dataPath string) Option {
 	return func(s *storage) {
 		s.dataPath = dataPath
+		s.dataPaths = nil
+	}
+}
+
+// WithDataPaths is like WithDataPath but distributes disk partitions across the given directories
+// in round-robin, so that servers with several disks can use all of them without RAID.
+// The WAL and other files than partitions reside in the first directory.
+// Partitions are read back from all of them at start-up, no matter which directory they were put in.
+func WithDataPaths(dataPaths ...string) Option {
+	return func(s *storage) {
+		s.dataPath = ""
+		if len(dataPaths) > 0 {
+			s.dataPath = dataPaths[0]
+		}
+		s.dataPaths = dataPaths
 	}
 }
 
@@ -114,9 +367,61 @@ func WithPartitionDuration(duration time.Duration) Option {
 	}
 }
 
+// WithPartitionMaxPoints makes partitions get rolled over once they hold the given number of data points,
+// even if they don't exceed the duration given by WithPartitionDuration.
+// Use this along with a longer partition duration to let the storage adapt the partition
+// range to the ingest rate, which makes partitions fine-grained for high-rate workloads
+// while keeping them coarse for low-rate ones.
+//
+// Keep in mind that the more often partitions are rolled over, the sooner out-of-order
+// data points fall out of the writable partitions.
+//
+// Defaults to 0 which means no limit.
+func WithPartitionMaxPoints(n int64) Option {
+	return func(s *storage) {
+		s.maxPointsPerPartition = n
+	}
+}
+
+// WithPartitionMaxBytes is like WithPartitionMaxPoints but takes the approximate number of bytes
+// data points occupy in memory partitions as a budget.
+//
+// Defaults to 0 which means no limit.
+func WithPartitionMaxBytes(n int64) Option {
+	return func(s *storage) {
+		s.maxBytesPerPartition = n
+	}
+}
+
+// WithCompressedHead makes memory partitions hold data points Gorilla-encoded, appending them to
+// an open chunk per metric, rather than as raw data points. It cuts the memory usage several times,
+// especially for high-resolution data, at the cost of decoding data points on every read.
+// Out-of-order data points are held as they are until getting flushed.
+//
+// Note that WithPartitionMaxBytes still estimates the size of data points as raw ones.
+func WithCompressedHead() Option {
+	return func(s *storage) {
+		s.compressedHead = true
+	}
+}
+
+// WithWarmUpRange makes disk partitions holding data points within the given range from the newest one
+// warmed up in the background after they get opened or flushed, so that the first queries after a restart
+// don't pay the latency of reading the disk. Warming up populates the page cache by reading the data files,
+// while the metric lookups need nothing to be warmed up since meta data are always held in heap.
+//
+// Defaults to 0 which means no warm-up.
+func WithWarmUpRange(d time.Duration) Option {
+	return func(s *storage) {
+		s.warmUpRange = d
+	}
+}
+
 // WithRetention specifies when to remove old data.
 // Data points will get automatically removed from the disk after a
 // specified period of time after a disk partition was created.
+// In the in-memory mode, it applies to memory partitions other than the writable ones in the same way,
+// checked every time the head partition gets rolled over. See also WithMaxInMemoryPartitions.
 // Defaults to 14d.
 func WithRetention(retention time.Duration) Option {
 	return func(s *storage) {
@@ -124,6 +429,18 @@ func WithRetention(retention time.Duration) Option {
 	}
 }
 
+// WithMaxInMemoryPartitions limits the number of memory partitions the in-memory mode keeps, including
+// the writable ones, so that the memory usage is bounded regardless of the retention. The oldest ones
+// get removed once the head partition gets rolled over beyond the limit. It has no effect with WithDataPath,
+// where memory partitions get persisted instead.
+//
+// Defaults to 0 which means no limit. Otherwise it must be at least 2, the number of writable partitions.
+func WithMaxInMemoryPartitions(n int) Option {
+	return func(s *storage) {
+		s.maxInMemoryPartitions = n
+	}
+}
+
 // WithTimestampPrecision specifies the precision of timestamps to be used by all operations.
 //
 // Defaults to Nanoseconds
@@ -133,10 +450,24 @@ func WithTimestampPrecision(precision TimestampPrecision) Option {
 	}
 }
 
+// WithValidTimeRange makes InsertRows reject the rows whose timestamps are out of [min, max]
+// with a *TimestampRangeError, which also tells the precision the timestamp seems to be in.
+// It helps to catch the precision mismatch, e.g. millisecond values fed into a storage with Seconds precision,
+// which otherwise causes selects to return nothing without any errors.
+// Note that the range has to be within the years 1678 to 2262 if the precision is Nanoseconds.
+//
+// By default, any timestamp is accepted.
+func WithValidTimeRange(min, max time.Time) Option {
+	return func(s *storage) {
+		s.validTimeRange = &timestampRange{min: min, max: max}
+	}
+}
+
 // WithWriteTimeout specifies the timeout to wait when workers are busy.
 //
 // The storage limits the number of concurrent goroutines to prevent from out of memory
 // errors and CPU trashing even if too many goroutines attempt to write.
+// InsertRows gives up with ErrOverloaded once it exceeds the timeout.
 //
 // Defaults to 30s.
 func WithWriteTimeout(timeout time.Duration) Option {
@@ -145,12 +476,288 @@ func WithWriteTimeout(timeout time.Duration) Option {
 	}
 }
 
-// WithLogger specifies the logger to emit verbose output.
+// WithWriteConcurrency specifies the range of the number of goroutines writing concurrently.
+// The limit starts at floor, and grows up to ceiling while writers are kept waiting and the write
+// latency stays low, which means writes wait for I/O such as WAL writes rather than compete for CPU.
+// It shrinks back once the write latency degrades. Giving the same value fixes the limit.
+//
+// Defaults to the number of available CPUs for floor, and four times as many for ceiling.
+func WithWriteConcurrency(floor, ceiling int) Option {
+	return func(s *storage) {
+		s.writeConcurrencyFloor = floor
+		s.writeConcurrencyCeiling = ceiling
+	}
+}
+
+// WithQueryConcurrency specifies the max number of goroutines decoding disk partitions on behalf of queries,
+// which are shared across all queries on top of the goroutines calling Select. Decoding partitions
+// concurrently cuts the latency of queries over a wide range spanning many disk partitions.
+// Giving 0 makes the goroutines calling Select decode partitions one by one.
+//
+// Defaults to the number of available CPUs.
+func WithQueryConcurrency(n int) Option {
+	return func(s *storage) {
+		s.queryConcurrency = n
+	}
+}
+
+// WithQueryCache enables the LRU cache of query results up to the given approximate number of bytes, so that
+// dashboards polling the same windows don't decode the same disk partitions over and over again. Only queries
+// over ranges held by disk partitions alone get cached, since memory partitions keep changing. Cached results
+// get dropped once partitions get flushed, compacted or removed, as well as on late writes and deletions.
+//
+// Defaults to 0 which means no cache.
+func WithQueryCache(bytes int64) Option {
+	return func(s *storage) {
+		s.queryCacheSize = bytes
+	}
+}
+
+// WithChunkCache enables the LRU cache of data points decoded from chunks of disk partitions up to the given
+// approximate number of bytes, so that repeated queries against recent disk partitions skip decompressing and
+// decoding the same chunks. Unlike WithQueryCache, cached chunks stay valid regardless of writes and deletions,
+// and serve any queries overlapping them.
+//
+// Defaults to 0 which means no cache.
+func WithChunkCache(bytes int64) Option {
+	return func(s *storage) {
+		s.chunkCacheSize = bytes
+	}
+}
+
+// WithMaxSeries specifies the max number of series the head partition can hold, so that an explosion of labels
+// can't exhaust memory. Inserting rows that would create series beyond it fails with SeriesLimitError, which
+// matches ErrTooManySeries, without inserting any of them. The count starts over every time the head partition
+// gets rotated. Concurrent inserts may exceed the limit slightly.
+//
+// Defaults to 0 which means no limit.
+func WithMaxSeries(n int) Option {
+	return func(s *storage) {
+		s.maxSeries = n
+	}
+}
+
+// WithIdleSeriesTimeout makes buffers of series in memory partitions shrunk to fit their data points once they
+// haven't got any data point for the given duration, which frees the capacity preallocated for series that
+// stopped receiving data points before the partition gets rotated. Buffers grow again if they get data points.
+//
+// Defaults to 0 which means buffers are kept as they are.
+func WithIdleSeriesTimeout(timeout time.Duration) Option {
+	return func(s *storage) {
+		s.idleSeriesTimeout = timeout
+	}
+}
+
+// WithQueryTimeout specifies the timeout for Select, so that one runaway range scan
+// can't hold resources indefinitely. It can be overridden per call with SelectTimeout.
+//
+// Once it exceeds the timeout, Select stops decoding data points and returns ErrQueryTimeout
+// without any data points; partial results are never returned.
+//
+// Defaults to 0 which means no timeout.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(s *storage) {
+		s.queryTimeout = timeout
+	}
+}
+
+// WithQueryMemoryLimit specifies the approximate number of bytes Select can materialize
+// for data points, so that a query over a huge range can't exhaust the host application's memory.
+// It can be overridden per call with SelectMemoryLimit.
+//
+// Once it exceeds the limit, Select gives up and returns ErrQueryMemoryLimitExceeded.
+//
+// Defaults to 0 which means no limit.
+func WithQueryMemoryLimit(bytes int64) Option {
+	return func(s *storage) {
+		s.queryMemoryLimit = bytes
+	}
+}
+
+// WithZeroTimestampAllowed makes zero timestamps get stored as is, namely as 1970-01-01T00:00:00Z,
+// instead of being filled with the current time. Use this when replaying historical data sets
+// that can contain the epoch.
+func WithZeroTimestampAllowed() Option {
+	return func(s *storage) {
+		s.zeroTimestampAllowed = true
+	}
+}
+
+// WithDuplicatePolicy specifies how selecting resolves data points sharing a timestamp,
+// which can exist across partitions after backfills and late writes, so that callers
+// never see duplicate timestamps in one result. See DuplicatePolicy for available policies.
+//
+// Defaults to KeepDuplicates which gives back all of them.
+func WithDuplicatePolicy(policy DuplicatePolicy) Option {
+	return func(s *storage) {
+		s.duplicatePolicy = policy
+	}
+}
+
+// WithBestEffortOpen makes NewStorage skip disk partitions that fail to open, such as
+// corrupt ones, instead of failing. Skipped partitions are reported through the logger,
+// and left as they are on disk for the investigation.
+//
+// By default, NewStorage fails if any of partitions fails to open.
+func WithBestEffortOpen() Option {
+	return func(s *storage) {
+		s.bestEffortOpen = true
+	}
+}
+
+// WithLazyOpen makes NewStorage defer decoding meta files of disk partitions
+// until the first operation touches them, which keeps start-up fast
+// with a large number of partitions. Until then, only their directory names are read.
+// Note that errors opening partitions, such as corruption, surface when they get used.
+//
+// By default, all disk partitions get opened at start-up.
+func WithLazyOpen() Option {
+	return func(s *storage) {
+		s.lazyOpen = true
+	}
+}
+
+// WithMaxMemoryBytes specifies the approximate number of bytes memory partitions and data files of disk partitions
+// mapped into memory can take. Once they exceed it, data files get unmapped from the least recently queried one,
+// and get mapped again when a query touches them next time. Memory partitions are never evicted, so keep them
+// small enough with WithPartitionMaxBytes or the like.
+//
+// Defaults to 0 which means no limit.
+func WithMaxMemoryBytes(bytes int64) Option {
+	return func(s *storage) {
+		s.maxMemoryBytes = bytes
+	}
+}
+
+// WithAllowedMemoryPercent is like WithMaxMemoryBytes but specifies the limit as the percent of memory available
+// to the process, which is the smaller of the physical memory and the limit of the cgroup. The smaller limit
+// applies if both are given.
+//
+// Defaults to 0 which means no limit.
+func WithAllowedMemoryPercent(percent float64) Option {
+	return func(s *storage) {
+		s.allowedMemoryPercent = percent
+	}
+}
+
+// WithMmapIdleTimeout makes data files of disk partitions unmapped from memory once no query has touched them
+// for the given duration, which keeps mappings of a long retention from piling up in the address space.
+// Data files get mapped into memory again when a query touches them next time.
+//
+// Data files get mapped into memory only once a query touches them regardless of this option.
+// Defaults to 0 which means they are kept mapped.
+func WithMmapIdleTimeout(timeout time.Duration) Option {
+	return func(s *storage) {
+		s.mmapIdleTimeout = timeout
+	}
+}
+
+// WithOpenConcurrency specifies the max number of disk partitions opened concurrently by NewStorage.
+// Opening them concurrently shortens start-up with a large number of partitions, especially on
+// storage media serving parallel reads well.
+//
+// Defaults to the number of available CPUs.
+func WithOpenConcurrency(n int) Option {
+	return func(s *storage) {
+		s.openConcurrency = n
+	}
+}
+
+// WithStartupProgress specifies the function called with the progress of NewStorage whenever it makes progress,
+// such as each disk partition getting opened and the WAL getting replayed, so that host applications can show
+// the status of booting. It is called synchronously from NewStorage and its goroutines, but never concurrently.
+func WithStartupProgress(fn func(progress StartupProgress)) Option {
+	return func(s *storage) {
+		s.startup.fn = fn
+	}
+}
+
+// WithDeleteGracePeriod specifies how long deletions stay reversible with Undelete.
+// Deleted data points are kept on disk for the period, and removed by the compaction following it.
+//
+// Defaults to 0 which means deletions are irreversible.
+func WithDeleteGracePeriod(d time.Duration) Option {
+	return func(s *storage) {
+		s.deleteGracePeriod = d
+	}
+}
+
+// WithDegradedThreshold specifies the number of consecutive failures of writing to disk, namely appending to
+// the WAL and flushing partitions, at which the storage gets degraded into read-only. Once degraded, operations
+// writing data give back a *DegradedError, instead of piling up data points in heap that can't be persisted,
+// while selecting keeps working. It lasts until the storage gets opened again. Giving 0 disables it.
+//
+// Defaults to 3.
+func WithDegradedThreshold(n int) Option {
+	return func(s *storage) {
+		s.health.threshold = n
+	}
+}
+
+// WithDegradedHandler specifies the function called with the details once the storage gets degraded
+// into read-only. See WithDegradedThreshold.
+func WithDegradedHandler(handler func(err *DegradedError)) Option {
+	return func(s *storage) {
+		s.health.handler = handler
+	}
+}
+
+// WithCorruptionHandler specifies the function called with the details whenever corruption in disk partitions
+// is found, while opening them, selecting data points and compacting them, so that failing storage media
+// can be alerted on. The handler may get called concurrently, hence it must be goroutine safe.
+func WithCorruptionHandler(handler func(err *CorruptionError)) Option {
+	return func(s *storage) {
+		s.corruptionHandler = handler
+	}
+}
+
+// WithTracer specifies the tracer starting spans around InsertRows, flushing each memory partition, and Select,
+// with attributes such as the number of rows and partitions scanned, to debug latency in production services.
+// See Tracer to plug OpenTelemetry in.
+//
+// Defaults to nil which means no tracing.
+func WithTracer(tracer Tracer) Option {
+	return func(s *storage) {
+		s.tracer = tracer
+	}
+}
+
+// WithOnFlush specifies the function called whenever a memory partition gets flushed into a disk partition,
+// whether it succeeded or not, so that embedders can emit their own metrics or trigger backups without polling.
+// It is called synchronously while flushing, hence it must return quickly and must not call Flush or Close.
+func WithOnFlush(fn func(info FlushInfo)) Option {
+	return func(s *storage) {
+		s.hooks.onFlush = fn
+	}
+}
+
+// WithOnPartitionCreated specifies the function called whenever a partition gets created, namely a new head
+// memory partition, and a partition written by Merge or BulkLoad. Disk partitions swapped for flushed memory
+// partitions are told by the function given by WithOnFlush instead.
+// It is called synchronously, hence it must return quickly and must not call into the storage.
+func WithOnPartitionCreated(fn func(info PartitionInfo)) Option {
+	return func(s *storage) {
+		s.hooks.onPartitionCreated = fn
+	}
+}
+
+// WithOnPartitionRemoved specifies the function called whenever a partition gets removed, namely once it
+// expires by the retention, gets evicted in the in-memory mode, or has all data points deleted by compaction.
+// It is called synchronously, hence it must return quickly and must not call Flush or Close.
+func WithOnPartitionRemoved(fn func(info PartitionInfo)) Option {
+	return func(s *storage) {
+		s.hooks.onPartitionRemoved = fn
+	}
+}
+
+// WithLogger specifies the logger to emit verbose output. Give a LeveledLogger via Leveled to have messages
+// logged at their severities with their context as keys and values; otherwise each of them is given to Printf
+// prefixed with its severity.
 //
 // Defaults to a logger implementation that does nothing.
 func WithLogger(logger Logger) Option {
 	return func(s *storage) {
-		s.logger = logger
+		s.logger = leveledFrom(logger)
 	}
 }
 
@@ -166,6 +773,186 @@ func WithWALBufferedSize(size int) Option {
 	}
 }
 
+// WithWALPreallocSize makes disk space of the given number of bytes preallocated for each WAL segment,
+// and WAL segments no longer needed recycled as the next ones instead of being removed.
+// It reduces filesystem metadata churn and latency spikes caused by allocating blocks while writing.
+// Preallocation is available only on Linux, where the space is allocated without changing the file size.
+//
+// Defaults to 0 which means no preallocation.
+func WithWALPreallocSize(size int64) Option {
+	return func(s *storage) {
+		s.walPreallocSize = size
+	}
+}
+
+// WithWALCompression makes records written to WAL segments compressed with snappy, rows appended
+// at a time together, which cuts the disk bandwidth taken by the WAL under high ingest rates at the
+// expense of some CPU. Segments are readable regardless of whether it's given.
+//
+// Defaults to false which means records are written as is.
+func WithWALCompression() Option {
+	return func(s *storage) {
+		s.walCompression = true
+	}
+}
+
+// WithWALSegmentSize makes the active WAL segment rotated once its size exceeds the given number of bytes,
+// so that segments never grow too large while a partition is being written. Segments get removed once all
+// partitions whose data points they hold get flushed.
+//
+// Defaults to 0 which means segments get rotated only when partitions are.
+func WithWALSegmentSize(size int64) Option {
+	return func(s *storage) {
+		s.walSegmentSize = size
+	}
+}
+
+// WithMmapWAL makes WAL segments written through memory mapping instead of write system calls,
+// which turns each append into a copy into memory and cuts the per-append overhead at very high
+// ingest rates. Segments get extended by the size given by WithWALPreallocSize, or 4MiB by default,
+// at a time. Written records are msynced to disk once the given interval has passed since the last
+// msync, and whenever a segment gets closed. Giving 0 makes them msynced on every write.
+//
+// It's available on Linux, macOS, FreeBSD, OpenBSD and DragonFly BSD; NewStorage fails elsewhere.
+// It can't be used together with WithWALEncryptionKey.
+func WithMmapWAL(syncInterval time.Duration) Option {
+	return func(s *storage) {
+		s.walMmap = true
+		s.walMmapSyncInterval = syncInterval
+	}
+}
+
+// WithWALSync specifies when WAL segments get fsynced, which is either WALSyncNever, WALSyncEveryWrite
+// or WALSyncInterval. The more often they get fsynced, the fewer data points get lost on an OS crash or
+// power failure at the expense of write latency. Segments get fsynced whenever they get closed as well
+// unless it's WALSyncNever.
+//
+// Defaults to WALSyncNever.
+func WithWALSync(policy WALSyncPolicy) Option {
+	return func(s *storage) {
+		s.walSyncPolicy = policy
+	}
+}
+
+// WithWALEncryptionKey specifies the AES key to encrypt WAL segments with, so that metric names,
+// labels and values don't sit on disk in plaintext. The key must be either 16, 24, or 32 bytes
+// to select AES-128, AES-192, or AES-256.
+// Segments written in plaintext before the key was given are still readable.
+//
+// Note that it offers confidentiality only; use a file system that detects tampering if needed.
+//
+// Defaults to nil which means WAL segments are not encrypted.
+func WithWALEncryptionKey(key []byte) Option {
+	return func(s *storage) {
+		s.walEncryptionKey = key
+	}
+}
+
+// WithCompression specifies the algorithm to compress chunks of data points in disk partitions.
+// It doesn't affect partitions already persisted; they are read with the algorithm they were written.
+//
+// Defaults to NoCompression.
+func WithCompression(compression Compression) Option {
+	return func(s *storage) {
+		s.compression = compression
+	}
+}
+
+// WithCompressionLevel specifies the level passed to the compression algorithm,
+// e.g. from gzip.BestSpeed to gzip.BestCompression for Gzip, and from 1 to 22 for Zstd.
+// Higher levels trade flush CPU for disk footprint.
+//
+// Defaults to 0 which means the default level of the algorithm.
+func WithCompressionLevel(level int) Option {
+	return func(s *storage) {
+		s.compressionLevel = level
+	}
+}
+
+// WithChunkSize specifies the maximum number of data points encoded in a chunk.
+// A chunk is a unit of Gorilla encoding and compression. The larger the size,
+// the better the compression ratio at the expense of decoding data points out of the queried range.
+// Giving 0 means every metric is encoded into a single chunk within a partition.
+//
+// Defaults to 0.
+func WithChunkSize(size int) Option {
+	return func(s *storage) {
+		s.chunkSize = size
+	}
+}
+
+// WithBinaryMeta makes meta files of disk partitions written in a compact binary format rather than JSON,
+// which is much smaller and faster to decode with a large number of series per partition.
+// Partitions are read regardless of the format of their meta files, hence it can be turned on and off
+// any time, while versions of tstorage without the binary format can't read partitions written with it.
+//
+// Defaults to false.
+func WithBinaryMeta() Option {
+	return func(s *storage) {
+		s.binaryMeta = true
+	}
+}
+
+// WithMetricRetention specifies the retention for the given metric, which takes effect when
+// it is shorter than the one given by WithRetention.
+// Unlike WithRetention, data points of the metric get removed based on their own timestamps:
+// disk partitions holding data points older than the retention get rewritten without them by
+// the periodic compaction, so that series with mixed retention can share partitions.
+//
+// It works only when WithDataPath is given.
+func WithMetricRetention(metric string, retention time.Duration) Option {
+	return func(s *storage) {
+		if s.metricRetentions == nil {
+			s.metricRetentions = make(map[string]time.Duration)
+		}
+		s.metricRetentions[metric] = retention
+	}
+}
+
+// WithMetricRateLimit limits the ingest rate of the given metric to pointsPerSec data points per second
+// in total across its labels, allowing bursts of up to burst data points. It protects the storage from
+// a single misbehaving producer flooding a metric while others starve for workers.
+//
+// InsertRows gives back a *RateLimitError without inserting any rows if rows of any metric exceed its limit,
+// hence burst must be at least the number of data points of the metric given at once.
+// ValidateRows doesn't take it into account, and neither Merge nor BulkLoad is limited.
+func WithMetricRateLimit(metric string, pointsPerSec float64, burst int) Option {
+	return func(s *storage) {
+		s.rateLimiter.setLimit(metric, pointsPerSec, burst)
+	}
+}
+
+// WithRollup adds a coarser resolution, which keeps data points aggregated into one for each step with the given
+// function for the given retention, aside from raw data points kept for the one given by WithRetention.
+// Calling it more than once makes a multi-resolution policy, e.g. raw data points for 24h, 1m averages
+// for 30d and 1h averages for 1y.
+//
+// Data points get rolled up when memory partitions get flushed into disk partitions, or removed in the in-memory
+// mode, aligning steps to the Unix epoch. Late data points written afterwards aren't rolled up, and a step
+// crossing partitions gets aggregated in each of them.
+//
+// Once raw data points don't reach as old as start, Select, SelectCtx and SelectInto select data points older
+// than the oldest raw one from the finest resolution holding data points as old as start, and raw data points
+// for the rest. SelectAggregated aggregates data points rolled up again instead of raw ones, as long as the
+// resolution is made with the same function other than AggrAvg, its step divides the given one, and start is
+// aligned to it. The step must be at least one unit of the timestamp precision.
+func WithRollup(step, retention time.Duration, fn AggrFunc) Option {
+	return func(s *storage) {
+		s.rollups = append(s.rollups, rollup{step: step, retention: retention, fn: fn})
+	}
+}
+
+// WithPartitions registers user-defined partition backends into the partition list.
+// They are put in order of their min timestamp, alongside the partitions read from the data path.
+// See Partition for the lifecycle contract.
+func WithPartitions(partitions ...Partition) Option {
+	return func(s *storage) {
+		for _, p := range partitions {
+			s.customPartitions = append(s.customPartitions, &publicPartition{p: p})
+		}
+	}
+}
+
 // NewStorage gives back a new storage, which stores time-series data in the process memory by default.
 //
 // Give the WithDataPath option for running as a on-disk storage. Specify a directory with data already exists,
@@ -173,80 +960,187 @@ func WithWALBufferedSize(size int) Option {
 func NewStorage(opts ...Option) (Storage, error) {
 	s := &storage{
 		partitionList:      newPartitionList(),
-		workersLimitCh:     make(chan struct{}, defaultWorkersLimit),
+		openConcurrency:    defaultWorkersLimit,
+		queryConcurrency:   defaultWorkersLimit,
 		partitionDuration:  defaultPartitionDuration,
 		retention:          defaultRetention,
 		timestampPrecision: defaultTimestampPrecision,
 		writeTimeout:       defaultWriteTimeout,
 		walBufferedSize:    defaultWALBufferedSize,
+		compression:        NoCompression,
 		wal:                &nopWAL{},
 		logger:             &nopLogger{},
 		doneCh:             make(chan struct{}, 0),
+
+		writeConcurrencyFloor:   defaultWorkersLimit,
+		writeConcurrencyCeiling: defaultWorkersCeiling,
+		health:                  writeHealth{threshold: defaultDegradedThreshold},
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
 
+	if s.maxPointsPerPartition < 0 || s.maxBytesPerPartition < 0 {
+		return nil, fmt.Errorf("partition thresholds must not be negative")
+	}
+	if s.maxInMemoryPartitions != 0 && s.maxInMemoryPartitions < writablePartitionsNum {
+		return nil, fmt.Errorf("max in-memory partitions must be at least %d", writablePartitionsNum)
+	}
+	if s.chunkSize < 0 {
+		return nil, fmt.Errorf("chunk size must not be negative")
+	}
+	if s.openConcurrency < 1 {
+		return nil, fmt.Errorf("open concurrency must be positive")
+	}
+	if s.maxSeries < 0 {
+		return nil, fmt.Errorf("max series must not be negative")
+	}
+	if s.idleSeriesTimeout < 0 {
+		return nil, fmt.Errorf("idle series timeout must not be negative")
+	}
+	if s.mmapIdleTimeout < 0 {
+		return nil, fmt.Errorf("mmap idle timeout must not be negative")
+	}
+	if s.maxMemoryBytes < 0 {
+		return nil, fmt.Errorf("max memory bytes must not be negative")
+	}
+	if s.allowedMemoryPercent < 0 || s.allowedMemoryPercent > 100 {
+		return nil, fmt.Errorf("allowed memory percent must be within 0-100")
+	}
+	s.memoryBudget = s.maxMemoryBytes
+	if s.allowedMemoryPercent > 0 {
+		allowed := memory.Allowed(s.allowedMemoryPercent)
+		if allowed <= 0 {
+			return nil, fmt.Errorf("failed to determine the amount of memory available")
+		}
+		if s.memoryBudget == 0 || allowed < s.memoryBudget {
+			s.memoryBudget = allowed
+		}
+	}
+	if s.queryConcurrency < 0 {
+		return nil, fmt.Errorf("query concurrency must not be negative")
+	}
+	s.queryWorkers = make(chan struct{}, s.queryConcurrency)
+	if s.queryCacheSize < 0 {
+		return nil, fmt.Errorf("query cache size must not be negative")
+	}
+	if s.queryCacheSize > 0 {
+		s.queryCache = newQueryCache(s.queryCacheSize)
+	}
+	if s.chunkCacheSize < 0 {
+		return nil, fmt.Errorf("chunk cache size must not be negative")
+	}
+	if s.chunkCacheSize > 0 {
+		s.chunkCache = newChunkCache(s.chunkCacheSize)
+	}
+	if s.writeConcurrencyFloor < 1 || s.writeConcurrencyCeiling < s.writeConcurrencyFloor {
+		return nil, fmt.Errorf("write concurrency must be positive, and the ceiling must not be less than the floor")
+	}
+	s.workers = newWorkerPool(s.writeConcurrencyFloor, s.writeConcurrencyCeiling)
+	if err := s.rateLimiter.validate(); err != nil {
+		return nil, err
+	}
+	if s.health.threshold < 0 {
+		return nil, fmt.Errorf("degraded threshold must not be negative")
+	}
+	if s.walMmap && s.walEncryptionKey != nil {
+		return nil, fmt.Errorf("memory-mapped WAL can't be encrypted")
+	}
+	if s.walSyncPolicy.mode == walSyncInterval && s.walSyncPolicy.interval <= 0 {
+		return nil, fmt.Errorf("WAL sync interval must be positive")
+	}
+	if s.walSegmentSize < 0 {
+		return nil, fmt.Errorf("WAL segment size must not be negative")
+	}
+	if s.walPreallocSize < 0 {
+		return nil, fmt.Errorf("WAL preallocation size must not be negative")
+	}
+	if s.validTimeRange != nil {
+		if s.validTimeRange.min.After(s.validTimeRange.max) {
+			return nil, fmt.Errorf("the min of the valid time range must not be after the max")
+		}
+		s.validTimeRange.precision = s.timestampPrecision
+	}
+	compressor, err := newCompressor(s.compression, s.compressionLevel)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression settings: %w", err)
+	}
+	s.compressor = compressor
+	if err := s.openRollups(); err != nil {
+		return nil, err
+	}
+
 	if s.inMemoryMode() {
+		s.insertPartitions(s.customPartitions)
 		s.newPartition(nil, false)
+		s.reportStartupDone()
+		if s.idleSeriesTimeout > 0 {
+			go s.shrinkIdleSeriesPeriodically()
+		}
 		return s, nil
 	}
 
-	if err := os.MkdirAll(s.dataPath, fs.ModePerm); err != nil {
-		return nil, fmt.Errorf("failed to make data directory %s: %w", s.dataPath, err)
+	if len(s.dataPaths) == 0 {
+		s.dataPaths = []string{s.dataPath}
+	}
+	for _, dir := range s.dataPaths {
+		if dir == "" {
+			return nil, fmt.Errorf("data paths must not be empty")
+		}
+		if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+			return nil, fmt.Errorf("failed to make data directory %s: %w", dir, err)
+		}
+	}
+	if err := s.tombstones.load(s.dataPath); err != nil {
+		return nil, err
 	}
 
 	walDir := filepath.Join(s.dataPath, walDirName)
+	walOpts, err := s.walOptions()
+	if err != nil {
+		return nil, err
+	}
 	if s.walBufferedSize >= 0 {
-		wal, err := newDiskWAL(walDir, s.walBufferedSize)
+		wal, err := newDiskWAL(walDir, s.walBufferedSize, append(walOpts, withWALMetrics(&s.metrics.wal))...)
 		if err != nil {
 			return nil, err
 		}
-		s.wal = wal
+		s.wal = &monitoredWAL{wal: wal, health: &s.health}
 	}
 
 	// Read existent partitions from the disk.
-	dirs, err := os.ReadDir(s.dataPath)
+	paths, err := s.listPartitionDirs()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open data directory: %w", err)
-	}
-	if len(dirs) == 0 {
-		s.newPartition(nil, false)
-		return s, nil
+		return nil, err
 	}
-	isPartitionDir := func(f fs.DirEntry) bool {
-		return f.IsDir() && partitionDirRegex.MatchString(f.Name())
-	}
-	partitions := make([]partition, 0, len(dirs))
-	for _, e := range dirs {
-		if !isPartitionDir(e) {
-			continue
-		}
-		path := filepath.Join(s.dataPath, e.Name())
-		part, err := openDiskPartition(path, s.retention)
-		if errors.Is(err, ErrNoDataPoints) {
-			continue
-		}
-		if errors.Is(err, errInvalidPartition) {
-			// It should be recovered by WAL
-			continue
-		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to open disk partition for %s: %w", path, err)
-		}
-		partitions = append(partitions, part)
+	partitions, err := s.openPartitions(paths)
+	if err != nil {
+		return nil, err
 	}
-	sort.Slice(partitions, func(i, j int) bool {
-		return partitions[i].minTimestamp() < partitions[j].minTimestamp()
-	})
-	for _, p := range partitions {
-		s.newPartition(p, false)
+	partitions = append(partitions, s.customPartitions...)
+	s.insertPartitions(partitions)
+	if s.warmUpRange > 0 {
+		go s.warmUpPartitions(partitions)
 	}
 	// Start WAL recovery if there is.
-	if err := s.recoverWAL(walDir); err != nil {
+	if err := s.recoverWAL(walDir, walOpts...); err != nil {
 		return nil, fmt.Errorf("failed to recover WAL: %w", err)
 	}
 	s.newPartition(nil, false)
+	s.reportStartupDone()
+	if s.walSyncPolicy.mode == walSyncInterval {
+		s.walSyncWG.Add(1)
+		go s.syncWALPeriodically()
+	}
+	if s.mmapIdleTimeout > 0 {
+		go s.unmapIdlePartitionsPeriodically()
+	}
+	if s.memoryBudget > 0 {
+		go s.enforceMemoryBudgetPeriodically()
+	}
+	if s.idleSeriesTimeout > 0 {
+		go s.shrinkIdleSeriesPeriodically()
+	}
 
 	// periodically check and permanently remove expired partitions.
 	go func() {
@@ -257,10 +1151,15 @@ func NewStorage(opts ...Option) (Storage, error) {
 			case <-s.doneCh:
 				return
 			case <-ticker.C:
+				s.flushMu.Lock()
 				err := s.removeExpiredPartitions()
 				if err != nil {
-					s.logger.Printf("%v\n", err)
+					s.logger.Error("failed to remove expired partitions", "err", err)
 				}
+				if err := s.compactPartitions(); err != nil {
+					s.logger.Error("failed to compact partitions", "err", err)
+				}
+				s.flushMu.Unlock()
 			}
 		}
 	}()
@@ -269,38 +1168,194 @@ func NewStorage(opts ...Option) (Storage, error) {
 
 type storage struct {
 	partitionList partitionList
-
-	walBufferedSize    int
-	wal                wal
-	partitionDuration  time.Duration
-	retention          time.Duration
-	timestampPrecision TimestampPrecision
-	dataPath           string
-	writeTimeout       time.Duration
-
-	logger         Logger
-	workersLimitCh chan struct{}
-	// wg must be incremented to guarantee all writes are done gracefully.
+	// coarser resolutions in ascending order of step.
+	rollups []rollup
+	// user-defined partitions to be registered at start-up.
+	customPartitions []partition
+
+	// whether WAL segments are written through memory mapping, and how often they are msynced.
+	walMmap             bool
+	walMmapSyncInterval time.Duration
+
+	walBufferedSize   int
+	walEncryptionKey  []byte
+	walPreallocSize   int64
+	walSyncPolicy     WALSyncPolicy
+	walSegmentSize    int64
+	walCompression    bool
+	wal               wal
+	partitionDuration time.Duration
+	retention         time.Duration
+	// zero means no limit.
+	maxInMemoryPartitions int
+	metricRetentions      map[string]time.Duration
+	timestampPrecision    TimestampPrecision
+	dataPath              string
+	writeTimeout          time.Duration
+	queryTimeout          time.Duration
+	queryMemoryLimit      int64
+	// whether a zero timestamp is a valid one rather than the one to be filled.
+	zeroTimestampAllowed bool
+	// nil means any timestamp is valid.
+	validTimeRange *timestampRange
+	// whether to skip partitions that fail to open.
+	bestEffortOpen   bool
+	duplicatePolicy  DuplicatePolicy
+	compression      Compression
+	compressionLevel int
+	chunkSize        int
+	compressor       compressor
+	// whether to write meta files in the binary format.
+	binaryMeta bool
+
+	// thresholds to roll over partitions regardless of the duration; zero means no limit.
+	maxPointsPerPartition int64
+	maxBytesPerPartition  int64
+	// whether memory partitions hold data points Gorilla-encoded.
+	compressedHead bool
+	// range of disk partitions to be warmed up; zero means no warm-up.
+	warmUpRange time.Duration
+	// whether disk partitions get opened on first use rather than at start-up.
+	lazyOpen bool
+	// max number of disk partitions opened concurrently at start-up.
+	openConcurrency int
+	startup         startupReporter
+	// duration of disuse after which data files get unmapped; zero means never.
+	mmapIdleTimeout time.Duration
+	// limits of the memory usage given by options, and the one in effect; zero means no limit.
+	maxMemoryBytes       int64
+	allowedMemoryPercent float64
+	memoryBudget         int64
+
+	// deletions applied at query time until the compaction applies them.
+	tombstones        tombstoneSet
+	deleteGracePeriod time.Duration
+
+	// ingest rate limits by metric.
+	rateLimiter rateLimiter
+	// max number of series in the head partition; zero means no limit.
+	maxSeries int
+	// duration of idleness after which buffers of series get shrunk; zero means never.
+	idleSeriesTimeout time.Duration
+	// directories disk partitions are distributed across, which includes dataPath.
+	dataPaths []string
+	// the index of the directory the next partition goes into, in round-robin.
+	nextDataPath uint32
+	// range of the number of concurrent writers.
+	writeConcurrencyFloor   int
+	writeConcurrencyCeiling int
+
+	// max number of goroutines decoding disk partitions on behalf of queries, and the slots held by them.
+	queryConcurrency int
+	queryWorkers     chan struct{}
+	queryCacheSize   int64
+	// nil if the query cache is disabled.
+	queryCache     *queryCache
+	chunkCacheSize int64
+	// nil if the chunk cache is disabled.
+	chunkCache *chunkCache
+	// pool of buffers to hold partitions to be queried.
+	partitionsPool sync.Pool
+	// pool of buffers to hold data points to be split into columns.
+	pointsPool sync.Pool
+	// lateMu serializes late writes and flushing partitions, so that
+	// rows never go into a memory partition being flushed.
+	lateMu sync.Mutex
+
+	// counts of what the storage has done, which Stats reports.
+	metrics selfMetrics
+
+	// nil means no one is interested in corruption.
+	corruptionHandler func(err *CorruptionError)
+	health            writeHealth
+	hooks             hooks
+
+	logger LeveledLogger
+	// nil means no tracing.
+	tracer  Tracer
+	workers *workerPool
+	// wg must be incremented to guarantee all writes are done gracefully, using beginWrite.
 	wg sync.WaitGroup
+	// closeMu makes incrementing wg and setting closed mutually exclusive, so that
+	// Close never misses writes which have begun.
+	closeMu sync.Mutex
+	closed  atomic.Bool
+	// closeOnce makes Close idempotent, which keeps the result of the first call in closeErr.
+	closeOnce sync.Once
+	closeErr  error
+	// flushWG tracks flushes in the background, which Close waits for.
+	flushWG sync.WaitGroup
+	// walSyncWG tracks the goroutine syncing the WAL periodically, which Close waits for once it's stopped.
+	walSyncWG sync.WaitGroup
+	// flushMu serializes flushing partitions, so that each memory partition gets flushed only once.
+	// Compacting and removing partitions in the background hold it as well, so that snapshots see
+	// a fixed set of partitions.
+	flushMu sync.Mutex
 
 	doneCh chan struct{}
 }
 
 func (s *storage) InsertRows(rows []Row) error {
-	s.wg.Add(1)
+	return s.insertRows(context.Background(), rows, true)
+}
+
+func (s *storage) InsertRowsCtx(ctx context.Context, rows []Row) error {
+	return s.insertRows(ctx, rows, true)
+}
+
+// insertRows ingests the given rows, and applies the rate limits and the series limit to them if fromProducer is true.
+// Merge, BulkLoad and WAL recovery skip the limits since they move existing data rather than ingest from producers.
+func (s *storage) insertRows(ctx context.Context, rows []Row, fromProducer bool) (err error) {
+	if fromProducer {
+		defer func(numRows int) { s.metrics.countInsert(numRows, err) }(len(rows))
+	}
+	if fromProducer && s.tracer != nil {
+		var span Span
+		ctx, span = startSpan(ctx, s.tracer, spanInsertRows)
+		span.SetAttributes("rows", len(rows))
+		defer func() { endSpan(span, err) }()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.beginWrite(); err != nil {
+		return err
+	}
 	defer s.wg.Done()
+	if err := s.health.check(); err != nil {
+		return err
+	}
+	rows = s.fillTimestamps(rows)
+	if s.validTimeRange != nil {
+		if err := s.validTimeRange.validate(rows); err != nil {
+			return err
+		}
+	}
+	if fromProducer {
+		if err := s.rateLimiter.allow(rows); err != nil {
+			return err
+		}
+	}
 
+	// Whether any partition has been given the rows, before which failures leave all of them uninserted.
+	var storing bool
 	insert := func() error {
-		defer func() { <-s.workersLimitCh }()
+		started := time.Now()
+		defer func() { s.workers.release(time.Since(started)) }()
 		if err := s.ensureActiveHead(); err != nil {
 			return err
 		}
+		if head, ok := s.partitionList.getHead().(*memoryPartition); ok && fromProducer && s.maxSeries > 0 {
+			if err := head.checkSeriesLimit(rows, s.maxSeries); err != nil {
+				return err
+			}
+		}
+		storing = true
 		iterator := s.partitionList.newIterator()
 		n := s.partitionList.size()
 		rowsToInsert := rows
 		// Starting at the head partition, try to insert rows, and loop to insert outdated rows
-		// into older partitions. Any rows more than `writablePartitionsNum` partitions out
-		// of date are dropped.
+		// into older partitions. Any rows older than all partitions are dropped.
 		for i := 0; i < n && i < writablePartitionsNum; i++ {
 			if len(rowsToInsert) == 0 {
 				break
@@ -308,74 +1363,371 @@ func (s *storage) InsertRows(rows []Row) error {
 			if !iterator.next() {
 				break
 			}
+			if s.unreadable(iterator.value()) {
+				continue
+			}
 			outdatedRows, err := iterator.value().insertRows(rowsToInsert)
 			if err != nil {
 				return fmt.Errorf("failed to insert rows: %w", err)
 			}
-			rowsToInsert = outdatedRows
+			rowsToInsert = outdatedRows
+		}
+		if len(rowsToInsert) == 0 {
+			return nil
+		}
+
+		// Rows older than the writable partitions go into older partitions as late writes;
+		// disk partitions append them to their late files.
+		s.lateMu.Lock()
+		defer s.lateMu.Unlock()
+		for len(rowsToInsert) > 0 && iterator.next() {
+			part := iterator.value()
+			switch part.(type) {
+			case *memoryPartition, *diskPartition:
+			default:
+				// User-defined partitions are never written by late writes.
+				continue
+			}
+			if s.unreadable(part) || part.expired() {
+				continue
+			}
+			outdatedRows, err := part.insertRows(rowsToInsert)
+			if _, ok := part.(*diskPartition); ok {
+				s.queryCache.invalidate()
+			}
+			if err != nil {
+				return fmt.Errorf("failed to insert late rows: %w", err)
+			}
+			rowsToInsert = outdatedRows
+		}
+		if len(rowsToInsert) > 0 {
+			s.logger.Warn("dropped rows older than all partitions", "rows", len(rowsToInsert))
+		}
+		return nil
+	}
+
+	// Limit the number of concurrent goroutines to prevent from out of memory
+	// errors and CPU trashing even if too many goroutines attempt to write.
+	if !s.workers.acquire(ctx, s.writeTimeout) {
+		if fromProducer {
+			// Rejected rows must not eat into the rate limits.
+			s.rateLimiter.refund(rows)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: failed to write a data point in %s with %d concurrent writers",
+			ErrOverloaded, s.writeTimeout, s.workers.currentLimit())
+	}
+	if err := insert(); err != nil {
+		if fromProducer && !storing {
+			s.rateLimiter.refund(rows)
+		}
+		return err
+	}
+	return nil
+}
+
+// fillTimestamps gives back rows whose empty timestamps are filled with the current time.
+// The given rows are never modified.
+func (s *storage) fillTimestamps(rows []Row) []Row {
+	if s.zeroTimestampAllowed {
+		return rows
+	}
+	var filled []Row
+	for i := range rows {
+		if rows[i].Timestamp != 0 {
+			continue
+		}
+		if filled == nil {
+			filled = make([]Row, len(rows))
+			copy(filled, rows)
+		}
+		filled[i].Timestamp = toUnix(time.Now(), s.timestampPrecision)
+	}
+	if filled == nil {
+		return rows
+	}
+	return filled
+}
+
+// ensureActiveHead ensures the head of partitionList is an active partition.
+// If none, it creates a new one.
+func (s *storage) ensureActiveHead() error {
+	head := s.partitionList.getHead()
+	if head != nil && head.active() {
+		return nil
+	}
+
+	// All partitions seems to be inactive so add a new partition to the list.
+	if err := s.newPartition(nil, true); err != nil {
+		return err
+	}
+	s.flushWG.Add(1)
+	go func() {
+		defer s.flushWG.Done()
+		if err := s.flushPartitions(); err != nil {
+			s.logger.Error("failed to flush in-memory partitions", "err", err)
+			s.health.failed("flush", err)
+			return
+		}
+		s.health.succeeded()
+	}()
+	return nil
+}
+
+// beginWrite increments wg so that Close waits for the write, which must call wg.Done once done.
+// ErrClosed is returned once Close has begun.
+func (s *storage) beginWrite() error {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed.Load() {
+		return ErrClosed
+	}
+	s.wg.Add(1)
+	return nil
+}
+
+func (s *storage) Select(metric string, labels []Label, start, end int64, opts ...SelectOption) ([]*DataPoint, error) {
+	return s.SelectCtx(context.Background(), metric, labels, start, end, opts...)
+}
+
+func (s *storage) SelectCtx(parent context.Context, metric string, labels []Label, start, end int64, opts ...SelectOption) (points []*DataPoint, err error) {
+	if s.closed.Load() {
+		return nil, ErrClosed
+	}
+	defer s.metrics.queryDuration.observeSince(time.Now())
+	if s.tracer != nil {
+		var span Span
+		parent, span = startSpan(parent, s.tracer, spanSelect)
+		span.SetAttributes("metric", metric, "start", start, "end", end)
+		defer func() {
+			span.SetAttributes("data_points", len(points))
+			endSpan(span, err)
+		}()
+	}
+	if rs, boundary := s.rollupFor(start, end); rs != nil {
+		return s.selectStitched(parent, rs, boundary, metric, labels, start, end, opts)
+	}
+	return s.selectRaw(parent, metric, labels, start, end, opts)
+}
+
+// selectRaw selects raw data points, never going to rollups.
+func (s *storage) selectRaw(parent context.Context, metric string, labels []Label, start, end int64, opts []SelectOption) ([]*DataPoint, error) {
+	ctx, cancel := s.newQueryContext(parent, opts)
+	defer cancel()
+	points, err := s.selectDataPoints(ctx, metric, labels, start, end)
+	if err != nil {
+		// The caller is responsible for its own context being done, which isn't the query timing out.
+		if parentErr := parent.Err(); parentErr != nil {
+			return nil, parentErr
+		}
+		s.reportCorruption(err)
+		return nil, queryError(err)
+	}
+	return points, nil
+}
+
+func (s *storage) SelectInto(dst []DataPoint, metric string, labels []Label, start, end int64, opts ...SelectOption) ([]DataPoint, error) {
+	if s.closed.Load() {
+		return dst, ErrClosed
+	}
+	defer s.metrics.queryDuration.observeSince(time.Now())
+	if rs, boundary := s.rollupFor(start, end); rs != nil {
+		return s.selectIntoStitched(dst, rs, boundary, metric, labels, start, end, opts)
+	}
+	return s.selectInto(dst, metric, labels, start, end, opts)
+}
+
+// selectInto is like selectRaw but appends data points to dst, as SelectInto does.
+func (s *storage) selectInto(dst []DataPoint, metric string, labels []Label, start, end int64, opts []SelectOption) ([]DataPoint, error) {
+	ctx, cancel := s.newQueryContext(context.Background(), opts)
+	defer cancel()
+	if order := selectOrderFrom(ctx); order.limit > 0 {
+		// Go through references, which allocates, in order to stop at the partition meeting the limit.
+		points, err := s.selectDataPoints(ctx, metric, labels, start, end)
+		if err != nil {
+			s.reportCorruption(err)
+			return dst, queryError(err)
+		}
+		for _, p := range points {
+			dst = append(dst, *p)
+		}
+		return dst, nil
+	}
+	buf, ok := s.partitionsPool.Get().(*[]partition)
+	if !ok {
+		buf = &[]partition{}
+	}
+	defer func() {
+		*buf = (*buf)[:0]
+		s.partitionsPool.Put(buf)
+	}()
+	generation, epoch := s.partitionList.generation(), s.queryCache.currentEpoch()
+	parts, err := s.appendPartitionsInRange((*buf)[:0], metric, start, end)
+	if err != nil {
+		return dst, queryError(err)
+	}
+	*buf = parts
+	n := len(dst)
+	cacheKey, cacheable := s.queryCacheKey(ctx, metric, labels, start, end, parts, generation)
+	if cacheable {
+		if cached, ok := s.queryCache.get(cacheKey); ok {
+			dst = append(dst, cached...)
+			if selectOrderFrom(ctx).descending {
+				reverseDataPoints(dst[n:])
+			}
+			return dst, nil
 		}
-		return nil
 	}
-
-	// Limit the number of concurrent goroutines to prevent from out of memory
-	// errors and CPU trashing even if too many goroutines attempt to write.
-	select {
-	case s.workersLimitCh <- struct{}{}:
-		return insert()
-	default:
+	// Flags telling whether each data point comes from disk, populated only when required.
+	var fromDisk []bool
+	// Iterate over partitions from the oldest one in order to keep the order in ascending.
+	for i := len(parts) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return dst[:n], queryError(err)
+		}
+		before := len(dst)
+		dst, err = parts[i].appendDataPoints(ctx, dst, metric, labels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			s.reportCorruption(err)
+			return dst[:n], queryError(fmt.Errorf("failed to select data points: %w", err))
+		}
+		if s.duplicatePolicy == PreferDisk {
+			_, isDisk := parts[i].(*diskPartition)
+			fromDisk = appendDiskFlags(fromDisk, isDisk, len(dst)-before)
+		}
+	}
+	if len(dst) == n {
+		return dst, ErrNoDataPoints
+	}
+	if fromDisk != nil {
+		sortTagged(taggedDataPoints{points: dst[n:], fromDisk: fromDisk})
+	} else {
+		sortDataPoints(dst[n:])
+	}
+	points := dst[n:]
+	if !s.tombstones.isEmpty() {
+		// Dropping keeps the flags aligned as long as it's done before resolving duplicates.
+		points, fromDisk = dropDeletedDataPoints(points, fromDisk, s.tombstones.get(marshalMetricName(metric, labels)))
+		if len(points) == 0 {
+			return dst[:n], ErrNoDataPoints
+		}
 	}
+	points, err = dedupeDataPoints(points, fromDisk, s.duplicatePolicy)
+	if err != nil {
+		return dst[:n], err
+	}
+	if cacheable {
+		s.queryCache.put(cacheKey, epoch, append([]DataPoint(nil), points...))
+	}
+	if selectOrderFrom(ctx).descending {
+		reverseDataPoints(points)
+	}
+	return dst[:n+len(points)], nil
+}
 
-	// Seems like all workers are busy; wait for up to writeTimeout
+func (s *storage) SelectChunks(metric string, labels []Label, start, end int64) (ChunkIterator, error) {
+	if s.closed.Load() {
+		return nil, ErrClosed
+	}
+	parts, err := s.appendPartitionsInRange(nil, metric, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkIterator{
+		parts:      parts,
+		metric:     metric,
+		labels:     labels,
+		start:      start,
+		end:        end,
+		chunkSize:  s.chunkSize,
+		tombstones: s.tombstones.get(marshalMetricName(metric, labels)),
+		report:     s.reportCorruption,
+	}, nil
+}
 
-	t := timerpool.Get(s.writeTimeout)
-	select {
-	case s.workersLimitCh <- struct{}{}:
-		timerpool.Put(t)
-		return insert()
-	case <-t.C:
-		timerpool.Put(t)
-		return fmt.Errorf("failed to write a data point in %s, since it is overloaded with %d concurrent writers",
-			s.writeTimeout, defaultWorkersLimit)
+// unreadable reports whether the given partition is a disk partition that failed to get loaded.
+// Such a partition is neither written nor removed by retention. The load error gets logged only once.
+func (s *storage) unreadable(part partition) bool {
+	d, ok := part.(*diskPartition)
+	if !ok {
+		return false
+	}
+	err := d.load()
+	if err == nil {
+		return false
 	}
+	if d.loadErrReported.CompareAndSwap(false, true) {
+		s.reportCorruption(err)
+		s.logger.Error("skipped the disk partition failing to get loaded", "path", d.dirPath, "err", err)
+	}
+	return true
 }
 
-// ensureActiveHead ensures the head of partitionList is an active partition.
-// If none, it creates a new one.
-func (s *storage) ensureActiveHead() error {
-	head := s.partitionList.getHead()
-	if head != nil && head.active() {
-		return nil
+// reportCorruption passes the corruption the given error describes, if any, to the corruption handler.
+func (s *storage) reportCorruption(err error) {
+	var ce *CorruptionError
+	if s.corruptionHandler != nil && errors.As(err, &ce) {
+		s.corruptionHandler(ce)
 	}
+}
 
-	// All partitions seems to be inactive so add a new partition to the list.
-	if err := s.newPartition(nil, true); err != nil {
-		return err
+// newQueryContext gives back a context derived from the given one that carries the settings for the query.
+func (s *storage) newQueryContext(parent context.Context, opts []SelectOption) (context.Context, context.CancelFunc) {
+	o := selectOptions{
+		timeout:     s.queryTimeout,
+		memoryLimit: s.queryMemoryLimit,
 	}
-	go func() {
-		if err := s.flushPartitions(); err != nil {
-			s.logger.Printf("failed to flush in-memory partitions: %v", err)
+	if len(opts) > 0 {
+		// Apply options to another one in order not to let o escape to heap.
+		po := &selectOptions{timeout: o.timeout, memoryLimit: o.memoryLimit}
+		for _, opt := range opts {
+			opt(po)
 		}
-	}()
-	return nil
+		o = *po
+	}
+	ctx := withSelectOrder(withValuePredicate(withQueryBudget(parent, o.memoryLimit), o.predicate), o.order)
+	ctx = withChunkCache(ctx, s.chunkCache)
+	if o.timeout > 0 {
+		return context.WithTimeout(ctx, o.timeout)
+	}
+	return ctx, func() {}
+}
+
+// queryError converts the error caused by the query context into the public one.
+func queryError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrQueryTimeout
+	}
+	return err
+}
+
+// errInvalidRange gives back ErrInvalidTimestampRange along with the given range.
+func errInvalidRange(start, end int64) error {
+	return fmt.Errorf("%w: start %d must be less than end %d", ErrInvalidTimestampRange, start, end)
 }
 
-func (s *storage) Select(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+// appendPartitionsInRange appends partitions that may hold data points within the given range
+// to dst in order of newest to oldest.
+func (s *storage) appendPartitionsInRange(dst []partition, metric string, start, end int64) ([]partition, error) {
 	if metric == "" {
-		return nil, fmt.Errorf("metric must be set")
+		return nil, ErrEmptyMetric
 	}
 	if start >= end {
-		return nil, fmt.Errorf("the given start is greater than end")
+		return nil, errInvalidRange(start, end)
 	}
-	points := make([]*DataPoint, 0)
-
-	// Iterate over all partitions from the newest one.
-	iterator := s.partitionList.newIterator()
-	for iterator.next() {
-		part := iterator.value()
+	n := len(dst)
+	all := s.partitionList.appendPartitions(dst)
+	dst = all[:n]
+	for _, part := range all[n:] {
 		if part == nil {
 			return nil, fmt.Errorf("unexpected empty partition found")
 		}
-		if part.minTimestamp() == 0 {
+		if !unopened(part) && part.size() == 0 {
 			// Skip the partition that has no points.
 			continue
 		}
@@ -386,31 +1738,222 @@ func (s *storage) Select(metric string, labels []Label, start, end int64) ([]*Da
 		if part.minTimestamp() > end {
 			continue
 		}
-		ps, err := part.selectDataPoints(metric, labels, start, end)
+		dst = append(dst, part)
+	}
+	// Don't keep references to partitions out of range.
+	for i := len(dst); i < len(all); i++ {
+		all[i] = nil
+	}
+	return dst, nil
+}
+
+// selectDataPoints gives back data points across all partitions, which can be aborted with ctx.
+func (s *storage) selectDataPoints(ctx context.Context, metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+	generation, epoch := s.partitionList.generation(), s.queryCache.currentEpoch()
+	parts, err := s.appendPartitionsInRange(nil, metric, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if s.tracer != nil {
+		spanFrom(ctx).SetAttributes("partitions", len(parts))
+	}
+	cacheKey, cacheable := s.queryCacheKey(ctx, metric, labels, start, end, parts, generation)
+	if cacheable {
+		if cached, ok := s.queryCache.get(cacheKey); ok {
+			points := make([]*DataPoint, len(cached))
+			copied := append([]DataPoint(nil), cached...)
+			for i := range copied {
+				points[i] = &copied[i]
+			}
+			return selectOrderFrom(ctx).apply(points), nil
+		}
+	}
+	// Data points from each partition, in order of newest to oldest.
+	results := make([][]*DataPoint, 0, len(parts))
+	// Whether each of results comes from disk, populated only when required.
+	var diskResults []bool
+	var numPoints int
+	order := selectOrderFrom(ctx)
+	// Select from all partitions up front unless it may stop halfway through.
+	var selected [][]*DataPoint
+	var selectErrs []error
+	if order.limit == 0 && len(parts) > 1 {
+		selected, selectErrs = s.selectPartitions(ctx, parts, metric, labels, start, end)
+	}
+
+	// Iterate over partitions from the newest one.
+	for i, part := range parts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var ps []*DataPoint
+		if selected != nil {
+			ps, err = selected[i], selectErrs[i]
+		} else {
+			ps, err = part.selectDataPoints(ctx, metric, labels, start, end)
+		}
 		if errors.Is(err, ErrNoDataPoints) {
 			continue
 		}
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return nil, err
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to select data points: %w", err)
 		}
-		// in order to keep the order in ascending.
-		points = append(ps, points...)
+		results = append(results, ps)
+		numPoints += len(ps)
+		if s.duplicatePolicy == PreferDisk {
+			_, isDisk := part.(*diskPartition)
+			diskResults = append(diskResults, isDisk)
+		}
+		// Stop once older partitions can't hold any of the latest data points up to the limit.
+		if order.limit > 0 && numPoints >= order.limit && i+1 < len(parts) {
+			points, err := s.resolveDataPointRefs(results, diskResults, metric, labels)
+			if err == nil && order.coveredBy(points, parts[i+1].maxTimestamp()) {
+				return order.apply(points), nil
+			}
+		}
+	}
+	points, err := s.resolveDataPointRefs(results, diskResults, metric, labels)
+	if err != nil {
+		return nil, err
+	}
+	if cacheable {
+		copied := make([]DataPoint, len(points))
+		for i, p := range points {
+			copied[i] = *p
+		}
+		s.queryCache.put(cacheKey, epoch, copied)
+	}
+	return order.apply(points), nil
+}
+
+// resolveDataPointRefs merges data points from each partition, in order of newest to oldest, into one in ascending
+// order, and then drops deleted ones and resolves duplicates.
+func (s *storage) resolveDataPointRefs(results [][]*DataPoint, diskResults []bool, metric string, labels []Label) ([]*DataPoint, error) {
+	var numPoints int
+	for _, ps := range results {
+		numPoints += len(ps)
 	}
-	if len(points) == 0 {
+	if numPoints == 0 {
 		return nil, ErrNoDataPoints
 	}
-	return points, nil
+	// Copy into a new slice since ps may share the underlying array with the partition.
+	points := make([]*DataPoint, 0, numPoints)
+	var fromDisk []bool
+	for i := len(results) - 1; i >= 0; i-- {
+		// in order to keep the order in ascending.
+		points = append(points, results[i]...)
+		if diskResults != nil {
+			fromDisk = appendDiskFlags(fromDisk, diskResults[i], len(results[i]))
+		}
+	}
+	if fromDisk != nil {
+		sortTagged(taggedDataPointRefs{points: points, fromDisk: fromDisk})
+	} else {
+		sortDataPointRefs(points)
+	}
+	if !s.tombstones.isEmpty() {
+		points, fromDisk = dropDeletedDataPointRefs(points, fromDisk, s.tombstones.get(marshalMetricName(metric, labels)))
+		if len(points) == 0 {
+			return nil, ErrNoDataPoints
+		}
+	}
+	return dedupeDataPointRefs(points, fromDisk, s.duplicatePolicy)
+}
+
+// sortDataPointRefs sorts the given points in ascending order of timestamp unless they are already sorted.
+// Partitions may overlap when the older one accepted out-of-order points after the newer one was created.
+// Points sharing a timestamp are kept in the given order, that is, points in older partitions come first,
+// and points within a partition are in order of insertion.
+func sortDataPointRefs(points []*DataPoint) {
+	for i := 1; i < len(points); i++ {
+		if points[i].Timestamp < points[i-1].Timestamp {
+			sort.SliceStable(points, func(i, j int) bool {
+				return points[i].Timestamp < points[j].Timestamp
+			})
+			return
+		}
+	}
+}
+
+// sortDataPoints is like sortDataPointRefs but takes data points.
+func sortDataPoints(points []DataPoint) {
+	for i := 1; i < len(points); i++ {
+		if points[i].Timestamp < points[i-1].Timestamp {
+			sort.SliceStable(points, func(i, j int) bool {
+				return points[i].Timestamp < points[j].Timestamp
+			})
+			return
+		}
+	}
+}
+
+func (s *storage) Flush() error {
+	return s.FlushCtx(context.Background())
+}
+
+func (s *storage) FlushCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.beginWrite(); err != nil {
+		return err
+	}
+	defer s.wg.Done()
+	if err := s.health.check(); err != nil {
+		return err
+	}
+	if s.inMemoryMode() {
+		return nil
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	var inactive []*memoryPartition
+	iterator := s.partitionList.newIterator()
+	for i := 0; iterator.next(); i++ {
+		memPart, ok := iterator.value().(*memoryPartition)
+		if i == 0 || !ok || memPart.active() {
+			continue
+		}
+		inactive = append(inactive, memPart)
+	}
+	// Flush from the oldest, since each flush removes the oldest WAL segment.
+	for i := len(inactive) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.flushPartition(inactive[i]); err != nil {
+			s.health.failed("flush", err)
+			return fmt.Errorf("failed to flush in-memory partitions: %w", err)
+		}
+		s.health.succeeded()
+	}
+	return nil
 }
 
 func (s *storage) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close()
+	})
+	return s.closeErr
+}
+
+func (s *storage) close() error {
+	// Reject new writes, and then wait for ones in progress.
+	s.closeMu.Lock()
+	s.closed.Store(true)
+	s.closeMu.Unlock()
 	s.wg.Wait()
+	s.flushWG.Wait()
 	close(s.doneCh)
+	s.walSyncWG.Wait()
 	if err := s.wal.flush(); err != nil {
 		return fmt.Errorf("failed to flush buffered WAL: %w", err)
 	}
 
-	// TODO: Prevent from new goroutines calling InsertRows(), for graceful shutdown.
-
 	// Make all writable partitions read-only by inserting as same number of those.
 	for i := 0; i < writablePartitionsNum; i++ {
 		if err := s.newPartition(nil, true); err != nil {
@@ -427,25 +1970,65 @@ func (s *storage) Close() error {
 	if err := s.wal.removeAll(); err != nil {
 		return fmt.Errorf("failed to remove WAL: %w", err)
 	}
-	return nil
+	// Rollups have got the rest of data points by the flush above.
+	return s.closeRollups()
 }
 
 func (s *storage) newPartition(p partition, punctuateWal bool) error {
-	if p == nil {
-		p = newMemoryPartition(s.wal, s.partitionDuration, s.timestampPrecision)
+	created := p == nil
+	if created {
+		m := newMemoryPartition(s.wal, s.partitionDuration, s.timestampPrecision).(*memoryPartition)
+		m.maxPoints = s.partitionMaxPoints()
+		m.compressed = s.compressedHead
+		p = m
 	}
 	s.partitionList.insert(p)
+	if created {
+		s.hooks.partitionCreated(p)
+	}
 	if punctuateWal {
 		return s.wal.punctuate()
 	}
 	return nil
 }
 
+// partitionMaxPoints gives back the number of data points at which memory partitions get rolled over.
+// Zero means no limit.
+func (s *storage) partitionMaxPoints() int64 {
+	max := s.maxPointsPerPartition
+	if s.maxBytesPerPartition > 0 {
+		n := s.maxBytesPerPartition / memoryPointSize
+		if n == 0 {
+			n = 1
+		}
+		if max == 0 || n < max {
+			max = n
+		}
+	}
+	return max
+}
+
+// insertPartitions puts the given partitions into the partition list in order of min timestamp.
+func (s *storage) insertPartitions(partitions []partition) {
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].minTimestamp() < partitions[j].minTimestamp()
+	})
+	for _, p := range partitions {
+		s.newPartition(p, false)
+	}
+}
+
 // flushPartitions persists all in-memory partitions ready to persisted.
-// For the in-memory mode, just removes it from the partition list.
+// For the in-memory mode, it evicts old ones by the policy instead. See evictMemoryPartitions.
 func (s *storage) flushPartitions() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if s.inMemoryMode() {
+		return s.evictMemoryPartitions()
+	}
 	// Keep the first two partitions as is even if they are inactive,
 	// to accept out-of-order data points.
+	var memParts []*memoryPartition
 	i := 0
 	iterator := s.partitionList.newIterator()
 	for iterator.next() {
@@ -457,48 +2040,157 @@ func (s *storage) flushPartitions() error {
 		if part == nil {
 			return fmt.Errorf("unexpected empty partition found")
 		}
-		memPart, ok := part.(*memoryPartition)
-		if !ok {
-			continue
+		if memPart, ok := part.(*memoryPartition); ok {
+			memParts = append(memParts, memPart)
 		}
-
-		if s.inMemoryMode() {
-			if err := s.partitionList.remove(part); err != nil {
-				return fmt.Errorf("failed to remove partition: %w", err)
-			}
-			continue
+	}
+	// Flush from the oldest one, so that rollups get data points in order.
+	for i := len(memParts) - 1; i >= 0; i-- {
+		if err := s.flushPartition(memParts[i]); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// Start swapping in-memory partition for disk one.
-		// The disk partition will place at where in-memory one existed.
+// evictMemoryPartitions removes memory partitions beyond the number given by WithMaxInMemoryPartitions,
+// and ones created longer ago than the retention, in the in-memory mode. The writable ones are always kept.
+func (s *storage) evictMemoryPartitions() error {
+	s.lateMu.Lock()
+	defer s.lateMu.Unlock()
 
-		dir := filepath.Join(s.dataPath, fmt.Sprintf("p-%d-%d", memPart.minTimestamp(), memPart.maxTimestamp()))
-		if err := s.flush(dir, memPart); err != nil {
-			return fmt.Errorf("failed to compact memory partition into %s: %w", dir, err)
+	var evicted []*memoryPartition
+	cutoff := time.Now().Add(-s.retention)
+	i := 0
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		memPart, ok := iterator.value().(*memoryPartition)
+		if !ok {
+			// User-defined partitions are never evicted.
+			continue
 		}
-		newPart, err := openDiskPartition(dir, s.retention)
-		if errors.Is(err, ErrNoDataPoints) {
-			if err := s.partitionList.remove(part); err != nil {
-				return fmt.Errorf("failed to remove partition: %w", err)
-			}
+		i++
+		if i <= writablePartitionsNum {
 			continue
 		}
-		if err != nil {
-			return fmt.Errorf("failed to generate disk partition for %s: %w", dir, err)
+		if (s.maxInMemoryPartitions > 0 && i > s.maxInMemoryPartitions) ||
+			(s.retention > 0 && memPart.createdAt.Before(cutoff)) {
+			evicted = append(evicted, memPart)
 		}
-		if err := s.partitionList.swap(part, newPart); err != nil {
-			return fmt.Errorf("failed to swap partitions: %w", err)
+	}
+	// Evict from the oldest one, so that rollups get data points in order.
+	for i := len(evicted) - 1; i >= 0; i-- {
+		s.rollUp(evicted[i])
+		info := newPartitionInfo(evicted[i])
+		if err := s.partitionList.remove(evicted[i]); err != nil {
+			return fmt.Errorf("failed to remove partition: %w", err)
 		}
+		s.hooks.partitionRemoved(info)
+	}
+	return nil
+}
+
+// flushPartition swaps the given memory partition for a disk one.
+func (s *storage) flushPartition(memPart *memoryPartition) (err error) {
+	s.lateMu.Lock()
+	defer s.lateMu.Unlock()
+	started := time.Now()
+	defer s.metrics.flushDuration.observeSince(started)
+	info := FlushInfo{DataPoints: int64(memPart.size())}
+	if info.DataPoints > 0 {
+		info.MinTimestamp = memPart.minTimestamp()
+		info.MaxTimestamp = memPart.maxTimestamp()
+	}
+	_, span := startSpan(context.Background(), s.tracer, spanFlushPartition)
+	defer func() {
+		info.Duration = time.Since(started)
+		info.Err = err
+		s.hooks.flushed(info)
+		span.SetAttributes("data_points", info.DataPoints, "dir", info.Dir)
+		endSpan(span, err)
+	}()
+
+	// Start swapping in-memory partition for disk one.
+	// The disk partition will place at where in-memory one existed.
 
+	dir := s.newPartitionDir(memPart.minTimestamp(), memPart.maxTimestamp())
+	if err := s.flush(dir, memPart); err != nil {
+		return fmt.Errorf("failed to compact memory partition into %s: %w", dir, err)
+	}
+	newPart, err := openDiskPartition(dir, s.retention)
+	if errors.Is(err, ErrNoDataPoints) {
+		if err := s.partitionList.remove(memPart); err != nil {
+			return fmt.Errorf("failed to remove partition: %w", err)
+		}
+		// Its WAL segments are no longer needed as well.
 		if err := s.wal.removeOldest(); err != nil {
 			return fmt.Errorf("failed to remove oldest WAL segment: %w", err)
 		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to generate disk partition for %s: %w", dir, err)
+	}
+	s.rollUp(memPart)
+	if err := s.partitionList.swap(memPart, newPart); err != nil {
+		return fmt.Errorf("failed to swap partitions: %w", err)
+	}
+	info.Dir = dir
+	if s.warmUpRange > 0 {
+		newPart.(*diskPartition).warmUp()
+	}
+
+	if err := s.wal.removeOldest(); err != nil {
+		return fmt.Errorf("failed to remove oldest WAL segment: %w", err)
 	}
 	return nil
 }
 
+// newPartitionDir gives back the path to the directory for a new disk partition holding the given range,
+// in the data directory chosen in round-robin.
+func (s *storage) newPartitionDir(minT, maxT int64) string {
+	i := (atomic.AddUint32(&s.nextDataPath, 1) - 1) % uint32(len(s.dataPaths))
+	return filepath.Join(s.dataPaths[i], fmt.Sprintf("p-%d-%d", minT, maxT))
+}
+
 // flush compacts the data points in the given partition and flushes them to the given directory.
 func (s *storage) flush(dirPath string, m *memoryPartition) error {
+	return s.commitPartition(dirPath, m, time.Now())
+}
+
+// flushingDirSuffix is the suffix of the temporary directory a partition is written into before getting renamed.
+// It must not match partitionDirRegex so that half-written partitions are never opened.
+const flushingDirSuffix = ".tmp"
+
+// commitPartition writes the given partition into a temporary directory, and then renames it to the given one,
+// so that a crash in the middle never leaves a partial partition there. The given directory gets replaced if exists.
+func (s *storage) commitPartition(dirPath string, m *memoryPartition, createdAt time.Time) error {
+	tmpDir := dirPath + flushingDirSuffix
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", tmpDir, err)
+	}
+	if err := s.writePartition(tmpDir, m, createdAt); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	// Rename never replaces a non-empty directory.
+	if err := os.RemoveAll(dirPath); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to remove %s: %w", dirPath, err)
+	}
+	if err := os.Rename(tmpDir, dirPath); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpDir, dirPath, err)
+	}
+	if err := syncDir(filepath.Dir(dirPath)); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", filepath.Dir(dirPath), err)
+	}
+	return nil
+}
+
+// writePartition writes the data points in the given partition to the given directory,
+// as a disk partition created at the given time.
+func (s *storage) writePartition(dirPath string, m *memoryPartition, createdAt time.Time) error {
 	if dirPath == "" {
 		return fmt.Errorf("dir path is required")
 	}
@@ -512,59 +2204,67 @@ func (s *storage) flush(dirPath string, m *memoryPartition) error {
 		return fmt.Errorf("failed to create file %q: %w", dirPath, err)
 	}
 	defer f.Close()
-	encoder := newSeriesEncoder(f)
+	encoder := newChunkEncoder(withFaults(faultPartitionWrite, f), 0, s.compressor, s.chunkSize)
 
 	metrics := map[string]diskMetric{}
-	m.metrics.Range(func(key, value interface{}) bool {
-		mt, ok := value.(*memoryMetric)
-		if !ok {
-			s.logger.Printf("unknown value found\n")
-			return false
-		}
-		offset, err := f.Seek(0, io.SeekCurrent)
-		if err != nil {
-			s.logger.Printf("failed to set file offset of metric %q: %v\n", mt.name, err)
-			return false
-		}
+	var rangeErr error
+	m.rangeMetrics(func(mt *memoryMetric) bool {
+		offset := encoder.offset
 
 		if err := mt.encodeAllPoints(encoder); err != nil {
-			s.logger.Printf("failed to encode a data point that metric is %q: %v\n", mt.name, err)
+			rangeErr = fmt.Errorf("failed to encode a data point that metric is %q: %w", mt.name, err)
 			return false
 		}
 
 		if err := encoder.flush(); err != nil {
-			s.logger.Printf("failed to flush data points that metric is %q: %v\n", mt.name, err)
+			rangeErr = fmt.Errorf("failed to flush data points that metric is %q: %w", mt.name, err)
 			return false
 		}
 
-		totalNumPoints := mt.size + int64(len(mt.outOfOrderPoints))
+		chunks := encoder.reset()
+		if len(chunks) == 0 {
+			return true
+		}
+		// Take the time range from chunks since out-of-order data points, merged into them, can be
+		// older than all in-order ones.
+		var numPoints int64
+		for _, c := range chunks {
+			numPoints += c.NumDataPoints
+		}
 		metrics[mt.name] = diskMetric{
 			Name:          mt.name,
 			Offset:        offset,
-			MinTimestamp:  mt.minTimestamp,
-			MaxTimestamp:  mt.maxTimestamp,
-			NumDataPoints: totalNumPoints,
+			MinTimestamp:  chunks[0].MinTimestamp,
+			MaxTimestamp:  chunks[len(chunks)-1].MaxTimestamp,
+			NumDataPoints: numPoints,
+			Chunks:        chunks,
 		}
 		return true
 	})
+	if rangeErr != nil {
+		return rangeErr
+	}
+	if err := syncFile(f); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", f.Name(), err)
+	}
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	if err := writeIndex(dirPath, newLabelIndex(names)); err != nil {
+		return err
+	}
 
-	b, err := json.Marshal(&meta{
+	// It should write the meta file at last because what valid meta file exists proves the disk partition is valid.
+	return writeMeta(dirPath, &meta{
 		MinTimestamp:  m.minTimestamp(),
 		MaxTimestamp:  m.maxTimestamp(),
 		NumDataPoints: m.size(),
 		Metrics:       metrics,
-		CreatedAt:     time.Now(),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to encode metadata: %w", err)
-	}
-
-	// It should write the meta file at last because what valid meta file exists proves the disk partition is valid.
-	metaPath := filepath.Join(dirPath, metaFileName)
-	if err := os.WriteFile(metaPath, b, fs.ModePerm); err != nil {
-		return fmt.Errorf("failed to write metadata to %s: %w", metaPath, err)
-	}
-	return nil
+		CreatedAt:     createdAt,
+		Compression:   s.compression,
+		FormatVersion: formatVersion,
+	}, s.binaryMeta)
 }
 
 func (s *storage) removeExpiredPartitions() error {
@@ -575,22 +2275,31 @@ func (s *storage) removeExpiredPartitions() error {
 		if part == nil {
 			return fmt.Errorf("unexpected nil partition found")
 		}
+		if s.unreadable(part) {
+			continue
+		}
 		if part.expired() {
 			expiredList = append(expiredList, part)
 		}
 	}
 
 	for i := range expiredList {
+		info := newPartitionInfo(expiredList[i])
 		if err := s.partitionList.remove(expiredList[i]); err != nil {
 			return fmt.Errorf("failed to remove expired partition")
 		}
+		s.hooks.partitionRemoved(info)
 	}
 	return nil
 }
 
-// recoverWAL inserts all records within the given wal, and then removes all WAL segment files.
-func (s *storage) recoverWAL(walDir string) error {
-	reader, err := newDiskWALReader(walDir)
+// recoverWAL inserts all records within the given wal, which get written to the current segment again,
+// and then removes the replayed segment files.
+func (s *storage) recoverWAL(walDir string, opts ...diskWALOption) error {
+	s.startup.update(func(p *StartupProgress) {
+		p.Stage = StartupReplayingWAL
+	})
+	reader, err := newDiskWALReader(walDir, opts...)
 	if errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
@@ -602,13 +2311,116 @@ func (s *storage) recoverWAL(walDir string) error {
 		return fmt.Errorf("failed to read WAL: %w", err)
 	}
 
-	if len(reader.rowsToInsert) == 0 {
-		return nil
+	// Rows that disk partitions hold are durable already. Only the others get inserted, which logs them
+	// to the current segment again so that they survive another crash.
+	reader.rowsToInsert = s.dropPersistedRows(reader.rowsToInsert)
+	if len(reader.rowsToInsert) > 0 {
+		if err := s.insertRows(context.Background(), reader.rowsToInsert, false); err != nil {
+			return fmt.Errorf("failed to insert rows recovered from WAL: %w", err)
+		}
+		s.startup.update(func(p *StartupProgress) {
+			p.WALRowsReplayed = len(reader.rowsToInsert)
+		})
+	}
+	// Make sure the replayed rows are persisted to the current segment before removing the old ones,
+	// so that they survive another crash.
+	if err := s.wal.flush(); err != nil {
+		return fmt.Errorf("failed to flush replayed rows to WAL: %w", err)
+	}
+	return s.wal.removeReplayed()
+}
+
+// dropPersistedRows gives back the rows recovered from the WAL but ones disk partitions hold already. Rows of a
+// memory partition can outlive flushing it in the WAL, since they get logged to the segment of the head partition
+// at the time, and re-inserting them would make late writes duplicating them. A row is taken as held if the disk
+// partition covering its timestamp has a data point of the same series, timestamp and value that no other row
+// has been matched with.
+func (s *storage) dropPersistedRows(rows []Row) []Row {
+	var disks []*diskPartition
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		if d, ok := iterator.value().(*diskPartition); ok {
+			disks = append(disks, d)
+		}
+	}
+	if len(disks) == 0 {
+		return rows
+	}
+	type pointKey struct {
+		timestamp int64
+		value     uint64
+	}
+	type seriesKey struct {
+		partition *diskPartition
+		name      string
+	}
+	// Data points persisted in each series, counted so that each of them matches one row at most.
+	persisted := make(map[seriesKey]map[pointKey]int)
+	kept := rows[:0]
+	for i := range rows {
+		var covering *diskPartition
+		for _, d := range disks {
+			if d.minTimestamp() <= rows[i].Timestamp && rows[i].Timestamp <= d.maxTimestamp() {
+				covering = d
+				break
+			}
+		}
+		if covering == nil {
+			kept = append(kept, rows[i])
+			continue
+		}
+		key := seriesKey{partition: covering, name: marshalMetricName(rows[i].Metric, rows[i].Labels)}
+		points, ok := persisted[key]
+		if !ok {
+			points = make(map[pointKey]int)
+			selected, err := covering.selectDataPoints(context.Background(), rows[i].Metric, rows[i].Labels, math.MinInt64, math.MaxInt64)
+			if err != nil && !errors.Is(err, ErrNoDataPoints) {
+				s.logger.Warn("failed to look into persisted data points", "dir", covering.dirPath, "err", err)
+			}
+			for _, p := range selected {
+				points[pointKey{timestamp: p.Timestamp, value: math.Float64bits(p.Value)}]++
+			}
+			persisted[key] = points
+		}
+		pk := pointKey{timestamp: rows[i].Timestamp, value: math.Float64bits(rows[i].Value)}
+		if points[pk] > 0 {
+			points[pk]--
+			continue
+		}
+		kept = append(kept, rows[i])
+	}
+	if dropped := len(rows) - len(kept); dropped > 0 {
+		s.logger.Debug("skipped rows in the WAL persisted already", "rows", dropped)
+	}
+	return kept
+}
+
+// walOptions gives back the options to read and write WAL segments with.
+func (s *storage) walOptions() ([]diskWALOption, error) {
+	var opts []diskWALOption
+	if s.walEncryptionKey != nil {
+		block, err := aes.NewCipher(s.walEncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WAL encryption key: %w", err)
+		}
+		opts = append(opts, withWALCipher(block))
+	}
+	if s.walPreallocSize > 0 {
+		opts = append(opts, withWALPreallocation(s.walPreallocSize))
+	}
+	if s.walMmap {
+		opts = append(opts, withWALMmap(s.walMmapSyncInterval))
+	}
+	if s.walSegmentSize > 0 {
+		opts = append(opts, withWALSegmentSize(s.walSegmentSize))
+	}
+	if s.walCompression {
+		opts = append(opts, withWALCompression())
 	}
-	if err := s.InsertRows(reader.rowsToInsert); err != nil {
-		return fmt.Errorf("failed to insert rows recovered from WAL: %w", err)
+	if s.walSyncPolicy != WALSyncNever {
+		opts = append(opts, withWALSync(s.walSyncPolicy))
 	}
-	return s.wal.refresh()
+	return opts, nil
 }
 
 func (s *storage) inMemoryMode() bool {
@@ -1,6 +1,8 @@
 package tstorage
 
 import (
+	"strconv"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -17,6 +19,24 @@ func BenchmarkStorage_InsertRows(b *testing.B) {
 	}
 }
 
+// Insert data points of distinct metrics from many goroutines
+func BenchmarkStorage_InsertRowsParallelDistinctMetrics(b *testing.B) {
+	storage, err := NewStorage()
+	require.NoError(b, err)
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		metric := "metric" + strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+		var i int64
+		for pb.Next() {
+			i++
+			storage.InsertRows([]Row{
+				{Metric: metric, DataPoint: DataPoint{Timestamp: i, Value: 0.1}},
+			})
+		}
+	})
+}
+
 // Select data points among a thousand data in memory
 func BenchmarkStorage_SelectAmongThousandPoints(b *testing.B) {
 	storage, err := NewStorage()
@@ -46,3 +66,19 @@ func BenchmarkStorage_SelectAmongMillionPoints(b *testing.B) {
 		_, _ = storage.Select("metric1", nil, 10, 100)
 	}
 }
+
+// Select data points among a thousand data in memory into the reused buffer
+func BenchmarkStorage_SelectIntoAmongThousandPoints(b *testing.B) {
+	storage, err := NewStorage()
+	require.NoError(b, err)
+	for i := 1; i < 1000; i++ {
+		storage.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: int64(i), Value: 0.1}},
+		})
+	}
+	var dst []DataPoint
+	b.ResetTimer()
+	for i := 1; i < b.N; i++ {
+		dst, _ = storage.SelectInto(dst[:0], "metric1", nil, 10, 100)
+	}
+}
@@ -62,7 +62,7 @@ func ExampleStorage_InsertRows() {
 }
 
 // simulates writing and reading in concurrent.
-func ExampleStorage_InsertRows_Select_concurrent() {
+func ExampleStorage_InsertRows_selectConcurrent() {
 	storage, err := tstorage.NewStorage(
 		tstorage.WithPartitionDuration(5*time.Hour),
 		tstorage.WithTimestampPrecision(tstorage.Seconds),
@@ -468,8 +468,7 @@ func ExampleStorage_Select_from_disk() {
 	//Timestamp: 1600000049, Value: 0.2
 }
 
-// Out of order data points that are not yet flushed are in the buffer
-// but do not appear in select.
+// Out of order data points that are not yet flushed appear in select as well.
 func ExampleStorage_Select_from_memory_out_of_order() {
 	storage, err := tstorage.NewStorage(
 		tstorage.WithTimestampPrecision(tstorage.Seconds),
@@ -491,7 +490,7 @@ func ExampleStorage_Select_from_memory_out_of_order() {
 	if err != nil {
 		panic(err)
 	}
-	points, err := storage.Select("metric1", nil, 1600000000, 1600000003)
+	points, err := storage.Select("metric1", nil, 1600000000, 1600000004)
 	if err != nil {
 		panic(err)
 	}
@@ -499,10 +498,9 @@ func ExampleStorage_Select_from_memory_out_of_order() {
 		fmt.Printf("Timestamp: %v, Value: %v\n", p.Timestamp, p.Value)
 	}
 
-	// Out-of-order data points are ignored because they will get merged when flushing.
-
 	// Output:
 	// Timestamp: 1600000000, Value: 0.1
+	// Timestamp: 1600000001, Value: 0.1
 	// Timestamp: 1600000002, Value: 0.1
 	// Timestamp: 1600000003, Value: 0.1
 }
@@ -726,10 +724,11 @@ func ExampleStorage_InsertRows_expired() {
 		fmt.Printf("Timestamp: %v, Value: %v\n", p.Timestamp, p.Value)
 	}
 
-	// Missing data point at 1600000002 because it was dropped.
+	// The data point at 1600000002 was appended to the flushed partition as a late write.
 
 	// Output:
 	// Timestamp: 1600000001, Value: 0.1
+	// Timestamp: 1600000002, Value: 0.1
 	// Timestamp: 1600000003, Value: 0.1
 	// Timestamp: 1600000004, Value: 0.1
 	// Timestamp: 1600000005, Value: 0.1
@@ -1,16 +1,27 @@
 package tstorage
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_storage_Select(t *testing.T) {
 	tests := []struct {
 		name    string
-		storage storage
+		storage *storage
 		metric  string
 		labels  []Label
 		start   int64
@@ -23,7 +34,7 @@ func Test_storage_Select(t *testing.T) {
 			metric: "metric1",
 			start:  1,
 			end:    4,
-			storage: func() storage {
+			storage: func() *storage {
 				part1 := newMemoryPartition(nil, 1*time.Hour, Seconds)
 				_, err := part1.insertRows([]Row{
 					{DataPoint: DataPoint{Timestamp: 1}, Metric: "metric1"},
@@ -35,9 +46,9 @@ func Test_storage_Select(t *testing.T) {
 				}
 				list := newPartitionList()
 				list.insert(part1)
-				return storage{
-					partitionList:  list,
-					workersLimitCh: make(chan struct{}, defaultWorkersLimit),
+				return &storage{
+					partitionList: list,
+					workers:       newWorkerPool(defaultWorkersLimit, defaultWorkersLimit),
 				}
 			}(),
 			want: []*DataPoint{
@@ -51,7 +62,7 @@ func Test_storage_Select(t *testing.T) {
 			metric: "metric1",
 			start:  1,
 			end:    10,
-			storage: func() storage {
+			storage: func() *storage {
 				part1 := newMemoryPartition(nil, 1*time.Hour, Seconds)
 				_, err := part1.insertRows([]Row{
 					{DataPoint: DataPoint{Timestamp: 1}, Metric: "metric1"},
@@ -84,9 +95,9 @@ func Test_storage_Select(t *testing.T) {
 				list.insert(part2)
 				list.insert(part3)
 
-				return storage{
-					partitionList:  list,
-					workersLimitCh: make(chan struct{}, defaultWorkersLimit),
+				return &storage{
+					partitionList: list,
+					workers:       newWorkerPool(defaultWorkersLimit, defaultWorkersLimit),
 				}
 			}(),
 			want: []*DataPoint{
@@ -111,3 +122,782 @@ func Test_storage_Select(t *testing.T) {
 		})
 	}
 }
+
+func Test_storage_WithPartitions(t *testing.T) {
+	older := &fakePublicPartition{
+		minT:   1,
+		maxT:   2,
+		points: []*DataPoint{{Timestamp: 1}, {Timestamp: 2}},
+	}
+	newer := &fakePublicPartition{
+		minT:   3,
+		maxT:   4,
+		points: []*DataPoint{{Timestamp: 3}, {Timestamp: 4}},
+	}
+	expired := &fakePublicPartition{
+		minT:      5,
+		maxT:      5,
+		points:    []*DataPoint{{Timestamp: 5}},
+		IsExpired: true,
+	}
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		// Give in random order to make sure they get sorted.
+		WithPartitions(newer, expired, older),
+	)
+	require.NoError(t, err)
+
+	got, err := s.Select("metric1", nil, 1, 6)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1}, {Timestamp: 2}, {Timestamp: 3}, {Timestamp: 4}, {Timestamp: 5}}, got)
+
+	require.NoError(t, s.Close())
+	assert.True(t, expired.cleaned)
+	assert.False(t, older.cleaned)
+}
+
+func Test_storage_partitionMaxPoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxPoints int64
+		maxBytes  int64
+		want      int64
+	}{
+		{
+			name: "no limit",
+			want: 0,
+		},
+		{
+			name:      "only points given",
+			maxPoints: 100,
+			want:      100,
+		},
+		{
+			name:     "only bytes given",
+			maxBytes: 2400,
+			want:     100,
+		},
+		{
+			name:      "the smaller one wins",
+			maxPoints: 50,
+			maxBytes:  2400,
+			want:      50,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &storage{maxPointsPerPartition: tt.maxPoints, maxBytesPerPartition: tt.maxBytes}
+			assert.Equal(t, tt.want, s.partitionMaxPoints())
+		})
+	}
+}
+
+func Test_storage_selectDataPoints_deadlineExceeded(t *testing.T) {
+	part := newMemoryPartition(nil, 1*time.Hour, Seconds)
+	_, err := part.insertRows([]Row{
+		{DataPoint: DataPoint{Timestamp: 1}, Metric: "metric1"},
+	})
+	require.NoError(t, err)
+	list := newPartitionList()
+	list.insert(part)
+	s := &storage{partitionList: list}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = s.selectDataPoints(ctx, "metric1", nil, 1, 2)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Without timeout.
+	got, err := s.Select("metric1", nil, 1, 2, SelectTimeout(0))
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1}}, got)
+}
+
+func Test_storage_SelectInto(t *testing.T) {
+	part1 := newMemoryPartition(nil, 1*time.Hour, Seconds)
+	_, err := part1.insertRows([]Row{
+		{DataPoint: DataPoint{Timestamp: 1}, Metric: "metric1"},
+		{DataPoint: DataPoint{Timestamp: 2}, Metric: "metric1"},
+	})
+	require.NoError(t, err)
+	part2 := newMemoryPartition(nil, 1*time.Hour, Seconds)
+	_, err = part2.insertRows([]Row{
+		{DataPoint: DataPoint{Timestamp: 3}, Metric: "metric1"},
+	})
+	require.NoError(t, err)
+	list := newPartitionList()
+	list.insert(part1)
+	list.insert(part2)
+	s := &storage{partitionList: list}
+
+	dst := make([]DataPoint, 0, 3)
+	got, err := s.SelectInto(dst, "metric1", nil, 1, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []DataPoint{{Timestamp: 1}, {Timestamp: 2}, {Timestamp: 3}}, got)
+
+	if !raceEnabled {
+		allocs := testing.AllocsPerRun(100, func() {
+			got, _ = s.SelectInto(got[:0], "metric1", nil, 1, 4)
+		})
+		assert.Zero(t, allocs)
+	}
+
+	got, err = s.SelectInto(got[:0], "unknown", nil, 1, 4)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	assert.Empty(t, got)
+}
+
+func Test_storage_Select_overlappingPartitions(t *testing.T) {
+	older := newMemoryPartition(nil, 1*time.Hour, Seconds)
+	_, err := older.insertRows([]Row{
+		{DataPoint: DataPoint{Timestamp: 1, Value: 0.1}, Metric: "metric1"},
+		{DataPoint: DataPoint{Timestamp: 3, Value: 0.1}, Metric: "metric1"},
+	})
+	require.NoError(t, err)
+	newer := newMemoryPartition(nil, 1*time.Hour, Seconds)
+	_, err = newer.insertRows([]Row{
+		{DataPoint: DataPoint{Timestamp: 2, Value: 0.2}, Metric: "metric1"},
+		{DataPoint: DataPoint{Timestamp: 3, Value: 0.2}, Metric: "metric1"},
+	})
+	require.NoError(t, err)
+	list := newPartitionList()
+	list.insert(older)
+	list.insert(newer)
+	s := &storage{partitionList: list}
+
+	want := []DataPoint{
+		{Timestamp: 1, Value: 0.1},
+		{Timestamp: 2, Value: 0.2},
+		{Timestamp: 3, Value: 0.1},
+		{Timestamp: 3, Value: 0.2},
+	}
+	for i := 0; i < 3; i++ {
+		got, err := s.Select("metric1", nil, 1, 4)
+		require.NoError(t, err)
+		values := make([]DataPoint, 0, len(got))
+		for _, p := range got {
+			values = append(values, *p)
+		}
+		assert.Equal(t, want, values)
+
+		gotValues, err := s.SelectInto(nil, "metric1", nil, 1, 4)
+		require.NoError(t, err)
+		assert.Equal(t, want, gotValues)
+	}
+}
+
+func Test_storage_negativeTimestamps(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: -1000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: -10, Value: 0.2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 0, Value: 0.3}},
+	}
+	want := []*DataPoint{
+		{Timestamp: -1000, Value: 0.1},
+		{Timestamp: -10, Value: 0.2},
+		{Timestamp: 0, Value: 0.3},
+	}
+
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithZeroTimestampAllowed(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows(rows))
+	got, err := s.Select("metric1", nil, -1000, 1)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	require.NoError(t, s.Close())
+
+	// Read them off the disk partition.
+	s, err = NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithZeroTimestampAllowed(),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err = s.Select("metric1", nil, -1000, 1)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func Test_storage_fillTimestamps(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 0, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: -10, Value: 0.2}},
+	}
+	s := &storage{timestampPrecision: Seconds}
+	got := s.fillTimestamps(rows)
+	assert.NotZero(t, got[0].Timestamp)
+	assert.Equal(t, int64(-10), got[1].Timestamp)
+	assert.Zero(t, rows[0].Timestamp, "the given rows must not be modified")
+
+	s.zeroTimestampAllowed = true
+	got = s.fillTimestamps(rows)
+	assert.Zero(t, got[0].Timestamp)
+}
+
+func Test_storage_WithBestEffortOpen(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+	}))
+	require.NoError(t, s.Close())
+
+	// Put a partition that lacks its data file.
+	broken := filepath.Join(tmpDir, "p-broken")
+	require.NoError(t, os.Mkdir(broken, fs.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(broken, metaFileName), []byte("{}"), fs.ModePerm))
+
+	_, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	assert.Error(t, err)
+
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithBestEffortOpen())
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", nil, 1600000000, 1600000001)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+	_, err = os.Stat(broken)
+	assert.NoError(t, err, "the skipped partition must be left")
+}
+
+func Test_storage_WithLazyOpen(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000002, Value: 0.2}},
+	}))
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithLazyOpen())
+	require.NoError(t, err)
+	defer s.Close()
+	var disk *diskPartition
+	for _, p := range s.(*storage).partitionList.appendPartitions(nil) {
+		if d, ok := p.(*diskPartition); ok {
+			disk = d
+		}
+	}
+	require.NotNil(t, disk)
+	assert.True(t, unopened(disk))
+
+	_, err = s.Select("metric1", nil, 1600000003, 1600000004)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	assert.True(t, unopened(disk), "partitions out of the range must not be opened")
+
+	// A late write into it.
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.3}},
+	}))
+	got, err := s.Select("metric1", nil, 1600000000, 1600000003)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1600000000, Value: 0.1},
+		{Timestamp: 1600000001, Value: 0.3},
+		{Timestamp: 1600000002, Value: 0.2},
+	}, got)
+	assert.False(t, unopened(disk))
+}
+
+func Test_storage_WithLazyOpen_unreadable(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000002, Value: 0.2}},
+	}))
+	require.NoError(t, s.Close())
+
+	metas, err := filepath.Glob(filepath.Join(tmpDir, "p-*", metaFileName))
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	require.NoError(t, os.WriteFile(metas[0], []byte("{"), fs.ModePerm))
+
+	l := &recordingLogger{}
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithLazyOpen(), WithLogger(Leveled(l)))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600003600, Value: 0.4}},
+	}))
+
+	// Late writes skip the partition failing to get loaded rather than failing on it.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.3}},
+		}))
+	}
+	// Retention leaves it for someone to take care of.
+	require.NoError(t, s.(*storage).removeExpiredPartitions())
+	_, err = os.Stat(filepath.Dir(metas[0]))
+	assert.NoError(t, err)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var logged int
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, "error: skipped the disk partition failing to get loaded") {
+			logged++
+		}
+	}
+	assert.Equal(t, 1, logged, "lines: %v", l.lines)
+}
+
+func Test_storage_WithOpenConcurrency(t *testing.T) {
+	tmpDir := t.TempDir()
+	want := make([]*DataPoint, 0, 5)
+	for i := int64(0); i < 5; i++ {
+		m := newMemoryPartition(nil, time.Hour, Seconds)
+		_, err := m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + i*3600, Value: float64(i)}}})
+		require.NoError(t, err)
+		dir := filepath.Join(tmpDir, fmt.Sprintf("p-%d-%d", m.minTimestamp(), m.maxTimestamp()))
+		s := &storage{compressor: &nopCompressor{}}
+		require.NoError(t, s.writePartition(dir, m.(*memoryPartition), time.Now()))
+		want = append(want, &DataPoint{Timestamp: 1600000000 + i*3600, Value: float64(i)})
+	}
+
+	_, err := NewStorage(WithDataPath(tmpDir), WithOpenConcurrency(0))
+	assert.Error(t, err)
+
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithOpenConcurrency(2))
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, 5+1, s.(*storage).partitionList.size())
+	got, err := s.Select("metric1", nil, 1600000000, 1600020000)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func Test_storage_WithWALSegmentSize(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds), WithPartitionMaxPoints(2), WithWALSegmentSize(1))
+	require.NoError(t, err)
+	want := make([]*DataPoint, 0, 8)
+	for i := int64(0); i < 8; i++ {
+		p := DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: p}}))
+		want = append(want, &p)
+	}
+	require.NoError(t, s.Flush())
+
+	// Only segments of the head partition are left, which are one for each row and the active one.
+	entries, err := os.ReadDir(filepath.Join(dir, walDirName))
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	// Crash without closing.
+	s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	got, err := s.Select("metric1", nil, 1600000000, 1600000010)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	require.NoError(t, s.Close())
+
+	_, err = NewStorage(WithDataPath(t.TempDir()), WithWALSegmentSize(-1))
+	assert.Error(t, err)
+}
+
+func Test_storage_WithDataPaths(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	s, err := NewStorage(WithDataPaths(dirs...), WithTimestampPrecision(Seconds), WithPartitionMaxPoints(1))
+	require.NoError(t, err)
+	want := make([]*DataPoint, 0, 4)
+	for i := int64(0); i < 4; i++ {
+		p := DataPoint{Timestamp: 1600000000 + i*7200, Value: float64(i)}
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: p}}))
+		want = append(want, &p)
+	}
+	require.NoError(t, s.Close())
+
+	// Partitions are distributed across the directories, while the WAL resides in the first one.
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var partitions int
+		for _, e := range entries {
+			if partitionDirRegex.MatchString(e.Name()) {
+				partitions++
+			}
+		}
+		assert.Equal(t, 2, partitions, dir)
+	}
+	_, err = os.Stat(filepath.Join(dirs[1], walDirName))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	s, err = NewStorage(WithDataPaths(dirs...), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	got, err := s.Select("metric1", nil, 1600000000, 1600030000)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	require.NoError(t, s.Close())
+
+	_, err = NewStorage(WithDataPaths(dirs[0], ""))
+	assert.Error(t, err)
+}
+
+func Test_storage_recoverWAL_crashTwice(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}))
+
+	segmentNames := func() []string {
+		entries, err := os.ReadDir(filepath.Join(dir, walDirName))
+		require.NoError(t, err)
+		names := make([]string, 0, len(entries))
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	// Crash without closing twice in a row; the replayed rows must survive the second crash.
+	for i := 0; i < 2; i++ {
+		replayed := segmentNames()
+		s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+		require.NoError(t, err)
+		got, err := s.Select("metric1", nil, 1600000000, 1600000001)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+
+		// The replayed segments are gone.
+		current := segmentNames()
+		for _, name := range replayed {
+			assert.NotContains(t, current, name)
+		}
+	}
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_recoverWAL_persistedRows(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithDataPath(dir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour), WithWALBufferedSize(0)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	for _, ts := range []int64{1600000000, 1600007200, 1600010800} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	// It goes into the older memory partition but gets logged to the segment of the head,
+	// which outlives flushing the former.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001}}}))
+	s.(*storage).flushWG.Wait()
+	require.NoError(t, s.Flush())
+	require.DirExists(t, filepath.Join(dir, "p-1600000000-1600007200"))
+
+	want := []*DataPoint{{Timestamp: 1600000000}, {Timestamp: 1600000001}, {Timestamp: 1600007200}, {Timestamp: 1600010800}}
+	// Crash without closing twice in a row; each data point must be there once.
+	for i := 0; i < 2; i++ {
+		s, err = NewStorage(opts...)
+		require.NoError(t, err)
+		got, err := s.Select("metric1", nil, 1600000000, 1600010801)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_InsertRows_outdated(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}))
+	// The head accepts the row making it inactive, and then rolls over.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600003600, Value: 0.2}}}))
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600007200, Value: 0.4}}}))
+	require.Equal(t, 2, s.(*storage).partitionList.size())
+
+	// Older than the head, which goes into the other writable partition.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000010, Value: 0.3}}}))
+	assert.Equal(t, 1, s.(*storage).partitionList.getHead().size())
+	got, err := s.Select("metric1", nil, 1600000000, 1600007201)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1600000000, Value: 0.1},
+		{Timestamp: 1600000010, Value: 0.3},
+		{Timestamp: 1600003600, Value: 0.2},
+		{Timestamp: 1600007200, Value: 0.4},
+	}, got)
+}
+
+func Test_storage_inMemoryEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		// makes the partitions other than the head old.
+		aged bool
+		want []*DataPoint
+	}{
+		{
+			name: "kept without limits",
+			want: []*DataPoint{{Timestamp: 1}, {Timestamp: 2}, {Timestamp: 3}, {Timestamp: 4}},
+		},
+		{
+			name: "beyond the max partitions",
+			opts: []Option{WithMaxInMemoryPartitions(3)},
+			want: []*DataPoint{{Timestamp: 2}, {Timestamp: 3}, {Timestamp: 4}},
+		},
+		{
+			name: "older than the retention except writable ones",
+			opts: []Option{WithRetention(time.Hour)},
+			aged: true,
+			want: []*DataPoint{{Timestamp: 3}, {Timestamp: 4}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(append([]Option{WithTimestampPrecision(Seconds), WithPartitionMaxPoints(1)}, tt.opts...)...)
+			require.NoError(t, err)
+			defer s.Close()
+			for ts := int64(1); ts <= 4; ts++ {
+				require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+			}
+			s.(*storage).flushWG.Wait()
+			if tt.aged {
+				iterator := s.(*storage).partitionList.newIterator()
+				for iterator.next() {
+					iterator.value().(*memoryPartition).createdAt = time.Now().Add(-2 * time.Hour)
+				}
+			}
+			require.NoError(t, s.(*storage).flushPartitions())
+
+			got, err := s.Select("metric1", nil, 0, 5)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := NewStorage(WithMaxInMemoryPartitions(1))
+	assert.Error(t, err)
+}
+
+func Test_storage_Close(t *testing.T) {
+	s, err := NewStorage(WithDataPath(t.TempDir()))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000}}}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Close())
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, s.Close())
+
+	err = s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001}}})
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = s.Select("metric1", nil, 1600000000, 1600000002)
+	assert.ErrorIs(t, err, ErrClosed)
+	dst := []DataPoint{{Timestamp: 1600000000}}
+	got, err := s.SelectInto(dst, "metric1", nil, 1600000000, 1600000002)
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.Equal(t, dst, got)
+	assert.ErrorIs(t, s.Merge(t.TempDir()), ErrClosed)
+	assert.ErrorIs(t, s.BulkLoad(strings.NewReader("")), ErrClosed)
+}
+
+func Test_storage_Close_concurrentInserts(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+
+	// Every insert either completes before Close gets done, or gets rejected.
+	var (
+		wg       sync.WaitGroup
+		inserted atomic.Int64
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				err := s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: int64(1600000000 + i*100 + j)}}})
+				if errors.Is(err, ErrClosed) {
+					return
+				}
+				if assert.NoError(t, err) {
+					inserted.Add(1)
+				}
+			}
+		}(i)
+	}
+	require.NoError(t, s.Close())
+	wg.Wait()
+
+	s, err = NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", nil, 1600000000, 1600001000)
+	if inserted.Load() == 0 {
+		assert.ErrorIs(t, err, ErrNoDataPoints)
+		return
+	}
+	require.NoError(t, err)
+	assert.Len(t, got, int(inserted.Load()))
+}
+
+func Test_storage_errors(t *testing.T) {
+	s, err := NewStorage(WithWriteConcurrency(1, 1), WithWriteTimeout(time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{
+			name: "select without metric",
+			call: func() error {
+				_, err := s.Select("", nil, 1, 2)
+				return err
+			},
+			want: ErrInvalidMetricName,
+		},
+		{
+			name: "select with reversed range",
+			call: func() error {
+				_, err := s.Select("metric1", nil, 2, 1)
+				return err
+			},
+			want: ErrInvalidTimestampRange,
+		},
+		{
+			name: "select into with reversed range",
+			call: func() error {
+				dst := []DataPoint{{Timestamp: 1}}
+				got, err := s.SelectInto(dst, "metric1", nil, 2, 1)
+				assert.Equal(t, dst, got)
+				return err
+			},
+			want: ErrInvalidTimestampRange,
+		},
+		{
+			name: "delete with empty range",
+			call: func() error { return s.Delete("metric1", nil, 1, 1) },
+			want: ErrInvalidTimestampRange,
+		},
+		{
+			name: "too long metric",
+			call: func() error {
+				errs := s.ValidateRows([]Row{{Metric: strings.Repeat("a", math.MaxUint16+1), DataPoint: DataPoint{Timestamp: 1}}})
+				require.Len(t, errs, 1)
+				return errs[0]
+			},
+			want: ErrInvalidMetricName,
+		},
+		{
+			name: "insert with busy workers",
+			call: func() error {
+				workers := s.(*storage).workers
+				require.True(t, workers.acquire(context.Background(), time.Second))
+				defer workers.release(0)
+				return s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}})
+			},
+			want: ErrOverloaded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, tt.call(), tt.want)
+		})
+	}
+	assert.ErrorIs(t, ErrEmptyMetric, ErrInvalidMetricName)
+}
+
+func Test_storage_InsertRowsCtx(t *testing.T) {
+	s, err := NewStorage(WithWriteConcurrency(1, 1), WithWriteTimeout(time.Minute))
+	require.NoError(t, err)
+	defer s.Close()
+	rows := []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, s.InsertRowsCtx(canceled, rows), context.Canceled)
+
+	// Busy workers keep it waiting until the deadline rather than the write timeout.
+	workers := s.(*storage).workers
+	require.True(t, workers.acquire(context.Background(), time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.InsertRowsCtx(ctx, rows), context.DeadlineExceeded)
+	workers.release(0)
+
+	require.NoError(t, s.InsertRowsCtx(context.Background(), rows))
+	_, err = s.Select("metric1", nil, 1, 2)
+	assert.NoError(t, err)
+}
+
+func Test_storage_SelectCtx(t *testing.T) {
+	s, err := NewStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}}))
+
+	got, err := s.SelectCtx(context.Background(), "metric1", nil, 1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1}}, got)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.SelectCtx(canceled, "metric1", nil, 1, 2)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = s.SelectCtx(expired, "metric1", nil, 1, 2)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, ErrQueryTimeout)
+}
+
+func Test_storage_Flush(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	for _, ts := range []int64{1600000000, 1600003600, 1600007200} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	s.(*storage).flushWG.Wait()
+
+	kinds := func() []string {
+		var got []string
+		iterator := s.(*storage).partitionList.newIterator()
+		for iterator.next() {
+			got = append(got, fmt.Sprintf("%T", iterator.value()))
+		}
+		return got
+	}
+	// The inactive one is still writable, so that it's kept in memory.
+	require.Equal(t, []string{"*tstorage.memoryPartition", "*tstorage.memoryPartition"}, kinds())
+
+	require.NoError(t, s.Flush())
+	assert.Equal(t, []string{"*tstorage.memoryPartition", "*tstorage.diskPartition"}, kinds())
+	assert.DirExists(t, filepath.Join(dir, "p-1600000000-1600003600"))
+
+	// Still writable as a disk partition.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000010}}}))
+	got, err := s.Select("metric1", nil, 1600000000, 1600007201)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000}, {Timestamp: 1600000010}, {Timestamp: 1600003600}, {Timestamp: 1600007200}}, got)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, s.FlushCtx(canceled), context.Canceled)
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Flush(), ErrClosed)
+}
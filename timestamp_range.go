@@ -0,0 +1,73 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTimestampOutOfRange is returned when a row's timestamp is outside of the range given by WithValidTimeRange.
+// The concrete error is a *TimestampRangeError, which tells the details.
+var ErrTimestampOutOfRange = errors.New("timestamp out of range")
+
+// TimestampRangeError describes a timestamp that doesn't fit in the valid range for the configured precision.
+type TimestampRangeError struct {
+	Timestamp int64
+	Precision TimestampPrecision
+	// The valid range in the unit of Precision, inclusive.
+	Min, Max int64
+	// SuggestedPrecision is the precision the timestamp looks like it's in.
+	// Empty if no precision makes it fit in the range.
+	SuggestedPrecision TimestampPrecision
+}
+
+func (e *TimestampRangeError) Error() string {
+	msg := fmt.Sprintf("timestamp %d is out of the valid range [%d, %d] for precision %q", e.Timestamp, e.Min, e.Max, e.Precision)
+	if e.SuggestedPrecision != "" {
+		msg += fmt.Sprintf("; it looks like it is in %q", e.SuggestedPrecision)
+	}
+	return msg
+}
+
+// Is makes errors.Is(err, ErrTimestampOutOfRange) report true.
+func (e *TimestampRangeError) Is(target error) bool {
+	return target == ErrTimestampOutOfRange
+}
+
+// timestampRange is the range of timestamps that are plausible in the given precision.
+type timestampRange struct {
+	min, max  time.Time
+	precision TimestampPrecision
+}
+
+// validate ensures all timestamps of the given rows are in the range.
+func (r *timestampRange) validate(rows []Row) error {
+	min, max := toUnix(r.min, r.precision), toUnix(r.max, r.precision)
+	for i := range rows {
+		t := rows[i].Timestamp
+		if t >= min && t <= max {
+			continue
+		}
+		return &TimestampRangeError{
+			Timestamp:          t,
+			Precision:          r.precision,
+			Min:                min,
+			Max:                max,
+			SuggestedPrecision: r.guessPrecision(t),
+		}
+	}
+	return nil
+}
+
+// guessPrecision gives back the precision under which the given timestamp fits in the range.
+func (r *timestampRange) guessPrecision(t int64) TimestampPrecision {
+	for _, p := range []TimestampPrecision{Seconds, Milliseconds, Microseconds, Nanoseconds} {
+		if p == r.precision {
+			continue
+		}
+		if t >= toUnix(r.min, p) && t <= toUnix(r.max, p) {
+			return p
+		}
+	}
+	return ""
+}
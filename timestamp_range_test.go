@@ -0,0 +1,82 @@
+package tstorage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_timestampRange_validate(t *testing.T) {
+	min := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	max := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		precision      TimestampPrecision
+		timestamp      int64
+		wantErr        bool
+		wantSuggestion TimestampPrecision
+	}{
+		{
+			name:      "seconds in range",
+			precision: Seconds,
+			timestamp: 1600000000,
+		},
+		{
+			name:           "milliseconds given to seconds precision",
+			precision:      Seconds,
+			timestamp:      1600000000000,
+			wantErr:        true,
+			wantSuggestion: Milliseconds,
+		},
+		{
+			name:           "seconds given to nanoseconds precision",
+			precision:      Nanoseconds,
+			timestamp:      1600000000,
+			wantErr:        true,
+			wantSuggestion: Seconds,
+		},
+		{
+			name:      "out of range in any precision",
+			precision: Milliseconds,
+			timestamp: -1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &timestampRange{min: min, max: max, precision: tt.precision}
+			err := r.validate([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: tt.timestamp}}})
+			assert.Equal(t, tt.wantErr, err != nil)
+			if !tt.wantErr {
+				return
+			}
+			assert.True(t, errors.Is(err, ErrTimestampOutOfRange))
+			var rangeErr *TimestampRangeError
+			require.True(t, errors.As(err, &rangeErr))
+			assert.Equal(t, tt.wantSuggestion, rangeErr.SuggestedPrecision)
+		})
+	}
+}
+
+func Test_storage_InsertRows_validTimeRange(t *testing.T) {
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithValidTimeRange(time.Unix(0, 0), time.Unix(2000000000, 0)),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001000, Value: 0.2}},
+	})
+	assert.ErrorIs(t, err, ErrTimestampOutOfRange)
+	_, err = s.Select("metric1", nil, 1600000000, 1600000001)
+	assert.ErrorIs(t, err, ErrNoDataPoints, "no rows should be inserted if any is invalid")
+
+	_, err = NewStorage(WithValidTimeRange(time.Unix(1, 0), time.Unix(0, 0)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,373 @@
+package tstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const tombstonesFileName = "tombstones.json"
+
+// ErrNothingToUndelete is returned by Undelete when there is no deletion made within the grace period.
+var ErrNothingToUndelete = errors.New("nothing to undelete")
+
+// tombstone marks data points of a metric within the range as deleted.
+type tombstone struct {
+	// start is inclusive, end is exclusive.
+	start, end int64
+	deletedAt  time.Time
+}
+
+// overlaps reports whether the tombstone covers any timestamp within the given closed range.
+func (t *tombstone) overlaps(minT, maxT int64) bool {
+	return t.start <= maxT && minT < t.end
+}
+
+// tombstoneRecord is a mapper for an entry of the tombstones file.
+// It holds the metric and labels as they are since the marshaled metric name is binary.
+type tombstoneRecord struct {
+	Metric    string    `json:"metric"`
+	Labels    []Label   `json:"labels,omitempty"`
+	Start     int64     `json:"start"`
+	End       int64     `json:"end"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// tombstoneSet holds tombstones of metrics, keyed by the marshaled metric name.
+// Slices of tombstones are never modified once they are put in, so that they can be read without locking.
+// The zero value is ready to use, which doesn't persist tombstones.
+type tombstoneSet struct {
+	mu         sync.RWMutex
+	tombstones map[string][]tombstone
+	// path to the file persisting tombstones; empty means they are held only in heap.
+	path string
+}
+
+// load reads the tombstones persisted in the given directory, and then lets them persisted there from now on.
+func (ts *tombstoneSet) load(dirPath string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.path = filepath.Join(dirPath, tombstonesFileName)
+	b, err := os.ReadFile(ts.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tombstones: %w", err)
+	}
+	var records []tombstoneRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("%w: failed to decode tombstones: %w", ErrCorrupted, err)
+	}
+	ts.tombstones = make(map[string][]tombstone, len(records))
+	for _, r := range records {
+		name := marshalMetricName(r.Metric, r.Labels)
+		ts.tombstones[name] = append(ts.tombstones[name], tombstone{start: r.Start, end: r.End, deletedAt: r.DeletedAt})
+	}
+	return nil
+}
+
+// get gives back tombstones of the given metric. The returned slice must not be modified.
+func (ts *tombstoneSet) get(name string) []tombstone {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.tombstones[name]
+}
+
+func (ts *tombstoneSet) isEmpty() bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return len(ts.tombstones) == 0
+}
+
+// add puts the given tombstone, and then persists all of them.
+func (ts *tombstoneSet) add(name string, t tombstone) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	old := ts.tombstones[name]
+	added := make([]tombstone, len(old), len(old)+1)
+	copy(added, old)
+	if ts.tombstones == nil {
+		ts.tombstones = make(map[string][]tombstone)
+	}
+	ts.tombstones[name] = append(added, t)
+	if err := ts.persist(); err != nil {
+		ts.set(name, old)
+		return err
+	}
+	return nil
+}
+
+// remove removes tombstones for which the given function reports true, and then persists the rest.
+// It gives back the number of tombstones removed.
+func (ts *tombstoneSet) remove(fn func(name string, t *tombstone) bool) (int, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var removed int
+	old := make(map[string][]tombstone)
+	for name, tombstones := range ts.tombstones {
+		kept := make([]tombstone, 0, len(tombstones))
+		for i := range tombstones {
+			if !fn(name, &tombstones[i]) {
+				kept = append(kept, tombstones[i])
+			}
+		}
+		if len(kept) < len(tombstones) {
+			removed += len(tombstones) - len(kept)
+			old[name] = tombstones
+			ts.set(name, kept)
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := ts.persist(); err != nil {
+		for name, tombstones := range old {
+			ts.set(name, tombstones)
+		}
+		return 0, err
+	}
+	return removed, nil
+}
+
+// set replaces tombstones of the given metric. It must be called with mu held.
+func (ts *tombstoneSet) set(name string, tombstones []tombstone) {
+	if len(tombstones) == 0 {
+		delete(ts.tombstones, name)
+		return
+	}
+	ts.tombstones[name] = tombstones
+}
+
+// persist writes all tombstones to a temporary file first, syncs it and then renames it, so that
+// a partially written file never exists and the tombstones survive crashes once it returns.
+// It must be called with mu held.
+func (ts *tombstoneSet) persist() error {
+	if ts.path == "" {
+		return nil
+	}
+	records := make([]tombstoneRecord, 0, len(ts.tombstones))
+	for name, tombstones := range ts.tombstones {
+		metric, labels := unmarshalMetricName(name)
+		for _, t := range tombstones {
+			records = append(records, tombstoneRecord{
+				Metric:    metric,
+				Labels:    labels,
+				Start:     t.start,
+				End:       t.end,
+				DeletedAt: t.deletedAt,
+			})
+		}
+	}
+	b, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("failed to encode tombstones: %w", err)
+	}
+	tmpPath := ts.path + ".tmp"
+	if err := writeFileSync(tmpPath, b); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, ts.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, ts.path, err)
+	}
+	if err := syncDir(filepath.Dir(ts.path)); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", filepath.Dir(ts.path), err)
+	}
+	return nil
+}
+
+// deleted reports whether any of the given tombstones covers the given timestamp.
+func deleted(tombstones []tombstone, timestamp int64) bool {
+	for i := range tombstones {
+		if tombstones[i].start <= timestamp && timestamp < tombstones[i].end {
+			return true
+		}
+	}
+	return false
+}
+
+// dropDeletedDataPointRefs removes data points any of the given tombstones covers in place,
+// along with the flags telling whether each of them comes from disk, if any.
+func dropDeletedDataPointRefs(points []*DataPoint, fromDisk []bool, tombstones []tombstone) ([]*DataPoint, []bool) {
+	n := 0
+	for i, p := range points {
+		if deleted(tombstones, p.Timestamp) {
+			continue
+		}
+		points[n] = p
+		if fromDisk != nil {
+			fromDisk[n] = fromDisk[i]
+		}
+		n++
+	}
+	if fromDisk != nil {
+		fromDisk = fromDisk[:n]
+	}
+	return points[:n], fromDisk
+}
+
+// dropDeletedDataPoints is like dropDeletedDataPointRefs but for data points held by value.
+func dropDeletedDataPoints(points []DataPoint, fromDisk []bool, tombstones []tombstone) ([]DataPoint, []bool) {
+	n := 0
+	for i := range points {
+		if deleted(tombstones, points[i].Timestamp) {
+			continue
+		}
+		points[n] = points[i]
+		if fromDisk != nil {
+			fromDisk[n] = fromDisk[i]
+		}
+		n++
+	}
+	if fromDisk != nil {
+		fromDisk = fromDisk[:n]
+	}
+	return points[:n], fromDisk
+}
+
+// dropDeletedChunks re-encodes chunks any of the given tombstones overlaps without the data points
+// it covers. Other chunks are given back as they are.
+func dropDeletedChunks(chunks []Chunk, tombstones []tombstone, chunkSize int) ([]Chunk, error) {
+	kept := make([]Chunk, 0, len(chunks))
+	for _, c := range chunks {
+		overlapped := false
+		for i := range tombstones {
+			if tombstones[i].overlaps(c.MinTimestamp, c.MaxTimestamp) {
+				overlapped = true
+				break
+			}
+		}
+		if !overlapped {
+			kept = append(kept, c)
+			continue
+		}
+		points, err := c.DataPoints()
+		if err != nil {
+			return nil, err
+		}
+		points, _ = dropDeletedDataPoints(points, nil, tombstones)
+		kept, err = appendEncodedChunks(kept, points, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return kept, nil
+}
+
+func (s *storage) Delete(metric string, labels []Label, start, end int64) error {
+	if metric == "" {
+		return ErrEmptyMetric
+	}
+	if start >= end {
+		return errInvalidRange(start, end)
+	}
+	if err := s.beginWrite(); err != nil {
+		return err
+	}
+	defer s.wg.Done()
+	name := marshalMetricName(metric, labels)
+	t := tombstone{start: start, end: end, deletedAt: time.Now()}
+	err := s.tombstones.add(name, t)
+	s.queryCache.invalidate()
+	if err != nil {
+		return fmt.Errorf("failed to delete data points: %w", err)
+	}
+	if s.deleteGracePeriod > 0 {
+		// Data points must be kept to be undeleted, so no deletion is written to the WAL for them to be
+		// replayed as they are. The tombstones file, already synced, hides them after crashes instead.
+		return nil
+	}
+	// Let the deletion be replayed along with inserts, so that deleted data points never get back to memory.
+	if err := s.wal.appendDelete(name, start, end); err != nil {
+		return fmt.Errorf("failed to write deletion to WAL: %w", err)
+	}
+	if err := s.deleteMemoryPoints(name, start, end); err != nil {
+		return fmt.Errorf("failed to delete data points: %w", err)
+	}
+	return nil
+}
+
+// deleteMemoryPoints removes data points of the given metric within the range from memory partitions.
+// The tombstone is still needed to hide the ones recovered from the WAL and written afterwards.
+func (s *storage) deleteMemoryPoints(name string, start, end int64) error {
+	// Prevent memory partitions from getting flushed while data points are removed.
+	s.lateMu.Lock()
+	defer s.lateMu.Unlock()
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		memPart, ok := iterator.value().(*memoryPartition)
+		if !ok || memPart.size() == 0 || start > memPart.maxTimestamp() {
+			continue
+		}
+		if _, err := memPart.deletePoints(name, start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *storage) Undelete(metric string, labels []Label) error {
+	if metric == "" {
+		return ErrEmptyMetric
+	}
+	if err := s.beginWrite(); err != nil {
+		return err
+	}
+	defer s.wg.Done()
+	target := marshalMetricName(metric, labels)
+	since := time.Now().Add(-s.deleteGracePeriod)
+	n, err := s.tombstones.remove(func(name string, t *tombstone) bool {
+		return name == target && !t.deletedAt.Before(since)
+	})
+	s.queryCache.invalidate()
+	if err != nil {
+		return fmt.Errorf("failed to undelete data points: %w", err)
+	}
+	if n == 0 {
+		return ErrNothingToUndelete
+	}
+	return nil
+}
+
+// appliedTombstones gives back tombstones of the given metric made before the given time,
+// which compaction applies by removing data points they cover.
+func (s *storage) appliedTombstones(name string, before time.Time) []tombstone {
+	var applied []tombstone
+	for _, t := range s.tombstones.get(name) {
+		if t.deletedAt.Before(before) {
+			applied = append(applied, t)
+		}
+	}
+	return applied
+}
+
+// purgeTombstones removes tombstones made before the given time once data points they cover are
+// removed from disk partitions, unless they overlap any of the other partitions.
+// It must be called after the compaction applied them.
+func (s *storage) purgeTombstones(before time.Time) error {
+	others := make([]partition, 0)
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		if _, ok := iterator.value().(*diskPartition); !ok {
+			others = append(others, iterator.value())
+		}
+	}
+	_, err := s.tombstones.remove(func(_ string, t *tombstone) bool {
+		if !t.deletedAt.Before(before) {
+			return false
+		}
+		for _, p := range others {
+			if p.size() > 0 && t.overlaps(p.minTimestamp(), p.maxTimestamp()) {
+				return false
+			}
+		}
+		return true
+	})
+	return err
+}
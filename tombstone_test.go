@@ -0,0 +1,188 @@
+package tstorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Delete_Undelete(t *testing.T) {
+	dataPath := t.TempDir()
+	labels := []Label{{Name: "host", Value: "a"}}
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithDeleteGracePeriod(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+		{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: 1600000002, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.4}},
+	}))
+
+	require.NoError(t, s.Delete("metric1", labels, 1600000001, 1600000002))
+	got, err := s.Select("metric1", labels, 1600000000, 1600000003)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}, {Timestamp: 1600000002, Value: 0.3}}, got)
+	into, err := s.SelectInto(nil, "metric1", labels, 1600000000, 1600000003)
+	require.NoError(t, err)
+	assert.Equal(t, []DataPoint{{Timestamp: 1600000000, Value: 0.1}, {Timestamp: 1600000002, Value: 0.3}}, into)
+	it, err := s.SelectChunks("metric1", labels, 1600000000, 1600000003)
+	require.NoError(t, err)
+	var fromChunks []DataPoint
+	for it.Next() {
+		c := it.At()
+		points, err := c.DataPoints()
+		require.NoError(t, err)
+		fromChunks = append(fromChunks, points...)
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, into, fromChunks)
+	// Other series are left as they are.
+	got, err = s.Select("metric1", nil, 1600000000, 1600000003)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000001, Value: 0.4}}, got)
+
+	require.NoError(t, s.Delete("metric1", nil, 1600000000, 1600000003))
+	_, err = s.Select("metric1", nil, 1600000000, 1600000003)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	info, err := os.Stat(filepath.Join(dataPath, tombstonesFileName))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	assert.NoFileExists(t, filepath.Join(dataPath, tombstonesFileName+".tmp"))
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Delete("metric1", labels, 1600000000, 1600000001), ErrClosed)
+	assert.ErrorIs(t, s.Undelete("metric1", labels), ErrClosed)
+
+	// Deletions survive restarts, and then get reverted.
+	s, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithDeleteGracePeriod(time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	got, err = s.Select("metric1", labels, 1600000000, 1600000003)
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+	require.NoError(t, s.Undelete("metric1", labels))
+	got, err = s.Select("metric1", labels, 1600000000, 1600000003)
+	require.NoError(t, err)
+	assert.Len(t, got, 3)
+	assert.ErrorIs(t, s.Undelete("metric1", labels), ErrNothingToUndelete)
+	_, err = s.Select("metric1", nil, 1600000000, 1600000003)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
+
+func Test_storage_Delete_memoryPartitions(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+	}))
+
+	// Without the grace period, data points get removed from heap right away.
+	require.NoError(t, s.Delete("metric1", nil, 1600000001, 1600000002))
+	assert.Equal(t, 1, s.(*storage).partitionList.getHead().size())
+	assert.ErrorIs(t, s.Undelete("metric1", nil), ErrNothingToUndelete)
+
+	// Data points written afterwards are still hidden.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.3}}}))
+	got, err := s.Select("metric1", nil, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+}
+
+func Test_storage_Delete_replayWAL(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+	}))
+	require.NoError(t, s.Delete("metric1", nil, 1600000001, 1600000002))
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.3}}}))
+
+	// Crash without closing; the deleted data point never gets back to heap, unlike ones written afterwards.
+	s, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	var size int
+	iterator := s.(*storage).partitionList.newIterator()
+	for iterator.next() {
+		size += iterator.value().size()
+	}
+	assert.Equal(t, 2, size)
+	got, err := s.Select("metric1", nil, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+}
+
+func Test_storage_Delete_gracePeriod_crash(t *testing.T) {
+	dataPath := t.TempDir()
+	opts := []Option{WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithWALBufferedSize(0), WithDeleteGracePeriod(time.Hour)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+	}))
+	require.NoError(t, s.Delete("metric1", nil, 1600000001, 1600000002))
+
+	// Crash without closing; the deleted data point is replayed but still hidden, so that it can be undeleted.
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", nil, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+	require.NoError(t, s.Undelete("metric1", nil))
+	got, err = s.Select("metric1", nil, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}, {Timestamp: 1600000001, Value: 0.2}}, got)
+}
+
+func Test_storage_compactPartitions_tombstones(t *testing.T) {
+	dataPath := t.TempDir()
+	s := &storage{
+		partitionList:      newPartitionList(),
+		dataPath:           dataPath,
+		retention:          defaultRetention,
+		timestampPrecision: Seconds,
+		compressor:         &nopCompressor{},
+		logger:             &nopLogger{},
+	}
+	require.NoError(t, s.tombstones.load(dataPath))
+	m := newMemoryPartition(nil, 0, Seconds).(*memoryPartition)
+	_, err := m.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.3}},
+	})
+	require.NoError(t, err)
+	dir := dataPath + "/p-1"
+	require.NoError(t, s.flush(dir, m))
+	d, err := openDiskPartition(dir, s.retention)
+	require.NoError(t, err)
+	s.partitionList.insert(d)
+
+	s.deleteGracePeriod = time.Hour
+	require.NoError(t, s.Delete("metric1", nil, 1600000001, 1600000002))
+	assert.False(t, s.needsCompaction(d.(*diskPartition)), "deletions within the grace period must be kept")
+
+	s.deleteGracePeriod = 0
+	assert.True(t, s.needsCompaction(d.(*diskPartition)))
+	require.NoError(t, s.compactPartitions())
+	assert.True(t, s.tombstones.isEmpty())
+	assert.ErrorIs(t, s.Undelete("metric1", nil), ErrNothingToUndelete)
+
+	head := s.partitionList.getHead().(*diskPartition)
+	got, err := head.selectDataPoints(context.Background(), "metric1", nil, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+	got, err = head.selectDataPoints(context.Background(), "metric2", nil, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000001, Value: 0.3}}, got)
+}
@@ -0,0 +1,64 @@
+package tstorage
+
+import "context"
+
+// Tracer starts spans around inserts, flushes and selects, so that their latency can be debugged along with
+// traces of the caller. OpenTelemetry's trace.Tracer satisfies it with a thin wrapper converting keyvals into
+// attributes. Give it to WithTracer.
+type Tracer interface {
+	// Start starts a span with the given name as a child of the span in ctx if any, and gives back
+	// the context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by Tracer.
+type Span interface {
+	// SetAttributes sets attributes, where keyvals are alternating keys and values such as "rows", 10.
+	SetAttributes(keyvals ...interface{})
+	// RecordError records the error the operation failed with.
+	RecordError(err error)
+	// End ends the span.
+	End()
+}
+
+// Names of spans the storage starts.
+const (
+	spanInsertRows     = "tstorage.InsertRows"
+	spanFlushPartition = "tstorage.flushPartition"
+	spanSelect         = "tstorage.Select"
+)
+
+type spanKey struct{}
+
+// startSpan starts a span with the given tracer, and gives back the context carrying it so that
+// functions deeper in the call can add attributes to it with spanFrom. A nil tracer starts a span
+// doing nothing. Callers on hot paths check the tracer beforehand instead, so as not to box attributes.
+func startSpan(ctx context.Context, tracer Tracer, name string) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, nopSpan{}
+	}
+	ctx, span := tracer.Start(ctx, name)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFrom gives back the span carried by ctx, which does nothing if none.
+func spanFrom(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return nopSpan{}
+}
+
+// endSpan records the given error if any, and then ends the given span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(_ ...interface{}) {}
+func (nopSpan) RecordError(_ error)            {}
+func (nopSpan) End()                           {}
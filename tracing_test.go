@@ -0,0 +1,112 @@
+package tstorage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedSpan struct {
+	name  string
+	attrs map[interface{}]interface{}
+	err   error
+	ended bool
+}
+
+// recordingTracer records all spans started.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	span := &recordedSpan{name: name, attrs: map[interface{}]interface{}{}}
+	r.spans = append(r.spans, span)
+	return ctx, &recordingSpan{tracer: r, span: span}
+}
+
+func (r *recordingTracer) find(name string) []recordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []recordedSpan
+	for _, s := range r.spans {
+		if s.name == name {
+			found = append(found, *s)
+		}
+	}
+	return found
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	span   *recordedSpan
+}
+
+func (r *recordingSpan) SetAttributes(keyvals ...interface{}) {
+	r.tracer.mu.Lock()
+	defer r.tracer.mu.Unlock()
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		r.span.attrs[keyvals[i]] = keyvals[i+1]
+	}
+}
+
+func (r *recordingSpan) RecordError(err error) {
+	r.tracer.mu.Lock()
+	defer r.tracer.mu.Unlock()
+	r.span.err = err
+}
+
+func (r *recordingSpan) End() {
+	r.tracer.mu.Lock()
+	defer r.tracer.mu.Unlock()
+	r.span.ended = true
+}
+
+func Test_storage_WithTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	s, err := NewStorage(
+		WithDataPath(t.TempDir()),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+		WithTracer(tracer),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	for _, ts := range []int64{1600000000, 1600003600, 1600007200} {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}},
+			{Metric: "metric2", DataPoint: DataPoint{Timestamp: ts}},
+		}))
+	}
+	s.(*storage).flushWG.Wait()
+	require.NoError(t, s.Flush())
+	_, err = s.Select("metric1", nil, 1600000000, 1600007201)
+	require.NoError(t, err)
+	_, err = s.Select("metric1", nil, 1500000000, 1500000001)
+	require.ErrorIs(t, err, ErrNoDataPoints)
+
+	inserts := tracer.find(spanInsertRows)
+	require.Len(t, inserts, 3)
+	assert.Equal(t, 2, inserts[0].attrs["rows"])
+	assert.True(t, inserts[0].ended)
+
+	flushes := tracer.find(spanFlushPartition)
+	require.Len(t, flushes, 1)
+	assert.Equal(t, int64(4), flushes[0].attrs["data_points"])
+	assert.NoError(t, flushes[0].err)
+
+	selects := tracer.find(spanSelect)
+	require.Len(t, selects, 2)
+	assert.Equal(t, "metric1", selects[0].attrs["metric"])
+	assert.Equal(t, 2, selects[0].attrs["partitions"])
+	assert.Equal(t, 3, selects[0].attrs["data_points"])
+	assert.NoError(t, selects[0].err)
+	assert.ErrorIs(t, selects[1].err, ErrNoDataPoints)
+	assert.True(t, selects[1].ended)
+}
@@ -0,0 +1,111 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	// ErrInvalidMetricName is returned when the given metric name can't be stored,
+	// such as an empty or too long one.
+	ErrInvalidMetricName = errors.New("invalid metric name")
+	// ErrEmptyMetric is returned when the metric name isn't set, including by ValidateRows for a row without it.
+	// It's an ErrInvalidMetricName.
+	ErrEmptyMetric = fmt.Errorf("%w: metric name must be set", ErrInvalidMetricName)
+	// ErrInvalidLabel is reported by ValidateRows for a row having a label that would be dropped or truncated.
+	ErrInvalidLabel = errors.New("invalid label")
+	// ErrNotWritable is reported by ValidateRows for a row too old to go into any partition,
+	// which InsertRows would silently drop.
+	ErrNotWritable = errors.New("timestamp is older than any partition")
+)
+
+// RowError describes why a row given to ValidateRows is invalid.
+type RowError struct {
+	// The position of the row in the given rows.
+	Index int
+	Err   error
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Index, e.Err)
+}
+
+func (e RowError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateRows checks whether each of the given rows is going to be stored by InsertRows as it is.
+// Nothing gets modified, including the given rows.
+// Keep in mind that the writability of rows depends on the partitions at the time of calling.
+func (s *storage) ValidateRows(rows []Row) []RowError {
+	var errs []RowError
+	writableMin, bounded := s.writableMinTimestamp()
+	for i := range rows {
+		if err := s.validateRow(&rows[i], writableMin, bounded); err != nil {
+			errs = append(errs, RowError{Index: i, Err: err})
+		}
+	}
+	return errs
+}
+
+func (s *storage) validateRow(row *Row, writableMin int64, bounded bool) error {
+	if row.Metric == "" {
+		return ErrEmptyMetric
+	}
+	if len(row.Metric) > math.MaxUint16 {
+		return fmt.Errorf("%w: metric name must be shorter than %d bytes", ErrInvalidMetricName, math.MaxUint16+1)
+	}
+	for _, label := range row.Labels {
+		switch {
+		case label.Name == "" || label.Value == "":
+			return fmt.Errorf("%w: both name and value must be set: %q=%q", ErrInvalidLabel, label.Name, label.Value)
+		case len(label.Name) > maxLabelNameLen:
+			return fmt.Errorf("%w: name must be up to %d bytes: %q", ErrInvalidLabel, maxLabelNameLen, label.Name)
+		case len(label.Value) > maxLabelValueLen:
+			return fmt.Errorf("%w: value of %q must be up to %d bytes", ErrInvalidLabel, label.Name, maxLabelValueLen)
+		}
+	}
+
+	if row.Timestamp == 0 && !s.zeroTimestampAllowed {
+		// It's going to be filled with the current time.
+		return nil
+	}
+	if s.validTimeRange != nil {
+		if err := s.validTimeRange.validate([]Row{*row}); err != nil {
+			return err
+		}
+	}
+	if bounded && row.Timestamp < writableMin {
+		return fmt.Errorf("%w: %d < %d", ErrNotWritable, row.Timestamp, writableMin)
+	}
+	return nil
+}
+
+// writableMinTimestamp gives back the min timestamp InsertRows currently accepts.
+// bounded is false if any timestamp is accepted.
+func (s *storage) writableMinTimestamp() (min int64, bounded bool) {
+	if head := s.partitionList.getHead(); head == nil || !head.active() {
+		// A new head partition is going to be created, which accepts any rows at first.
+		return 0, false
+	}
+	iterator := s.partitionList.newIterator()
+	for i := 0; i < writablePartitionsNum && iterator.next(); i++ {
+		p := iterator.value()
+		if p.size() == 0 {
+			// An empty partition takes its min timestamp from the first rows.
+			return 0, false
+		}
+		min, bounded = p.minTimestamp(), true
+	}
+	// Older rows go into older partitions as late writes.
+	for iterator.next() {
+		switch p := iterator.value().(type) {
+		case *memoryPartition, *diskPartition:
+			if p.size() > 0 && !p.expired() {
+				min = p.minTimestamp()
+			}
+		}
+	}
+	return min, bounded
+}
@@ -0,0 +1,82 @@
+package tstorage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_ValidateRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		stored  []Row
+		rows    []Row
+		wantErr []error
+	}{
+		{
+			name: "valid rows",
+			rows: []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", Labels: []Label{{Name: "host", Value: "host-1"}}, DataPoint: DataPoint{Timestamp: 2, Value: 0.1}},
+			},
+			wantErr: []error{nil, nil},
+		},
+		{
+			name: "invalid metric and labels",
+			rows: []Row{
+				{DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", Labels: []Label{{Name: "host"}}, DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", Labels: []Label{{Name: strings.Repeat("a", maxLabelNameLen+1), Value: "a"}}, DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+			},
+			wantErr: []error{ErrEmptyMetric, ErrInvalidLabel, ErrInvalidLabel},
+		},
+		{
+			name: "out of the valid time range",
+			opts: []Option{WithValidTimeRange(time.Unix(0, 0), time.Unix(100, 0))},
+			rows: []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 101, Value: 0.1}},
+				// It is going to be filled.
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 0, Value: 0.1}},
+			},
+			wantErr: []error{ErrTimestampOutOfRange, nil},
+		},
+		{
+			name: "older than the writable partitions",
+			stored: []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 0.1}},
+			},
+			rows: []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 9, Value: 0.1}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 0.1}},
+			},
+			wantErr: []error{ErrNotWritable, nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(append([]Option{WithTimestampPrecision(Seconds)}, tt.opts...)...)
+			require.NoError(t, err)
+			defer s.Close()
+			if tt.stored != nil {
+				require.NoError(t, s.InsertRows(tt.stored))
+			}
+
+			errs := s.ValidateRows(tt.rows)
+			got := make([]error, len(tt.rows))
+			for _, e := range errs {
+				got[e.Index] = e
+			}
+			for i := range tt.wantErr {
+				if tt.wantErr[i] == nil {
+					assert.NoError(t, got[i], "row %d", i)
+					continue
+				}
+				assert.ErrorIs(t, got[i], tt.wantErr[i], "row %d", i)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package tstorage
+
+import "context"
+
+// ValuePredicate reports whether a data point of the given value should be selected. See SelectWhere.
+type ValuePredicate func(value float64) bool
+
+// ValueGreaterThan gives back a predicate selecting values greater than v.
+func ValueGreaterThan(v float64) ValuePredicate {
+	return func(value float64) bool { return value > v }
+}
+
+// ValueLessThan gives back a predicate selecting values less than v.
+func ValueLessThan(v float64) ValuePredicate {
+	return func(value float64) bool { return value < v }
+}
+
+// ValueBetween gives back a predicate selecting values within min-max, both inclusive.
+func ValueBetween(min, max float64) ValuePredicate {
+	return func(value float64) bool { return value >= min && value <= max }
+}
+
+type valuePredicateKey struct{}
+
+// withValuePredicate gives back a context that carries the given predicate, which partitions
+// apply while decoding data points. Giving nil means no filter.
+func withValuePredicate(ctx context.Context, pred ValuePredicate) context.Context {
+	if pred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, valuePredicateKey{}, pred)
+}
+
+// valuePredicate gives back the predicate carried by ctx, which is nil if none.
+func valuePredicate(ctx context.Context) ValuePredicate {
+	pred, _ := ctx.Value(valuePredicateKey{}).(ValuePredicate)
+	return pred
+}
+
+// filterValues drops data points the predicate carried by ctx rejects, in place.
+func filterValues(ctx context.Context, points []DataPoint) []DataPoint {
+	pred := valuePredicate(ctx)
+	if pred == nil {
+		return points
+	}
+	kept := points[:0]
+	for _, p := range points {
+		if pred(p.Value) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// filterValueRefs is like filterValues but for references to data points, which gives back a new slice
+// since the given one may be shared with the partition.
+func filterValueRefs(ctx context.Context, points []*DataPoint) []*DataPoint {
+	pred := valuePredicate(ctx)
+	if pred == nil {
+		return points
+	}
+	kept := make([]*DataPoint, 0, len(points))
+	for _, p := range points {
+		if pred(p.Value) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
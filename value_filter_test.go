@@ -0,0 +1,84 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectWhere(t *testing.T) {
+	s, err := NewStorage(
+		WithDataPath(t.TempDir()),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	insert := func(ts int64, value float64) {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: value}}}))
+	}
+	for i, ts := range []int64{1600000000, 1600000001, 1600000002, 1600003600, 1600007200, 1600007201, 1600010800} {
+		insert(ts, float64(i*10))
+	}
+	// Goes into the late file of the flushed partition.
+	insert(1600000003, 200)
+	s.(*storage).flushWG.Wait()
+
+	tests := []struct {
+		name string
+		opts []SelectOption
+		want []DataPoint
+	}{
+		{
+			name: "greater than",
+			opts: []SelectOption{SelectWhere(ValueGreaterThan(35))},
+			want: []DataPoint{
+				{Timestamp: 1600000003, Value: 200},
+				{Timestamp: 1600007200, Value: 40},
+				{Timestamp: 1600007201, Value: 50},
+				{Timestamp: 1600010800, Value: 60},
+			},
+		},
+		{
+			name: "less than",
+			opts: []SelectOption{SelectWhere(ValueLessThan(15))},
+			want: []DataPoint{
+				{Timestamp: 1600000000, Value: 0},
+				{Timestamp: 1600000001, Value: 10},
+			},
+		},
+		{
+			name: "all of predicates",
+			opts: []SelectOption{SelectWhere(ValueBetween(10, 50)), SelectWhere(ValueLessThan(50))},
+			want: []DataPoint{
+				{Timestamp: 1600000001, Value: 10},
+				{Timestamp: 1600000002, Value: 20},
+				{Timestamp: 1600003600, Value: 30},
+				{Timestamp: 1600007200, Value: 40},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SelectInto(nil, "metric1", nil, 1600000000, 1600020000, tt.opts...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			refs, err := s.Select("metric1", nil, 1600000000, 1600020000, tt.opts...)
+			require.NoError(t, err)
+			require.Len(t, refs, len(tt.want))
+			for i := range refs {
+				assert.Equal(t, tt.want[i], *refs[i])
+			}
+		})
+	}
+
+	_, err = s.Select("metric1", nil, 1600000000, 1600020000, SelectWhere(ValueGreaterThan(1000)))
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	// Filtering never affects data points kept in partitions.
+	got, err := s.Select("metric1", nil, 1600000000, 1600020000)
+	require.NoError(t, err)
+	assert.Len(t, got, 8)
+}
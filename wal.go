@@ -15,16 +15,39 @@ const (
 	   +--------+---------------------+--------+--------------------+----------------+
 	*/
 	operationInsert walOperation = iota
+	// The record format for operationInsertDelta is as shown below, which inserts a data point into the
+	// same metric as the previous record in the segment. The timestamp is the delta from the previous one,
+	// and the value is the bits of the float XORed with the previous one:
+	/*
+	   +--------+--------------------------+---------------------+
+	   | op(1b) | timestamp delta(varints) | value xor(uvarints) |
+	   +--------+--------------------------+---------------------+
+	*/
+	operationInsertDelta
+	// The record format for operationDelete is as shown below, which deletes data points of the metric
+	// within the range from start inclusive to end exclusive written before it:
+	/*
+	   +--------+---------------------+--------+----------------+--------------+
+	   | op(1b) | len metric(varints) | metric | start(varints) | end(varints) |
+	   +--------+---------------------+--------+----------------+--------------+
+	*/
+	operationDelete
 )
 
 // wal represents a write-ahead log, which offers durability guarantees.
 type wal interface {
 	append(op walOperation, rows []Row) error
+	// appendDelete appends the record deleting data points of the given marshaled metric name within the range.
+	appendDelete(name string, start, end int64) error
 	flush() error
+	// sync flushes buffered records and commits them to stable storage.
+	sync() error
 	punctuate() error
 	removeOldest() error
 	removeAll() error
-	refresh() error
+	removeReplayed() error
+	// snapshot copies the records written so far into the given directory.
+	snapshot(dir string) error
 }
 
 type nopWAL struct {
@@ -37,10 +60,18 @@ func (f *nopWAL) append(_ walOperation, _ []Row) error {
 	return nil
 }
 
+func (f *nopWAL) appendDelete(_ string, _, _ int64) error {
+	return nil
+}
+
 func (f *nopWAL) flush() error {
 	return nil
 }
 
+func (f *nopWAL) sync() error {
+	return nil
+}
+
 func (f *nopWAL) punctuate() error {
 	return nil
 }
@@ -53,6 +84,10 @@ func (f *nopWAL) removeAll() error {
 	return nil
 }
 
-func (f *nopWAL) refresh() error {
+func (f *nopWAL) removeReplayed() error {
+	return nil
+}
+
+func (f *nopWAL) snapshot(_ string) error {
 	return nil
 }
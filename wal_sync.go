@@ -0,0 +1,114 @@
+package tstorage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nakabonne/tstorage/internal/syscall"
+)
+
+// WALSyncPolicy decides how often WAL segments get fsynced, which trades the latency of writes for the
+// window of data points lost on an OS crash or power failure. See WithWALSync.
+type WALSyncPolicy struct {
+	mode     walSyncMode
+	interval time.Duration
+}
+
+type walSyncMode int
+
+const (
+	walSyncNever walSyncMode = iota
+	walSyncEveryWrite
+	walSyncInterval
+)
+
+var (
+	// WALSyncNever leaves writing WAL segments back to disk to the OS. Data points written to segments
+	// survive a crash of the process, but ones not yet written back get lost on an OS crash or power failure.
+	WALSyncNever = WALSyncPolicy{mode: walSyncNever}
+	// WALSyncEveryWrite fsyncs the active segment every time rows get written, so that no data point
+	// inserted successfully gets lost. Rows get written to the segment on every write regardless of
+	// WithWALBufferedSize.
+	WALSyncEveryWrite = WALSyncPolicy{mode: walSyncEveryWrite}
+)
+
+// WALSyncInterval fsyncs the active segment, along with writing buffered rows to it, every given interval,
+// so that data points inserted more than the interval ago never get lost. The interval must be positive.
+func WALSyncInterval(interval time.Duration) WALSyncPolicy {
+	return WALSyncPolicy{mode: walSyncInterval, interval: interval}
+}
+
+func (p WALSyncPolicy) String() string {
+	switch p.mode {
+	case walSyncNever:
+		return "never"
+	case walSyncEveryWrite:
+		return "every write"
+	case walSyncInterval:
+		return fmt.Sprintf("every %s", p.interval)
+	default:
+		return fmt.Sprintf("unknown(%d)", p.mode)
+	}
+}
+
+// withWALSync makes segments fsynced in accordance with the given policy. Segments get fsynced
+// when they get closed as well unless it's WALSyncNever, since the periodic sync covers only the active one.
+func withWALSync(policy WALSyncPolicy) diskWALOption {
+	return func(o *diskWALOptions) {
+		o.syncPolicy = policy
+	}
+}
+
+// sync writes buffered records to the active segment, and commits it to stable storage.
+func (w *diskWAL) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.syncSegment()
+}
+
+// syncSegment commits the active segment to stable storage.
+func (w *diskWAL) syncSegment() error {
+	if w.mw != nil {
+		return w.mw.sync()
+	}
+	if err := injectFault(faultWALSync); err != nil {
+		return fmt.Errorf("failed to fsync segment: %w", err)
+	}
+	started := time.Now()
+	if err := w.fd.Sync(); err != nil {
+		return fmt.Errorf("failed to fsync segment: %w", err)
+	}
+	w.metrics.syncDuration.observeSince(started)
+	return nil
+}
+
+// syncDir commits the entries of the WAL directory to stable storage, so that segments created survive.
+func (w *diskWAL) syncDir() error {
+	if err := injectFault(faultWALSync); err != nil {
+		return fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
+	if err := syscall.SyncDir(w.dir); err != nil {
+		return fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
+	return nil
+}
+
+// syncWALPeriodically syncs the WAL every interval of the sync policy until the storage gets closed.
+func (s *storage) syncWALPeriodically() {
+	defer s.walSyncWG.Done()
+	ticker := time.NewTicker(s.walSyncPolicy.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-ticker.C:
+			if err := s.wal.sync(); err != nil {
+				s.logger.Error("failed to sync WAL", "err", err)
+			}
+		}
+	}
+}
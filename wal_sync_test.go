@@ -0,0 +1,66 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_diskWAL_syncPolicy(t *testing.T) {
+	rows := []Row{{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}}}
+	tests := []struct {
+		name             string
+		policy           WALSyncPolicy
+		wantAppendErr    bool
+		wantPunctuateErr bool
+	}{
+		{name: "never", policy: WALSyncNever},
+		{name: "every write", policy: WALSyncEveryWrite, wantAppendErr: true},
+		{name: "interval", policy: WALSyncInterval(time.Hour), wantPunctuateErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal")
+			w, err := newDiskWAL(path, 4096, withWALSync(tt.policy))
+			require.NoError(t, err)
+			// Every sync fails from now on, which tells whether it gets synced.
+			injectFaults(t, fault{point: faultWALSync, action: faultFail})
+
+			err = w.append(operationInsert, rows)
+			if tt.wantAppendErr {
+				assert.ErrorIs(t, err, errInjectedFault)
+			} else {
+				assert.NoError(t, err)
+			}
+			err = w.punctuate()
+			if tt.wantPunctuateErr {
+				assert.ErrorIs(t, err, errInjectedFault)
+			} else if !tt.wantAppendErr {
+				assert.NoError(t, err)
+			}
+			assert.ErrorIs(t, w.sync(), errInjectedFault)
+		})
+	}
+}
+
+func Test_storage_WithWALSync(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(WithDataPath(dir), WithTimestampPrecision(Seconds), WithWALSync(WALSyncInterval(10*time.Millisecond)))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}))
+
+	// Buffered rows get written to the segment without any further writes.
+	segmentPath := filepath.Join(dir, walDirName, "0")
+	assert.Eventually(t, func() bool {
+		info, err := os.Stat(segmentPath)
+		return err == nil && info.Size() > 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, s.Close())
+
+	_, err = NewStorage(WithDataPath(t.TempDir()), WithWALSync(WALSyncInterval(0)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+package tstorage
+
+import "os"
+
+// warmUpPartitions warms up disk partitions among the given ones to be warmed up.
+// It gives up once the storage gets closed.
+func (s *storage) warmUpPartitions(partitions []partition) {
+	var pages int
+	for _, d := range s.partitionsToWarmUp(partitions) {
+		select {
+		case <-s.doneCh:
+			return
+		default:
+		}
+		pages += d.warmUp()
+	}
+	s.logger.Info("warmed up disk partitions", "pages", pages)
+}
+
+// partitionsToWarmUp gives back disk partitions among the given ones holding data points
+// within the warm-up range from the newest data point.
+func (s *storage) partitionsToWarmUp(partitions []partition) []*diskPartition {
+	var newest int64
+	candidates := make([]*diskPartition, 0, len(partitions))
+	for _, part := range partitions {
+		d, ok := part.(*diskPartition)
+		if !ok {
+			continue
+		}
+		if len(candidates) == 0 || d.maxTimestamp() > newest {
+			newest = d.maxTimestamp()
+		}
+		candidates = append(candidates, d)
+	}
+	from := newest - toPrecision(s.warmUpRange, s.timestampPrecision)
+	targets := candidates[:0]
+	for _, d := range candidates {
+		// Checked after the range so that partitions opened lazily aren't opened needlessly.
+		if d.maxTimestamp() >= from && !d.expired() {
+			targets = append(targets, d)
+		}
+	}
+	return targets
+}
+
+// warmUp reads the memory-mapped data file a byte per page, so that the page cache gets populated
+// and the mapping gets faulted in before the first query touches it. It gives back the number of pages read.
+func (d *diskPartition) warmUp() int {
+	if err := d.load(); err != nil {
+		return 0
+	}
+	release, err := d.acquireData()
+	if err != nil {
+		return 0
+	}
+	defer release()
+	pageSize := os.Getpagesize()
+	var pages int
+	var sum byte
+	for i := 0; i < len(d.mappedFile); i += pageSize {
+		sum += d.mappedFile[i]
+		pages++
+	}
+	// Keep the reads from being optimized away.
+	d.warmUpSum = sum
+	return pages
+}
@@ -0,0 +1,29 @@
+package tstorage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_diskPartition_warmUp(t *testing.T) {
+	rows := make([]Row, 0, 10000)
+	for i := int64(1); i <= 10000; i++ {
+		rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: i * 7, Value: float64(i) * 1.1}})
+	}
+	d := newTestDiskPartition(t, rows)
+	pageSize := os.Getpagesize()
+	assert.Equal(t, (int(d.dataSize)+pageSize-1)/pageSize, d.warmUp())
+}
+
+func Test_storage_partitionsToWarmUp(t *testing.T) {
+	old := newTestDiskPartition(t, []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}})
+	recent := newTestDiskPartition(t, []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 7200}}})
+	newest := newTestDiskPartition(t, []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10000}}})
+	s := &storage{warmUpRange: time.Hour, timestampPrecision: Seconds}
+
+	got := s.partitionsToWarmUp([]partition{old, &fakePartition{}, recent, newest})
+	assert.Equal(t, []*diskPartition{recent, newest}, got)
+}
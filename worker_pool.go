@@ -0,0 +1,134 @@
+package tstorage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nakabonne/tstorage/internal/timerpool"
+)
+
+const (
+	// adaptInterval is the number of writes between adjustments of the limit.
+	adaptInterval = 16
+	// latencyTolerance is how many times as long as the baseline write latency is taken as degraded.
+	latencyTolerance = 2.0
+	// latencyAlpha is the smoothing factor for the moving average of write latency.
+	latencyAlpha = 0.2
+	// baselineDrift is the fraction the baseline follows the average at each adjustment, so that
+	// a latency observed long ago doesn't keep the limit low forever.
+	baselineDrift = 0.01
+)
+
+// workerPool limits the number of concurrent writers, adapting the limit between floor and ceiling.
+// It grows the limit while writers are waiting for a slot and the write latency stays around the baseline,
+// which means writes wait for I/O rather than compete for CPU, and shrinks it once the latency degrades.
+//
+// Slots are tokens in a channel of the ceiling size; the pool itself holds the ones beyond the limit.
+type workerPool struct {
+	slots   chan struct{}
+	floor   int
+	ceiling int
+	// The number of writers waiting for a slot.
+	waiting int64
+
+	mu    sync.Mutex
+	limit int
+	// Moving average and baseline of write latency in nanoseconds.
+	latency   float64
+	baseline  float64
+	completed int
+}
+
+func newWorkerPool(floor, ceiling int) *workerPool {
+	p := &workerPool{
+		slots:   make(chan struct{}, ceiling),
+		floor:   floor,
+		ceiling: ceiling,
+		limit:   floor,
+	}
+	for i := floor; i < ceiling; i++ {
+		p.slots <- struct{}{}
+	}
+	return p
+}
+
+// acquire waits for a slot for up to the given timeout or until the context is done,
+// and reports whether it got one.
+func (p *workerPool) acquire(ctx context.Context, timeout time.Duration) bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	// Seems like all workers are busy; wait for up to timeout
+	atomic.AddInt64(&p.waiting, 1)
+	defer atomic.AddInt64(&p.waiting, -1)
+	t := timerpool.Get(timeout)
+	defer timerpool.Put(t)
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release gives back the slot, along with the time it took to write.
+func (p *workerPool) release(elapsed time.Duration) {
+	<-p.slots
+	p.observe(elapsed)
+}
+
+func (p *workerPool) observe(elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	latency := float64(elapsed)
+	if p.completed == 0 {
+		p.latency, p.baseline = latency, latency
+	} else {
+		p.latency += latencyAlpha * (latency - p.latency)
+	}
+	if p.latency < p.baseline {
+		p.baseline = p.latency
+	}
+	p.completed++
+	if p.completed%adaptInterval == 0 {
+		p.adapt()
+	}
+}
+
+// adapt adjusts the limit by one. It must be called with mu held.
+func (p *workerPool) adapt() {
+	defer func() {
+		p.baseline += baselineDrift * (p.latency - p.baseline)
+	}()
+	if p.latency > latencyTolerance*p.baseline {
+		if p.limit <= p.floor {
+			return
+		}
+		// Take a slot back only if it's free, otherwise try again next time.
+		select {
+		case p.slots <- struct{}{}:
+			p.limit--
+		default:
+		}
+		return
+	}
+	if atomic.LoadInt64(&p.waiting) > 0 && p.limit < p.ceiling {
+		// The pool holds at least one slot as long as the limit is below the ceiling.
+		<-p.slots
+		p.limit++
+	}
+}
+
+// currentLimit gives back the number of writers allowed at the moment.
+func (p *workerPool) currentLimit() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limit
+}
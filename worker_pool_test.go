@@ -0,0 +1,71 @@
+package tstorage
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_workerPool_acquire(t *testing.T) {
+	p := newWorkerPool(1, 2)
+	require.True(t, p.acquire(context.Background(), time.Second))
+	// The slot beyond the limit is held by the pool.
+	assert.False(t, p.acquire(context.Background(), 10*time.Millisecond))
+	p.release(time.Millisecond)
+	assert.True(t, p.acquire(context.Background(), time.Second))
+}
+
+func Test_workerPool_adapt(t *testing.T) {
+	p := newWorkerPool(1, 3)
+	writes := func(n int, latency time.Duration) {
+		for i := 0; i < n; i++ {
+			require.True(t, p.acquire(context.Background(), time.Second))
+			p.release(latency)
+		}
+	}
+
+	// Nobody waits, so there is no need to grow.
+	writes(adaptInterval, time.Millisecond)
+	assert.Equal(t, 1, p.currentLimit())
+
+	// Writers are kept waiting while the latency stays low.
+	atomic.StoreInt64(&p.waiting, 1)
+	writes(adaptInterval*4, time.Millisecond)
+	assert.Equal(t, 3, p.currentLimit())
+
+	// The latency degrades.
+	atomic.StoreInt64(&p.waiting, 0)
+	writes(adaptInterval*4, 10*time.Millisecond)
+	assert.Equal(t, 1, p.currentLimit())
+}
+
+func Test_storage_WithWriteConcurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		floor   int
+		ceiling int
+		wantErr bool
+	}{
+		{name: "fixed", floor: 2, ceiling: 2},
+		{name: "adaptive", floor: 1, ceiling: 8},
+		{name: "zero floor", floor: 0, ceiling: 8, wantErr: true},
+		{name: "ceiling below floor", floor: 4, ceiling: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(WithWriteConcurrency(tt.floor, tt.ceiling))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.floor, s.(*storage).workers.currentLimit())
+			assert.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000}}}))
+			require.NoError(t, s.Close())
+		})
+	}
+}